@@ -0,0 +1,107 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Alias binds the node at path in the directory newDir in addition to its
+// existing location, in the manner of a hard link. Since the kernel sees a
+// single node, invalidation of the node through either location affects
+// all of its aliases. The absolute path reported for the node, for example
+// to policy functions, is that of its original location. Unbinding the node
+// at one location leaves it bound at its other locations.
+//
+// A directory may not be aliased within itself. Alias returns EEXIST if
+// newDir already holds a node with the same name.
+func (fs *FileSystem) Alias(path, newDir string) error {
+	path = rooted(path)
+	newDir = rooted(newDir)
+
+	fs.mu.Lock()
+	n, err := walkPath(fs.root, "alias", path)
+	if err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+	if n == Node(fs.root) {
+		fs.mu.Unlock()
+		return &os.PathError{Op: "alias", Path: path, Err: syscall.EINVAL}
+	}
+	if _, ok := n.(*Dir); ok && (newDir == path || strings.HasPrefix(newDir, path+string(filepath.Separator))) {
+		fs.mu.Unlock()
+		return &os.PathError{Op: "alias", Path: newDir, Err: syscall.EINVAL}
+	}
+	f, err := walkPath(fs.root, "alias", newDir)
+	if err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+	d, ok := f.(*Dir)
+	if !ok {
+		fs.mu.Unlock()
+		return &os.PathError{Op: "alias", Path: newDir, Err: syscall.ENOTDIR}
+	}
+	d.mu.Lock()
+	if _, exists := d.files[n.Name()]; exists {
+		d.mu.Unlock()
+		fs.mu.Unlock()
+		return &os.PathError{Op: "alias", Path: filepath.Join(newDir, n.Name()), Err: syscall.EEXIST}
+	}
+	d.files[n.Name()] = n
+	d.mu.Unlock()
+	fs.generation++
+	if fs.aliases == nil {
+		fs.aliases = make(map[Node][]*Dir)
+	}
+	fs.aliases[n] = append(fs.aliases[n], d)
+	fs.mu.Unlock()
+
+	fs.event(Event{Op: "bind", Path: filepath.Join(newDir, n.Name())})
+	return nil
+}
+
+// isAlias returns whether d holds n as an alias rather than at its
+// original location. isAlias must be called with fs.mu held.
+func (fs *FileSystem) isAlias(d *Dir, n Node) bool {
+	for _, a := range fs.aliases[n] {
+		if a == d {
+			return true
+		}
+	}
+	return false
+}
+
+// unalias removes the location of n in d from the alias table,
+// promoting an alias to be the original location if d was the original
+// location. It returns whether n remains bound at another location.
+// unalias must be called with fs.mu held.
+func (fs *FileSystem) unalias(d *Dir, n Node) bool {
+	aliases := fs.aliases[n]
+	if len(aliases) == 0 {
+		return false
+	}
+	if fs.parent[n] == d {
+		fs.parent[n] = aliases[0]
+		aliases = aliases[1:]
+	} else {
+		for i, a := range aliases {
+			if a == d {
+				aliases = append(aliases[:i:i], aliases[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(aliases) == 0 {
+		delete(fs.aliases, n)
+	} else {
+		fs.aliases[n] = aliases
+	}
+	return true
+}
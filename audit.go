@@ -0,0 +1,170 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditRecord is a record of a write operation held in an AuditLog.
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Path   string    `json:"path"`
+	Uid    uint32    `json:"uid"`
+	Gid    uint32    `json:"gid"`
+	Pid    uint32    `json:"pid"`
+	Offset int64     `json:"offset"`
+	Data   []byte    `json:"data"`
+
+	// Prev is the hex encoded digest of the
+	// previous record in the log, or the empty
+	// string for the first record.
+	Prev string `json:"prev"`
+
+	// Digest is the hex encoded SHA-256 digest
+	// of the record, including Prev.
+	Digest string `json:"digest"`
+}
+
+// digest returns the hex encoded digest of the record.
+func (r *AuditRecord) digest() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00%d\x00%d\x00%d\x00",
+		r.Time.UTC().Format(time.RFC3339Nano), r.Path, r.Uid, r.Gid, r.Pid, r.Offset, len(r.Data))
+	h.Write(r.Data)
+	io.WriteString(h, r.Prev)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AuditLog is a hash-chained log of successful write operations. Each
+// record holds the digest of the record before it so that modification,
+// removal or reordering of records can be detected by Verify.
+type AuditLog struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+// ErrAuditChain is returned by AuditLog.Verify when the hash chain is broken.
+var ErrAuditChain = errors.New("sisyphus: audit chain broken")
+
+// NewAuditLog returns a new empty AuditLog.
+func NewAuditLog() *AuditLog { return &AuditLog{} }
+
+// SetAudit sets the audit log used to record writes to the file system.
+// A nil AuditLog disables auditing.
+func (fs *FileSystem) SetAudit(a *AuditLog) {
+	fs.mu.Lock()
+	fs.audit = a
+	fs.mu.Unlock()
+}
+
+// recordWrite adds a record of a write of data at off to n to the
+// file system's audit log and events node if it has them.
+func (fs *FileSystem) recordWrite(ctx context.Context, n Node, off int64, data []byte) {
+	if fs == nil {
+		return
+	}
+	fs.mu.Lock()
+	a := fs.audit
+	events := fs.events != nil
+	var path string
+	if a != nil || events {
+		path = fs.pathLocked(n)
+	}
+	fs.mu.Unlock()
+	hdr := header(ctx)
+	if events {
+		fs.event(Event{
+			Op:     "write",
+			Path:   path,
+			Offset: off,
+			Length: len(data),
+			Uid:    hdr.Uid,
+			Gid:    hdr.Gid,
+			Pid:    hdr.Pid,
+		})
+	}
+	if a == nil {
+		return
+	}
+	a.add(AuditRecord{
+		Time:   fs.now(),
+		Path:   path,
+		Uid:    hdr.Uid,
+		Gid:    hdr.Gid,
+		Pid:    hdr.Pid,
+		Offset: off,
+		Data:   append([]byte(nil), data...),
+	})
+}
+
+// add appends r to the log, chaining it to the last record.
+func (a *AuditLog) add(r AuditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.records) != 0 {
+		r.Prev = a.records[len(a.records)-1].Digest
+	}
+	r.Digest = r.digest()
+	a.records = append(a.records, r)
+}
+
+// Records returns a copy of the records held by the log.
+func (a *AuditLog) Records() []AuditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]AuditRecord(nil), a.records...)
+}
+
+// Verify checks the hash chain of the log, returning ErrAuditChain
+// if it is broken.
+func (a *AuditLog) Verify() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return VerifyAudit(a.records)
+}
+
+// VerifyAudit checks the hash chain of the provided audit records,
+// returning ErrAuditChain if it is broken. It can be used to check
+// records read back from JSON exported by AuditLog.WriteJSON.
+func VerifyAudit(records []AuditRecord) error {
+	var prev string
+	for i := range records {
+		r := &records[i]
+		if r.Prev != prev || r.Digest != r.digest() {
+			return fmt.Errorf("%w at record %d", ErrAuditChain, i)
+		}
+		prev = r.Digest
+	}
+	return nil
+}
+
+// WriteJSON writes the records held by the log to w as a JSON array.
+func (a *AuditLog) WriteJSON(w io.Writer) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	records := a.records
+	if records == nil {
+		records = []AuditRecord{}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "\t")
+	err := enc.Encode(records)
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
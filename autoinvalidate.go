@@ -0,0 +1,151 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// InvalidateEvery invalidates the kernel cache of n every interval until
+// the returned stop function is called. Invalidations made while the file
+// system is not being served are skipped. This prevents clients with
+// aggressive page caching from reading stale values of frequently updated
+// nodes.
+func (fs *FileSystem) InvalidateEvery(n Node, interval time.Duration) (stop func()) {
+	t := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				fs.invalidateRange(n, 0, -1)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return stopper(done)
+}
+
+// InvalidateOnChange invalidates the kernel cache of n for each change
+// received on changes until changes is closed or the returned stop
+// function is called. Writes invalidate the written range and truncations
+// invalidate from the new size to the end of the file. The changes channel
+// is typically obtained from the Subscribe method of an ObservableBytes
+// backing n. Invalidations made while the file system is not being served
+// are skipped.
+func (fs *FileSystem) InvalidateOnChange(n Node, changes <-chan Change) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case c, ok := <-changes:
+				if !ok {
+					return
+				}
+				switch c.Kind {
+				case ChangeWrite:
+					fs.invalidateRange(n, c.Offset, int64(c.Length))
+				case ChangeTruncate:
+					fs.invalidateRange(n, c.Offset, -1)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return stopper(done)
+}
+
+// invalidateWritten invalidates the kernel cache of n after a write made
+// through the file system if the file system is being served, so that
+// clients reading through other handles see the content of the device
+// after the write, which may differ from the data written. The FUSE
+// library in use does not support poll, so waiting pollers are not woken.
+func (fs *FileSystem) invalidateWritten(n Node) {
+	if fs == nil {
+		return
+	}
+	fs.mu.Lock()
+	served := fs.server != nil
+	fs.mu.Unlock()
+	if !served {
+		return
+	}
+	fs.written.add(n, func(n Node) { fs.invalidateRange(n, 0, -1) })
+}
+
+// invalidationQueue coalesces the invalidations of written nodes. Writes
+// made to a node while its invalidation is queued share the invalidation.
+type invalidationQueue struct {
+	mu      sync.Mutex
+	pending map[Node]bool
+	running bool
+}
+
+// add queues n for invalidation, starting a goroutine to call invalidate
+// for the queued nodes if one is not running.
+//
+// The kernel may hold the locks of the written pages until the write
+// request is answered, so the pages are invalidated outside the request
+// handler.
+func (q *invalidationQueue) add(n Node, invalidate func(Node)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == nil {
+		q.pending = make(map[Node]bool)
+	}
+	q.pending[n] = true
+	if q.running {
+		return
+	}
+	q.running = true
+	go func() {
+		for {
+			q.mu.Lock()
+			var n Node
+			for n = range q.pending {
+				break
+			}
+			if n == nil {
+				q.running = false
+				q.mu.Unlock()
+				return
+			}
+			delete(q.pending, n)
+			q.mu.Unlock()
+			invalidate(n)
+		}
+	}()
+}
+
+// stopper returns a function that closes done once.
+func stopper(done chan struct{}) func() {
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// invalidateRange invalidates length bytes of the kernel cache of n
+// starting at off if the file system is being served. A negative length
+// invalidates to the end of the file. Any cached device size held by n is
+// discarded.
+func (fs *FileSystem) invalidateRange(n Node, off, length int64) error {
+	invalidateSize(n)
+	fs.mu.Lock()
+	server := fs.server
+	fs.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	err := server.fuse.InvalidateNodeDataRange(n, off, length)
+	if err == fuse.ErrNotCached {
+		err = nil
+	}
+	return err
+}
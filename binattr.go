@@ -0,0 +1,107 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"sync"
+	"syscall"
+)
+
+// BinAttr is a ReadWriter simulating a binary sysfs attribute, such as
+// a sensor's bin_data or a firmware blob. Reads and writes may be made at
+// any offset within the maximum size of the attribute. As for sysfs binary
+// attributes, writes that extend past the maximum size are truncated to
+// fit, and writes starting at or beyond it return EFBIG. BinAttr is safe
+// for concurrent use.
+type BinAttr struct {
+	mu   sync.Mutex
+	data Bytes
+	max  int64
+}
+
+// NewBinAttr returns a new BinAttr holding data with the given maximum
+// size. NewBinAttr returns EFBIG if data is longer than max.
+func NewBinAttr(data []byte, max int64) (*BinAttr, error) {
+	if int64(len(data)) > max {
+		return nil, syscall.EFBIG
+	}
+	return &BinAttr{data: append(Bytes(nil), data...), max: max}, nil
+}
+
+// Set replaces the content of the attribute with data. Set returns
+// EFBIG if data is longer than the maximum size.
+func (a *BinAttr) Set(data []byte) error {
+	if int64(len(data)) > a.max {
+		return syscall.EFBIG
+	}
+	a.mu.Lock()
+	a.data = append(a.data[:0], data...)
+	a.mu.Unlock()
+	return nil
+}
+
+// Bytes returns a copy of the content of the attribute.
+func (a *BinAttr) Bytes() []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]byte(nil), a.data...)
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (a *BinAttr) ReadAt(b []byte, off int64) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.data.ReadAt(b, off)
+}
+
+// WriteAt satisfies the io.WriterAt interface. Data beyond the maximum
+// size is discarded and the number of bytes written is returned with
+// EFBIG.
+func (a *BinAttr) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= a.max {
+		return 0, syscall.EFBIG
+	}
+	var err error
+	if rem := a.max - off; int64(len(b)) > rem {
+		b = b[:rem]
+		err = syscall.EFBIG
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n, werr := a.data.WriteAt(b, off)
+	if werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// Truncate truncates the attribute to n bytes. Truncation beyond the
+// current length extends the attribute with zeros, up to the maximum
+// size.
+func (a *BinAttr) Truncate(n int64) error {
+	if n < 0 {
+		return syscall.EINVAL
+	}
+	if n > a.max {
+		return syscall.EFBIG
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n > int64(len(a.data)) {
+		a.data = append(a.data, make([]byte, n-int64(len(a.data)))...)
+		return nil
+	}
+	return a.data.Truncate(n)
+}
+
+// Size returns the current length of the attribute and a nil error.
+func (a *BinAttr) Size() (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return int64(len(a.data)), nil
+}
@@ -0,0 +1,117 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"io"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Capabilities describes the behaviour of a device. File nodes consult
+// the capabilities of their device to configure how the device is opened,
+// the attributes reported for it and the operations passed to it.
+type Capabilities struct {
+	// Stream indicates that the device
+	// is not seekable. Its nodes are
+	// opened non-seekable with direct
+	// I/O and report a zero size
+	// without calling Size.
+	Stream bool
+
+	// Pollable indicates that the data
+	// of the device changes without
+	// writes through the file system.
+	// Its nodes are opened with direct
+	// I/O so that reads always reach
+	// the device. The FUSE library in
+	// use does not support poll, so
+	// clients are not notified.
+	Pollable bool
+
+	// Sync indicates that the Sync
+	// method of the device is called
+	// when its node is flushed.
+	Sync bool
+
+	// Close indicates that the Close
+	// method of the device is called
+	// when a handle of its node is
+	// released.
+	Close bool
+
+	// MaxSize is the maximum size of
+	// the device's data. Writes and
+	// truncations beyond MaxSize fail
+	// with EFBIG. If MaxSize is zero
+	// the size is not limited.
+	MaxSize int64
+}
+
+// Capable is implemented by devices that declare their capabilities.
+type Capable interface {
+	Capabilities() Capabilities
+}
+
+// syncer is implemented by devices that can be synced.
+type syncer interface {
+	Sync() error
+}
+
+// capabilities returns the capabilities of dev. If dev is not Capable,
+// its capabilities are derived from the methods it implements: Sync and
+// Close are set if dev has Sync and Close methods.
+func capabilities(dev interface{}) Capabilities {
+	if c, ok := dev.(Capable); ok {
+		return c.Capabilities()
+	}
+	var c Capabilities
+	_, c.Sync = dev.(syncer)
+	_, c.Close = dev.(io.Closer)
+	return c
+}
+
+// openFlags returns the open response flags required by c.
+func (c Capabilities) openFlags() fuse.OpenResponseFlags {
+	var flags fuse.OpenResponseFlags
+	if c.Stream {
+		flags |= fuse.OpenNonSeekable | fuse.OpenDirectIO
+	}
+	if c.Pollable {
+		flags |= fuse.OpenDirectIO
+	}
+	return flags
+}
+
+// checkSize returns EFBIG if size exceeds the maximum size allowed by c.
+func (c Capabilities) checkSize(size int64) error {
+	if c.MaxSize > 0 && size > c.MaxSize {
+		return syscall.EFBIG
+	}
+	return nil
+}
+
+// syncDevice syncs dev if it has the Sync capability.
+func syncDevice(dev interface{}) error {
+	if !capabilities(dev).Sync {
+		return nil
+	}
+	if s, ok := dev.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// closeDevice closes dev if it has the Close capability.
+func closeDevice(dev interface{}) error {
+	if !capabilities(dev).Close {
+		return nil
+	}
+	if c, ok := dev.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// SendPolicy specifies how a channel-backed device behaves
+// when its channel is not ready to receive.
+type SendPolicy int
+
+const (
+	// Block blocks the write until
+	// the channel is ready.
+	Block SendPolicy = iota
+
+	// Drop discards the payload and
+	// reports the write as successful.
+	Drop
+
+	// Reject discards the payload and
+	// fails the write with EAGAIN.
+	Reject
+)
+
+// ChanWriter is a Writer that sends each write payload on a channel.
+type ChanWriter struct {
+	ch     chan<- []byte
+	policy SendPolicy
+	trim   bool
+}
+
+// NewChanWriter returns a new ChanWriter sending on ch according to the
+// provided policy. If trim is true, a single trailing newline is removed
+// from each payload before it is sent; the full byte count is still
+// reported to the writer.
+func NewChanWriter(ch chan<- []byte, policy SendPolicy, trim bool) *ChanWriter {
+	return &ChanWriter{ch: ch, policy: policy, trim: trim}
+}
+
+// WriteAt satisfies the io.WriterAt interface. The offset is ignored and
+// a copy of b is sent on the channel.
+func (w *ChanWriter) WriteAt(b []byte, off int64) (int, error) {
+	return w.WriteAtFlags(b, off, 0)
+}
+
+// WriteAtFlags satisfies the FlagWriterAt interface. It behaves as WriteAt
+// except that writes through file handles opened with O_NONBLOCK follow
+// the Reject policy when the policy of w is Block.
+func (w *ChanWriter) WriteAtFlags(b []byte, _ int64, flags fuse.OpenFlags) (int, error) {
+	if w.ch == nil {
+		return 0, syscall.EBADFD
+	}
+	n := len(b)
+	if w.trim {
+		b = bytes.TrimSuffix(b, []byte{'\n'})
+	}
+	msg := append([]byte(nil), b...)
+	policy := w.policy
+	if policy == Block && flags&fuse.OpenNonblock != 0 {
+		policy = Reject
+	}
+	switch policy {
+	case Drop:
+		select {
+		case w.ch <- msg:
+		default:
+		}
+	case Reject:
+		select {
+		case w.ch <- msg:
+		default:
+			return 0, syscall.EAGAIN
+		}
+	default:
+		w.ch <- msg
+	}
+	return n, nil
+}
+
+// Truncate is a no-op.
+func (w *ChanWriter) Truncate(_ int64) error { return nil }
+
+// Size returns zero and a nil error.
+func (w *ChanWriter) Size() (int64, error) { return 0, nil }
+
+// Capabilities satisfies the Capable interface. A ChanWriter is a stream.
+func (w *ChanWriter) Capabilities() Capabilities { return Capabilities{Stream: true} }
+
+// ChanReader is a Reader that serves a stream of messages received from
+// a channel. Reads block until a message is available and return io.EOF
+// once the channel is closed and all received data has been read. Read
+// offsets are ignored; each message is served once in order of arrival.
+// Reads made through the file system that are interrupted while waiting
+// return EINTR.
+type ChanReader struct {
+	// turn is held by the read
+	// receiving from ch.
+	turn chan struct{}
+
+	ch   <-chan []byte
+	buf  []byte
+	done bool
+}
+
+// NewChanReader returns a new ChanReader receiving from ch.
+func NewChanReader(ch <-chan []byte) *ChanReader {
+	return &ChanReader{turn: make(chan struct{}, 1), ch: ch}
+}
+
+// ReadAt satisfies the io.ReaderAt interface. The offset is ignored.
+func (r *ChanReader) ReadAt(b []byte, off int64) (int, error) {
+	return r.readAtContext(context.Background(), b, off, 0)
+}
+
+// ReadAtFlags satisfies the FlagReaderAt interface. It behaves as ReadAt
+// except that reads through file handles opened with O_NONBLOCK return
+// EAGAIN rather than block when no message is available.
+func (r *ChanReader) ReadAtFlags(b []byte, off int64, flags fuse.OpenFlags) (int, error) {
+	return r.readAtContext(context.Background(), b, off, flags)
+}
+
+// readAtContext behaves as ReadAtFlags, returning EINTR if ctx is
+// cancelled while waiting for a message or for another read to finish.
+func (r *ChanReader) readAtContext(ctx context.Context, b []byte, _ int64, flags fuse.OpenFlags) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	select {
+	case r.turn <- struct{}{}:
+	case <-ctx.Done():
+		return 0, syscall.EINTR
+	}
+	defer func() { <-r.turn }()
+	for len(r.buf) == 0 {
+		if r.done || r.ch == nil {
+			return 0, io.EOF
+		}
+		var (
+			msg []byte
+			ok  bool
+		)
+		if flags&fuse.OpenNonblock != 0 {
+			select {
+			case msg, ok = <-r.ch:
+			default:
+				return 0, syscall.EAGAIN
+			}
+		} else {
+			select {
+			case msg, ok = <-r.ch:
+			case <-ctx.Done():
+				return 0, syscall.EINTR
+			}
+		}
+		if !ok {
+			r.done = true
+			return 0, io.EOF
+		}
+		r.buf = msg
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Concurrent marks the ChanReader as safe for concurrent use.
+func (r *ChanReader) Concurrent() {}
+
+// Size returns zero and a nil error.
+func (r *ChanReader) Size() (int64, error) { return 0, nil }
+
+// Capabilities satisfies the Capable interface. A ChanReader is a stream.
+func (r *ChanReader) Capabilities() Capabilities { return Capabilities{Stream: true} }
@@ -0,0 +1,98 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// BindChecksum binds a read only sibling of the RO or RW node at the given
+// path named with the node's name and a ".sha256" suffix. The content of
+// the sibling is the SHA-256 checksum of the node's device in the format
+// of sha256sum, so that transfers through the mount can be verified with
+// sha256sum -c. The checksum is computed from the live content of the node
+// when the sibling is read at offset zero. The sibling is not unbound when
+// the node is unbound.
+func (fs *FileSystem) BindChecksum(path string) (*RO, error) {
+	path = rooted(path)
+	n, err := fs.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	switch n.(type) {
+	case *RO, *RW:
+	case *Dir:
+		return nil, &os.PathError{Op: "checksum", Path: path, Err: syscall.EISDIR}
+	default:
+		return nil, &os.PathError{Op: "checksum", Path: path, Err: syscall.EBADF}
+	}
+	sum, err := NewRO(n.Name()+".sha256", 0444, &checksum{target: n})
+	if err != nil {
+		return nil, err
+	}
+	err = fs.Bind(filepath.Dir(path), sum)
+	if err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
+
+// checksum is a Reader holding the SHA-256 checksum of a file node.
+type checksum struct {
+	mu     sync.Mutex
+	target Node
+	line   []byte
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (c *checksum) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if off == 0 || c.line == nil {
+		h := sha256.New()
+		err := hashNode(h, c.target)
+		if err != nil {
+			return 0, err
+		}
+		c.line = []byte(hex.EncodeToString(h.Sum(nil)) + "  " + c.target.Name() + "\n")
+	}
+	return readAt(c.line, b, off)
+}
+
+// Size returns the length of the checksum line and a nil error.
+func (c *checksum) Size() (int64, error) {
+	return int64(hex.EncodedLen(sha256.Size) + len("  ") + len(c.target.Name()) + len("\n")), nil
+}
+
+// hashNode writes the content of the device of the file node n to h.
+func hashNode(h hash.Hash, n Node) error {
+	var (
+		mu  *sync.Mutex
+		dev io.ReaderAt
+	)
+	switch n := n.(type) {
+	case *RO:
+		mu, dev = &n.mu, n.dev
+	case *RW:
+		mu, dev = &n.mu, n.dev
+	default:
+		return syscall.EBADF
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	_, err := io.Copy(h, io.NewSectionReader(dev, 0, math.MaxInt64))
+	return err
+}
@@ -0,0 +1,98 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// View is a view of a FileSystem restricted to the subtree below a
+// directory. Paths passed to View methods are interpreted from the root of
+// the view, whether or not they are absolute, and cannot address nodes
+// outside the subtree. Errors and events report absolute paths within the
+// file system.
+type View struct {
+	fs   *FileSystem
+	root string
+}
+
+// Chroot returns a view of the file system rooted at the directory at the
+// given path. The view addresses the directory by path, so if the directory
+// is later unbound, operations on the view fail until a directory is bound
+// at the same path.
+func (fs *FileSystem) Chroot(path string) (*View, error) {
+	path = rooted(path)
+	n, err := fs.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := n.(*Dir); !ok {
+		return nil, &os.PathError{Op: "chroot", Path: path, Err: syscall.ENOTDIR}
+	}
+	return &View{fs: fs, root: path}, nil
+}
+
+// Sys returns the FileSystem of the view.
+func (v *View) Sys() *FileSystem { return v.fs }
+
+// Path returns the absolute path within the file system of the given path
+// within the view.
+func (v *View) Path(path string) string {
+	return filepath.Join(v.root, rooted(path))
+}
+
+// Chroot returns a view of the file system rooted at the directory at the
+// given path within the view.
+func (v *View) Chroot(path string) (*View, error) {
+	return v.fs.Chroot(v.Path(path))
+}
+
+// Lookup returns the node at the given path within the view.
+func (v *View) Lookup(path string) (Node, error) {
+	return v.fs.Lookup(v.Path(path))
+}
+
+// Bind binds the node at the given directory path within the view. It is
+// otherwise equivalent to the Bind method of FileSystem.
+func (v *View) Bind(dir string, n Node) error {
+	return v.fs.Bind(v.Path(dir), n)
+}
+
+// BindConflict binds the node at the given directory path within the view.
+// It is otherwise equivalent to the BindConflict method of FileSystem.
+func (v *View) BindConflict(dir string, n Node, c Conflict) (name string, err error) {
+	return v.fs.BindConflict(v.Path(dir), n, c)
+}
+
+// Unbind unbinds the node at the given path within the view, returning the
+// node if successful. The path must not be the root of the view.
+func (v *View) Unbind(path string) (Node, error) {
+	if rooted(path) == string(filepath.Separator) {
+		return nil, &os.PathError{Op: "unbind", Path: v.root, Err: syscall.EINVAL}
+	}
+	return v.fs.Unbind(v.Path(path))
+}
+
+// ChownTree sets the uid and gid of the node at the given path within the
+// view and of all nodes below it as described for the ChownTree method of
+// FileSystem.
+func (v *View) ChownTree(path string, uid, gid uint32) error {
+	return v.fs.ChownTree(v.Path(path), uid, gid)
+}
+
+// InvalidatePath invalidates the kernel cache of the node at the given path
+// within the view as described for the InvalidatePath method of FileSystem.
+func (v *View) InvalidatePath(path string) error {
+	return v.fs.InvalidatePath(v.Path(path))
+}
+
+// NotifyChanged invalidates the kernel cache of a range of the node at the
+// given path within the view as described for the NotifyChanged method of
+// FileSystem.
+func (v *View) NotifyChanged(path string, off, length int64) error {
+	return v.fs.NotifyChanged(v.Path(path), off, length)
+}
@@ -0,0 +1,319 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The sisyphus command mounts a virtual file system described by a JSON
+// specification file.
+//
+// The specification is a JSON object describing the root directory:
+//
+//	{
+//		"mode": "0775",
+//		"nodes": [
+//			{"name": "sys", "type": "dir", "nodes": [
+//				{"name": "address", "type": "ro", "content": "ev3-ports:outA\n"},
+//				{"name": "position", "type": "rw", "counter": 0},
+//				{"name": "command", "type": "wo"},
+//				{"name": "uptime", "type": "ro", "exec": ["uptime"], "timeout": "1s"},
+//				{"name": "remote", "type": "rw", "http": "http://localhost:8080/value"}
+//			]}
+//		]
+//	}
+//
+// Node types are "dir", "ro", "rw" and "wo". File nodes are backed by
+// static content, a counter, a command, or an HTTP resource. Writes to
+// "wo" nodes without a backend are logged to standard output.
+//
+// If the -ctl flag is given, the control API is served at the specified
+// address for use by the sisyphusctl command. If the -events flag is given,
+// a read only node at the specified path within the mount holds a
+// line-delimited JSON record of writes, binds and unbinds. If the -debug
+// flag is given, FUSE protocol messages for the specified path within the
+// mount are logged; a path of "/" logs messages for the whole mount.
+//
+// The -uid and -gid flags report all nodes as owned by the specified user
+// and group, and the -umask flag clears the specified permission bits from
+// reported modes, so that the same specification may be served by root on
+// an EV3 or by an unprivileged user on a development machine.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+
+	"github.com/ev3go/sisyphus"
+)
+
+func main() {
+	spec := flag.String("spec", "", "specify the JSON tree specification file (required)")
+	mnt := flag.String("mnt", "", "specify the mount point (required)")
+	readOnly := flag.Bool("ro", false, "serve the file system read only")
+	ctl := flag.String("ctl", "", "specify an address to serve the control API (optional)")
+	events := flag.String("events", "", "specify a path in the mount for the events node (optional)")
+	debug := flag.String("debug", "", "specify a path in the mount to log FUSE protocol messages for (optional)")
+	uid := flag.Int("uid", -1, "report all nodes as owned by this uid (optional)")
+	gid := flag.Int("gid", -1, "report all nodes as owned by this gid (optional)")
+	umask := flag.String("umask", "", "specify an octal umask applied to reported modes (optional)")
+	flag.Parse()
+	if *spec == "" || *mnt == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	b, err := ioutil.ReadFile(*spec)
+	if err != nil {
+		log.Fatalf("failed to read specification: %v", err)
+	}
+	var root node
+	err = json.Unmarshal(b, &root)
+	if err != nil {
+		log.Fatalf("failed to parse specification: %v", err)
+	}
+	filesys, err := root.fileSystem()
+	if err != nil {
+		log.Fatalf("invalid specification: %v", err)
+	}
+	err = filesys.Validate()
+	if err != nil {
+		log.Fatalf("invalid specification: %v", err)
+	}
+	filesys.SetReadOnly(*readOnly)
+	mapping, err := attrMapping(*uid, *gid, *umask)
+	if err != nil {
+		log.Fatalf("invalid attribute mapping: %v", err)
+	}
+	filesys.SetAttrMapping(mapping)
+	if *events != "" {
+		err = filesys.SetEvents(*events)
+		if err != nil {
+			log.Fatalf("failed to set events node: %v", err)
+		}
+	}
+
+	if *debug != "" {
+		filesys.SetDebug(func(r sisyphus.DebugRecord) {
+			log.Printf("fuse: %s", r.Message)
+		}, sisyphus.DebugAll, *debug)
+	}
+
+	mntopts := append(sisyphus.DefaultTuning.MountOptions(), fuse.FSName("sisyphus"))
+	c, err := sisyphus.Serve(*mnt, filesys, nil, mntopts...)
+	if err != nil {
+		log.Fatalf("failed to serve %s: %v", *mnt, err)
+	}
+	log.Printf("serving %s at %s", *spec, *mnt)
+
+	if *ctl != "" {
+		go func() {
+			log.Printf("serving control API at %s", *ctl)
+			err := http.ListenAndServe(*ctl, sisyphus.NewControlHandler(filesys))
+			if err != nil {
+				log.Printf("control API failed: %v", err)
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	err = c.Close()
+	if err != nil {
+		log.Fatalf("failed to close server: %v", err)
+	}
+}
+
+// attrMapping returns the attribute mapping for the uid, gid and umask
+// flags. If only one of uid and gid is specified, the other is taken from
+// the current process.
+func attrMapping(uid, gid int, umask string) (sisyphus.AttrMapping, error) {
+	var m sisyphus.AttrMapping
+	if uid >= 0 || gid >= 0 {
+		if uid < 0 {
+			uid = os.Getuid()
+		}
+		if gid < 0 {
+			gid = os.Getgid()
+		}
+		m.MapOwners = true
+		m.Uid = uint32(uid)
+		m.Gid = uint32(gid)
+	}
+	if umask != "" {
+		mask, err := strconv.ParseUint(umask, 8, 32)
+		if err != nil {
+			return m, err
+		}
+		m.Umask = os.FileMode(mask)
+	}
+	return m, nil
+}
+
+// node is a node specification.
+type node struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Mode  string `json:"mode"`
+	Nodes []node `json:"nodes"`
+
+	Content  *string  `json:"content"`
+	Counter  *int64   `json:"counter"`
+	Exec     []string `json:"exec"`
+	HTTP     string   `json:"http"`
+	Method   string   `json:"method"`
+	Timeout  string   `json:"timeout"`
+	CacheTTL string   `json:"cache"`
+}
+
+// fileSystem returns a file system with n as its root.
+func (n node) fileSystem() (*sisyphus.FileSystem, error) {
+	mode, err := n.mode(0775)
+	if err != nil {
+		return nil, err
+	}
+	filesys := sisyphus.NewFileSystem(mode, time.Now)
+	for _, c := range n.Nodes {
+		sn, err := c.node("/")
+		if err != nil {
+			return nil, err
+		}
+		filesys.With(sn)
+	}
+	return filesys.Sync(), nil
+}
+
+// node returns the sisyphus node described by n.
+func (n node) node(dir string) (sisyphus.Node, error) {
+	path := filepath.Join(dir, n.Name)
+	switch n.Type {
+	case "dir", "":
+		mode, err := n.mode(0775)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		d, err := sisyphus.NewDir(n.Name, mode)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for _, c := range n.Nodes {
+			sn, err := c.node(path)
+			if err != nil {
+				return nil, err
+			}
+			d.With(sn)
+		}
+		return d, nil
+
+	case "ro":
+		mode, err := n.mode(0444)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		dev, err := n.device(path)
+		if err != nil {
+			return nil, err
+		}
+		return sisyphus.NewRO(n.Name, mode, dev)
+
+	case "rw":
+		mode, err := n.mode(0666)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		dev, err := n.device(path)
+		if err != nil {
+			return nil, err
+		}
+		rw, ok := dev.(sisyphus.ReadWriter)
+		if !ok {
+			return nil, fmt.Errorf("%s: backend is not writable", path)
+		}
+		return sisyphus.NewRW(n.Name, mode, rw)
+
+	case "wo":
+		mode, err := n.mode(0222)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if n.Content == nil && n.Counter == nil && n.HTTP == "" {
+			return sisyphus.NewWO(n.Name, mode, logger(path))
+		}
+		dev, err := n.device(path)
+		if err != nil {
+			return nil, err
+		}
+		w, ok := dev.(sisyphus.Writer)
+		if !ok {
+			return nil, fmt.Errorf("%s: backend is not writable", path)
+		}
+		return sisyphus.NewWO(n.Name, mode, w)
+
+	default:
+		return nil, fmt.Errorf("%s: unknown node type %q", path, n.Type)
+	}
+}
+
+// device returns the device described by n.
+func (n node) device(path string) (sisyphus.Reader, error) {
+	timeout, err := duration(n.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid timeout: %v", path, err)
+	}
+	switch {
+	case n.Counter != nil:
+		return sisyphus.NewCounter(*n.Counter), nil
+	case len(n.Exec) != 0:
+		return sisyphus.NewExec(timeout, n.Exec[0], n.Exec[1:]...), nil
+	case n.HTTP != "":
+		ttl, err := duration(n.CacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid cache duration: %v", path, err)
+		}
+		return sisyphus.NewHTTPDevice(n.HTTP, n.Method, timeout, ttl), nil
+	default:
+		var content []byte
+		if n.Content != nil {
+			content = []byte(*n.Content)
+		}
+		return sisyphus.NewBytes(content), nil
+	}
+}
+
+// mode returns the file mode of n, or def if no mode is specified.
+func (n node) mode(def os.FileMode) (os.FileMode, error) {
+	if n.Mode == "" {
+		return def, nil
+	}
+	m, err := strconv.ParseUint(n.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q", n.Mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// duration parses s as a time.Duration. The empty string is zero.
+func duration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// logger returns a Func that logs writes to the node at path.
+func logger(path string) sisyphus.Func {
+	return sisyphus.Func(func(b []byte, off int64) (int, error) {
+		fmt.Printf("%s: %q\n", path, b)
+		return len(b), nil
+	}).TrimNewline()
+}
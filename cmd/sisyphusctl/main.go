@@ -0,0 +1,118 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The sisyphusctl command controls a running sisyphus mount through its
+// control API.
+//
+// Usage:
+//
+//	sisyphusctl [-addr host:port] <command> [arguments]
+//
+// The commands are:
+//
+//	stats                          print file system statistics
+//	readonly on|off                set the read only state
+//	get <path>                     print the content of a file node
+//	set <path> [content]           replace the content of a file node,
+//	                               reading standard input if content
+//	                               is not given
+//	bind <dir> <name> <type> <mode> [content]
+//	                               bind a new dir, ro or rw node
+//	unbind <path>                  unbind a node
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:7070", "specify the control API address")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: sisyphusctl [-addr host:port] <command> [arguments]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := client{base: "http://" + *addr}
+	var err error
+	switch cmd, args := args[0], args[1:]; {
+	case cmd == "stats" && len(args) == 0:
+		err = c.do(http.MethodGet, "/stats", nil, nil)
+	case cmd == "readonly" && len(args) == 1 && (args[0] == "on" || args[0] == "off"):
+		err = c.do(http.MethodPut, "/readonly", url.Values{"on": {fmt.Sprint(args[0] == "on")}}, nil)
+	case cmd == "get" && len(args) == 1:
+		err = c.do(http.MethodGet, "/content", url.Values{"path": {args[0]}}, nil)
+	case cmd == "set" && (len(args) == 1 || len(args) == 2):
+		var body io.Reader = os.Stdin
+		if len(args) == 2 {
+			body = strings.NewReader(args[1])
+		}
+		err = c.do(http.MethodPut, "/content", url.Values{"path": {args[0]}}, body)
+	case cmd == "bind" && (len(args) == 4 || len(args) == 5):
+		var body io.Reader
+		if len(args) == 5 {
+			body = strings.NewReader(args[4])
+		}
+		err = c.do(http.MethodPost, "/node", url.Values{
+			"dir":  {args[0]},
+			"name": {args[1]},
+			"type": {args[2]},
+			"mode": {args[3]},
+		}, body)
+	case cmd == "unbind" && len(args) == 1:
+		err = c.do(http.MethodDelete, "/node", url.Values{"path": {args[0]}}, nil)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// client is a control API client.
+type client struct {
+	base string
+}
+
+// do performs a control API request, copying the response body to
+// standard output on success.
+func (c client) do(method, path string, query url.Values, body io.Reader) error {
+	u := c.base + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
@@ -0,0 +1,162 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+)
+
+// Command is a Writer that parses each write into a verb and arguments and
+// dispatches them to a handler registered for the verb. It is intended for
+// sysfs-like command attributes such as tacho-motor command files.
+//
+// Each write must be made at offset zero and hold a single command line,
+// optionally terminated by a newline. The line is split into fields at
+// white space. Fields may be quoted with single quotes, which take their
+// content literally, or double quotes, within which a backslash escapes the
+// following character. Outside quotes, a backslash escapes the following
+// character. The first field is the verb and the remaining fields are its
+// arguments.
+//
+// Writes at a non-zero offset, empty or malformed command lines and unknown
+// verbs without a default handler return EINVAL. Errors returned by a
+// handler are returned from WriteAt.
+type Command struct {
+	mu       sync.Mutex
+	handlers map[string]func(args []string) error
+	def      func(verb string, args []string) error
+}
+
+// NewCommand returns a new Command with no registered verbs.
+func NewCommand() *Command {
+	return &Command{handlers: make(map[string]func(args []string) error)}
+}
+
+// Handle registers fn as the handler for verb, replacing any existing
+// handler, and returns c.
+func (c *Command) Handle(verb string, fn func(args []string) error) *Command {
+	c.mu.Lock()
+	c.handlers[verb] = fn
+	c.mu.Unlock()
+	return c
+}
+
+// Default sets fn as the handler for verbs without a registered handler,
+// and returns c. If fn is nil, unknown verbs return EINVAL.
+func (c *Command) Default(fn func(verb string, args []string) error) *Command {
+	c.mu.Lock()
+	c.def = fn
+	c.mu.Unlock()
+	return c
+}
+
+// Verbs returns the sorted list of registered verbs. The list may be used
+// to provide a sysfs-like commands attribute.
+func (c *Command) Verbs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	verbs := make([]string, 0, len(c.handlers))
+	for v := range c.handlers {
+		verbs = append(verbs, v)
+	}
+	sort.Strings(verbs)
+	return verbs
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (c *Command) WriteAt(b []byte, off int64) (int, error) {
+	if off != 0 {
+		return 0, syscall.EINVAL
+	}
+	fields, ok := splitCommand(string(bytes.TrimSuffix(b, []byte{'\n'})))
+	if !ok || len(fields) == 0 {
+		return 0, syscall.EINVAL
+	}
+	verb, args := fields[0], fields[1:]
+
+	c.mu.Lock()
+	fn := c.handlers[verb]
+	def := c.def
+	c.mu.Unlock()
+	var err error
+	switch {
+	case fn != nil:
+		err = fn(args)
+	case def != nil:
+		err = def(verb, args)
+	default:
+		err = syscall.EINVAL
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Truncate is a no-op.
+func (c *Command) Truncate(_ int64) error { return nil }
+
+// Size returns zero and a nil error.
+func (c *Command) Size() (int64, error) { return 0, nil }
+
+// splitCommand splits line into fields as described for Command. It
+// returns false if line has an unterminated quote or a trailing escape.
+func splitCommand(line string) (fields []string, ok bool) {
+	var (
+		field   strings.Builder
+		inField bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				field.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				field.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inField = true
+		case r == '\\':
+			escaped = true
+			inField = true
+		case unicode.IsSpace(r):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, false
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, true
+}
@@ -0,0 +1,106 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Conflict specifies how a bind handles an existing node with the same
+// name in the target directory.
+type Conflict int
+
+const (
+	// Replace unbinds the existing node
+	// and binds the new node in its place,
+	// invalidating the kernel's cached
+	// directory entry. This is the
+	// behaviour of Bind.
+	Replace Conflict = iota
+
+	// Fail leaves the existing node
+	// bound and returns EEXIST.
+	Fail
+
+	// KeepBoth binds the new node with
+	// the first name of the form name.N,
+	// with N counting from 1, that is
+	// not in use.
+	KeepBoth
+)
+
+// BindConflict binds the node at the given directory path, handling an
+// existing node with the same name according to c. It returns the name
+// the node was bound with, which differs from its original name only when
+// c is KeepBoth. Nodes renamed by KeepBoth keep their new name if they are
+// later unbound. BindConflict returns an error for the same reasons as
+// Bind.
+func (fs *FileSystem) BindConflict(dir string, n Node, c Conflict) (name string, err error) {
+	fs.mu.Lock()
+	d, old, err := fs.bindConflict(dir, n, c)
+	server := fs.server
+	fs.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	dir = rooted(dir)
+	path := filepath.Join(dir, n.Name())
+	if old != nil {
+		fs.event(Event{Op: "unbind", Path: path})
+		if server != nil {
+			err = server.fuse.InvalidateEntry(d, n.Name())
+			if err == fuse.ErrNotCached {
+				err = nil
+			}
+		}
+	}
+	fs.event(Event{Op: "bind", Path: path})
+	return n.Name(), err
+}
+
+// rename sets the name of an unbound node to name. It returns false if
+// the node cannot be renamed.
+func rename(n Node, name string) bool {
+	if !validName(name) {
+		return false
+	}
+	switch n := n.(type) {
+	case *Dir:
+		n.name = name
+	case *RO:
+		n.name = name
+	case *RW:
+		n.name = name
+	case *WO:
+		n.name = name
+	case *Symlink:
+		n.name = name
+	default:
+		return false
+	}
+	return true
+}
+
+// freeName returns the first name of the form name.N that is not used
+// in d. It must be called with d.mu held.
+func freeName(d *Dir, name string) string {
+	for i := 1; ; i++ {
+		s := fmt.Sprintf("%s.%d", name, i)
+		if _, ok := d.files[s]; !ok {
+			return s
+		}
+	}
+}
+
+// conflictError returns the error for a name conflict in dir.
+func conflictError(dir, name string) error {
+	return &os.PathError{Op: "bind", Path: filepath.Join(dir, name), Err: syscall.EEXIST}
+}
@@ -0,0 +1,231 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// ControlStats is the runtime state of a file system reported by the
+// control handler.
+type ControlStats struct {
+	ReadOnly bool                 `json:"read_only"`
+	Requests RequestStats         `json:"requests"`
+	Opens    map[string]OpenStats `json:"opens"`
+}
+
+// NewControlHandler returns an http.Handler providing runtime control of
+// filesys. The handler serves the following endpoints:
+//
+//	GET    /stats                          report ControlStats as JSON
+//	PUT    /readonly?on=<bool>             set the read only state
+//	GET    /content?path=<path>            read the content of a file node
+//	PUT    /content?path=<path>            replace the content of a file node
+//	POST   /node?dir=<dir>&name=<name>&type=<dir|ro|rw>&mode=<octal>
+//	                                       bind a new node with the request
+//	                                       body as its content
+//	DELETE /node?path=<path>               unbind a node
+//
+// Content can be replaced for RW nodes, and for RO nodes backed by Bytes
+// or MutableString. Newly bound file nodes are backed by Bytes.
+//
+// The handler does not authenticate or authorize requests, and any client
+// able to reach it can read and replace file content and change the tree.
+// It must only be served on a listener restricted to trusted clients, such
+// as a unix socket with suitable permissions or the loopback interface.
+func NewControlHandler(filesys *FileSystem) http.Handler {
+	mux := http.NewServeMux()
+	c := control{fs: filesys}
+	mux.HandleFunc("/stats", c.stats)
+	mux.HandleFunc("/readonly", c.readOnly)
+	mux.HandleFunc("/content", c.content)
+	mux.HandleFunc("/node", c.node)
+	return mux
+}
+
+// control implements the control handler endpoints.
+type control struct {
+	fs *FileSystem
+}
+
+func (c control) stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c.fs.mu.Lock()
+	ro := c.fs.readOnly
+	c.fs.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ControlStats{
+		ReadOnly: ro,
+		Requests: c.fs.RequestStats(),
+		Opens:    c.fs.OpenReport(),
+	})
+}
+
+func (c control) readOnly(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+	if err != nil {
+		http.Error(w, "invalid on parameter", http.StatusBadRequest)
+		return
+	}
+	c.fs.SetReadOnly(on)
+}
+
+func (c control) content(w http.ResponseWriter, r *http.Request) {
+	path := filepath.Clean(r.URL.Query().Get("path"))
+	c.fs.mu.Lock()
+	n, err := walkPath(c.fs.root, "control", path)
+	c.fs.mu.Unlock()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var data []byte
+		switch n := n.(type) {
+		case *RO:
+			n.mu.Lock()
+			data, err = readAll(n.dev)
+			n.mu.Unlock()
+		case *RW:
+			n.mu.Lock()
+			data, err = readAll(n.dev)
+			n.mu.Unlock()
+		default:
+			err = &os.PathError{Op: "read", Path: path, Err: syscall.EBADF}
+		}
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Write(data)
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = setContent(n, path, data)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		err = c.fs.invalidateRange(n, 0, -1)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// setContent replaces the content of n with data.
+func setContent(n Node, path string, data []byte) error {
+	switch n := n.(type) {
+	case *RW:
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		err := n.dev.Truncate(0)
+		if err != nil {
+			return err
+		}
+		_, err = n.dev.WriteAt(data, 0)
+		n.mtime = n.fs.now()
+		return err
+	case *RO:
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		switch dev := n.dev.(type) {
+		case *Bytes:
+			*dev = append((*dev)[:0], data...)
+		case *MutableString:
+			dev.Store(string(data))
+		default:
+			return &os.PathError{Op: "write", Path: path, Err: syscall.EPERM}
+		}
+		n.mtime = n.fs.now()
+		return nil
+	default:
+		return &os.PathError{Op: "write", Path: path, Err: syscall.EBADF}
+	}
+}
+
+func (c control) node(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodPost:
+		mode, err := strconv.ParseUint(q.Get("mode"), 8, 32)
+		if err != nil {
+			http.Error(w, "invalid mode parameter", http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var n Node
+		name := q.Get("name")
+		switch q.Get("type") {
+		case "dir":
+			n, err = NewDir(name, os.FileMode(mode))
+		case "ro":
+			n, err = NewRO(name, os.FileMode(mode), NewBytes(data))
+		case "rw":
+			n, err = NewRW(name, os.FileMode(mode), NewBytes(data))
+		default:
+			http.Error(w, "invalid type parameter", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = c.fs.Bind(q.Get("dir"), n)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		_, err := c.fs.Unbind(q.Get("path"))
+		if err != nil {
+			httpError(w, err)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// httpError writes err to w with a status code reflecting the error.
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, syscall.ENOENT):
+		code = http.StatusNotFound
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EROFS):
+		code = http.StatusForbidden
+	case errors.Is(err, syscall.EBADF), errors.Is(err, syscall.ENOTDIR), errors.Is(err, syscall.EINVAL), errors.Is(err, ErrBadName):
+		code = http.StatusBadRequest
+	case errors.Is(err, syscall.EEXIST):
+		code = http.StatusConflict
+	}
+	http.Error(w, err.Error(), code)
+}
@@ -0,0 +1,79 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"os"
+	"syscall"
+)
+
+// Copy replaces the content of the RW node at dst with the content of the
+// RO or RW node at src, returning the number of bytes copied. The copy is
+// made directly between the nodes' devices without passing through the
+// kernel. If the file system is being served, the kernel cache of dst is
+// invalidated.
+//
+// The FUSE copy_file_range operation is not supported by the underlying
+// FUSE library, so clients copying between nodes read and write the data.
+func (fs *FileSystem) Copy(dst, src string) (int64, error) {
+	fs.mu.Lock()
+	s, err := walkPath(fs.root, "copy", rooted(src))
+	if err != nil {
+		fs.mu.Unlock()
+		return 0, err
+	}
+	d, err := walkPath(fs.root, "copy", rooted(dst))
+	if err != nil {
+		fs.mu.Unlock()
+		return 0, err
+	}
+	server := fs.server
+	fs.mu.Unlock()
+
+	var data []byte
+	switch s := s.(type) {
+	case *RO:
+		s.mu.Lock()
+		data, err = readAll(s.dev)
+		s.atime = fs.now()
+		s.mu.Unlock()
+	case *RW:
+		s.mu.Lock()
+		data, err = readAll(s.dev)
+		s.atime = fs.now()
+		s.mu.Unlock()
+	case *Dir:
+		return 0, &os.PathError{Op: "copy", Path: src, Err: syscall.EISDIR}
+	default:
+		return 0, &os.PathError{Op: "copy", Path: src, Err: syscall.EBADF}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	f, ok := d.(*RW)
+	if !ok {
+		if _, ok := d.(*Dir); ok {
+			return 0, &os.PathError{Op: "copy", Path: dst, Err: syscall.EISDIR}
+		}
+		return 0, &os.PathError{Op: "copy", Path: dst, Err: syscall.EBADF}
+	}
+	f.mu.Lock()
+	err = f.dev.Truncate(0)
+	var n int
+	if err == nil {
+		n, err = f.dev.WriteAt(data, 0)
+	}
+	f.mtime = fs.now()
+	f.mu.Unlock()
+	if err != nil {
+		return int64(n), err
+	}
+
+	if server != nil {
+		err = fs.Invalidate(f)
+	}
+	return int64(n), err
+}
@@ -0,0 +1,72 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+)
+
+// Counter is a ReadWriter backed by an atomically updated integer. Its file
+// content is the decimal value of the integer followed by a newline. Writes
+// set the value of the integer from the decimal text written at offset zero.
+// The zero value of Counter is ready to use and holds zero.
+type Counter struct {
+	v int64
+}
+
+// NewCounter returns a new Counter holding v.
+func NewCounter(v int64) *Counter { return &Counter{v: v} }
+
+// Inc increments the value of the counter by one, returning the new value.
+func (c *Counter) Inc() int64 { return atomic.AddInt64(&c.v, 1) }
+
+// Dec decrements the value of the counter by one, returning the new value.
+func (c *Counter) Dec() int64 { return atomic.AddInt64(&c.v, -1) }
+
+// Add adds delta to the value of the counter, returning the new value.
+func (c *Counter) Add(delta int64) int64 { return atomic.AddInt64(&c.v, delta) }
+
+// Set sets the value of the counter.
+func (c *Counter) Set(v int64) { atomic.StoreInt64(&c.v, v) }
+
+// Load returns the value of the counter.
+func (c *Counter) Load() int64 { return atomic.LoadInt64(&c.v) }
+
+// text returns the file content of the counter.
+func (c *Counter) text() []byte {
+	return strconv.AppendInt(nil, c.Load(), 10)
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (c *Counter) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	return readAt(append(c.text(), '\n'), b, off)
+}
+
+// WriteAt satisfies the io.WriterAt interface. Only writes at offset
+// zero are accepted, and b must hold a decimal integer optionally
+// followed by a newline.
+func (c *Counter) WriteAt(b []byte, off int64) (int, error) {
+	if off != 0 {
+		return 0, syscall.EINVAL
+	}
+	v, err := strconv.ParseInt(string(bytes.TrimSuffix(b, []byte{'\n'})), 10, 64)
+	if err != nil {
+		return 0, syscall.EINVAL
+	}
+	c.Set(v)
+	return len(b), nil
+}
+
+// Truncate is a no-op.
+func (c *Counter) Truncate(_ int64) error { return nil }
+
+// Size returns the length of the file content of the counter and a nil error.
+func (c *Counter) Size() (int64, error) { return int64(len(c.text()) + 1), nil }
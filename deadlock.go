@@ -0,0 +1,131 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// SetDeadlockDetection sets whether the file system detects re-entrant
+// access to a node from its own device. A device that accesses the node it
+// serves through the mounted file system while the node is handling a
+// request would otherwise hang forever, since the kernel's request waits on
+// the node's lock which is held until the device returns. When detection is
+// enabled, such requests fail with EDEADLK and an error naming the node.
+//
+// Detection tracks the operating system threads executing device calls and
+// compares them with the thread making each FUSE request, so access from
+// other goroutines or from child processes of the device is not detected.
+// Detection is only available on Linux and adds a small cost to each device
+// call.
+func (fs *FileSystem) SetDeadlockDetection(detect bool) {
+	var v uint32
+	if detect {
+		v = 1
+	}
+	atomic.StoreUint32(&fs.devCalls.enabled, v)
+}
+
+// deviceCalls tracks the threads executing device calls.
+type deviceCalls struct {
+	// enabled is non-zero if detection
+	// is enabled. It is accessed
+	// atomically.
+	enabled uint32
+
+	mu      sync.Mutex
+	threads map[int]Node
+}
+
+// enterDevice records that the calling goroutine is executing a device call
+// for n and returns a function that must be called when the call returns.
+// enterDevice may be called with n's lock held.
+func (fs *FileSystem) enterDevice(n Node) (exit func()) {
+	if !threadIDs || fs == nil || atomic.LoadUint32(&fs.devCalls.enabled) == 0 {
+		return noExit
+	}
+	runtime.LockOSThread()
+	tid := gettid()
+	if tid == 0 {
+		runtime.UnlockOSThread()
+		return noExit
+	}
+	c := &fs.devCalls
+	c.mu.Lock()
+	if c.threads == nil {
+		c.threads = make(map[int]Node)
+	}
+	prev, nested := c.threads[tid]
+	c.threads[tid] = n
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		if nested {
+			c.threads[tid] = prev
+		} else {
+			delete(c.threads, tid)
+		}
+		c.mu.Unlock()
+		runtime.UnlockOSThread()
+	}
+}
+
+func noExit() {}
+
+type reentryKey struct{}
+
+// reentry is a request made by a thread executing a device call for n.
+type reentry struct {
+	fs  *FileSystem
+	n   Node
+	pid uint32
+}
+
+// withReentry returns ctx marked as re-entrant if the request made by
+// the thread pid was made during a device call.
+func (fs *FileSystem) withReentry(ctx context.Context, pid uint32) context.Context {
+	if atomic.LoadUint32(&fs.devCalls.enabled) == 0 || pid == 0 {
+		return ctx
+	}
+	fs.devCalls.mu.Lock()
+	n, ok := fs.devCalls.threads[int(pid)]
+	fs.devCalls.mu.Unlock()
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, reentryKey{}, reentry{fs: fs, n: n, pid: pid})
+}
+
+// reentrant returns an EDEADLK error if the request held in ctx was made
+// by a thread executing a device call for n. reentrant does not take n's
+// lock. It is called by check before any other check of an operation.
+func reentrant(ctx context.Context, n Node) error {
+	r, ok := ctx.Value(reentryKey{}).(reentry)
+	if !ok || r.n != n {
+		return nil
+	}
+	return WithErrno(fmt.Errorf("sisyphus: re-entrant access to %s from its device by thread %d", r.fs.path(n), r.pid), syscall.EDEADLK)
+}
+
+// sys returns the file system holding n for an operation made by the
+// request held in ctx. Node operations obtain their file system with sys
+// rather than the node's Sys method, since the lock taken by Sys is held
+// by the device call that made a re-entrant request. It is used by node
+// operation methods as
+//
+//	defer sys(ctx, f).trace(op, f)(&err)
+//
+//	done, err := sys(ctx, f).check(ctx, op, f)
+func sys(ctx context.Context, n Node) *FileSystem {
+	if r, ok := ctx.Value(reentryKey{}).(reentry); ok && r.n == n {
+		return r.fs
+	}
+	return n.Sys()
+}
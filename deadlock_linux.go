@@ -0,0 +1,13 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import "syscall"
+
+// threadIDs is whether thread IDs are available for deadlock detection.
+const threadIDs = true
+
+// gettid returns the thread ID of the calling thread.
+func gettid() int { return syscall.Gettid() }
@@ -0,0 +1,14 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package sisyphus
+
+// threadIDs is whether thread IDs are available for deadlock detection.
+const threadIDs = false
+
+// gettid returns zero since thread IDs are not available.
+func gettid() int { return 0 }
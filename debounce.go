@@ -0,0 +1,113 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"sync"
+	"time"
+)
+
+// Debounce is a Writer that coalesces bursts of writes, delivering only
+// the last payload written within a window to an underlying Writer. The
+// payload is delivered once no write has been made for the duration of
+// the window, or when Sync is called.
+type Debounce struct {
+	mu     sync.Mutex
+	dev    Writer
+	window time.Duration
+
+	timer   *time.Timer
+	pending bool
+	data    []byte
+	off     int64
+
+	// err is the error returned by
+	// the last delayed delivery.
+	err error
+}
+
+// NewDebounce returns a new Debounce delivering writes to dev after
+// the given window.
+func NewDebounce(dev Writer, window time.Duration) *Debounce {
+	return &Debounce{dev: dev, window: window}
+}
+
+// WriteAt satisfies the io.WriterAt interface. WriteAt retains b and off
+// for later delivery and reports the complete write as successful unless
+// an earlier delayed delivery failed, in which case that error is returned
+// and b is discarded.
+func (d *Debounce) WriteAt(b []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		err := d.err
+		d.err = nil
+		return 0, err
+	}
+	d.data = append(d.data[:0], b...)
+	d.off = off
+	d.pending = true
+	if d.timer == nil {
+		d.timer = time.AfterFunc(d.window, d.fire)
+	} else {
+		d.timer.Reset(d.window)
+	}
+	return len(b), nil
+}
+
+// fire delivers the pending payload when the window expires.
+func (d *Debounce) fire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.err = d.deliver()
+}
+
+// deliver writes any pending payload to the underlying Writer.
+func (d *Debounce) deliver() error {
+	if !d.pending {
+		return nil
+	}
+	d.pending = false
+	_, err := d.dev.WriteAt(d.data, d.off)
+	return err
+}
+
+// Sync delivers any pending payload immediately, returning the error
+// from the delivery or from an earlier delayed delivery. If the
+// underlying Writer has a Sync method it is then called.
+func (d *Debounce) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	err := d.err
+	d.err = nil
+	if derr := d.deliver(); err == nil {
+		err = derr
+	}
+	if err != nil {
+		return err
+	}
+	if s, ok := d.dev.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Truncate discards any pending payload and truncates the underlying Writer.
+func (d *Debounce) Truncate(n int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending = false
+	return d.dev.Truncate(n)
+}
+
+// Size returns the size of the underlying Writer.
+func (d *Debounce) Size() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dev.Size()
+}
@@ -0,0 +1,186 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+)
+
+// DebugLevel is the verbosity of FUSE protocol debug logging.
+type DebugLevel int
+
+const (
+	// DebugOff disables logging.
+	DebugOff DebugLevel = iota
+
+	// DebugErrors logs failed requests,
+	// failed notifications and protocol
+	// diagnostics.
+	DebugErrors
+
+	// DebugAll logs all requests,
+	// responses and notifications.
+	DebugAll
+)
+
+// DebugRecord is a FUSE protocol debug message.
+type DebugRecord struct {
+	// Level is the lowest DebugLevel
+	// at which the record is logged.
+	Level DebugLevel
+
+	// Op is the FUSE operation of the
+	// message, for example "Lookup".
+	// It is empty for diagnostics.
+	Op string
+
+	// Path is the absolute path of the
+	// node addressed by the message, or
+	// empty if it is not known.
+	Path string
+
+	// Message is the text of the
+	// bazil.org/fuse debug message.
+	Message string
+}
+
+// SetDebug sets the function used to log FUSE protocol debug messages for
+// the file system when it is served. Records above level are not logged.
+// If paths are provided, only records addressing those paths or nodes below
+// them are logged, so that debugging can be enabled for a single file. A nil
+// log or a DebugOff level disables logging. SetDebug may be called while the
+// file system is being served.
+//
+// The path of a record is determined from the lookups made by the kernel
+// after logging has been enabled. Nodes looked up before SetDebug is
+// called are not known until the kernel looks them up again.
+func (fs *FileSystem) SetDebug(log func(DebugRecord), level DebugLevel, paths ...string) {
+	scope := make([]string, len(paths))
+	for i, p := range paths {
+		scope[i] = path.Clean("/" + p)
+	}
+	fs.debug.mu.Lock()
+	fs.debug.log = log
+	fs.debug.level = level
+	fs.debug.paths = scope
+	fs.debug.mu.Unlock()
+}
+
+// debugLog maps bazil.org/fuse debug messages to DebugRecords.
+type debugLog struct {
+	mu    sync.Mutex
+	log   func(DebugRecord)
+	level DebugLevel
+	paths []string
+
+	// nodes holds the paths of the
+	// kernel node IDs seen in lookups.
+	nodes map[fuse.NodeID]string
+
+	// requests holds the paths of
+	// requests awaiting a response.
+	requests map[fuse.RequestID]string
+}
+
+// message satisfies the bazil.org/fuse/fs.Config Debug field. It must
+// not retain msg.
+func (l *debugLog) message(msg interface{}) {
+	l.mu.Lock()
+	log := l.log
+	if log == nil || l.level == DebugOff {
+		l.nodes = nil
+		l.requests = nil
+		l.mu.Unlock()
+		return
+	}
+	rec := l.record(msg)
+	ok := rec.Level <= l.level && l.inScope(rec.Path)
+	l.mu.Unlock()
+	if ok {
+		log(rec)
+	}
+}
+
+// record returns the DebugRecord for msg, updating the node table. It
+// must be called with l.mu held.
+//
+// The message types of bazil.org/fuse/fs are not exported, so their
+// exported fields are inspected by reflection.
+func (l *debugLog) record(msg interface{}) DebugRecord {
+	rec := DebugRecord{Level: DebugErrors, Message: fmt.Sprint(msg)}
+	v := reflect.Indirect(reflect.ValueOf(msg))
+	if v.Kind() != reflect.Struct {
+		return rec
+	}
+	if l.nodes == nil {
+		l.nodes = map[fuse.NodeID]string{fuse.RootID: "/"}
+		l.requests = make(map[fuse.RequestID]string)
+	}
+	switch v.Type().Name() {
+	case "request":
+		rec.Level = DebugAll
+		rec.Op = v.FieldByName("Op").String()
+		req, ok := v.FieldByName("In").Interface().(fuse.Request)
+		if !ok {
+			return rec
+		}
+		hdr := req.Hdr()
+		rec.Path = l.nodes[hdr.Node]
+		switch req := req.(type) {
+		case *fuse.LookupRequest:
+			if rec.Path != "" {
+				rec.Path = path.Join(rec.Path, req.Name)
+			}
+		case *fuse.ForgetRequest:
+			delete(l.nodes, hdr.Node)
+		}
+		l.requests[hdr.ID] = rec.Path
+
+	case "response":
+		rec.Level = DebugAll
+		rec.Op = v.FieldByName("Op").String()
+		if v.FieldByName("Errno").String() != "" {
+			rec.Level = DebugErrors
+		}
+		id := fuse.RequestID(v.FieldByName("Request").FieldByName("ID").Uint())
+		rec.Path = l.requests[id]
+		delete(l.requests, id)
+		if out, ok := v.FieldByName("Out").Interface().(*fuse.LookupResponse); ok && rec.Path != "" {
+			l.nodes[out.Node] = rec.Path
+		}
+
+	case "notification":
+		rec.Level = DebugAll
+		rec.Op = v.FieldByName("Op").String()
+		if v.FieldByName("Err").String() != "" {
+			rec.Level = DebugErrors
+		}
+		rec.Path = l.nodes[fuse.NodeID(v.FieldByName("Node").Uint())]
+	}
+	return rec
+}
+
+// inScope returns whether a record for path p should be logged. It must
+// be called with l.mu held.
+func (l *debugLog) inScope(p string) bool {
+	if len(l.paths) == 0 {
+		return true
+	}
+	if p == "" {
+		return false
+	}
+	for _, s := range l.paths {
+		if p == s || s == "/" || strings.HasPrefix(p, s+"/") {
+			return true
+		}
+	}
+	return false
+}
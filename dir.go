@@ -6,10 +6,12 @@ package sisyphus
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -23,21 +25,36 @@ type Dir struct {
 	name string
 	attr
 
+	// attrFunc is an optional hook
+	// adjusting reported attributes.
+	attrFunc AttrFunc
+
 	files map[string]Node
 
+	// factory is an optional function
+	// creating nodes on lookup misses.
+	factory NodeFactory
+
+	// entryValid is the validity of
+	// lookup results if setValid is true.
+	entryValid time.Duration
+	setValid   bool
+
 	fs *FileSystem
 }
 
 var (
-	_ Node                  = (*Dir)(nil)
-	_ fs.Node               = (*Dir)(nil)
-	_ fs.HandleReadDirAller = (*Dir)(nil)
-	_ fs.NodeStringLookuper = (*Dir)(nil)
+	_ Node                   = (*Dir)(nil)
+	_ fs.Node                = (*Dir)(nil)
+	_ fs.NodeGetxattrer      = (*Dir)(nil)
+	_ fs.NodeListxattrer     = (*Dir)(nil)
+	_ fs.HandleReadDirAller  = (*Dir)(nil)
+	_ fs.NodeRequestLookuper = (*Dir)(nil)
 )
 
 // NewDir returns a new Dir with the given name and file mode.
 func NewDir(name string, mode os.FileMode) (*Dir, error) {
-	if name != "/" && strings.Contains(name, string(filepath.Separator)) {
+	if name != "/" && !validName(name) {
 		return nil, ErrBadName
 	}
 	return &Dir{
@@ -50,7 +67,7 @@ func NewDir(name string, mode os.FileMode) (*Dir, error) {
 }
 
 // MustNewDir returns a new Dir with the given name and file mode. It
-// will panic if name contains a filepath separator unless name is "/".
+// will panic if name is not a valid base name unless name is "/".
 func MustNewDir(name string, mode os.FileMode) *Dir {
 	d, err := NewDir(name, mode)
 	if err != nil {
@@ -59,23 +76,89 @@ func MustNewDir(name string, mode os.FileMode) *Dir {
 	return d
 }
 
-// Own sets the uid and gid of the directory.
+// Own sets the uid and gid of the directory. If the directory is bound
+// to a file system, its change time is updated. Own may be called before
+// the directory is bound.
 func (d *Dir) Own(uid, gid uint32) *Dir {
-	d.uid = uid
-	d.gid = gid
-	d.mtime = d.fs.now()
+	d.mu.Lock()
+	d.own(d.fs, uid, gid)
+	d.mu.Unlock()
+	return d
+}
+
+// SetAttrFunc sets a function that is called to adjust the attributes
+// reported for the directory.
+func (d *Dir) SetAttrFunc(fn AttrFunc) *Dir {
+	d.mu.Lock()
+	d.attrFunc = fn
+	d.mu.Unlock()
+	return d
+}
+
+// NodeFactory is a function returning a new node with the given name. A
+// NodeFactory returns a nil Node and nil error, or an error, if no node
+// should be created with the name.
+type NodeFactory func(name string) (Node, error)
+
+// SetFactory sets a function that is called when a lookup in the directory
+// does not find a node with the requested name. A node returned by the
+// factory is bound in the directory as if by the FileSystem Bind method and
+// returned by the lookup, so that nodes such as indexed value attributes
+// need not be bound for every possible name. If the factory returns a nil
+// Node, the lookup fails with ENOENT. The factory is not called for names
+// that are not looked up, so created nodes are only listed by the
+// directory after they have been looked up. A nil factory removes the
+// directory's factory.
+func (d *Dir) SetFactory(fn NodeFactory) *Dir {
+	d.mu.Lock()
+	d.factory = fn
+	d.mu.Unlock()
 	return d
 }
 
 // With adds nodes to the dirctory. If with is used the FileSystem Sync method
-// should be called when all nodes have been added.
+// should be called when all nodes have been added. With is safe for
+// concurrent use, so subtrees may be constructed in parallel before a
+// single call to Sync.
 func (d *Dir) With(nodes ...Node) Node {
+	unlock := d.lockSys()
 	for _, n := range nodes {
 		d.files[n.Name()] = n
 	}
+	unlock()
 	return d
 }
 
+// lockSys locks the lock of the file system holding d, if there is one,
+// and then d.mu, returning a function that releases both. Path walks
+// read the nodes of a directory holding only the file system's lock,
+// so changes to the nodes of a bound directory must hold both.
+func (d *Dir) lockSys() (unlock func()) {
+	for {
+		d.mu.Lock()
+		filesys := d.fs
+		d.mu.Unlock()
+		if filesys != nil {
+			filesys.mu.Lock()
+		}
+		d.mu.Lock()
+		if d.fs == filesys {
+			return func() {
+				d.mu.Unlock()
+				if filesys != nil {
+					filesys.mu.Unlock()
+				}
+			}
+		}
+		// The directory was moved to another
+		// file system while it was unlocked.
+		d.mu.Unlock()
+		if filesys != nil {
+			filesys.mu.Unlock()
+		}
+	}
+}
+
 // Name returns the name of the directory.
 func (d *Dir) Name() string { return d.name }
 
@@ -108,41 +191,191 @@ func (d *Dir) Invalidate() error {
 }
 
 // Attr satisfies the bazil.org/fuse/fs.Node interface.
-func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	defer d.Sys().trace(OpAttr, d)(&err)
 
+	d.mu.Lock()
 	copyAttr(a, d.attr)
+	d.fs.mapAttr(a)
+	a.BlockSize = blockSize
+	a.Nlink = 2
+	for _, f := range d.files {
+		if _, ok := f.(*Dir); ok {
+			a.Nlink++
+		}
+	}
+	fn := d.attrFunc
+	d.mu.Unlock()
+	if fn != nil {
+		return fn(ctx, a)
+	}
 	return nil
 }
 
 // ReadDirAll satisfies the bazil.org/fuse/HandleReadDirAller.Node interface.
-func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+// The FUSE library in use only reads directories through ReadDirAll, so the
+// full listing is built for each directory read; offset-based paged reads
+// are not supported.
+func (d *Dir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer d.Sys().trace(OpReadDir, d)(&err)
+
+	done, err := d.Sys().check(ctx, OpReadDir, d)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	d.mu.Lock()
-	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.files))
+	nodes := make([]Node, 0, len(d.files))
+	for name, f := range d.files {
+		names = append(names, name)
+		nodes = append(nodes, f)
+	}
+	d.atime = d.fs.now()
+	d.mu.Unlock()
 
-	files := make([]fuse.Dirent, 0, len(d.files))
+	// Child attributes are obtained without
+	// d.mu held since Attr may take the file
+	// system lock.
+	files := make([]fuse.Dirent, 0, len(names))
 	var attr fuse.Attr
-	for name, f := range d.files {
+	for i, f := range nodes {
 		err := f.Attr(ctx, &attr)
 		if err != nil {
 			return files, err
 		}
-		files = append(files, fuse.Dirent{Inode: attr.Inode, Name: name})
+		files = append(files, fuse.Dirent{Inode: attr.Inode, Name: names[i]})
 	}
-	d.atime = d.fs.now()
 	return files, nil
 }
 
-// Lookup satisfies the bazil.org/fuse/NodeStringLookuper.Node interface.
-func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+// SetEntryValid sets the time for which the kernel may cache the results
+// of looking up names in the directory. A zero duration causes the kernel
+// to look up names on each access, which is suitable for directories whose
+// children are bound and unbound while the file system is served, such as
+// hotplug device directories. A negative duration restores the default
+// validity used by the FUSE library.
+func (d *Dir) SetEntryValid(valid time.Duration) *Dir {
 	d.mu.Lock()
-	defer d.mu.Unlock()
+	d.entryValid = valid
+	d.setValid = valid >= 0
+	d.mu.Unlock()
+	return d
+}
 
-	n, ok := d.files[name]
+// Lookup satisfies the bazil.org/fuse/NodeRequestLookuper.Node interface.
+// Lookup of a missing name returns ENOENT. The FUSE library in use always
+// assigns a node ID to a successful lookup and cannot reply with the zero
+// node ID that marks a negative entry, so the kernel does not cache missing
+// names and each probe for a missing name is passed to the file system.
+func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node, err error) {
+	defer d.Sys().trace(OpLookup, d)(&err)
+
+	name := req.Name
+
+	done, err := d.Sys().checkChild(ctx, OpLookup, d, name)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	d.mu.Lock()
+	n, ok := d.child(name)
 	d.atime = d.fs.now()
+	valid, setValid := d.entryValid, d.setValid
+	d.mu.Unlock()
+
 	if !ok {
+		n, err = d.create(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if setValid {
+		resp.EntryValid = valid
+	}
+	return n, nil
+}
+
+// create binds a node with the given name made by the directory's
+// factory, returning the bound node. If a node with the name was bound
+// while the factory was called, that node is returned instead. create
+// must not be called with d.mu held.
+func (d *Dir) create(name string) (Node, error) {
+	d.mu.Lock()
+	factory := d.factory
+	filesys := d.fs
+	d.mu.Unlock()
+	if factory == nil || filesys == nil {
+		return nil, fuse.ENOENT
+	}
+
+	n, err := factory(name)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
 		return nil, fuse.ENOENT
 	}
+	if n.Name() != name {
+		return nil, Errno(syscall.EIO, fmt.Sprintf("sisyphus: factory created %q for %q", n.Name(), name))
+	}
+
+	filesys.mu.Lock()
+	d.mu.Lock()
+	c, ok := d.child(name)
+	d.mu.Unlock()
+	if ok {
+		filesys.mu.Unlock()
+		return c, nil
+	}
+	dir := filesys.pathLocked(d)
+	if dir == "" {
+		filesys.mu.Unlock()
+		return nil, fuse.ENOENT
+	}
+	_, _, err = filesys.bindConflict(dir, n, Fail)
+	filesys.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	filesys.event(Event{Op: "bind", Path: filepath.Join(dir, name)})
 	return n, nil
 }
+
+// child returns the named child of d. If the file system holding d
+// folds case and no child has exactly the given name, the first child
+// in lexical order whose name is equal to name under Unicode case folding
+// is returned. child must be called with d.mu or the file system's lock
+// held.
+func (d *Dir) child(name string) (Node, bool) {
+	n, ok := d.files[name]
+	if ok || !d.fs.foldsCase() {
+		return n, ok
+	}
+	var found string
+	for c := range d.files {
+		if strings.EqualFold(c, name) && (found == "" || c < found) {
+			found = c
+		}
+	}
+	if found == "" {
+		return nil, false
+	}
+	return d.files[found], true
+}
+
+// Getxattr satisfies the bazil.org/fuse/fs.NodeGetxattrer interface.
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	defer d.Sys().trace(OpGetxattr, d)(&err)
+
+	return d.Sys().getxattr(req, resp)
+}
+
+// Listxattr satisfies the bazil.org/fuse/fs.NodeListxattrer interface.
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	defer d.Sys().trace(OpListxattr, d)(&err)
+
+	return d.Sys().listxattr(req, resp)
+}
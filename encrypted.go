@@ -0,0 +1,124 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"sync"
+)
+
+// EncryptedBytes is a ReadWriter with the same semantics as Bytes that
+// holds its data encrypted with AES-GCM. The data is decrypted only for
+// the duration of each operation and the plaintext is cleared afterwards.
+type EncryptedBytes struct {
+	mu   sync.Mutex
+	aead cipher.AEAD
+
+	// sealed is the nonce followed by
+	// the sealed data.
+	sealed []byte
+}
+
+// NewEncryptedBytes returns a new EncryptedBytes holding data encrypted
+// with key, which must be 16, 24 or 32 bytes long to select AES-128,
+// AES-192 or AES-256. The caller should clear data after the call.
+func NewEncryptedBytes(key, data []byte) (*EncryptedBytes, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e := &EncryptedBytes{aead: aead}
+	err = e.seal(data)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// seal encrypts plain into the backing data using a new nonce.
+func (e *EncryptedBytes) seal(plain []byte) error {
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(plain)+e.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	e.sealed = e.aead.Seal(nonce, nonce, plain, nil)
+	return nil
+}
+
+// open returns the decrypted backing data.
+func (e *EncryptedBytes) open() ([]byte, error) {
+	ns := e.aead.NonceSize()
+	return e.aead.Open(nil, e.sealed[:ns], e.sealed[ns:], nil)
+}
+
+// zero zeros the full capacity of b.
+func zero(b []byte) {
+	b = b[:cap(b)]
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (e *EncryptedBytes) ReadAt(b []byte, off int64) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	plain, err := e.open()
+	if err != nil {
+		return 0, err
+	}
+	defer zero(plain)
+	p := Bytes(plain)
+	return p.ReadAt(b, off)
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (e *EncryptedBytes) WriteAt(b []byte, off int64) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	plain, err := e.open()
+	if err != nil {
+		return 0, err
+	}
+	p := Bytes(plain)
+	defer func() { zero(plain); zero(p) }()
+	n, err := p.WriteAt(b, off)
+	if err != nil {
+		return n, err
+	}
+	return n, e.seal(p)
+}
+
+// Truncate truncates the data at n bytes from the beginning.
+func (e *EncryptedBytes) Truncate(n int64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	plain, err := e.open()
+	if err != nil {
+		return err
+	}
+	defer zero(plain)
+	p := Bytes(plain)
+	err = p.Truncate(n)
+	if err != nil {
+		return err
+	}
+	return e.seal(p)
+}
+
+// Size returns the length of the plaintext data and a nil error.
+func (e *EncryptedBytes) Size() (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return int64(len(e.sealed) - e.aead.NonceSize() - e.aead.Overhead()), nil
+}
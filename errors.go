@@ -0,0 +1,81 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"errors"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Errno returns an error describing reason that is returned to the kernel
+// as e. The returned error matches e with errors.Is and can be extracted
+// as a syscall.Errno with errors.As.
+func Errno(e syscall.Errno, reason string) error {
+	if reason == "" {
+		return WithErrno(e, e)
+	}
+	return WithErrno(errors.New(reason+": "+e.Error()), e)
+}
+
+// WithErrno returns an error wrapping err that is returned to the kernel
+// as e. The returned error matches both err and e with errors.Is, and
+// unwraps to err, so devices may annotate their own error values with an
+// errno without losing them. WithErrno returns nil if err is nil.
+func WithErrno(err error, e syscall.Errno) error {
+	if err == nil {
+		return nil
+	}
+	return errno{error: err, errno: fuse.Errno(e)}
+}
+
+// errno is an error that satisfies fuse.ErrorNumber.
+type errno struct {
+	error
+	errno fuse.Errno
+}
+
+var _ fuse.ErrorNumber = errno{}
+
+func (e errno) Errno() fuse.Errno {
+	return e.errno
+}
+
+// Unwrap returns the wrapped error.
+func (e errno) Unwrap() error {
+	return e.error
+}
+
+// Is returns whether target is the errno of e.
+func (e errno) Is(target error) bool {
+	t, ok := target.(syscall.Errno)
+	return ok && fuse.Errno(t) == e.errno
+}
+
+// As sets target to the errno of e if target is a *syscall.Errno.
+func (e errno) As(target interface{}) bool {
+	t, ok := target.(*syscall.Errno)
+	if ok {
+		*t = syscall.Errno(e.errno)
+	}
+	return ok
+}
+
+// fuseError returns err in a form that is returned to the kernel with the
+// most precise errno available. Errors that wrap a syscall.Errno, such as
+// an *os.PathError or an error created by fmt.Errorf with the %w verb, but
+// that do not otherwise specify an errno, are returned as that errno rather
+// than as EIO.
+func fuseError(err error) error {
+	if err == nil || hasErrno(err) {
+		return err
+	}
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		return WithErrno(err, e)
+	}
+	return err
+}
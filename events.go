@@ -0,0 +1,131 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Event is a file system event record written to the events node.
+type Event struct {
+	Time time.Time `json:"time"`
+
+	// Op is the event kind, one of
+	// "write", "bind" or "unbind".
+	Op string `json:"op"`
+
+	Path string `json:"path"`
+
+	// Offset and Length are the location
+	// and size of a write.
+	Offset int64 `json:"offset,omitempty"`
+	Length int   `json:"length,omitempty"`
+
+	// Uid, Gid and Pid identify the
+	// process making a write.
+	Uid uint32 `json:"uid,omitempty"`
+	Gid uint32 `json:"gid,omitempty"`
+	Pid uint32 `json:"pid,omitempty"`
+}
+
+// maxEventLog is the size beyond which the oldest records of an event log
+// are discarded.
+const maxEventLog = 1 << 20
+
+// eventLog is a Reader holding line-delimited JSON event records.
+type eventLog struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (l *eventLog) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return readAt(l.data, b, off)
+}
+
+// Size returns the length of the log and a nil error.
+func (l *eventLog) Size() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(len(l.data)), nil
+}
+
+// add appends the encoding of e to the log.
+func (l *eventLog) add(e Event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.data = append(append(l.data, b...), '\n')
+	if len(l.data) <= maxEventLog {
+		return
+	}
+	// Retain the most recent whole records
+	// within half of the maximum size.
+	cut := len(l.data) - maxEventLog/2
+	cut += bytes.IndexByte(l.data[cut-1:], '\n')
+	l.data = append([]byte(nil), l.data[cut:]...)
+}
+
+// SetEvents binds a read only events node at path. The node holds a
+// line-delimited JSON Event record for each write made through the FUSE
+// mount and each Bind and Unbind, allowing clients to follow file system
+// activity with tail -f. If the file system is being served, the kernel's
+// cached attributes of the events node are invalidated after each event so
+// that readers see its new size. When the records exceed 1MiB, the oldest
+// are discarded to leave the most recent half, so readers following the
+// node see it truncated.
+func (fs *FileSystem) SetEvents(path string) error {
+	path = rooted(path)
+	dir, name := filepath.Split(path)
+	n, err := NewRO(name, 0444, &eventLog{})
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	err = fs.bind(dir, n)
+	if err != nil {
+		return err
+	}
+	fs.events = n
+	return nil
+}
+
+// event adds e to the file system's events node if it has one and
+// passes it to the file system's link farms.
+// event must not be called with fs.mu held.
+func (fs *FileSystem) event(e Event) {
+	if fs == nil {
+		return
+	}
+	fs.mu.Lock()
+	n := fs.events
+	server := fs.server
+	farms := fs.farms
+	fs.mu.Unlock()
+	if n != nil {
+		e.Time = fs.now()
+		n.dev.(*eventLog).add(e)
+		if server != nil {
+			server.fuse.InvalidateNodeAttr(n)
+		}
+	}
+	for _, l := range farms {
+		l.event(e)
+	}
+}
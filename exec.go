@@ -0,0 +1,111 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Exec is a Reader backed by the standard output of a command. The command
+// is run when a read is made at offset zero, and the output is retained to
+// serve reads at later offsets until the file is closed.
+type Exec struct {
+	mu sync.Mutex
+
+	name    string
+	args    []string
+	timeout time.Duration
+
+	out   []byte
+	valid bool
+}
+
+// NewExec returns a new Exec that runs the named program with the given
+// arguments. If timeout is positive, the command is killed if it has not
+// completed after timeout and the read returns ETIMEDOUT.
+func NewExec(timeout time.Duration, name string, args ...string) *Exec {
+	return &Exec{name: name, args: args, timeout: timeout}
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (e *Exec) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if off == 0 || !e.valid {
+		err := e.run()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if off >= int64(len(e.out)) {
+		return 0, io.EOF
+	}
+	n := copy(b, e.out[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// run runs the command and retains its output.
+func (e *Exec) run() error {
+	ctx := context.Background()
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+	out, err := exec.CommandContext(ctx, e.name, e.args...).Output()
+	if err != nil {
+		e.out = nil
+		e.valid = false
+		if ctx.Err() == context.DeadlineExceeded {
+			return WithErrno(ctx.Err(), syscall.ETIMEDOUT)
+		}
+		return execErrno(err)
+	}
+	e.out = out
+	e.valid = true
+	return nil
+}
+
+// execErrno maps an error from running a command to an errno.
+func execErrno(err error) error {
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return WithErrno(err, syscall.ENOENT)
+	case errors.Is(err, os.ErrPermission):
+		return WithErrno(err, syscall.EACCES)
+	default:
+		return WithErrno(err, syscall.EIO)
+	}
+}
+
+// Size returns the length of the output of the last run of
+// the command and a nil error.
+func (e *Exec) Size() (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return int64(len(e.out)), nil
+}
+
+// Close discards the retained output so that the command is
+// run again when the file is next read.
+func (e *Exec) Close() error {
+	e.mu.Lock()
+	e.valid = false
+	e.mu.Unlock()
+	return nil
+}
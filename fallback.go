@@ -0,0 +1,166 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// ErrorPolicy specifies how a FileSystem handles errors returned by the
+// Size, ReadAt and WriteAt methods of RO, RW and WO node devices when the
+// error does not carry an errno. The zero ErrorPolicy returns EBADFD for
+// failed Size calls made by Attr and returns other errors unaltered, which
+// the kernel sees as EIO.
+type ErrorPolicy struct {
+	// Retry specifies whether a failed
+	// device call is retried once before
+	// the error is handled. Writes are
+	// only retried if no data was written.
+	Retry bool
+
+	// Errno is the errno returned to the
+	// kernel for device errors. If Errno
+	// is zero the default is used.
+	Errno syscall.Errno
+
+	// Detach is the number of consecutive
+	// failed operations on a node after
+	// which the node is unbound from the
+	// file system. If Detach is zero
+	// nodes are never detached.
+	Detach int
+}
+
+// SetErrorPolicy sets the device error policy of the file system. Each
+// device error handled by the policy is passed to the Error function of
+// the file system's Hooks, if it is not nil.
+func (fs *FileSystem) SetErrorPolicy(p ErrorPolicy) {
+	fs.errPolicy.Store(p)
+	fs.failures.reset()
+}
+
+// errorPolicy returns the device error policy of the file system. It may
+// be called with a node's lock held. A nil FileSystem has the zero policy.
+func (fs *FileSystem) errorPolicy() ErrorPolicy {
+	if fs == nil {
+		return ErrorPolicy{}
+	}
+	p, _ := fs.errPolicy.Load().(ErrorPolicy)
+	return p
+}
+
+// hasErrno returns whether err specifies the errno returned to the kernel.
+// It follows the rules of bazil.org/fuse.ToErrno.
+func hasErrno(err error) bool {
+	if _, ok := err.(syscall.Errno); ok {
+		return true
+	}
+	var errnum fuse.ErrorNumber
+	return errors.As(err, &errnum)
+}
+
+// retryable returns whether a device call returning err should be retried.
+func (fs *FileSystem) retryable(err error) bool {
+	return err != nil && err != io.EOF && !hasErrno(fuseError(err)) && fs.errorPolicy().Retry
+}
+
+// deviceSize returns the size of dev, retrying according to the error
+// policy.
+func (fs *FileSystem) deviceSize(dev interface{ Size() (int64, error) }) (int64, error) {
+	size, err := dev.Size()
+	if fs.retryable(err) {
+		size, err = dev.Size()
+	}
+	return size, err
+}
+
+// deviceRead reads from dev into b at off with the given open flags for
+// the request held in ctx, retrying according to the error policy.
+func (fs *FileSystem) deviceRead(ctx context.Context, dev io.ReaderAt, b []byte, off int64, flags fuse.OpenFlags) (int, error) {
+	n, err := readAtFlags(ctx, dev, b, off, flags)
+	if fs.retryable(err) {
+		n, err = readAtFlags(ctx, dev, b, off, flags)
+	}
+	return n, err
+}
+
+// deviceError applies the error policy to err, the result of a device call
+// made for the operation op on n, and returns the error to be returned to
+// the kernel. Errors specifying an errno, either directly or by wrapping a
+// syscall.Errno, are returned with that errno and are not subject to the
+// policy. If the policy does not specify an errno, def is used. If def is
+// zero err is returned unaltered. deviceError must not be called with a
+// node's lock held.
+func (fs *FileSystem) deviceError(op Op, n Node, err error, def syscall.Errno) error {
+	p := fs.errorPolicy()
+	if err == nil {
+		if fs != nil && p.Detach != 0 {
+			fs.failures.clear(n)
+		}
+		return nil
+	}
+	if e := fuseError(err); hasErrno(e) {
+		return e
+	}
+
+	if fs != nil {
+		fs.mu.Lock()
+		hook := fs.hooks.Error
+		path := fs.pathLocked(n)
+		fs.mu.Unlock()
+		if hook != nil {
+			hook(op, path, err)
+		}
+		if p.Detach != 0 && fs.failures.add(n) >= p.Detach {
+			fs.failures.clear(n)
+			fs.UnbindNode(n)
+		}
+	}
+
+	if p.Errno != 0 {
+		def = p.Errno
+	}
+	if def == 0 {
+		return err
+	}
+	return WithErrno(err, def)
+}
+
+// failures counts consecutive device failures of nodes.
+type failures struct {
+	mu    sync.Mutex
+	count map[Node]int
+}
+
+// add increments the failure count of n and returns the new count.
+func (f *failures) add(n Node) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.count == nil {
+		f.count = make(map[Node]int)
+	}
+	f.count[n]++
+	return f.count[n]
+}
+
+// clear resets the failure count of n.
+func (f *failures) clear(n Node) {
+	f.mu.Lock()
+	delete(f.count, n)
+	f.mu.Unlock()
+}
+
+// reset resets the failure counts of all nodes.
+func (f *failures) reset() {
+	f.mu.Lock()
+	f.count = nil
+	f.mu.Unlock()
+}
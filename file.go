@@ -0,0 +1,175 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"bazil.org/fuse"
+)
+
+// FileDevice is a ReadWriter backed by a file in a real file system.
+type FileDevice struct {
+	mu sync.Mutex
+
+	file *os.File
+
+	// path, flag and perm are used to
+	// open the file on demand when the
+	// FileDevice was created by path.
+	path string
+	flag int
+	perm os.FileMode
+
+	// opened is set once the file has
+	// been opened so that truncating and
+	// exclusive flags apply only once.
+	opened bool
+
+	// handles is the number of open
+	// file handles using the file.
+	handles int
+
+	// append is whether writes are
+	// made at the end of the file.
+	append bool
+}
+
+// NewFileDevice returns a new FileDevice backed by the provided open file.
+// The file is not closed when the node holding the FileDevice is released.
+// If the file was opened with os.O_APPEND, writes are made at the end of
+// the file regardless of the offset passed to WriteAt; on systems where
+// the open flags of f cannot be determined, writes to such a file fail.
+func NewFileDevice(f *os.File) *FileDevice {
+	return &FileDevice{file: f, append: appendMode(f)}
+}
+
+// OpenFileDevice returns a new FileDevice backed by the file at path.
+// The file is opened with the provided flag and perm when it is first
+// used, and is closed when the last file handle holding it open is
+// released. When the file is reopened after being closed, os.O_TRUNC and
+// os.O_EXCL are not applied again. If flag includes os.O_APPEND, writes
+// are made at the end of the file regardless of the offset passed to
+// WriteAt.
+func OpenFileDevice(path string, flag int, perm os.FileMode) *FileDevice {
+	return &FileDevice{path: path, flag: flag, perm: perm, append: flag&os.O_APPEND != 0}
+}
+
+// open returns the backing file, opening it if necessary.
+func (f *FileDevice) open() (*os.File, error) {
+	if f.file != nil {
+		return f.file, nil
+	}
+	flag := f.flag
+	if f.opened {
+		flag &^= os.O_TRUNC | os.O_EXCL
+	}
+	var err error
+	f.file, err = os.OpenFile(f.path, flag, f.perm)
+	if err != nil {
+		f.file = nil
+		return nil, err
+	}
+	f.opened = true
+	return f.file, nil
+}
+
+// Open satisfies the Opener interface. It opens the backing file if the
+// FileDevice was created by path so that errors opening the file are
+// returned when the node is opened rather than on first use.
+func (f *FileDevice) Open(_ context.Context, _ fuse.OpenFlags) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.open()
+	if err != nil {
+		return err
+	}
+	f.handles++
+	return nil
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (f *FileDevice) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	return file.ReadAt(b, off)
+}
+
+// WriteAt satisfies the io.WriterAt interface. If the FileDevice was
+// opened with os.O_APPEND, off is ignored and b is written at the end
+// of the file.
+func (f *FileDevice) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	if f.append {
+		// Writes to a file opened with
+		// O_APPEND are made at its end.
+		return file.Write(b)
+	}
+	return file.WriteAt(b, off)
+}
+
+// Truncate truncates the backing file to n bytes.
+func (f *FileDevice) Truncate(n int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := f.open()
+	if err != nil {
+		return err
+	}
+	return file.Truncate(n)
+}
+
+// Size returns the size of the backing file.
+func (f *FileDevice) Size() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Sync commits the contents of the backing file to stable storage.
+func (f *FileDevice) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Sync()
+}
+
+// Close releases a file handle's use of the backing file, closing the
+// file if it was opened on demand and no other file handle holds it open.
+// The file will be reopened if the FileDevice is used again.
+func (f *FileDevice) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.handles > 0 {
+		f.handles--
+	}
+	if f.path == "" || f.file == nil || f.handles > 0 {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
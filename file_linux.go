@@ -0,0 +1,27 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"os"
+	"syscall"
+)
+
+// appendMode returns whether f was opened with O_APPEND.
+func appendMode(f *os.File) bool {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var flags uintptr
+	err = rc.Control(func(fd uintptr) {
+		var errno syscall.Errno
+		flags, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+		if errno != 0 {
+			flags = 0
+		}
+	})
+	return err == nil && flags&syscall.O_APPEND != 0
+}
@@ -0,0 +1,13 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package sisyphus
+
+import "os"
+
+// appendMode returns false since the open flags of f are not available.
+func appendMode(f *os.File) bool { return false }
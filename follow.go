@@ -0,0 +1,130 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// follower holds the state of a file node whose reads at or beyond the
+// end of its data wait for data to be appended. A follower is protected
+// by the lock of the node holding it.
+type follower struct {
+	enabled bool
+	poll    time.Duration
+	wake    chan struct{}
+}
+
+// set sets whether reads follow appended data and the interval at which
+// waiting reads check the device size.
+func (w *follower) set(follow bool, poll time.Duration) {
+	w.enabled = follow
+	w.poll = poll
+	w.signal()
+}
+
+// wait returns a channel that is closed when the data may have changed.
+func (w *follower) wait() <-chan struct{} {
+	if w.wake == nil {
+		w.wake = make(chan struct{})
+	}
+	return w.wake
+}
+
+// signal wakes reads waiting for data.
+func (w *follower) signal() {
+	if w.wake != nil {
+		close(w.wake)
+		w.wake = nil
+	}
+}
+
+// needsData returns whether a read for req must wait for data given the
+// current size of the device.
+func (w *follower) needsData(req *fuse.ReadRequest, size int64) bool {
+	return w.enabled && req.Size != 0 && req.Offset >= size
+}
+
+// await waits until the file holds data at the offset of req if the file
+// follows appended data. mu is the lock of the node holding w and size
+// returns the current size of the node's device. size is called with mu
+// held, and polled is true if it is called after the poll interval passed
+// without a signal. await returns EAGAIN rather than waiting if the file
+// was opened with O_NONBLOCK. Errors obtaining the device size are left to
+// be reported by the read.
+func (w *follower) await(ctx context.Context, mu sync.Locker, req *fuse.ReadRequest, size func(polled bool) (int64, error)) error {
+	var polled bool
+	for {
+		mu.Lock()
+		if !w.enabled {
+			mu.Unlock()
+			return nil
+		}
+		n, err := size(polled)
+		if err != nil || !w.needsData(req, n) {
+			mu.Unlock()
+			return nil
+		}
+		if req.FileFlags&fuse.OpenNonblock != 0 {
+			mu.Unlock()
+			return syscall.EAGAIN
+		}
+		wake, poll := w.wait(), w.poll
+		mu.Unlock()
+
+		polled, err = awaitData(ctx, wake, poll)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// awaitData waits until wake is closed or poll has passed, returning
+// whether poll passed. It returns EINTR if ctx is cancelled while waiting.
+func awaitData(ctx context.Context, wake <-chan struct{}, poll time.Duration) (polled bool, err error) {
+	var tick <-chan time.Time
+	if poll > 0 {
+		t := time.NewTimer(poll)
+		defer t.Stop()
+		tick = t.C
+	}
+	select {
+	case <-wake:
+		return false, nil
+	case <-tick:
+		return true, nil
+	case <-ctx.Done():
+		return false, syscall.EINTR
+	}
+}
+
+// await waits for data at the offset of req as described for the follower
+// await method.
+func (f *RO) await(ctx context.Context, req *fuse.ReadRequest) error {
+	return f.follow.await(ctx, &f.mu, req, func(polled bool) (int64, error) {
+		if polled {
+			f.sizes.invalidate()
+		}
+		defer f.fs.enterDevice(f)()
+		return f.sizes.get(f.fs, f.dev)
+	})
+}
+
+// await waits for data at the offset of req as described for the follower
+// await method.
+func (f *RW) await(ctx context.Context, req *fuse.ReadRequest) error {
+	return f.follow.await(ctx, &f.mu, req, func(polled bool) (int64, error) {
+		if polled {
+			f.sizes.invalidate()
+		}
+		defer f.fs.enterDevice(f)()
+		return f.sizes.get(f.fs, f.dev)
+	})
+}
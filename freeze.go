@@ -0,0 +1,66 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import "syscall"
+
+// Freeze makes the node at the given path and all nodes below it fail
+// operations with the errno e until the node is thawed, simulating a
+// driver that is resetting or a device that is having its firmware
+// updated. If e is zero, EBUSY is used; EAGAIN may be used to indicate
+// that clients should retry. Operations that are not subject to the file
+// system's policy, such as obtaining attributes and releasing handles, are
+// not affected. Freezing a frozen node replaces its errno. A node is thawed
+// if it is unbound.
+func (fs *FileSystem) Freeze(path string, e syscall.Errno) error {
+	if e == 0 {
+		e = syscall.EBUSY
+	}
+	path = rooted(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := walkPath(fs.root, "freeze", path)
+	if err != nil {
+		return err
+	}
+	if fs.frozen == nil {
+		fs.frozen = make(map[Node]syscall.Errno)
+	}
+	fs.frozen[n] = e
+	return nil
+}
+
+// Thaw thaws the node at the given path. Nodes below a thawed node remain
+// frozen if they were frozen themselves.
+func (fs *FileSystem) Thaw(path string) error {
+	path = rooted(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := walkPath(fs.root, "thaw", path)
+	if err != nil {
+		return err
+	}
+	delete(fs.frozen, n)
+	return nil
+}
+
+// frozenLocked returns the errno for operations on n if n or a directory
+// containing it is frozen, and zero otherwise. It must be called with
+// fs.mu held.
+func (fs *FileSystem) frozenLocked(n Node) syscall.Errno {
+	if len(fs.frozen) == 0 {
+		return 0
+	}
+	for {
+		if e, ok := fs.frozen[n]; ok {
+			return e
+		}
+		d, ok := fs.parent[n]
+		if !ok {
+			return 0
+		}
+		n = d
+	}
+}
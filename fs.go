@@ -7,8 +7,10 @@ package sisyphus
 import (
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -34,27 +36,130 @@ type Node interface {
 }
 
 // FileSystem is a virtual file system.
+//
+// Paths passed to FileSystem methods are cleaned and relative paths are
+// interpreted from the root of the file system, so "sys/motor0" and
+// "/sys/motor0" address the same node.
 type FileSystem struct {
 	mu     sync.Mutex
 	root   *Dir
 	server *server
 
+	// parent holds the containing directory
+	// of each bound node other than root.
+	parent map[Node]*Dir
+
+	// aliases holds the additional
+	// directories holding aliased
+	// nodes.
+	aliases map[Node][]*Dir
+
+	policy     func(op Op, path string, hdr fuse.Header) error
+	namePolicy func(name string) error
+	hooks      Hooks
+	readOnly   bool
+	limiter    *limiter
+	xattrs     xattrs
+	audit      *AuditLog
+	requests   requests
+	debug      debugLog
+
+	// events is the events node
+	// if one has been set.
+	events *RO
+
+	// farms holds the link farms
+	// following bind events.
+	farms []*LinkFarm
+
+	// latency holds the latency
+	// profiles of directories.
+	latency map[*Dir]LatencyProfile
+
+	// quota holds the size limits
+	// of directory subtrees, usage
+	// holds the device sizes counted
+	// against them and generation
+	// counts changes to the tree.
+	quota      map[*Dir]*quota
+	usage      map[Node]int64
+	generation uint64
+
+	// trash holds unbound nodes
+	// for restoration.
+	trash trash
+
+	// runner runs background
+	// goroutines while served.
+	runner Runner
+
+	// sessions tracks client
+	// processes.
+	sessions sessions
+
+	// priority holds the priority
+	// classes of nodes and bulk is
+	// the semaphore limiting bulk
+	// operations.
+	priority map[Node]Priority
+	bulk     chan struct{}
+
+	// frozen holds the errnos of
+	// frozen nodes.
+	frozen map[Node]syscall.Errno
+
+	// fence blocks writes while the
+	// file system is quiesced.
+	fence fence
+
+	// written queues the kernel cache
+	// invalidations of written nodes.
+	written invalidationQueue
+
+	// probe is the self-test probe
+	// while a self-test is running.
+	probe *RW
+
+	// foldCase is non-zero if name
+	// lookup is case-insensitive. It
+	// is accessed atomically.
+	foldCase uint32
+
+	// sysfs is non-zero if the file
+	// system is in strict sysfs mode.
+	// It is accessed atomically.
+	sysfs uint32
+
+	// errPolicy holds the ErrorPolicy
+	// for device errors and failures
+	// counts consecutive device errors.
+	errPolicy atomic.Value
+	failures  failures
+
+	// mapping holds the AttrMapping
+	// applied to reported attributes.
+	mapping atomic.Value
+
+	// devCalls tracks threads executing
+	// device calls for deadlock detection.
+	devCalls deviceCalls
+
 	now func() time.Time
 }
 
-var nofs *FileSystem
-
 // NewFileSystem returns a new file system setting the mode of the root and
 // the clock.
 func NewFileSystem(mode os.FileMode, clock func() time.Time) *FileSystem {
 	var fs FileSystem
 	fs.now = clock
+	fs.parent = make(map[Node]*Dir)
 	fs.root, _ = NewDir("/", mode)
 	fs.root.SetSys(&fs)
 	return &fs
 }
 
-// With adds nodes to the file system's root.
+// With adds nodes to the file system's root. With is safe for concurrent
+// use.
 func (fs *FileSystem) With(nodes ...Node) *FileSystem {
 	fs.root.With(nodes...)
 	return fs
@@ -70,6 +175,7 @@ func (fs *FileSystem) Sync() *FileSystem {
 }
 
 func (fs *FileSystem) sync(n Node) {
+	fs.generation++
 	if n.Sys() != fs {
 		n.SetSys(fs)
 	}
@@ -78,7 +184,16 @@ func (fs *FileSystem) sync(n Node) {
 	if !ok {
 		return
 	}
+	dir.mu.Lock()
+	files := make([]Node, 0, len(dir.files))
 	for _, f := range dir.files {
+		files = append(files, f)
+	}
+	dir.mu.Unlock()
+	for _, f := range files {
+		if !fs.isAlias(dir, f) {
+			fs.parent[f] = dir
+		}
 		fs.sync(f)
 	}
 }
@@ -92,12 +207,15 @@ func (fs *FileSystem) Invalidate(n Node) error {
 	return err
 }
 
-// InvalidatePath invalidates the kernel cache of the node at the given path.
+// InvalidatePath invalidates the kernel cache of the node at the given path
+// and discards any cached device size held by the node.
 func (fs *FileSystem) InvalidatePath(path string) error {
+	path = rooted(path)
 	n, err := walkPath(fs.root, "invalidate", path)
 	if err != nil {
 		return err
 	}
+	invalidateSize(n)
 	err = fs.server.fuse.InvalidateNodeData(n)
 	if err == fuse.ErrNotCached {
 		err = nil
@@ -105,63 +223,365 @@ func (fs *FileSystem) InvalidatePath(path string) error {
 	return err
 }
 
-// Bind binds the node at the given directory path.
-func (fs *FileSystem) Bind(dir string, n Node) error {
-	defer fs.mu.Unlock()
+// NotifyChanged invalidates the kernel cache of length bytes starting at
+// off of the node at the given path. A negative length invalidates to the
+// end of the file. NotifyChanged is a no-op if the file system is not being
+// served. Any cached device size held by the node is discarded. The FUSE
+// library in use does not support poll, so waiting pollers are not woken.
+func (fs *FileSystem) NotifyChanged(path string, off, length int64) error {
+	path = rooted(path)
 	fs.mu.Lock()
-	return fs.bind(dir, n)
+	n, err := walkPath(fs.root, "notify", path)
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return fs.invalidateRange(n, off, length)
+}
+
+// Bind binds the node at the given directory path, replacing any existing
+// node with the same name as described for Replace. Bind returns an
+// error wrapping ErrBadName if the node's name is not a valid base name,
+// or the error returned by the file system's name policy.
+func (fs *FileSystem) Bind(dir string, n Node) error {
+	_, err := fs.BindConflict(dir, n, Replace)
+	return err
 }
 
 func (fs *FileSystem) bind(dir string, n Node) error {
-	dir = filepath.Clean(dir)
+	_, _, err := fs.bindConflict(dir, n, Replace)
+	return err
+}
+
+// bindConflict binds n in dir handling name conflicts according to c,
+// returning the directory and any node replaced by n. bindConflict must
+// be called with fs.mu held.
+func (fs *FileSystem) bindConflict(dir string, n Node, c Conflict) (*Dir, Node, error) {
+	dir = rooted(dir)
 	f, err := walkPath(fs.root, "open", dir)
 	if os.IsNotExist(err) {
-		return &os.PathError{
+		return nil, nil, &os.PathError{
 			Op:   "open",
 			Path: dir,
 			Err:  syscall.ENOENT,
 		}
 	}
 
-	d := f.(*Dir)
+	d, ok := f.(*Dir)
+	if !ok {
+		return nil, nil, &os.PathError{
+			Op:   "open",
+			Path: dir,
+			Err:  syscall.ENOTDIR,
+		}
+	}
+	err = fs.checkName(dir, n)
+	if err != nil {
+		return nil, nil, err
+	}
 	d.mu.Lock()
+	old, exists := d.files[n.Name()]
+	if exists && old != n {
+		switch c {
+		case Fail:
+			d.mu.Unlock()
+			return nil, nil, conflictError(dir, n.Name())
+		case KeepBoth:
+			name := freeName(d, n.Name())
+			err = fs.checkNamed(dir, name)
+			if err != nil {
+				d.mu.Unlock()
+				return nil, nil, err
+			}
+			if !rename(n, name) {
+				d.mu.Unlock()
+				return nil, nil, conflictError(dir, n.Name())
+			}
+			old = nil
+		default:
+			fs.detach(d, old)
+		}
+	} else {
+		old = nil
+	}
 	d.files[n.Name()] = n
 	d.mu.Unlock()
 	fs.sync(f)
 
-	return nil
+	return d, old, nil
 }
 
-// Unbind unbinds to node at the given path, returning the node
-// if successful.
+// Unbind unbinds the node at the given path, returning the node
+// if successful. The path must not be the root. The unbound node
+// and its descendants are detached from the file system, and the
+// node is held in the trash if it is enabled.
 func (fs *FileSystem) Unbind(path string) (Node, error) {
-	path = filepath.Clean(path)
-	if len(path) == 0 && path[0] == filepath.Separator {
+	path = rooted(path)
+	if path == string(filepath.Separator) {
 		return nil, &os.PathError{Op: "unbind", Path: path, Err: syscall.EINVAL}
 	}
 
+	node, err := fs.unbind(path)
+	if err != nil {
+		return nil, err
+	}
+	fs.discard(path, node)
+	fs.event(Event{Op: "unbind", Path: path})
+	return node, nil
+}
+
+func (fs *FileSystem) unbind(path string) (Node, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	dir, name := filepath.Split(path)
+	dir, name := filepath.Dir(path), filepath.Base(path)
 	n, err := walkPath(fs.root, "unbind", dir)
 	if err != nil {
 		return nil, err
 	}
-	d := n.(*Dir)
+	d, ok := n.(*Dir)
+	if !ok {
+		return nil, &os.PathError{Op: "unbind", Path: path, Err: syscall.ENOTDIR}
+	}
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	node, ok := d.files[name]
 	if !ok {
 		return nil, &os.PathError{Op: "unbind", Path: path, Err: syscall.ENOENT}
 	}
-	delete(d.files, name)
-	nofs.sync(node)
+	fs.detach(d, node)
 	return node, nil
 }
 
+// UnbindNode unbinds n from wherever it is bound in the file system.
+// The node is held in the trash if it is enabled.
+func (fs *FileSystem) UnbindNode(n Node) error {
+	fs.mu.Lock()
+	path := fs.pathLocked(n)
+	d, ok := fs.parent[n]
+	if !ok {
+		fs.mu.Unlock()
+		return &os.PathError{Op: "unbind", Path: n.Name(), Err: syscall.ENOENT}
+	}
+	d.mu.Lock()
+	fs.detach(d, n)
+	d.mu.Unlock()
+	fs.mu.Unlock()
+
+	fs.discard(path, n)
+	fs.event(Event{Op: "unbind", Path: path})
+	return nil
+}
+
+// detach removes n from d. detach must be called with fs.mu and
+// d.mu held.
+func (fs *FileSystem) detach(d *Dir, n Node) {
+	fs.generation++
+	delete(d.files, n.Name())
+	if fs.unalias(d, n) {
+		return
+	}
+	fs.forget(n)
+	if n == Node(fs.events) {
+		fs.events = nil
+	}
+	clearSys(n)
+}
+
+// clearSys clears the file system of n and its descendants.
+func clearSys(n Node) {
+	n.SetSys(nil)
+	d, ok := n.(*Dir)
+	if !ok {
+		return
+	}
+	d.mu.Lock()
+	files := make([]Node, 0, len(d.files))
+	for _, f := range d.files {
+		files = append(files, f)
+	}
+	d.mu.Unlock()
+	for _, f := range files {
+		clearSys(f)
+	}
+}
+
+// forget removes n and its descendants from the parent table.
+func (fs *FileSystem) forget(n Node) {
+	delete(fs.parent, n)
+	delete(fs.aliases, n)
+	delete(fs.priority, n)
+	delete(fs.frozen, n)
+	delete(fs.usage, n)
+	dir, ok := n.(*Dir)
+	if !ok {
+		return
+	}
+	delete(fs.latency, dir)
+	delete(fs.quota, dir)
+	for _, f := range dir.files {
+		fs.forget(f)
+	}
+}
+
+// path returns the absolute path of n within the file system
+// or the empty string if n is not bound.
+func (fs *FileSystem) path(n Node) string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.pathLocked(n)
+}
+
+func (fs *FileSystem) pathLocked(n Node) string {
+	if n == Node(fs.root) {
+		return "/"
+	}
+	var elem []string
+	for n != Node(fs.root) {
+		p, ok := fs.parent[n]
+		if !ok {
+			return ""
+		}
+		elem = append(elem, n.Name())
+		n = p
+	}
+	for i, j := 0, len(elem)-1; i < j; i, j = i+1, j-1 {
+		elem[i], elem[j] = elem[j], elem[i]
+	}
+	return "/" + strings.Join(elem, "/")
+}
+
+// OpenReport returns the open accounting of every RO, RW and WO
+// node in the file system keyed by absolute path.
+func (fs *FileSystem) OpenReport() map[string]OpenStats {
+	report := make(map[string]OpenStats)
+	fs.walk(func(path string, n Node) {
+		type opener interface {
+			Opens() OpenStats
+		}
+		if o, ok := n.(opener); ok {
+			report[path] = o.Opens()
+		}
+	})
+	return report
+}
+
+// Lookup returns the node at the given path.
+func (fs *FileSystem) Lookup(path string) (Node, error) {
+	path = rooted(path)
+	fs.mu.Lock()
+	n, err := walkPath(fs.root, "lookup", path)
+	fs.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ChownTree sets the uid and gid of the node at the given path and of all
+// nodes below it, updating their change times. If the file system is being
+// served, the kernel's cached attributes of the nodes are invalidated.
+func (fs *FileSystem) ChownTree(path string, uid, gid uint32) error {
+	path = rooted(path)
+	fs.mu.Lock()
+	n, err := walkPath(fs.root, "chown", path)
+	if err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+	var nodes []Node
+	walkNode(path, n, func(_ string, n Node) {
+		nodes = append(nodes, n)
+	})
+	server := fs.server
+	fs.mu.Unlock()
+
+	for _, n := range nodes {
+		chown(n, uid, gid)
+		if server == nil {
+			continue
+		}
+		ierr := server.fuse.InvalidateNodeAttr(n)
+		if ierr != nil && ierr != fuse.ErrNotCached && err == nil {
+			err = ierr
+		}
+	}
+	return err
+}
+
+// chown sets the uid and gid of n.
+func chown(n Node, uid, gid uint32) {
+	switch n := n.(type) {
+	case *Dir:
+		n.Own(uid, gid)
+	case *RO:
+		n.Own(uid, gid)
+	case *RW:
+		n.Own(uid, gid)
+	case *WO:
+		n.Own(uid, gid)
+	case *Symlink:
+		n.Own(uid, gid)
+	}
+}
+
+// NodeStats returns the I/O accounting of the file node at the given path.
+func (fs *FileSystem) NodeStats(path string) (NodeStats, error) {
+	path = rooted(path)
+	fs.mu.Lock()
+	n, err := walkPath(fs.root, "stats", path)
+	fs.mu.Unlock()
+	if err != nil {
+		return NodeStats{}, err
+	}
+	type stater interface {
+		Stats() NodeStats
+	}
+	s, ok := n.(stater)
+	if !ok {
+		return NodeStats{}, &os.PathError{Op: "stats", Path: path, Err: syscall.EISDIR}
+	}
+	return s.Stats(), nil
+}
+
+// walk calls fn for each node in the file system in lexical path
+// order, starting with the root. fn is called with fs.mu held.
+func (fs *FileSystem) walk(fn func(path string, n Node)) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	walkNode("/", fs.root, fn)
+}
+
+func walkNode(path string, n Node, fn func(path string, n Node)) {
+	fn(path, n)
+	d, ok := n.(*Dir)
+	if !ok {
+		return
+	}
+	d.mu.Lock()
+	names := make([]string, 0, len(d.files))
+	for name := range d.files {
+		names = append(names, name)
+	}
+	files := make([]Node, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		files[i] = d.files[name]
+	}
+	d.mu.Unlock()
+	for i, f := range files {
+		walkNode(filepath.Join(path, names[i]), f, fn)
+	}
+}
+
+// rooted returns the cleaned absolute form of path, interpreting
+// relative paths from the root of the file system.
+func rooted(path string) string {
+	return filepath.Join(string(filepath.Separator), path)
+}
+
 func pathElements(path string) []string {
-	e := strings.Split(filepath.Clean(path), string(filepath.Separator))[1:]
+	e := strings.Split(rooted(path), string(filepath.Separator))[1:]
 	if len(e) == 1 && len(e[0]) == 0 {
 		return nil
 	}
@@ -174,7 +594,7 @@ func walkPath(d *Dir, op, path string) (Node, error) {
 		return d, nil
 	}
 	for i, e := range elements {
-		n, ok := d.files[e]
+		n, ok := d.child(e)
 		if !ok {
 			if i < len(elements)-1 {
 				return nil, &os.PathError{Op: op, Path: path, Err: syscall.ENOENT}
@@ -199,15 +619,3 @@ var _ fs.FS = (*FileSystem)(nil)
 
 // Root satisfies the bazil.org/fuse/fs.FS interface.
 func (fs *FileSystem) Root() (fs.Node, error) { return fs.root, nil }
-
-// errno is an error that satisfies fuse.ErrorNumber.
-type errno struct {
-	error
-	errno fuse.Errno
-}
-
-var _ fuse.ErrorNumber = errno{}
-
-func (e errno) Errno() fuse.Errno {
-	return e.errno
-}
@@ -0,0 +1,120 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"sync"
+	"syscall"
+)
+
+// Gzip is a Reader that serves the gzip-compressed content of an underlying
+// Reader. The underlying content is read when a read is made at offset zero
+// and when the size is requested, and is compressed only if it has changed
+// since it was last compressed. The compressed data is retained to serve
+// reads at later offsets, and its length to report the size of the file.
+type Gzip struct {
+	mu    sync.Mutex
+	dev   Reader
+	level int
+
+	// data is the compressed content
+	// serving reads, compressed from
+	// content with the checksum sum.
+	data []byte
+	sum  [sha256.Size]byte
+
+	// size is the compressed length
+	// of the content with the checksum
+	// sizeSum when it differs from the
+	// content serving reads.
+	size    int64
+	sizeSum [sha256.Size]byte
+	sized   bool
+}
+
+// NewGzip returns a new Gzip compressing the content of dev at the given
+// compression level. The level is a compress/gzip compression level.
+func NewGzip(dev Reader, level int) (*Gzip, error) {
+	_, err := gzip.NewWriterLevel(nil, level)
+	if err != nil {
+		return nil, err
+	}
+	return &Gzip{dev: dev, level: level}, nil
+}
+
+// source returns the underlying content and its checksum.
+func (g *Gzip) source() ([]byte, [sha256.Size]byte, error) {
+	src, err := readAll(g.dev)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, err
+	}
+	return src, sha256.Sum256(src), nil
+}
+
+// compress returns the compressed form of src.
+func (g *Gzip) compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, g.level)
+	_, err := w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (g *Gzip) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if off == 0 || g.data == nil {
+		src, sum, err := g.source()
+		if err != nil {
+			return 0, err
+		}
+		if g.data == nil || sum != g.sum {
+			data, err := g.compress(src)
+			if err != nil {
+				return 0, err
+			}
+			g.data, g.sum = data, sum
+			g.sized = false
+		}
+	}
+	return readAt(g.data, b, off)
+}
+
+// Size returns the length of the compressed content. The content is
+// compressed only if it has changed since it was last compressed, and
+// the retained data serving reads in progress is not replaced.
+func (g *Gzip) Size() (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	src, sum, err := g.source()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case g.data != nil && sum == g.sum:
+		return int64(len(g.data)), nil
+	case g.sized && sum == g.sizeSum:
+		return g.size, nil
+	}
+	data, err := g.compress(src)
+	if err != nil {
+		return 0, err
+	}
+	g.size, g.sizeSum, g.sized = int64(len(data)), sum, true
+	return g.size, nil
+}
@@ -0,0 +1,83 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import "time"
+
+// Hooks is the set of functions called around each FUSE operation handled
+// by the nodes of a FileSystem. Any function may be nil.
+type Hooks struct {
+	// Before is called before each
+	// operation with the operation and
+	// the absolute path of the node.
+	Before func(op Op, path string)
+
+	// After is called when each operation
+	// completes with the operation, the
+	// absolute path of the node, the error
+	// returned to the kernel and the time
+	// taken to handle the operation.
+	After func(op Op, path string, err error, d time.Duration)
+
+	// Error is called with the operation,
+	// the absolute path of the node and
+	// the error for each device error
+	// handled by the file system's
+	// ErrorPolicy.
+	Error func(op Op, path string, err error)
+
+	// SessionStart is called with the
+	// session of each client process when
+	// its first request is seen, and
+	// SessionEnd is called when the last
+	// handle opened by the client is
+	// released. See FileSystem.Sessions.
+	SessionStart func(s Session)
+	SessionEnd   func(s Session)
+}
+
+// SetHooks sets the operation hooks of the file system. Hooks are called
+// without any file system or node lock held, and must be safe for concurrent
+// use.
+func (fs *FileSystem) SetHooks(h Hooks) {
+	fs.mu.Lock()
+	fs.hooks = h
+	fs.mu.Unlock()
+}
+
+// trace calls the before hook for op on n and returns a function that
+// calls the after hook with the error held by its parameter. It is used
+// by node operation methods as
+//
+//	defer sys(ctx, f).trace(op, f)(&err)
+//
+// A nil FileSystem has no hooks.
+func (fs *FileSystem) trace(op Op, n Node) func(*error) {
+	if fs == nil {
+		return noTrace
+	}
+	fs.mu.Lock()
+	h := fs.hooks
+	var path string
+	if h.Before != nil || h.After != nil {
+		path = fs.pathLocked(n)
+	}
+	fs.mu.Unlock()
+	if h.Before == nil && h.After == nil {
+		return noTrace
+	}
+	if h.Before != nil {
+		h.Before(op, path)
+	}
+	if h.After == nil {
+		return noTrace
+	}
+	start := time.Now()
+	return func(err *error) {
+		h.After(op, path, *err, time.Since(start))
+	}
+}
+
+func noTrace(*error) {}
@@ -0,0 +1,236 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// HTTPDevice is a ReadWriter backed by a remote HTTP resource. Reads are
+// made with GET requests honouring the requested range and writes are made
+// with the configured method.
+type HTTPDevice struct {
+	mu sync.Mutex
+
+	url    string
+	method string
+	client *http.Client
+
+	ttl     time.Duration
+	cache   []byte
+	fetched time.Time
+
+	// size is the content length from
+	// the last HEAD request made at sized.
+	size  int64
+	sized time.Time
+}
+
+// httpSizeTTL is the time a size obtained by a HEAD request is reused
+// for when an HTTPDevice is not caching its content.
+const httpSizeTTL = time.Second
+
+// NewHTTPDevice returns a new HTTPDevice for the resource at url. Writes
+// are sent using method, which must be "PUT" or "POST"; an empty method
+// is treated as "PUT". If timeout is positive, requests not completed
+// within timeout return ETIMEDOUT. If ttl is positive, the complete
+// resource is fetched and cached for reads for the ttl duration.
+// Sizes obtained by HEAD requests are reused for the ttl duration, or
+// for one second if ttl is not positive, so that repeated attribute
+// requests do not each reach the server.
+func NewHTTPDevice(url, method string, timeout, ttl time.Duration) *HTTPDevice {
+	if method == "" {
+		method = http.MethodPut
+	}
+	return &HTTPDevice{
+		url:    url,
+		method: method,
+		ttl:    ttl,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (d *HTTPDevice) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.ttl > 0 {
+		if d.cache == nil || time.Since(d.fetched) > d.ttl {
+			data, err := d.get("")
+			if err != nil {
+				return 0, err
+			}
+			d.cache = data
+			d.fetched = time.Now()
+		}
+		return readAt(d.cache, b, off)
+	}
+
+	data, err := d.get(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(b))-1))
+	if err == io.EOF {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := copy(b, data)
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// get performs a GET request for the resource with the given range. The
+// data returned for a non-partial response is trimmed to the requested
+// range.
+func (d *HTTPDevice) get(rng string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, httpErrno(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, httpErrno(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return data, nil
+	case http.StatusOK:
+		if rng == "" {
+			return data, nil
+		}
+		// The server ignored the range, so
+		// extract it from the full content.
+		var start, end int64
+		fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+		if start >= int64(len(data)) {
+			return nil, io.EOF
+		}
+		if end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		return data[start : end+1], nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, io.EOF
+	default:
+		return nil, statusErrno(resp)
+	}
+}
+
+// WriteAt satisfies the io.WriterAt interface. Writes at a non-zero offset
+// include a Content-Range header describing the written range.
+func (d *HTTPDevice) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	req, err := http.NewRequest(d.method, d.url, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	if off != 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", off, off+int64(len(b))-1))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, httpErrno(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return 0, statusErrno(resp)
+	}
+	d.cache = nil
+	d.sized = time.Time{}
+	return len(b), nil
+}
+
+// Truncate is a no-op.
+func (d *HTTPDevice) Truncate(_ int64) error { return nil }
+
+// Size returns the length of the cached resource if the device is
+// caching, or otherwise the content length reported by a HEAD request
+// for the resource. If the content length is unknown Size returns zero.
+// The content length is reused until it expires or the device is written.
+func (d *HTTPDevice) Size() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ttl > 0 && d.cache != nil {
+		return int64(len(d.cache)), nil
+	}
+	ttl := d.ttl
+	if ttl <= 0 {
+		ttl = httpSizeTTL
+	}
+	if !d.sized.IsZero() && time.Since(d.sized) <= ttl {
+		return d.size, nil
+	}
+	resp, err := d.client.Head(d.url)
+	if err != nil {
+		return 0, httpErrno(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, statusErrno(resp)
+	}
+	d.size = resp.ContentLength
+	if d.size < 0 {
+		d.size = 0
+	}
+	d.sized = time.Now()
+	return d.size, nil
+}
+
+// httpErrno maps an error from an HTTP client to an errno.
+func httpErrno(err error) error {
+	var timeout interface{ Timeout() bool }
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &timeout) && timeout.Timeout()) {
+		return WithErrno(err, syscall.ETIMEDOUT)
+	}
+	return WithErrno(err, syscall.EIO)
+}
+
+// statusErrno maps an unsuccessful HTTP response status to an errno.
+func statusErrno(resp *http.Response) error {
+	err := fmt.Errorf("sisyphus: %s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status)
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return WithErrno(err, syscall.ENOENT)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return WithErrno(err, syscall.EACCES)
+	case http.StatusMethodNotAllowed:
+		return WithErrno(err, syscall.EPERM)
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return WithErrno(err, syscall.ETIMEDOUT)
+	default:
+		return WithErrno(err, syscall.EIO)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"sync"
+	"time"
+)
+
+// JournalEntry is a record of an accepted operation held by a Journal.
+type JournalEntry struct {
+	Time time.Time
+
+	// Truncate indicates that the entry records
+	// a truncation to Offset bytes rather than
+	// a write of Data at Offset.
+	Truncate bool
+
+	Offset int64
+	Data   []byte
+}
+
+// Journal is a Writer that records every write and truncation accepted by
+// an underlying Writer so that they can be replayed into another Writer.
+type Journal struct {
+	mu      sync.Mutex
+	dev     Writer
+	now     func() time.Time
+	entries []JournalEntry
+}
+
+// NewJournal returns a new Journal recording operations on dev. Entries
+// are time stamped using clock, or time.Now if clock is nil.
+func NewJournal(dev Writer, clock func() time.Time) *Journal {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &Journal{dev: dev, now: clock}
+}
+
+// WriteAt satisfies the io.WriterAt interface. Writes that return an
+// error are not recorded.
+func (j *Journal) WriteAt(b []byte, off int64) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	n, err := j.dev.WriteAt(b, off)
+	if err != nil {
+		return n, err
+	}
+	j.entries = append(j.entries, JournalEntry{
+		Time:   j.now(),
+		Offset: off,
+		Data:   append([]byte(nil), b[:n]...),
+	})
+	return n, nil
+}
+
+// Truncate truncates the underlying Writer. Truncations that return an
+// error are not recorded.
+func (j *Journal) Truncate(n int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.dev.Truncate(n)
+	if err != nil {
+		return err
+	}
+	j.entries = append(j.entries, JournalEntry{Time: j.now(), Truncate: true, Offset: n})
+	return nil
+}
+
+// Size returns the size of the underlying Writer.
+func (j *Journal) Size() (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.dev.Size()
+}
+
+// Entries returns a copy of the recorded journal entries.
+func (j *Journal) Entries() []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]JournalEntry(nil), j.entries...)
+}
+
+// Reset discards all recorded journal entries.
+func (j *Journal) Reset() {
+	j.mu.Lock()
+	j.entries = nil
+	j.mu.Unlock()
+}
+
+// Replay applies the recorded journal entries to dst in order. Replay
+// stops at the first error.
+func (j *Journal) Replay(dst Writer) error {
+	return Replay(dst, j.Entries())
+}
+
+// Replay applies the provided journal entries to dst in order. Replay
+// stops at the first error.
+func Replay(dst Writer, entries []JournalEntry) error {
+	for _, e := range entries {
+		var err error
+		if e.Truncate {
+			err = dst.Truncate(e.Offset)
+		} else {
+			_, err = dst.WriteAt(e.Data, e.Offset)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
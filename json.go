@@ -0,0 +1,97 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"syscall"
+)
+
+// JSON is a Reader that serves the JSON encoding of a Go value followed by
+// a newline. The value is encoded when a read is made at offset zero, and
+// the encoding is retained to serve reads at later offsets. If the value is
+// an expvar.Var, its String method is used to obtain the encoding.
+type JSON struct {
+	mu     sync.Mutex
+	v      interface{}
+	indent bool
+
+	data []byte
+}
+
+// NewJSON returns a new JSON serving v. If indent is true, the encoding
+// is indented with tabs.
+func NewJSON(v interface{}, indent bool) *JSON {
+	return &JSON{v: v, indent: indent}
+}
+
+// Set sets the value served by the JSON.
+func (j *JSON) Set(v interface{}) {
+	j.mu.Lock()
+	j.v = v
+	j.mu.Unlock()
+}
+
+// encode returns the encoding of the current value.
+func (j *JSON) encode() ([]byte, error) {
+	var (
+		b   []byte
+		err error
+	)
+	switch v := j.v.(type) {
+	case expvar.Var:
+		b = []byte(v.String())
+	default:
+		if j.indent {
+			b, err = json.MarshalIndent(v, "", "\t")
+		} else {
+			b, err = json.Marshal(v)
+		}
+	}
+	if err != nil {
+		return nil, WithErrno(err, syscall.EIO)
+	}
+	return append(b, '\n'), nil
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (j *JSON) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if off == 0 || j.data == nil {
+		var err error
+		j.data, err = j.encode()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return readAt(j.data, b, off)
+}
+
+// ReadAll satisfies the ReadAller interface. The current value is encoded
+// and the encoding retained to serve reads at later offsets.
+func (j *JSON) ReadAll() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	data, err := j.encode()
+	if err != nil {
+		return nil, err
+	}
+	j.data = data
+	return data, nil
+}
+
+// Size returns the length of the encoding of the current value.
+func (j *JSON) Size() (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	b, err := j.encode()
+	return int64(len(b)), err
+}
@@ -0,0 +1,121 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LatencyProfile returns the simulated latency of an operation. It may
+// sample a distribution so that each call returns a different duration.
+// A LatencyProfile must be safe for concurrent use.
+type LatencyProfile func(op Op) time.Duration
+
+// LatencyRange is a range of operation latencies.
+type LatencyRange struct {
+	Min, Max time.Duration
+}
+
+// UniformLatency returns a LatencyProfile that returns latencies drawn
+// uniformly from the range given for each operation. Operations without
+// a range have no latency. Latencies are drawn from src, or from a source
+// seeded with 1 if src is nil.
+func UniformLatency(ranges map[Op]LatencyRange, src rand.Source) LatencyProfile {
+	if src == nil {
+		src = rand.NewSource(1)
+	}
+	var mu sync.Mutex
+	rnd := rand.New(src)
+	return func(op Op) time.Duration {
+		r, ok := ranges[op]
+		if !ok || r.Max <= 0 {
+			return 0
+		}
+		if r.Max <= r.Min {
+			return r.Min
+		}
+		mu.Lock()
+		d := r.Min + time.Duration(rnd.Int63n(int64(r.Max-r.Min)))
+		mu.Unlock()
+		return d
+	}
+}
+
+// SetLatency attaches a latency profile to the directory at the given path.
+// Operations on the directory and all nodes below it are delayed by the
+// latency returned by the profile for the operation before they are
+// performed, unless a directory nearer to the node has its own profile.
+// The delayed operations are those passed to the file system's policy
+// function. A nil profile removes any profile from the directory. The
+// profile is removed if the directory is unbound.
+//
+// A delayed operation that is interrupted by the client returns EINTR.
+func (fs *FileSystem) SetLatency(path string, p LatencyProfile) error {
+	path = rooted(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := walkPath(fs.root, "latency", path)
+	if err != nil {
+		return err
+	}
+	d, ok := n.(*Dir)
+	if !ok {
+		return &os.PathError{Op: "latency", Path: path, Err: syscall.ENOTDIR}
+	}
+	if p == nil {
+		delete(fs.latency, d)
+		return nil
+	}
+	if fs.latency == nil {
+		fs.latency = make(map[*Dir]LatencyProfile)
+	}
+	fs.latency[d] = p
+	return nil
+}
+
+// latencyLocked returns the latency profile applying to n, or nil if there
+// is none. latencyLocked must be called with fs.mu held.
+func (fs *FileSystem) latencyLocked(n Node) LatencyProfile {
+	if len(fs.latency) == 0 {
+		return nil
+	}
+	for {
+		if d, ok := n.(*Dir); ok {
+			if p, ok := fs.latency[d]; ok {
+				return p
+			}
+		}
+		p, ok := fs.parent[n]
+		if !ok {
+			return nil
+		}
+		n = p
+	}
+}
+
+// delay waits for the latency of op given by p, returning EINTR if ctx is
+// cancelled first.
+func delay(ctx context.Context, p LatencyProfile, op Op) error {
+	if p == nil {
+		return nil
+	}
+	d := p(op)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
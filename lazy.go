@@ -0,0 +1,133 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Lazy is a Reader whose content is loaded on first use. Content may be
+// loaded from a file, an embedded file system or a generator, and may be
+// evicted after a period without reads so that trees holding many large,
+// rarely read files start quickly and use little memory.
+type Lazy struct {
+	mu sync.Mutex
+
+	load func() ([]byte, error)
+	size func() (int64, error)
+	idle time.Duration
+
+	data   []byte
+	loaded bool
+	timer  *time.Timer
+}
+
+// NewLazy returns a new Lazy that obtains its content by calling load.
+// If size is not nil, it is called to obtain the size of the content while
+// the content is not loaded, so that the size can be reported without
+// loading the content. If idle is positive, the loaded content is evicted
+// after idle has passed without a read, and is loaded again when next
+// used. An embedded file may be served by passing a load function calling
+// the ReadFile method of an embed.FS.
+func NewLazy(load func() ([]byte, error), size func() (int64, error), idle time.Duration) *Lazy {
+	return &Lazy{load: load, size: size, idle: idle}
+}
+
+// NewLazyFile returns a new Lazy whose content is loaded from the file at
+// path. The size of the file is obtained without reading it.
+func NewLazyFile(path string, idle time.Duration) *Lazy {
+	return NewLazy(
+		func() ([]byte, error) { return ioutil.ReadFile(path) },
+		func() (int64, error) {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return 0, err
+			}
+			return fi.Size(), nil
+		},
+		idle,
+	)
+}
+
+// ReadAt satisfies the io.ReaderAt interface. The content is loaded if it
+// is not already loaded.
+func (l *Lazy) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.fetch()
+	if err != nil {
+		return 0, err
+	}
+	return readAt(l.data, b, off)
+}
+
+// Size returns the size of the content. If the content is not loaded and
+// the Lazy has a size function, the size function is used, otherwise the
+// content is loaded.
+func (l *Lazy) Size() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.loaded && l.size != nil {
+		return l.size()
+	}
+	err := l.fetch()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(l.data)), nil
+}
+
+// Loaded returns whether the content is loaded.
+func (l *Lazy) Loaded() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loaded
+}
+
+// Evict discards the loaded content. The content is loaded again when next
+// used.
+func (l *Lazy) Evict() {
+	l.mu.Lock()
+	l.evict()
+	l.mu.Unlock()
+}
+
+// fetch loads the content if it is not loaded and restarts the idle
+// timer. It must be called with l.mu held.
+func (l *Lazy) fetch() error {
+	if !l.loaded {
+		data, err := l.load()
+		if err != nil {
+			return err
+		}
+		l.data = data
+		l.loaded = true
+	}
+	if l.idle > 0 {
+		if l.timer == nil {
+			l.timer = time.AfterFunc(l.idle, l.Evict)
+		} else {
+			l.timer.Reset(l.idle)
+		}
+	}
+	return nil
+}
+
+// evict discards the loaded content. It must be called with l.mu held.
+func (l *Lazy) evict() {
+	l.data = nil
+	l.loaded = false
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// LinkFarm maintains a directory of symbolic links to the nodes bound in
+// another directory, such as the /dev/input/by-path links to input devices.
+type LinkFarm struct {
+	fs   *FileSystem
+	dir  string
+	src  string
+	name func(path string, n Node) string
+
+	mu sync.Mutex
+	// links holds the link name
+	// for each linked node path.
+	links map[string]string
+}
+
+// NewLinkFarm returns a LinkFarm that maintains symbolic links in dir to the
+// nodes bound in src. The name of the link to the node at path is returned
+// by name; nodes for which name returns the empty string are not linked.
+// Links are relative to dir so that they resolve within the mount.
+//
+// Links are created for the nodes already bound in src, and are added and
+// removed as nodes are bound in and unbound from src. The directory dir
+// must exist and must not be src. Errors binding individual links, for
+// example because two nodes have the same link name, are ignored.
+func (fs *FileSystem) NewLinkFarm(dir, src string, name func(path string, n Node) string) (*LinkFarm, error) {
+	dir = rooted(dir)
+	src = rooted(src)
+	if dir == src {
+		return nil, &os.PathError{Op: "link farm", Path: dir, Err: syscall.EINVAL}
+	}
+	l := &LinkFarm{fs: fs, dir: dir, src: src, name: name, links: make(map[string]string)}
+
+	fs.mu.Lock()
+	n, err := walkPath(fs.root, "link farm", dir)
+	if err == nil {
+		if _, ok := n.(*Dir); !ok {
+			err = &os.PathError{Op: "link farm", Path: dir, Err: syscall.ENOTDIR}
+		}
+	}
+	if err != nil {
+		fs.mu.Unlock()
+		return nil, err
+	}
+	n, err = walkPath(fs.root, "link farm", src)
+	if err != nil {
+		fs.mu.Unlock()
+		return nil, err
+	}
+	d, ok := n.(*Dir)
+	if !ok {
+		fs.mu.Unlock()
+		return nil, &os.PathError{Op: "link farm", Path: src, Err: syscall.ENOTDIR}
+	}
+	d.mu.Lock()
+	existing := make(map[string]Node, len(d.files))
+	for name, n := range d.files {
+		existing[name] = n
+	}
+	d.mu.Unlock()
+	fs.farms = append(fs.farms, l)
+	fs.mu.Unlock()
+
+	names := make([]string, 0, len(existing))
+	for name := range existing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l.add(filepath.Join(src, name), existing[name])
+	}
+	return l, nil
+}
+
+// Close stops the LinkFarm maintaining its links. Existing links are not
+// removed.
+func (l *LinkFarm) Close() {
+	fs := l.fs
+	fs.mu.Lock()
+	farms := make([]*LinkFarm, 0, len(fs.farms))
+	for _, f := range fs.farms {
+		if f != l {
+			farms = append(farms, f)
+		}
+	}
+	fs.farms = farms
+	fs.mu.Unlock()
+}
+
+// event updates the links for a bind or unbind event. event must not be
+// called with fs.mu held.
+func (l *LinkFarm) event(e Event) {
+	if filepath.Dir(e.Path) != l.src {
+		return
+	}
+	switch e.Op {
+	case "bind":
+		l.fs.mu.Lock()
+		n, err := walkPath(l.fs.root, "link farm", e.Path)
+		l.fs.mu.Unlock()
+		if err != nil {
+			return
+		}
+		l.add(e.Path, n)
+	case "unbind":
+		l.remove(e.Path)
+	}
+}
+
+// add binds a link to n at path.
+func (l *LinkFarm) add(path string, n Node) {
+	name := l.name(path, n)
+	if name == "" {
+		return
+	}
+	target, err := filepath.Rel(l.dir, path)
+	if err != nil {
+		return
+	}
+	link, err := NewSymlink(name, target)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.links[path]; ok {
+		return
+	}
+	// A link already bound with the same
+	// name is kept rather than replaced.
+	_, err = l.fs.BindConflict(l.dir, link, Fail)
+	if err != nil {
+		return
+	}
+	l.links[path] = name
+}
+
+// remove unbinds the link to the node that was at path.
+func (l *LinkFarm) remove(path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	name, ok := l.links[path]
+	if !ok {
+		return
+	}
+	delete(l.links, path)
+	l.fs.Unbind(filepath.Join(l.dir, name))
+}
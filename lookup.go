@@ -0,0 +1,27 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import "sync/atomic"
+
+// SetCaseInsensitive sets whether name lookup in the file system is
+// case-insensitive. When lookup is case-insensitive, names are still
+// stored and listed as given, but a lookup of a name that does not exactly
+// match a node falls back to a match under Unicode case folding. This is
+// useful when the mount is accessed through layers that fold case, such as
+// a Samba re-export.
+func (fs *FileSystem) SetCaseInsensitive(fold bool) {
+	var v uint32
+	if fold {
+		v = 1
+	}
+	atomic.StoreUint32(&fs.foldCase, v)
+}
+
+// foldsCase returns whether name lookup is case-insensitive.
+// A nil FileSystem does not fold case.
+func (fs *FileSystem) foldsCase() bool {
+	return fs != nil && atomic.LoadUint32(&fs.foldCase) != 0
+}
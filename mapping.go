@@ -0,0 +1,54 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"os"
+
+	"bazil.org/fuse"
+)
+
+// AttrMapping specifies adjustments made to the attributes of nodes as
+// they are reported to the kernel. It allows the same tree definition to
+// present appropriate ownership and permissions whether the file system
+// is served by root, as on an EV3, or by an unprivileged user on a
+// development machine. The attributes held by the nodes are not changed.
+type AttrMapping struct {
+	// MapOwners specifies whether the
+	// uid and gid of all nodes are
+	// reported as Uid and Gid.
+	MapOwners bool
+	Uid       uint32
+	Gid       uint32
+
+	// Umask holds permission bits that
+	// are cleared from reported modes.
+	Umask os.FileMode
+}
+
+// SetAttrMapping sets the attribute mapping of the file system.
+func (fs *FileSystem) SetAttrMapping(m AttrMapping) {
+	fs.mapping.Store(m)
+}
+
+// attrMapping returns the attribute mapping of the file system. It may be
+// called with a node's lock held. A nil FileSystem has the zero mapping.
+func (fs *FileSystem) attrMapping() AttrMapping {
+	if fs == nil {
+		return AttrMapping{}
+	}
+	m, _ := fs.mapping.Load().(AttrMapping)
+	return m
+}
+
+// mapAttr applies the attribute mapping of the file system to a.
+func (fs *FileSystem) mapAttr(a *fuse.Attr) {
+	m := fs.attrMapping()
+	if m.MapOwners {
+		a.Uid = m.Uid
+		a.Gid = m.Gid
+	}
+	a.Mode &^= m.Umask & os.ModePerm
+}
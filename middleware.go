@@ -0,0 +1,229 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"syscall"
+	"time"
+)
+
+// DeviceMiddleware wraps a ReadWriter to add behaviour to its ReadAt,
+// WriteAt, Truncate and Size methods.
+type DeviceMiddleware func(ReadWriter) ReadWriter
+
+// Chain returns dev wrapped by the provided middleware. The first
+// middleware is the outermost, so it sees each operation first.
+func Chain(dev ReadWriter, mw ...DeviceMiddleware) ReadWriter {
+	for i := len(mw) - 1; i >= 0; i-- {
+		dev = mw[i](dev)
+	}
+	return dev
+}
+
+// wrapped is a ReadWriter wrapping another, forwarding Sync, Close and
+// Capabilities to the wrapped device.
+type wrapped struct {
+	ReadWriter
+}
+
+// Sync syncs the wrapped device if it has the Sync capability.
+func (w wrapped) Sync() error {
+	return syncDevice(w.ReadWriter)
+}
+
+// Close closes the wrapped device if it has the Close capability.
+func (w wrapped) Close() error {
+	return closeDevice(w.ReadWriter)
+}
+
+// Capabilities returns the capabilities of the wrapped device.
+func (w wrapped) Capabilities() Capabilities {
+	return capabilities(w.ReadWriter)
+}
+
+// ValidateWrites returns a DeviceMiddleware that checks each write as
+// described for NewValidate. Writes that fail validation return EINVAL.
+func ValidateWrites(valid func([]byte) bool) DeviceMiddleware {
+	return func(dev ReadWriter) ReadWriter {
+		return validated{wrapped: wrapped{dev}, valid: valid}
+	}
+}
+
+type validated struct {
+	wrapped
+	valid func([]byte) bool
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (v validated) WriteAt(b []byte, off int64) (int, error) {
+	if !v.valid(bytes.TrimSuffix(b, []byte{'\n'})) {
+		return 0, syscall.EINVAL
+	}
+	return v.ReadWriter.WriteAt(b, off)
+}
+
+// TransformData returns a DeviceMiddleware that applies the read and
+// write transformations as described for NewTransform.
+func TransformData(read, write func([]byte) ([]byte, error)) DeviceMiddleware {
+	return func(dev ReadWriter) ReadWriter {
+		return NewTransform(dev, read, write)
+	}
+}
+
+// LogOps returns a DeviceMiddleware that calls logf to log each ReadAt,
+// WriteAt and Truncate operation and its result.
+func LogOps(logf func(format string, args ...interface{})) DeviceMiddleware {
+	return func(dev ReadWriter) ReadWriter {
+		return logged{wrapped: wrapped{dev}, logf: logf}
+	}
+}
+
+type logged struct {
+	wrapped
+	logf func(format string, args ...interface{})
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (l logged) ReadAt(b []byte, off int64) (int, error) {
+	n, err := l.ReadWriter.ReadAt(b, off)
+	l.logf("read %d bytes at %d: %d %v", len(b), off, n, err)
+	return n, err
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (l logged) WriteAt(b []byte, off int64) (int, error) {
+	n, err := l.ReadWriter.WriteAt(b, off)
+	l.logf("write %q at %d: %d %v", b, off, n, err)
+	return n, err
+}
+
+// Truncate truncates the wrapped device.
+func (l logged) Truncate(size int64) error {
+	err := l.ReadWriter.Truncate(size)
+	l.logf("truncate to %d: %v", size, err)
+	return err
+}
+
+// LimitWrites returns a DeviceMiddleware that applies a token bucket rate
+// limit to writes as described for FileSystem.SetWriteRateLimit. Writes
+// made when no token is available return EAGAIN. Time is obtained from
+// clock, or time.Now if clock is nil. Each device wrapped by the returned
+// middleware has its own bucket.
+func LimitWrites(rate float64, burst int, clock func() time.Time) DeviceMiddleware {
+	if clock == nil {
+		clock = time.Now
+	}
+	return func(dev ReadWriter) ReadWriter {
+		return limited{
+			wrapped: wrapped{dev},
+			limiter: &limiter{
+				rate:    rate,
+				burst:   float64(burst),
+				buckets: make(map[interface{}]*bucket),
+			},
+			now: clock,
+		}
+	}
+}
+
+type limited struct {
+	wrapped
+	*limiter
+	now func() time.Time
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (l limited) WriteAt(b []byte, off int64) (int, error) {
+	if !l.allow(nil, l.now()) {
+		return 0, syscall.EAGAIN
+	}
+	return l.ReadWriter.WriteAt(b, off)
+}
+
+// Timeout returns a DeviceMiddleware that abandons ReadAt, WriteAt,
+// Truncate and Size calls that do not complete within d, returning
+// ETIMEDOUT so that a stuck device cannot wedge client processes. An
+// abandoned call continues in the background and its result is discarded.
+// Calls to the wrapped device are serialised, so calls made while an
+// abandoned call is still running wait for it to complete for at most d.
+func Timeout(d time.Duration) DeviceMiddleware {
+	return func(dev ReadWriter) ReadWriter {
+		return timed{wrapped: wrapped{dev}, timeout: d, sem: make(chan struct{}, 1)}
+	}
+}
+
+type timed struct {
+	wrapped
+	timeout time.Duration
+	sem     chan struct{}
+}
+
+// do calls fn, returning ETIMEDOUT if fn does not complete within the
+// timeout, including time spent waiting for a previous call.
+func (t timed) do(fn func() (int64, error)) (int64, error) {
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case t.sem <- struct{}{}:
+	case <-timer.C:
+		return 0, syscall.ETIMEDOUT
+	}
+
+	type result struct {
+		n   int64
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() { <-t.sem }()
+		n, err := fn()
+		done <- result{n: n, err: err}
+	}()
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-timer.C:
+		return 0, syscall.ETIMEDOUT
+	}
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (t timed) ReadAt(b []byte, off int64) (int, error) {
+	// Read into a private buffer so that an
+	// abandoned call cannot write to b.
+	buf := make([]byte, len(b))
+	n, err := t.do(func() (int64, error) {
+		n, err := t.ReadWriter.ReadAt(buf, off)
+		return int64(n), err
+	})
+	return copy(b, buf[:n]), err
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (t timed) WriteAt(b []byte, off int64) (int, error) {
+	// Write from a private copy so that an
+	// abandoned call does not read b after
+	// it has been reused.
+	data := append([]byte(nil), b...)
+	n, err := t.do(func() (int64, error) {
+		n, err := t.ReadWriter.WriteAt(data, off)
+		return int64(n), err
+	})
+	return int(n), err
+}
+
+// Truncate truncates the wrapped device.
+func (t timed) Truncate(size int64) error {
+	_, err := t.do(func() (int64, error) {
+		return 0, t.ReadWriter.Truncate(size)
+	})
+	return err
+}
+
+// Size returns the size of the wrapped device.
+func (t timed) Size() (int64, error) {
+	return t.do(t.ReadWriter.Size)
+}
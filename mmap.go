@@ -0,0 +1,175 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package sisyphus
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Mmap is a ReadWriter backed by a memory-mapped file, allowing large files
+// to be served without holding their content in the Go heap. Writes beyond
+// the end of the mapping grow the file.
+type Mmap struct {
+	mu       sync.Mutex
+	file     *os.File
+	writable bool
+	data     []byte
+}
+
+// NewMmap returns a new Mmap backed by the file at path. If writable is
+// false, the file is mapped read only and writes return EROFS.
+func NewMmap(path string, writable bool) (*Mmap, error) {
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mmap{file: f, writable: writable}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	err = m.mmap(fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// mmap maps the first size bytes of the file, replacing any
+// existing mapping.
+func (m *Mmap) mmap(size int64) error {
+	if m.data != nil {
+		err := syscall.Munmap(m.data)
+		if err != nil {
+			return err
+		}
+		m.data = nil
+	}
+	if size == 0 {
+		return nil
+	}
+	prot := syscall.PROT_READ
+	if m.writable {
+		prot |= syscall.PROT_WRITE
+	}
+	data, err := syscall.Mmap(int(m.file.Fd()), 0, int(size), prot, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (m *Mmap) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return 0, syscall.EBADFD
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, m.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (m *Mmap) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return 0, syscall.EBADFD
+	}
+	if !m.writable {
+		return 0, syscall.EROFS
+	}
+	if end := off + int64(len(b)); end > int64(len(m.data)) {
+		err := m.truncate(end)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return copy(m.data[off:], b), nil
+}
+
+// Truncate changes the size of the backing file and its mapping.
+func (m *Mmap) Truncate(n int64) error {
+	if n < 0 {
+		return syscall.EINVAL
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return syscall.EBADFD
+	}
+	if !m.writable {
+		return syscall.EROFS
+	}
+	return m.truncate(n)
+}
+
+func (m *Mmap) truncate(n int64) error {
+	err := m.file.Truncate(n)
+	if err != nil {
+		return err
+	}
+	return m.mmap(n)
+}
+
+// Size returns the length of the mapping and a nil error.
+func (m *Mmap) Size() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.data)), nil
+}
+
+// Sync flushes changes in the mapping to the backing file.
+func (m *Mmap) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil || !m.writable {
+		return nil
+	}
+	return m.file.Sync()
+}
+
+// Unmap removes the mapping and closes the backing file. The Mmap
+// must not be used after Unmap has been called.
+func (m *Mmap) Unmap() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return nil
+	}
+	err := m.mmap(0)
+	cerr := m.file.Close()
+	m.file = nil
+	if err != nil {
+		return err
+	}
+	return cerr
+}
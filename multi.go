@@ -0,0 +1,73 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"io"
+	"syscall"
+)
+
+// multiReader is the concatenation of a set of Readers.
+type multiReader []Reader
+
+// MultiReader returns a Reader that presents the concatenation of the
+// provided Readers. The size of each Reader is obtained on each call to
+// ReadAt and Size, so the layout follows changes in the parts' sizes.
+func MultiReader(devs ...Reader) Reader {
+	return multiReader(append([]Reader(nil), devs...))
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (m multiReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	var n int
+	for _, d := range m {
+		if n == len(b) {
+			break
+		}
+		size, err := d.Size()
+		if err != nil {
+			return n, err
+		}
+		if off >= size {
+			off -= size
+			continue
+		}
+		want := b[n:]
+		if rem := size - off; int64(len(want)) > rem {
+			want = want[:rem]
+		}
+		c, err := d.ReadAt(want, off)
+		n += c
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if c < len(want) {
+			// The part was shorter than
+			// its reported size.
+			return n, io.ErrUnexpectedEOF
+		}
+		off = 0
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Size returns the sum of the sizes of the parts.
+func (m multiReader) Size() (int64, error) {
+	var total int64
+	for _, d := range m {
+		size, err := d.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
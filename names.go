@@ -0,0 +1,72 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// MaxNameLen is the maximum length of a node name in bytes.
+const MaxNameLen = 255
+
+// validName returns whether name is a valid base name for a node.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		len(name) <= MaxNameLen &&
+		!strings.ContainsAny(name, string(filepath.Separator)+"\x00")
+}
+
+// SetNamePolicy sets a name policy function for the file system. If policy
+// is not nil, it is called with the name of each node bound with Bind, and
+// a non-nil error returned by policy prevents the node from being bound.
+// The policy is applied in addition to the checks made by the node
+// constructors.
+func (fs *FileSystem) SetNamePolicy(policy func(name string) error) {
+	fs.mu.Lock()
+	fs.namePolicy = policy
+	fs.mu.Unlock()
+}
+
+// checkName returns an error if the name of n is not a valid base name
+// or is rejected by the file system's name policy. checkName must be
+// called with fs.mu held.
+func (fs *FileSystem) checkName(dir string, n Node) error {
+	return fs.checkNamed(dir, n.Name())
+}
+
+// checkNamed is like checkName for a node with the given name.
+func (fs *FileSystem) checkNamed(dir, name string) error {
+	path := filepath.Join(dir, name)
+	if !validName(name) {
+		return &os.PathError{Op: "bind", Path: path, Err: ErrBadName}
+	}
+	if fs.namePolicy == nil {
+		return nil
+	}
+	err := fs.namePolicy(name)
+	if err != nil {
+		return &os.PathError{Op: "bind", Path: path, Err: err}
+	}
+	return nil
+}
+
+// SysfsName is a name policy that accepts only names made of ASCII
+// letters, digits and the characters '_', '-', '.', ':' and '+', as
+// used for sysfs attributes and devices. It returns EINVAL for other
+// names.
+func SysfsName(name string) error {
+	for _, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case strings.ContainsRune("_-.:+", r):
+		default:
+			return syscall.EINVAL
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import "sync"
+
+// ChangeKind is the kind of a change to an ObservableBytes.
+type ChangeKind int
+
+const (
+	ChangeWrite ChangeKind = iota
+	ChangeTruncate
+)
+
+// Change describes a change to the content of an ObservableBytes.
+type Change struct {
+	Kind ChangeKind
+
+	// Offset is the offset of a write or the
+	// new size after a truncation.
+	Offset int64
+
+	// Length is the number of bytes written.
+	// It is zero for truncations.
+	Length int
+}
+
+// ObservableBytes is a ReadWriter with the same semantics as Bytes that
+// notifies subscribers of writes and truncations.
+type ObservableBytes struct {
+	mu   sync.Mutex
+	data Bytes
+	subs []chan Change
+}
+
+// NewObservableBytes returns a new ObservableBytes backed by the provided data.
+func NewObservableBytes(data []byte) *ObservableBytes {
+	return &ObservableBytes{data: Bytes(data)}
+}
+
+// subscriptionBuffer is the number of changes
+// buffered for each ObservableBytes subscriber.
+const subscriptionBuffer = 16
+
+// Subscribe returns a channel on which changes to the content are sent.
+// If a subscriber does not keep up, changes that would not fit in the
+// channel's buffer are dropped.
+func (f *ObservableBytes) Subscribe() <-chan Change {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan Change, subscriptionBuffer)
+	f.subs = append(f.subs, c)
+	return c
+}
+
+// Unsubscribe stops sending changes on c and closes it.
+func (f *ObservableBytes) Unsubscribe(c <-chan Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, s := range f.subs {
+		if (<-chan Change)(s) == c {
+			close(s)
+			f.subs = append(f.subs[:i], f.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// notify sends c to all subscribers without blocking.
+func (f *ObservableBytes) notify(c Change) {
+	for _, s := range f.subs {
+		select {
+		case s <- c:
+		default:
+		}
+	}
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (f *ObservableBytes) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data.ReadAt(b, off)
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (f *ObservableBytes) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.data.WriteAt(b, off)
+	if n != 0 {
+		f.notify(Change{Kind: ChangeWrite, Offset: off, Length: n})
+	}
+	return n, err
+}
+
+// Truncate truncates the data at n bytes from the beginning.
+func (f *ObservableBytes) Truncate(n int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.data.Truncate(n)
+	if err == nil {
+		f.notify(Change{Kind: ChangeTruncate, Offset: n})
+	}
+	return err
+}
+
+// Size returns the length of the backing data and a nil error.
+func (f *ObservableBytes) Size() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data.Size()
+}
@@ -0,0 +1,63 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import "io"
+
+// Pipe is a ReadWriter backed by a pair of pipes, giving a node the
+// behaviour of a bidirectional stream. Data written to the Go side of the
+// pipe is read by clients of the node, and data written by clients is
+// read from the Go side. Read and write offsets are ignored.
+type Pipe struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+// NewPipe returns a new Pipe and the Go side of the stream. Closing the
+// returned io.ReadWriteCloser causes client reads to return EOF once
+// pending data has been read, and client writes to fail.
+func NewPipe() (*Pipe, io.ReadWriteCloser) {
+	toClient, fromGo := io.Pipe()
+	fromClient, toGo := io.Pipe()
+	return &Pipe{r: toClient, w: toGo}, &pipeEnd{r: fromClient, w: fromGo}
+}
+
+// ReadAt satisfies the io.ReaderAt interface. The offset is ignored and
+// the read blocks until data is written by the Go side of the pipe.
+func (p *Pipe) ReadAt(b []byte, _ int64) (int, error) {
+	return p.r.Read(b)
+}
+
+// WriteAt satisfies the io.WriterAt interface. The offset is ignored and
+// the write blocks until the data is read by the Go side of the pipe.
+func (p *Pipe) WriteAt(b []byte, _ int64) (int, error) {
+	return p.w.Write(b)
+}
+
+// Concurrent marks the Pipe as safe for concurrent use.
+func (p *Pipe) Concurrent() {}
+
+// Truncate is a no-op.
+func (p *Pipe) Truncate(_ int64) error { return nil }
+
+// Size returns zero and a nil error.
+func (p *Pipe) Size() (int64, error) { return 0, nil }
+
+// Capabilities satisfies the Capable interface. A Pipe is a stream.
+func (p *Pipe) Capabilities() Capabilities { return Capabilities{Stream: true} }
+
+// pipeEnd is the Go side of a Pipe.
+type pipeEnd struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (e *pipeEnd) Read(b []byte) (int, error)  { return e.r.Read(b) }
+func (e *pipeEnd) Write(b []byte) (int, error) { return e.w.Write(b) }
+
+func (e *pipeEnd) Close() error {
+	e.w.Close()
+	return e.r.Close()
+}
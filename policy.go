@@ -0,0 +1,232 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Op is a file system operation.
+type Op int
+
+const (
+	OpLookup Op = iota + 1
+	OpReadDir
+	OpOpen
+	OpRead
+	OpWrite
+	OpSetattr
+	OpFlush
+	OpAttr
+	OpRelease
+	OpGetxattr
+	OpListxattr
+	OpReadlink
+)
+
+var opNames = [...]string{
+	OpLookup:    "lookup",
+	OpReadDir:   "readdir",
+	OpOpen:      "open",
+	OpRead:      "read",
+	OpWrite:     "write",
+	OpSetattr:   "setattr",
+	OpFlush:     "flush",
+	OpAttr:      "attr",
+	OpRelease:   "release",
+	OpGetxattr:  "getxattr",
+	OpListxattr: "listxattr",
+	OpReadlink:  "readlink",
+}
+
+// String returns the name of the operation.
+func (op Op) String() string {
+	if op <= 0 || int(op) >= len(opNames) {
+		return fmt.Sprintf("Op(%d)", int(op))
+	}
+	return opNames[op]
+}
+
+// SetPolicy sets the access policy function of the file system. If policy
+// is not nil, it is called before each lookup, readdir, open, read, write,
+// setattr, flush and readlink operation with the operation, the
+// absolute path of the node within the file system and the header of the
+// FUSE request. A non-nil error returned by policy is returned to the
+// kernel and the operation is not performed.
+func (fs *FileSystem) SetPolicy(policy func(op Op, path string, hdr fuse.Header) error) {
+	fs.mu.Lock()
+	fs.policy = policy
+	fs.mu.Unlock()
+}
+
+// SetReadOnly sets whether the file system is read only. While the file
+// system is read only, all write and setattr operations return EROFS.
+func (fs *FileSystem) SetReadOnly(readOnly bool) {
+	fs.mu.Lock()
+	fs.readOnly = readOnly
+	fs.mu.Unlock()
+}
+
+// check returns whether the operation op on node n is allowed for the
+// request held in ctx. Operations re-entering n from its own device fail
+// with EDEADLK. Other attr, release, getxattr and listxattr operations are
+// always allowed. Remaining operations are checked against the policies
+// of the file system, delaying allowed operations according to any
+// latency profile applying to n and scheduling them according to the
+// priority class of n. Write and setattr operations wait while the file
+// system is quiesced. If the operation is allowed, check returns a
+// function that must be called when the operation has completed. check
+// must not be called with a node's lock held. A nil FileSystem allows all
+// operations, as do the operations of a self-test on its probe.
+func (fs *FileSystem) check(ctx context.Context, op Op, n Node) (done func(), err error) {
+	return fs.checkChild(ctx, op, n, "")
+}
+
+// checkChild is like check but reports the path of the named child of n
+// to the policy function. If name is empty, the path of n is reported.
+func (fs *FileSystem) checkChild(ctx context.Context, op Op, n Node, name string) (done func(), err error) {
+	err = reentrant(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case OpAttr, OpRelease, OpGetxattr, OpListxattr:
+		return noExit, nil
+	}
+	if fs == nil || fs.isProbe(n, name) {
+		return noExit, nil
+	}
+	exit := noExit
+	if op == OpWrite || op == OpSetattr {
+		exit, err = fs.fence.enter(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				exit()
+			}
+		}()
+	}
+	fs.mu.Lock()
+	priority := fs.priorityLocked(n)
+	if overloaded, _ := ctx.Value(overloadKey{}).(bool); overloaded && priority != High {
+		fs.mu.Unlock()
+		return nil, syscall.EAGAIN
+	}
+	if e := fs.frozenLocked(n); e != 0 {
+		fs.mu.Unlock()
+		return nil, e
+	}
+	if fs.readOnly && (op == OpWrite || op == OpSetattr) {
+		fs.mu.Unlock()
+		return nil, syscall.EROFS
+	}
+	var bulk chan struct{}
+	if priority == Bulk && (op == OpRead || op == OpWrite) {
+		bulk = fs.bulk
+	}
+	policy := fs.policy
+	latency := fs.latencyLocked(n)
+	var path string
+	if policy != nil {
+		path = fs.pathLocked(n)
+		if name != "" && path != "" {
+			path = filepath.Join(path, name)
+		}
+	}
+	fs.mu.Unlock()
+	hdr := header(ctx)
+	if policy != nil {
+		err = policy(op, path, hdr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = delay(ctx, latency, op)
+	if err != nil {
+		return nil, err
+	}
+	release, err := schedule(ctx, bulk)
+	if err != nil {
+		return nil, err
+	}
+	if op == OpWrite {
+		err = fs.limitWrite(n, hdr)
+		if err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return func() {
+		release()
+		exit()
+	}, nil
+}
+
+type (
+	requestKey  struct{}
+	overloadKey struct{}
+)
+
+// withRequest returns a copy of config that stores each FUSE request
+// header in the request context, retaining any user provided WithContext,
+// and passes debug messages to the file system's debug log in addition to
+// any user provided Debug function.
+// Each request is attributed to the client session of its process.
+// Requests made by threads executing device calls are marked as
+// re-entrant when deadlock detection is enabled.
+// Requests arriving while the file system's pending request limit is
+// exceeded are marked as overloaded. A request is pending until the
+// server logs its response.
+func (filesys *FileSystem) withRequest(config *fs.Config) *fs.Config {
+	var c fs.Config
+	if config != nil {
+		c = *config
+	}
+	debug := c.Debug
+	c.Debug = func(msg interface{}) {
+		filesys.requests.response(msg)
+		if debug != nil {
+			debug(msg)
+		}
+		filesys.debug.message(msg)
+	}
+	user := c.WithContext
+	c.WithContext = func(ctx context.Context, req fuse.Request) context.Context {
+		if user != nil {
+			ctx = user(ctx, req)
+		}
+		hdr := req.Hdr()
+		ctx = context.WithValue(ctx, requestKey{}, fuse.Header{
+			Conn: hdr.Conn,
+			ID:   hdr.ID,
+			Node: hdr.Node,
+			Uid:  hdr.Uid,
+			Gid:  hdr.Gid,
+			Pid:  hdr.Pid,
+		})
+		ctx = filesys.withReentry(ctx, hdr.Pid)
+		filesys.seen(hdr)
+		if !filesys.requests.begin(hdr.ID, filesys.now()) {
+			ctx = context.WithValue(ctx, overloadKey{}, true)
+		}
+		return ctx
+	}
+	return &c
+}
+
+// header returns the FUSE request header held in ctx. The zero
+// Header is returned if ctx holds no request.
+func header(ctx context.Context) fuse.Header {
+	hdr, _ := ctx.Value(requestKey{}).(fuse.Header)
+	return hdr
+}
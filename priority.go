@@ -0,0 +1,103 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"syscall"
+)
+
+// Priority is the scheduling class of operations on a node.
+type Priority int
+
+const (
+	// Normal operations are subject to
+	// the pending request limit.
+	Normal Priority = iota
+
+	// High priority operations are not
+	// subject to the pending request
+	// limit, so that interactive use of
+	// the nodes remains responsive while
+	// the file system is overloaded.
+	High
+
+	// Bulk reads and writes are limited
+	// to the number of concurrent bulk
+	// operations set by SetBulkLimit,
+	// waiting until a slot is available.
+	Bulk
+)
+
+// SetPriority sets the priority class of operations on the node at the
+// given path and all nodes below it, unless a node nearer to them has its
+// own class. Setting the Normal class removes the node's class. The class
+// is removed if the node is unbound.
+func (fs *FileSystem) SetPriority(path string, p Priority) error {
+	path = rooted(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := walkPath(fs.root, "priority", path)
+	if err != nil {
+		return err
+	}
+	if p == Normal {
+		delete(fs.priority, n)
+		return nil
+	}
+	if fs.priority == nil {
+		fs.priority = make(map[Node]Priority)
+	}
+	fs.priority[n] = p
+	return nil
+}
+
+// SetBulkLimit sets the maximum number of Bulk priority reads and writes
+// that may be handled concurrently. Bulk operations arriving while the
+// limit is reached wait for a slot, leaving request handlers available for
+// other operations. A non-positive limit removes the limit. Changing the
+// limit does not affect bulk operations already waiting or in progress.
+func (fs *FileSystem) SetBulkLimit(limit int) {
+	fs.mu.Lock()
+	if limit > 0 {
+		fs.bulk = make(chan struct{}, limit)
+	} else {
+		fs.bulk = nil
+	}
+	fs.mu.Unlock()
+}
+
+// priorityLocked returns the priority class of operations on n. It must
+// be called with fs.mu held.
+func (fs *FileSystem) priorityLocked(n Node) Priority {
+	if len(fs.priority) == 0 {
+		return Normal
+	}
+	for {
+		if p, ok := fs.priority[n]; ok {
+			return p
+		}
+		d, ok := fs.parent[n]
+		if !ok {
+			return Normal
+		}
+		n = d
+	}
+}
+
+// schedule waits for a bulk operation slot from the semaphore bulk,
+// returning a function that releases the slot. It returns EINTR if ctx is
+// cancelled while waiting. A nil semaphore has no limit.
+func schedule(ctx context.Context, bulk chan struct{}) (release func(), err error) {
+	if bulk == nil {
+		return noExit, nil
+	}
+	select {
+	case bulk <- struct{}{}:
+	case <-ctx.Done():
+		return nil, syscall.EINTR
+	}
+	return func() { <-bulk }, nil
+}
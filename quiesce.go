@@ -0,0 +1,113 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"sync"
+	"syscall"
+)
+
+// Quiesce blocks new write and setattr operations on the file system and
+// waits for those in progress to complete, so that a Snapshot or SaveState
+// made before the returned release function is called captures a
+// consistent image. Blocked operations proceed when release is called, or
+// fail with EINTR if their request is interrupted. Quiesce may be called
+// while the file system is quiesced, and writes resume when every quiesce
+// has been released. If ctx is done before the operations in progress
+// complete, the quiesce is released and the error of ctx is returned.
+func (fs *FileSystem) Quiesce(ctx context.Context) (release func(), err error) {
+	drained := fs.fence.hold()
+	var once sync.Once
+	release = func() { once.Do(fs.fence.release) }
+	select {
+	case <-drained:
+		return release, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// fence blocks write operations while a FileSystem is quiesced.
+type fence struct {
+	mu sync.Mutex
+
+	// holds is the number of quiesces
+	// not yet released and resume is
+	// closed when the last is released.
+	holds  int
+	resume chan struct{}
+
+	// writes is the number of write
+	// operations in progress and drained
+	// is closed when it falls to zero.
+	writes  int
+	drained chan struct{}
+}
+
+// enter waits until the fence is not held and records the start of a
+// write operation, returning a function that records its completion. It
+// returns EINTR if ctx is cancelled while waiting.
+func (f *fence) enter(ctx context.Context) (exit func(), err error) {
+	for {
+		f.mu.Lock()
+		if f.holds == 0 {
+			f.writes++
+			f.mu.Unlock()
+			return f.exit, nil
+		}
+		resume := f.resume
+		f.mu.Unlock()
+		select {
+		case <-resume:
+		case <-ctx.Done():
+			return nil, syscall.EINTR
+		}
+	}
+}
+
+// exit records the completion of a write operation.
+func (f *fence) exit() {
+	f.mu.Lock()
+	f.writes--
+	if f.writes == 0 && f.drained != nil {
+		close(f.drained)
+		f.drained = nil
+	}
+	f.mu.Unlock()
+}
+
+// hold holds the fence, returning a channel that is closed when no write
+// operations are in progress.
+func (f *fence) hold() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.holds == 0 {
+		f.resume = make(chan struct{})
+	}
+	f.holds++
+	if f.writes == 0 {
+		drained := make(chan struct{})
+		close(drained)
+		return drained
+	}
+	if f.drained == nil {
+		f.drained = make(chan struct{})
+	}
+	return f.drained
+}
+
+// release releases a hold on the fence, resuming blocked write operations
+// if it was the last.
+func (f *fence) release() {
+	f.mu.Lock()
+	f.holds--
+	if f.holds == 0 {
+		close(f.resume)
+		f.resume = nil
+	}
+	f.mu.Unlock()
+}
@@ -0,0 +1,243 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"os"
+	"syscall"
+)
+
+// SetQuota sets a limit on the total size of the devices of the file nodes
+// in the subtree rooted at the directory at the given path. Writes and
+// truncations made through the file system that would grow the total size
+// beyond limit fail with EDQUOT. Operations that do not grow a file are
+// allowed even if the subtree is over its limit. A negative limit removes
+// the quota. The quota is removed if the directory is unbound.
+//
+// The usage of a subtree is counted from the sizes of its devices when
+// the quota is first checked and when the tree has changed, and is then
+// updated by the writes and truncations made through the file system.
+// Changes to device data made by other means are not counted until the
+// usage is next recounted. Quotas are checked before each growing
+// operation, so concurrent writes may together exceed the limit.
+func (fs *FileSystem) SetQuota(path string, limit int64) error {
+	path = rooted(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, err := fs.quotaDir(path)
+	if err != nil {
+		return err
+	}
+	if limit < 0 {
+		delete(fs.quota, d)
+		return nil
+	}
+	if fs.quota == nil {
+		fs.quota = make(map[*Dir]*quota)
+	}
+	if q, ok := fs.quota[d]; ok {
+		q.limit = limit
+		return nil
+	}
+	fs.quota[d] = &quota{limit: limit}
+	return nil
+}
+
+// quota is the size limit of a directory subtree and its usage.
+type quota struct {
+	limit int64
+
+	// used is the total size of the
+	// devices in the subtree. It is
+	// valid if counted is true and
+	// generation is the generation
+	// of the file system.
+	used       int64
+	counted    bool
+	generation uint64
+}
+
+// Usage returns the total size of the devices of the file nodes in the
+// subtree rooted at the directory at the given path.
+func (fs *FileSystem) Usage(path string) (int64, error) {
+	path = rooted(path)
+	fs.mu.Lock()
+	d, err := fs.quotaDir(path)
+	if err != nil {
+		fs.mu.Unlock()
+		return 0, err
+	}
+	nodes := subtree(d)
+	fs.mu.Unlock()
+
+	var total int64
+	for _, n := range nodes {
+		size, err := nodeSize(n)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// quotaDir returns the directory at path. It must be called with fs.mu
+// held.
+func (fs *FileSystem) quotaDir(path string) (*Dir, error) {
+	n, err := walkPath(fs.root, "quota", path)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := n.(*Dir)
+	if !ok {
+		return nil, &os.PathError{Op: "quota", Path: path, Err: syscall.ENOTDIR}
+	}
+	return d, nil
+}
+
+// checkQuota returns EDQUOT if growing the device of the file node n to
+// size bytes would exceed the quota of a directory holding n. checkQuota
+// must not be called with a node's lock held.
+func (fs *FileSystem) checkQuota(n Node, size int64) error {
+	if fs == nil {
+		return nil
+	}
+	fs.mu.Lock()
+	if n == fs.probe {
+		fs.mu.Unlock()
+		return nil
+	}
+	var stale []*Dir
+	for _, d := range fs.quotaDirsLocked(n) {
+		q := fs.quota[d]
+		if !q.counted || q.generation != fs.generation {
+			stale = append(stale, d)
+		}
+	}
+	fs.mu.Unlock()
+	if len(stale) != 0 {
+		fs.recount(stale)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	cur := fs.usage[n]
+	if size <= cur {
+		return nil
+	}
+	for _, d := range fs.quotaDirsLocked(n) {
+		if fs.quota[d].used+size-cur > fs.quota[d].limit {
+			return syscall.EDQUOT
+		}
+	}
+	return nil
+}
+
+// quotaDirsLocked returns the directories holding n that have a quota. It
+// must be called with fs.mu held.
+func (fs *FileSystem) quotaDirsLocked(n Node) []*Dir {
+	if len(fs.quota) == 0 {
+		return nil
+	}
+	var dirs []*Dir
+	for d, ok := fs.parent[n]; ok; d, ok = fs.parent[d] {
+		if _, ok := fs.quota[d]; ok {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// recount counts the usage of the quotas of dirs from the sizes of the
+// devices in their subtrees. Devices whose size cannot be obtained are
+// counted as empty. recount must not be called with fs.mu or a node's
+// lock held.
+func (fs *FileSystem) recount(dirs []*Dir) {
+	fs.mu.Lock()
+	generation := fs.generation
+	nodes := make([][]Node, len(dirs))
+	for i, d := range dirs {
+		nodes[i] = subtree(d)
+	}
+	fs.mu.Unlock()
+
+	sizes := make(map[Node]int64)
+	used := make([]int64, len(dirs))
+	for i := range dirs {
+		for _, n := range nodes[i] {
+			size, ok := sizes[n]
+			if !ok {
+				size, _ = nodeSize(n)
+				sizes[n] = size
+			}
+			used[i] += size
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.usage == nil {
+		fs.usage = make(map[Node]int64)
+	}
+	for n, size := range sizes {
+		fs.usage[n] = size
+	}
+	for i, d := range dirs {
+		q, ok := fs.quota[d]
+		if !ok {
+			continue
+		}
+		q.used = used[i]
+		q.counted = true
+		q.generation = generation
+	}
+}
+
+// account records that the device of the file node n has been written up
+// to end, or truncated to end if truncated is true, updating the usage of
+// the quotas of the directories holding n. account must not be called with
+// a node's lock held.
+func (fs *FileSystem) account(n Node, end int64, truncated bool) {
+	if fs == nil {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	cur, ok := fs.usage[n]
+	if !ok {
+		return
+	}
+	size := end
+	if !truncated && size < cur {
+		size = cur
+	}
+	fs.usage[n] = size
+	for _, d := range fs.quotaDirsLocked(n) {
+		fs.quota[d].used += size - cur
+	}
+}
+
+// subtree returns the nodes in the subtree rooted at d. It must be called
+// with fs.mu held.
+func subtree(d *Dir) []Node {
+	var nodes []Node
+	walkNode("/", d, func(_ string, n Node) {
+		nodes = append(nodes, n)
+	})
+	return nodes
+}
+
+// nodeSize returns the size of the device of n, or zero if n is not a
+// file node.
+func nodeSize(n Node) (int64, error) {
+	type sizer interface {
+		size() (int64, error)
+	}
+	s, ok := n.(sizer)
+	if !ok {
+		return 0, nil
+	}
+	return s.size()
+}
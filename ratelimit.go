@@ -0,0 +1,133 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// LimitKey specifies how write rate limits are accounted.
+type LimitKey int
+
+const (
+	// LimitByUID accounts write rate limits for
+	// each uid making requests.
+	LimitByUID LimitKey = iota
+
+	// LimitByNode accounts write rate limits
+	// for each node being written to.
+	LimitByNode
+)
+
+// SetWriteRateLimit sets a token bucket rate limit on write operations.
+// Tokens are added at rate per second up to a maximum of burst, and each
+// write consumes one token. Writes made when no token is available return
+// EAGAIN. Buckets are held for each uid or for each node according to by,
+// and are discarded once they have been idle long enough to refill.
+// A non-positive rate or burst removes the write rate limit.
+func (fs *FileSystem) SetWriteRateLimit(rate float64, burst int, by LimitKey) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if rate <= 0 || burst <= 0 {
+		fs.limiter = nil
+		return
+	}
+	fs.limiter = &limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		by:      by,
+		buckets: make(map[interface{}]*bucket),
+	}
+}
+
+// limitWrite returns EAGAIN if a write to n by the
+// requester in hdr exceeds the write rate limit.
+func (fs *FileSystem) limitWrite(n Node, hdr fuse.Header) error {
+	fs.mu.Lock()
+	l := fs.limiter
+	fs.mu.Unlock()
+	if l == nil {
+		return nil
+	}
+	var key interface{}
+	switch l.by {
+	case LimitByUID:
+		key = hdr.Uid
+	case LimitByNode:
+		key = n
+	}
+	if !l.allow(key, fs.now()) {
+		return syscall.EAGAIN
+	}
+	return nil
+}
+
+// limiter is a keyed token bucket rate limiter.
+type limiter struct {
+	rate  float64
+	burst float64
+	by    LimitKey
+
+	mu      sync.Mutex
+	buckets map[interface{}]*bucket
+
+	// swept is the last time idle
+	// buckets were discarded.
+	swept time.Time
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow returns whether a token is available for key at
+// time now, consuming the token if it is available.
+func (l *limiter) allow(key interface{}, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if dt := now.Sub(b.last); dt > 0 {
+		b.tokens += dt.Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep discards buckets that have been idle long enough to refill
+// completely, since they are equivalent to a new bucket. Buckets are
+// swept at most once per refill period.
+func (l *limiter) sweep(now time.Time) {
+	if l.rate <= 0 {
+		return
+	}
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.swept) < refill {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
@@ -0,0 +1,446 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Export serves the subtree of the file system at path to sisyphus
+// processes that import it, accepting connections from l until l is
+// closed. It allows a tree whose devices run heavy simulation logic to be
+// held on a workstation while it is mounted on an EV3 by a file system
+// holding the imported tree. Connections may be made over any stream
+// transport, such as TCP or a unix socket.
+//
+// Export provides no authentication or encryption. Any peer that can
+// connect to l may read, write and truncate every file in the exported
+// subtree, so l must only accept connections from trusted peers, for
+// example a unix socket with restrictive permissions or a TCP listener
+// bound to a loopback or otherwise trusted network.
+//
+// Export is experimental. Calls made by an importer are handled in turn
+// as requests on the exported nodes, so the policies, quotas and hooks of
+// the exporting file system are applied in addition to those of the
+// importing file system. A connection may only access the nodes listed
+// to it when it obtained the tree. Nodes bound in the subtree after it
+// has been imported are not seen by the importer.
+func (fs *FileSystem) Export(l net.Listener, path string) error {
+	e := &exporter{fs: fs, root: rooted(path)}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go e.serve(conn)
+	}
+}
+
+// Import returns a directory with the given name and mode holding the
+// tree exported by the sisyphus process at the other end of conn, as
+// described for Export. The devices of the imported file nodes forward
+// their calls over conn, which is closed if the tree cannot be obtained.
+// Import is experimental.
+func Import(conn io.ReadWriteCloser, name string, mode os.FileMode) (*Dir, error) {
+	c := &remoteClient{enc: gob.NewEncoder(conn), dec: gob.NewDecoder(conn)}
+	res, err := c.call(remoteIO{Op: "tree"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	entries := res.Entries
+	root, err := NewDir(name, mode)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	dirs := map[string]*Dir{"/": root}
+	for _, e := range entries {
+		if e.Path == "/" {
+			continue
+		}
+		parent, ok := dirs[filepath.Dir(e.Path)]
+		if !ok {
+			continue
+		}
+		name := filepath.Base(e.Path)
+		dev := &remoteDevice{client: c, path: e.Path}
+		var n Node
+		switch e.Type {
+		case "dir":
+			var d *Dir
+			d, err = NewDir(name, e.Mode)
+			dirs[e.Path] = d
+			n = d
+		case "ro":
+			n, err = NewRO(name, e.Mode, dev)
+		case "rw":
+			n, err = NewRW(name, e.Mode, dev)
+		case "wo":
+			n, err = NewWO(name, e.Mode, dev)
+		case "symlink":
+			n, err = NewSymlink(name, e.Target)
+		default:
+			continue
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		parent.With(n)
+	}
+	return root, nil
+}
+
+// remoteEntry describes an exported node.
+type remoteEntry struct {
+	Path   string
+	Type   string
+	Mode   os.FileMode
+	Target string
+}
+
+// remoteIO is a call made on an exported tree.
+type remoteIO struct {
+	Op   string
+	Path string
+	Off  int64
+	Size int64
+	Data []byte
+}
+
+// remoteResult is the result of a call made on an exported tree.
+type remoteResult struct {
+	Entries []remoteEntry
+
+	N     int64
+	Data  []byte
+	EOF   bool
+	Errno syscall.Errno
+	Msg   string
+}
+
+// setErr records err in the result.
+func (r *remoteResult) setErr(err error) {
+	switch {
+	case err == nil:
+	case err == io.EOF:
+		r.EOF = true
+	default:
+		r.Errno = syscall.Errno(fuse.ToErrno(fuseError(err)))
+		r.Msg = err.Error()
+	}
+}
+
+// err returns the error recorded in the result.
+func (r *remoteResult) err() error {
+	switch {
+	case r.EOF:
+		return io.EOF
+	case r.Errno != 0 && r.Msg == r.Errno.Error():
+		return r.Errno
+	case r.Errno != 0:
+		return WithErrno(errors.New(r.Msg), r.Errno)
+	}
+	return nil
+}
+
+// maxRemoteRead is the largest read made on an exported node by a single
+// call, matching the largest read request made by the kernel.
+const maxRemoteRead = 128 << 10
+
+// exporter is the RPC service of an exported subtree.
+type exporter struct {
+	fs   *FileSystem
+	root string
+}
+
+// exportConn is a connection to an exported subtree.
+type exportConn struct {
+	*exporter
+
+	// ctx is cancelled when the
+	// connection is closed.
+	ctx context.Context
+
+	// paths holds the paths listed
+	// to the peer by the tree call.
+	paths map[string]bool
+}
+
+// serve handles the calls made over conn until it is closed.
+func (e *exporter) serve(conn net.Conn) {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &exportConn{exporter: e, ctx: ctx}
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	for {
+		var req remoteIO
+		err := dec.Decode(&req)
+		if err != nil {
+			return
+		}
+		var res remoteResult
+		switch req.Op {
+		case "tree":
+			c.tree(&res)
+		case "read":
+			c.readAt(req, &res)
+		case "write":
+			c.writeAt(req, &res)
+		case "truncate":
+			c.truncate(req, &res)
+		case "size":
+			c.size(req, &res)
+		default:
+			res.setErr(syscall.ENOSYS)
+		}
+		err = enc.Encode(&res)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// tree returns the entries of the exported subtree, parents first, and
+// records their paths as accessible to the connection.
+func (c *exportConn) tree(res *remoteResult) {
+	c.fs.mu.Lock()
+	n, err := walkPath(c.fs.root, "export", c.root)
+	c.fs.mu.Unlock()
+	if err != nil {
+		res.setErr(err)
+		return
+	}
+	entries := &res.Entries
+	walkNode("/", n, func(path string, n Node) {
+		entry := remoteEntry{Path: path}
+		switch n := n.(type) {
+		case *Dir:
+			n.mu.Lock()
+			entry.Type, entry.Mode = "dir", n.mode
+			n.mu.Unlock()
+		case *RO:
+			n.mu.Lock()
+			entry.Type, entry.Mode = "ro", n.mode
+			n.mu.Unlock()
+		case *RW:
+			n.mu.Lock()
+			entry.Type, entry.Mode = "rw", n.mode
+			n.mu.Unlock()
+		case *WO:
+			n.mu.Lock()
+			entry.Type, entry.Mode = "wo", n.mode
+			n.mu.Unlock()
+		case *Symlink:
+			n.mu.Lock()
+			entry.Type, entry.Mode, entry.Target = "symlink", n.mode, n.target
+			n.mu.Unlock()
+		default:
+			return
+		}
+		*entries = append(*entries, entry)
+	})
+	c.paths = make(map[string]bool, len(res.Entries))
+	for _, e := range res.Entries {
+		c.paths[e.Path] = true
+	}
+}
+
+// node returns the exported node at path, which must be a clean absolute
+// path listed to the connection by the tree call. Other paths return
+// ENOENT.
+func (c *exportConn) node(path string) (Node, error) {
+	if !c.paths[path] || !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return nil, &os.PathError{Op: "export", Path: path, Err: syscall.ENOENT}
+	}
+	full := filepath.Join(c.root, path)
+	if c.root != "/" && full != c.root && !strings.HasPrefix(full, c.root+"/") {
+		return nil, &os.PathError{Op: "export", Path: path, Err: syscall.ENOENT}
+	}
+	c.fs.mu.Lock()
+	defer c.fs.mu.Unlock()
+	return walkPath(c.fs.root, "export", full)
+}
+
+// readAt reads from an exported node. Reads larger than maxRemoteRead
+// are shortened.
+func (c *exportConn) readAt(req remoteIO, res *remoteResult) {
+	if req.Size < 0 {
+		res.setErr(syscall.EINVAL)
+		return
+	}
+	if req.Size > maxRemoteRead {
+		req.Size = maxRemoteRead
+	}
+	n, err := c.node(req.Path)
+	if err != nil {
+		res.setErr(err)
+		return
+	}
+	rreq := fuse.ReadRequest{Offset: req.Off, Size: int(req.Size)}
+	resp := fuse.ReadResponse{Data: make([]byte, 0, req.Size)}
+	switch n := n.(type) {
+	case *RO:
+		err = n.Read(c.ctx, &rreq, &resp)
+	case *RW:
+		err = n.Read(c.ctx, &rreq, &resp)
+	default:
+		err = syscall.EBADF
+	}
+	res.N, res.Data = int64(len(resp.Data)), resp.Data
+	if err == nil && res.N < req.Size {
+		// The node reports the end of
+		// its data with a short read.
+		err = io.EOF
+	}
+	res.setErr(err)
+}
+
+// writeAt writes to an exported node.
+func (c *exportConn) writeAt(req remoteIO, res *remoteResult) {
+	n, err := c.node(req.Path)
+	if err != nil {
+		res.setErr(err)
+		return
+	}
+	wreq := fuse.WriteRequest{Offset: req.Off, Data: req.Data}
+	var resp fuse.WriteResponse
+	switch n := n.(type) {
+	case *RW:
+		err = n.Write(c.ctx, &wreq, &resp)
+	case *WO:
+		err = n.Write(c.ctx, &wreq, &resp)
+	default:
+		err = syscall.EBADF
+	}
+	res.N = int64(resp.Size)
+	res.setErr(err)
+}
+
+// truncate truncates an exported node.
+func (c *exportConn) truncate(req remoteIO, res *remoteResult) {
+	if req.Size < 0 {
+		res.setErr(syscall.EINVAL)
+		return
+	}
+	n, err := c.node(req.Path)
+	if err != nil {
+		res.setErr(err)
+		return
+	}
+	sreq := fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: uint64(req.Size)}
+	var resp fuse.SetattrResponse
+	switch n := n.(type) {
+	case *RW:
+		err = n.Setattr(c.ctx, &sreq, &resp)
+	case *WO:
+		err = n.Setattr(c.ctx, &sreq, &resp)
+	default:
+		err = syscall.EBADF
+	}
+	res.setErr(err)
+}
+
+// size returns the size of the device of an exported node.
+func (c *exportConn) size(req remoteIO, res *remoteResult) {
+	n, err := c.node(req.Path)
+	if err != nil {
+		res.setErr(err)
+		return
+	}
+	switch n := n.(type) {
+	case *RO:
+		res.N, err = n.size()
+	case *RW:
+		res.N, err = n.size()
+	case *WO:
+		res.N, err = n.size()
+	default:
+		err = syscall.EBADF
+	}
+	res.setErr(err)
+}
+
+// remoteClient makes calls on an exported tree. Calls are serialised.
+type remoteClient struct {
+	mu  sync.Mutex
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+// call makes the call req and returns its result. Transport errors are
+// returned as EIO.
+func (c *remoteClient) call(req remoteIO) (remoteResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var res remoteResult
+	err := c.enc.Encode(&req)
+	if err == nil {
+		err = c.dec.Decode(&res)
+	}
+	if err != nil {
+		return res, WithErrno(err, syscall.EIO)
+	}
+	return res, res.err()
+}
+
+// remoteDevice is a ReadWriter forwarding its calls to an exported node.
+type remoteDevice struct {
+	client *remoteClient
+	path   string
+}
+
+// ReadAt satisfies the io.ReaderAt interface. Reads larger than the
+// largest read made by a single call are made in parts.
+func (d *remoteDevice) ReadAt(b []byte, off int64) (int, error) {
+	var n int
+	for n < len(b) {
+		size := len(b) - n
+		if size > maxRemoteRead {
+			size = maxRemoteRead
+		}
+		res, err := d.client.call(remoteIO{Op: "read", Path: d.path, Off: off + int64(n), Size: int64(size)})
+		n += copy(b[n:], res.Data)
+		if err != nil {
+			return n, err
+		}
+		if len(res.Data) < size {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (d *remoteDevice) WriteAt(b []byte, off int64) (int, error) {
+	res, err := d.client.call(remoteIO{Op: "write", Path: d.path, Off: off, Data: b})
+	return int(res.N), err
+}
+
+// Truncate truncates the exported device.
+func (d *remoteDevice) Truncate(size int64) error {
+	_, err := d.client.call(remoteIO{Op: "truncate", Path: d.path, Size: size})
+	return err
+}
+
+// Size returns the size of the exported device.
+func (d *remoteDevice) Size() (int64, error) {
+	res, err := d.client.call(remoteIO{Op: "size", Path: d.path})
+	return res.N, err
+}
@@ -0,0 +1,164 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// RequestStats holds FUSE request accounting for a served FileSystem.
+type RequestStats struct {
+	// Pending is the number of requests
+	// currently being handled.
+	Pending int64
+
+	// Peak is the largest number of
+	// requests handled concurrently.
+	Peak int64
+
+	// Rejected is the number of requests
+	// that arrived while the pending
+	// limit was exceeded.
+	Rejected int64
+}
+
+// staleRequest is the time after which a request whose response has not
+// been seen is no longer counted as pending.
+const staleRequest = time.Minute
+
+// requests tracks the FUSE requests being handled by a server.
+type requests struct {
+	mu    sync.Mutex
+	max   int64
+	stats RequestStats
+
+	// active holds the start times of
+	// the requests being handled.
+	active map[fuse.RequestID]time.Time
+
+	// swept is the last time stale
+	// requests were discarded.
+	swept time.Time
+
+	// untracked is set when responses
+	// cannot be attributed to requests.
+	untracked bool
+}
+
+// begin records the start of the request id at time now. It returns false
+// if the request exceeds the pending request limit. Requests that have been
+// pending for longer than staleRequest are discarded, so that a response
+// that is never seen does not hold a pending slot indefinitely.
+func (r *requests) begin(id fuse.RequestID, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.untracked {
+		return true
+	}
+	if now.Sub(r.swept) >= staleRequest {
+		for id, start := range r.active {
+			if now.Sub(start) >= staleRequest {
+				delete(r.active, id)
+				r.stats.Pending--
+			}
+		}
+		r.swept = now
+	}
+	if _, ok := r.active[id]; !ok {
+		if r.active == nil {
+			r.active = make(map[fuse.RequestID]time.Time)
+		}
+		r.active[id] = now
+		r.stats.Pending++
+		if r.stats.Pending > r.stats.Peak {
+			r.stats.Peak = r.stats.Pending
+		}
+	}
+	ok := r.max <= 0 || r.stats.Pending <= r.max
+	if !ok {
+		r.stats.Rejected++
+	}
+	return ok
+}
+
+// end records the completion of the request id.
+func (r *requests) end(id fuse.RequestID) {
+	r.mu.Lock()
+	if _, ok := r.active[id]; ok {
+		delete(r.active, id)
+		r.stats.Pending--
+	}
+	r.mu.Unlock()
+}
+
+// response records the debug message msg, ending the request it answers
+// if it is a response. If msg is a response that does not identify its
+// request, requests are no longer tracked and the pending request limit
+// is not applied, since the completion of requests cannot be observed.
+func (r *requests) response(msg interface{}) {
+	id, ok := responseID(msg)
+	switch {
+	case ok:
+		r.end(id)
+	case isResponse(msg):
+		r.mu.Lock()
+		r.untracked = true
+		r.active = nil
+		r.stats.Pending = 0
+		r.mu.Unlock()
+	}
+}
+
+// responseID returns the ID of the request answered by the bazil.org/fuse/fs
+// debug message msg and whether msg is a response. The server logs a single
+// response for each request after its handler has returned, so a response
+// marks the completion of the request.
+//
+// The message types of bazil.org/fuse/fs are not exported, so their
+// exported fields are inspected by reflection.
+func responseID(msg interface{}) (fuse.RequestID, bool) {
+	if !isResponse(msg) {
+		return 0, false
+	}
+	v := reflect.Indirect(reflect.ValueOf(msg))
+	hdr := v.FieldByName("Request")
+	if hdr.Kind() != reflect.Struct {
+		return 0, false
+	}
+	id := hdr.FieldByName("ID")
+	if id.Kind() != reflect.Uint64 {
+		return 0, false
+	}
+	return fuse.RequestID(id.Uint()), true
+}
+
+// isResponse returns whether msg is a bazil.org/fuse/fs debug response.
+func isResponse(msg interface{}) bool {
+	v := reflect.Indirect(reflect.ValueOf(msg))
+	return v.Kind() == reflect.Struct && v.Type().Name() == "response"
+}
+
+// SetMaxPending sets the maximum number of FUSE requests that may be
+// handled concurrently. Lookup, read directory, open, read, write, flush
+// and setattr requests arriving while the limit is exceeded return EAGAIN,
+// unless they are made on High priority nodes. A non-positive max removes
+// the limit. Requests are no longer counted as pending if their completion
+// has not been observed after a minute.
+func (fs *FileSystem) SetMaxPending(max int64) {
+	fs.requests.mu.Lock()
+	fs.requests.max = max
+	fs.requests.mu.Unlock()
+}
+
+// RequestStats returns the FUSE request accounting for the file system.
+func (fs *FileSystem) RequestStats() RequestStats {
+	fs.requests.mu.Lock()
+	defer fs.requests.mu.Unlock()
+	return fs.requests.stats
+}
@@ -8,8 +8,6 @@ import (
 	"context"
 	"io"
 	"os"
-	"path/filepath"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -31,33 +29,55 @@ type RO struct {
 	name string
 	attr
 
+	// attrFunc is an optional hook
+	// adjusting reported attributes.
+	attrFunc AttrFunc
+
+	// sizes caches the device
+	// size if enabled.
+	sizes sizeCache
+
+	// follow holds the state of
+	// reads waiting for appended
+	// data.
+	follow follower
+
 	fs *FileSystem
 
 	openFlags fuse.OpenResponseFlags
+	opens     OpenStats
+	stats     NodeStats
 
 	dev Reader
 }
 
 var (
-	_ Node              = (*RO)(nil)
-	_ fs.Node           = (*RO)(nil)
-	_ fs.Handle         = (*RO)(nil)
-	_ fs.NodeOpener     = (*RO)(nil)
-	_ fs.HandleReleaser = (*RO)(nil)
-	_ fs.HandleReader   = (*RO)(nil)
+	_ Node               = (*RO)(nil)
+	_ fs.Node            = (*RO)(nil)
+	_ fs.NodeGetxattrer  = (*RO)(nil)
+	_ fs.NodeListxattrer = (*RO)(nil)
+	_ fs.Handle          = (*RO)(nil)
+	_ fs.NodeOpener      = (*RO)(nil)
+	_ fs.HandleReleaser  = (*RO)(nil)
+	_ fs.HandleReader    = (*RO)(nil)
 )
 
-// NewRO returns a new RO file with the given name and file mode.
+// NewRO returns a new RO file with the given name and file mode. It
+// returns ErrBadName if name is not a valid base name and ErrNilDevice
+// if dev is nil.
 func NewRO(name string, mode os.FileMode, dev Reader) (*RO, error) {
 	return NewROFlags(name, mode, 0, dev)
 }
 
-// NewRO returns a new RO file with the given name and file mode.
+// NewROFlags returns a new RO file with the given name and file mode.
 // The provided flags are used when opening the RO node.
 func NewROFlags(name string, mode os.FileMode, flags fuse.OpenResponseFlags, dev Reader) (*RO, error) {
-	if strings.Contains(name, string(filepath.Separator)) {
+	if !validName(name) {
 		return nil, ErrBadName
 	}
+	if dev == nil {
+		return nil, ErrNilDevice
+	}
 	return &RO{
 		name: name,
 		attr: attr{
@@ -69,13 +89,13 @@ func NewROFlags(name string, mode os.FileMode, flags fuse.OpenResponseFlags, dev
 }
 
 // MustNewRO returns a new RO with the given name and file mode. It
-// will panic if name contains a filepath separator.
+// will panic if name is not a valid base name or dev is nil.
 func MustNewRO(name string, mode os.FileMode, dev Reader) *RO {
 	return MustNewROFlags(name, mode, 0, dev)
 }
 
-// MustNewRO returns a new RO with the given name and file mode. It
-// will panic if name contains a filepath separator.
+// MustNewROFlags returns a new RO with the given name and file mode. It
+// will panic if name is not a valid base name or dev is nil.
 // The provided flags are used when opening the RO node.
 func MustNewROFlags(name string, mode os.FileMode, flags fuse.OpenResponseFlags, dev Reader) *RO {
 	ro, err := NewROFlags(name, mode, flags, dev)
@@ -85,13 +105,60 @@ func MustNewROFlags(name string, mode os.FileMode, flags fuse.OpenResponseFlags,
 	return ro
 }
 
-// Own sets the uid and gid of the file.
+// Own sets the uid and gid of the file. If the file is bound to a file
+// system, its change time is updated. Own may be called before the file
+// is bound.
 func (f *RO) Own(uid, gid uint32) *RO {
-	f.uid = uid
-	f.gid = gid
+	f.mu.Lock()
+	f.own(f.fs, uid, gid)
+	f.mu.Unlock()
+	return f
+}
+
+// SetAttrFunc sets a function that is called to adjust the attributes
+// reported for the file.
+func (f *RO) SetAttrFunc(fn AttrFunc) *RO {
+	f.mu.Lock()
+	f.attrFunc = fn
+	f.mu.Unlock()
+	return f
+}
+
+// SetSizeCache sets whether the file caches the size of its device. When
+// caching is enabled, Attr calls the device's Size method only when the
+// cached size has been invalidated by a write or truncation through the
+// file system, a call to InvalidateSize or Invalidate, or an invalidation
+// of the node's path by the file system.
+func (f *RO) SetSizeCache(cache bool) *RO {
+	f.mu.Lock()
+	f.sizes.setEnabled(cache)
+	f.mu.Unlock()
+	return f
+}
+
+// SetFollow sets whether reads at or beyond the end of the file's data
+// wait for data to be appended rather than returning end of file, so that
+// clients following a continuously appended log, such as tail -f, see new
+// data as it arrives. Waiting reads are woken by a call to InvalidateSize
+// or Invalidate, or an invalidation of the node's path by the file system,
+// and check the size of the device every poll interval if poll is positive.
+// Waiting reads through handles opened with O_NONBLOCK return EAGAIN, and
+// interrupted reads return EINTR.
+func (f *RO) SetFollow(follow bool, poll time.Duration) *RO {
+	f.mu.Lock()
+	f.follow.set(follow, poll)
+	f.mu.Unlock()
 	return f
 }
 
+// InvalidateSize discards the cached size of the file's device.
+func (f *RO) InvalidateSize() {
+	f.mu.Lock()
+	f.sizes.invalidate()
+	f.follow.signal()
+	f.mu.Unlock()
+}
+
 // Name returns the name of the file.
 func (f *RO) Name() string { return f.name }
 
@@ -116,56 +183,179 @@ func (f *RO) Sys() *FileSystem {
 	return f.fs
 }
 
+// size returns the size of the file's device.
+func (f *RO) size() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.fs.enterDevice(f)()
+	return f.sizes.get(f.fs, f.dev)
+}
+
+// Opens returns the open accounting of the file.
+func (f *RO) Opens() OpenStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.opens
+}
+
+// Stats returns the I/O accounting of the file.
+func (f *RO) Stats() NodeStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
+
 // Invalidate invalidates the kernel cache of the file.
 func (f *RO) Invalidate() error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	f.sizes.invalidate()
+	f.follow.signal()
 	return f.fs.Invalidate(f)
 }
 
 // Attr satisfies the bazil.org/fuse/fs.Node interface.
-func (f *RO) Attr(ctx context.Context, a *fuse.Attr) error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
+func (f *RO) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	defer sys(ctx, f).trace(OpAttr, f)(&err)
 
+	done, err := sys(ctx, f).check(ctx, OpAttr, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	f.mu.Lock()
+	defer f.fs.enterDevice(f)()
 	copyAttr(a, f.attr)
-	size, err := f.dev.Size()
+	f.fs.mapAttr(a)
+	filesys := f.fs
+	var size int64
+	if !capabilities(f.dev).Stream {
+		size, err = f.sizes.get(filesys, f.dev)
+	}
+	strict := filesys.strictSysfs()
+	fn := f.attrFunc
+	f.mu.Unlock()
 	if err != nil {
-		return errno{error: err, errno: fuse.Errno(syscall.EBADFD)}
+		return filesys.deviceError(OpAttr, f, err, syscall.EBADFD)
+	}
+	if strict {
+		size = sysfsSize
+	}
+	setSize(a, size)
+	if fn != nil {
+		return fn(ctx, a)
 	}
-	a.Size = uint64(size)
 	return nil
 }
 
 // Open satisfies the bazil.org/fuse/fs.NodeOpener interface.
-func (f *RO) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	resp.Flags |= fuse.OpenDirectIO
+func (f *RO) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer sys(ctx, f).trace(OpOpen, f)(&err)
+
+	done, err := sys(ctx, f).check(ctx, OpOpen, f)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	f.mu.Lock()
+	filesys := f.fs
+	err = filesys.openDevice(ctx, f, f.dev, req.Flags)
+	if err != nil {
+		f.mu.Unlock()
+		return nil, filesys.deviceError(OpOpen, f, err, 0)
+	}
+	f.opens.opened(filesys.now())
+	f.mu.Unlock()
+
+	resp.Flags |= fuse.OpenDirectIO | capabilities(f.dev).openFlags()
+	filesys.opened(header(ctx), f)
 	return f, nil
 }
 
 // Release satisfies the bazil.org/fuse/fs.HandleReleaser interface.
-// If the RO Reader device is an io.Closer, its Close method is called.
-func (f *RO) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+// If the RO Reader device has the Close capability, its Close method is
+// called.
+func (f *RO) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	defer sys(ctx, f).trace(OpRelease, f)(&err)
+
+	done, err := sys(ctx, f).check(ctx, OpRelease, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer f.Sys().released(header(ctx), f)
+
 	f.mu.Lock()
+	defer f.fs.enterDevice(f)()
 	defer f.mu.Unlock()
 
-	if c, ok := f.dev.(io.Closer); ok {
-		return c.Close()
-	}
-	return nil
+	f.opens.closed(f.fs.now())
+
+	return fuseError(closeDevice(f.dev))
 }
 
 // Read satisfies the bazil.org/fuse/fs.HandleReader interface.
-func (f *RO) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
+func (f *RO) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer sys(ctx, f).trace(OpRead, f)(&err)
 
+	done, err := sys(ctx, f).check(ctx, OpRead, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+	err = f.await(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
 	f.atime = f.fs.now()
+	filesys := f.fs
+	_, concurrent := f.dev.(Concurrent)
+	if concurrent {
+		f.mu.Unlock()
+	} else {
+		defer filesys.enterDevice(f)()
+	}
 
-	n, err := f.dev.ReadAt(resp.Data[:req.Size], int64(req.Offset))
+	size := filesys.sysfsReadSize(req.Offset, req.Size)
+	n, err := filesys.deviceRead(ctx, f.dev, resp.Data[:size], int64(req.Offset), req.FileFlags)
+	if concurrent {
+		f.mu.Lock()
+	}
+	f.stats.read(n, err, header(ctx).Uid, f.atime)
+	f.mu.Unlock()
 	resp.Data = resp.Data[:n]
 	if err == io.EOF {
 		return nil
 	}
-	return err
+	return filesys.deviceError(OpRead, f, err, 0)
+}
+
+// Getxattr satisfies the bazil.org/fuse/fs.NodeGetxattrer interface.
+func (f *RO) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	defer sys(ctx, f).trace(OpGetxattr, f)(&err)
+
+	done, err := sys(ctx, f).check(ctx, OpGetxattr, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return f.Sys().getxattr(req, resp)
+}
+
+// Listxattr satisfies the bazil.org/fuse/fs.NodeListxattrer interface.
+func (f *RO) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	defer sys(ctx, f).trace(OpListxattr, f)(&err)
+
+	done, err := sys(ctx, f).check(ctx, OpListxattr, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return f.Sys().listxattr(req, resp)
 }
@@ -0,0 +1,228 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package robot adapts sisyphus file systems for use with Go robotics
+// frameworks such as gobot, so that robot code written against ev3 sysfs
+// devices can be run unmodified against a simulated device tree, for
+// example in continuous integration.
+//
+// The package does not import any framework. An Adaptor satisfies the
+// gobot Adaptor and Connection interfaces, mounting the simulated tree
+// when the robot connects and unmounting it when the robot is finalized.
+// A Driver provides the naming and life cycle methods of a gobot Driver
+// for a device directory within the mount, and may be registered with a
+// gobot robot by embedding it in a type that adds the framework's
+// Connection method:
+//
+//	type motor struct{ *robot.Driver }
+//
+//	func (m motor) Connection() gobot.Connection { return m.Adaptor() }
+//
+// Device libraries that locate sysfs using a path prefix, such as the
+// ev3go ev3dev package, may be pointed at the Adaptor's Mountpoint.
+package robot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+
+	"github.com/ev3go/sisyphus"
+)
+
+// Adaptor is a robot connection serving a sisyphus file system.
+type Adaptor struct {
+	mu sync.Mutex
+
+	name    string
+	filesys *sisyphus.FileSystem
+	mntopts []fuse.MountOption
+
+	// mnt is the mount point and temp
+	// is whether it was created by
+	// Connect.
+	mnt  string
+	temp bool
+
+	server io.Closer
+}
+
+// NewAdaptor returns a new Adaptor serving filesys at the mount point mnt
+// with the given mount options. If mnt is empty, a temporary directory is
+// created when the Adaptor connects and removed when it is finalized.
+func NewAdaptor(filesys *sisyphus.FileSystem, mnt string, mntopts ...fuse.MountOption) *Adaptor {
+	return &Adaptor{name: "sisyphus", filesys: filesys, mnt: mnt, mntopts: mntopts}
+}
+
+// Name returns the name of the Adaptor.
+func (a *Adaptor) Name() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.name
+}
+
+// SetName sets the name of the Adaptor.
+func (a *Adaptor) SetName(name string) {
+	a.mu.Lock()
+	a.name = name
+	a.mu.Unlock()
+}
+
+// FileSystem returns the file system served by the Adaptor.
+func (a *Adaptor) FileSystem() *sisyphus.FileSystem {
+	return a.filesys
+}
+
+// Mountpoint returns the mount point of the file system. It is empty if
+// the Adaptor has not connected and was created without a mount point.
+func (a *Adaptor) Mountpoint() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.mnt
+}
+
+// Connect mounts and serves the file system. Connecting a connected
+// Adaptor is a no-op.
+func (a *Adaptor) Connect() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.server != nil {
+		return nil
+	}
+	if a.filesys == nil {
+		return errors.New("robot: nil file system")
+	}
+	if a.mnt == "" {
+		mnt, err := ioutil.TempDir("", "sisyphus-robot-")
+		if err != nil {
+			return err
+		}
+		a.mnt = mnt
+		a.temp = true
+	}
+	server, err := sisyphus.Serve(a.mnt, a.filesys, nil, a.mntopts...)
+	if err != nil {
+		a.removeTemp()
+		return err
+	}
+	a.server = server
+	return nil
+}
+
+// Finalize unmounts the file system, removing the mount point if it was
+// created by Connect. Finalizing an Adaptor that is not connected is a
+// no-op.
+func (a *Adaptor) Finalize() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.server == nil {
+		return nil
+	}
+	err := a.server.Close()
+	a.server = nil
+	a.removeTemp()
+	return err
+}
+
+// removeTemp removes the mount point if it was created by Connect. It
+// must be called with a.mu held.
+func (a *Adaptor) removeTemp() {
+	if !a.temp {
+		return
+	}
+	os.Remove(a.mnt)
+	a.mnt = ""
+	a.temp = false
+}
+
+// Driver is a robot device backed by a device directory of the file
+// system served by an Adaptor, such as "tacho-motor/motor0".
+type Driver struct {
+	mu   sync.Mutex
+	name string
+
+	adaptor *Adaptor
+	path    string
+}
+
+// NewDriver returns a new Driver for the device directory at path within
+// the file system served by a. The Driver is named with the base of path.
+func NewDriver(a *Adaptor, path string) *Driver {
+	return &Driver{name: filepath.Base(path), adaptor: a, path: path}
+}
+
+// Name returns the name of the Driver.
+func (d *Driver) Name() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.name
+}
+
+// SetName sets the name of the Driver.
+func (d *Driver) SetName(name string) {
+	d.mu.Lock()
+	d.name = name
+	d.mu.Unlock()
+}
+
+// Adaptor returns the Adaptor serving the Driver's device.
+func (d *Driver) Adaptor() *Adaptor {
+	return d.adaptor
+}
+
+// Path returns the path of the device directory in the mounted file
+// system.
+func (d *Driver) Path() string {
+	return filepath.Join(d.adaptor.Mountpoint(), d.path)
+}
+
+// Start checks that the device directory is present in the mounted file
+// system.
+func (d *Driver) Start() error {
+	fi, err := os.Stat(d.Path())
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("robot: %s is not a device directory", d.path)
+	}
+	return nil
+}
+
+// Halt satisfies the gobot Driver interface. It is a no-op since the
+// device is owned by the file system.
+func (d *Driver) Halt() error {
+	return nil
+}
+
+// Attr returns the value of the named attribute of the device with any
+// trailing newline removed.
+func (d *Driver) Attr(attr string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(d.Path(), attr))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
+
+// SetAttr writes value to the named attribute of the device.
+func (d *Driver) SetAttr(attr, value string) error {
+	f, err := os.OpenFile(filepath.Join(d.Path(), attr), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
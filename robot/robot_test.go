@@ -0,0 +1,93 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package robot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// robotConnection is the gobot Adaptor and Connection interface.
+type robotConnection interface {
+	Name() string
+	SetName(string)
+	Connect() error
+	Finalize() error
+}
+
+// robotDriver is the gobot Driver interface without its
+// Connection method.
+type robotDriver interface {
+	Name() string
+	SetName(string)
+	Start() error
+	Halt() error
+}
+
+var (
+	_ robotConnection = (*Adaptor)(nil)
+	_ robotDriver     = (*Driver)(nil)
+)
+
+func TestDriver(t *testing.T) {
+	// Use a plain directory in place of the
+	// mount since FUSE may not be available.
+	mnt, err := ioutil.TempDir("", "sisyphus-robot-test-")
+	if err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	defer os.RemoveAll(mnt)
+	dev := filepath.Join(mnt, "tacho-motor", "motor0")
+	err = os.MkdirAll(dev, 0755)
+	if err != nil {
+		t.Fatalf("unexpected error creating device directory: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dev, "address"), []byte("outA\n"), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error creating attribute: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dev, "speed_sp"), nil, 0644)
+	if err != nil {
+		t.Fatalf("unexpected error creating attribute: %v", err)
+	}
+
+	a := NewAdaptor(nil, mnt)
+	if err := a.Finalize(); err != nil {
+		t.Errorf("unexpected error finalizing unconnected adaptor: %v", err)
+	}
+	d := NewDriver(a, "tacho-motor/motor0")
+	if d.Name() != "motor0" {
+		t.Errorf("unexpected driver name: got:%q want:%q", d.Name(), "motor0")
+	}
+	err = d.Start()
+	if err != nil {
+		t.Fatalf("unexpected error starting driver: %v", err)
+	}
+	got, err := d.Attr("address")
+	if err != nil {
+		t.Errorf("unexpected error reading attribute: %v", err)
+	}
+	if got != "outA" {
+		t.Errorf("unexpected attribute value: got:%q want:%q", got, "outA")
+	}
+	err = d.SetAttr("speed_sp", "100")
+	if err != nil {
+		t.Errorf("unexpected error writing attribute: %v", err)
+	}
+	got, err = d.Attr("speed_sp")
+	if err != nil {
+		t.Errorf("unexpected error reading attribute: %v", err)
+	}
+	if got != "100" {
+		t.Errorf("unexpected attribute value after write: got:%q want:%q", got, "100")
+	}
+
+	missing := NewDriver(a, "tacho-motor/motor1")
+	if err := missing.Start(); !os.IsNotExist(err) {
+		t.Errorf("unexpected error starting missing driver: got:%v want not exist error", err)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Rotating is a ReadWriter holding a log that is rotated when it reaches
+// a size or age threshold, in the manner of rotated kernel and driver logs.
+// Writes append to the current generation of the log regardless of their
+// offset. When a write would grow the current generation beyond the size
+// threshold, or the current generation has reached the age threshold, the
+// current generation is retired and a new one started. Retired generations
+// are numbered from 1, the most recently retired, and may be served as
+// numbered sibling files using Nodes.
+type Rotating struct {
+	mu sync.Mutex
+
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+	now     func() time.Time
+
+	current []byte
+	started time.Time
+
+	// retired holds the retired
+	// generations, most recent
+	// first.
+	retired [][]byte
+}
+
+// NewRotating returns a new Rotating that rotates when a write would grow
+// the log beyond maxSize bytes or when the log is older than maxAge
+// according to clock. A zero or negative threshold is not applied. At most
+// keep retired generations are retained. If clock is nil, time.Now is used.
+func NewRotating(maxSize int64, maxAge time.Duration, keep int, clock func() time.Time) *Rotating {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &Rotating{maxSize: maxSize, maxAge: maxAge, keep: keep, now: clock, started: clock()}
+}
+
+// Nodes returns nodes serving the log. The first node is an RW node with
+// the given name and mode serving the current generation, and is followed
+// by an RO node for each retained generation named with the name and the
+// generation number separated by a dot, for example "log.1". Retired
+// generation nodes are read only and are empty until a generation has
+// been retired.
+func (r *Rotating) Nodes(name string, mode os.FileMode) ([]Node, error) {
+	cur, err := NewRW(name, mode, r)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []Node{cur}
+	for i := 1; i <= r.keep; i++ {
+		g, err := NewRO(fmt.Sprintf("%s.%d", name, i), mode&0444, generation{r: r, n: i})
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, g)
+	}
+	return nodes, nil
+}
+
+// Write appends b to the log, rotating it if necessary. It allows Go code
+// to use the log as an io.Writer, for example with the log package.
+func (r *Rotating) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if (r.maxAge > 0 && now.Sub(r.started) >= r.maxAge) ||
+		(r.maxSize > 0 && len(r.current) != 0 && int64(len(r.current)+len(b)) > r.maxSize) {
+		r.rotate(now)
+	}
+	r.current = append(r.current, b...)
+	return len(b), nil
+}
+
+// WriteAt satisfies the io.WriterAt interface. The offset is ignored and b
+// is appended to the log as described for Write.
+func (r *Rotating) WriteAt(b []byte, _ int64) (int, error) {
+	return r.Write(b)
+}
+
+// ReadAt satisfies the io.ReaderAt interface, reading from the current
+// generation.
+func (r *Rotating) ReadAt(b []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return readAt(r.current, b, off)
+}
+
+// Truncate truncates the current generation to size bytes.
+func (r *Rotating) Truncate(size int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if size < 0 || size > int64(len(r.current)) {
+		return syscall.EINVAL
+	}
+	r.current = r.current[:size]
+	return nil
+}
+
+// Size returns the length of the current generation and a nil error.
+func (r *Rotating) Size() (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int64(len(r.current)), nil
+}
+
+// Rotate retires the current generation and starts a new one.
+func (r *Rotating) Rotate() {
+	r.mu.Lock()
+	r.rotate(r.now())
+	r.mu.Unlock()
+}
+
+// Generation returns a copy of the retired generation n, counting from 1
+// for the most recently retired. Generation zero is the current generation.
+// It returns nil if there is no such generation.
+func (r *Rotating) Generation(n int) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g := r.generation(n)
+	if g == nil {
+		return nil
+	}
+	return append([]byte(nil), g...)
+}
+
+// generation returns generation n. It must be called with r.mu held.
+func (r *Rotating) generation(n int) []byte {
+	switch {
+	case n == 0:
+		return r.current
+	case n < 0 || n > len(r.retired):
+		return nil
+	default:
+		return r.retired[n-1]
+	}
+}
+
+// rotate retires the current generation. It must be called with r.mu
+// held.
+func (r *Rotating) rotate(now time.Time) {
+	if r.keep > 0 {
+		r.retired = append([][]byte{r.current}, r.retired...)
+		if len(r.retired) > r.keep {
+			r.retired = r.retired[:r.keep]
+		}
+	}
+	r.current = nil
+	r.started = now
+}
+
+// generation is a Reader serving a retired generation of a Rotating.
+type generation struct {
+	r *Rotating
+	n int
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (g generation) ReadAt(b []byte, off int64) (int, error) {
+	g.r.mu.Lock()
+	defer g.r.mu.Unlock()
+	return readAt(g.r.generation(g.n), b, off)
+}
+
+// Size returns the length of the generation and a nil error.
+func (g generation) Size() (int64, error) {
+	g.r.mu.Lock()
+	defer g.r.mu.Unlock()
+	return int64(len(g.r.generation(g.n))), nil
+}
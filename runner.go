@@ -0,0 +1,93 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"sync"
+
+	"bazil.org/fuse/fs"
+)
+
+// Runner runs background goroutines, such as device simulation loops and
+// pollers, for the lifetime of a served FileSystem. Registered functions
+// are started when the file system is served and their context is
+// cancelled when the server is closed or the kernel destroys the file
+// system, so that tearing down a mount does not leak goroutines.
+type Runner struct {
+	mu      sync.Mutex
+	funcs   []func(context.Context)
+	cancel  context.CancelFunc
+	ctx     context.Context
+	running sync.WaitGroup
+}
+
+// Runner returns the runner of the file system.
+func (fs *FileSystem) Runner() *Runner {
+	return &fs.runner
+}
+
+// Go registers fn to be run in its own goroutine while the runner is
+// started. If the runner is already started, fn is started immediately.
+// The context passed to fn is cancelled when the runner is stopped, and
+// fn must return promptly when it is. fn is run again each time the
+// runner is started.
+func (r *Runner) Go(fn func(ctx context.Context)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.funcs = append(r.funcs, fn)
+	if r.ctx != nil {
+		r.start(fn)
+	}
+}
+
+// Start starts the registered functions if the runner is not already
+// started. Start is called by Serve, and may be called directly to run
+// the functions of a file system that is not mounted, for example in
+// tests.
+func (r *Runner) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ctx != nil {
+		return
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	for _, fn := range r.funcs {
+		r.start(fn)
+	}
+}
+
+// start runs fn in a new goroutine. It must be called with r.mu held
+// while the runner is started.
+func (r *Runner) start(fn func(context.Context)) {
+	r.running.Add(1)
+	go func(ctx context.Context) {
+		defer r.running.Done()
+		fn(ctx)
+	}(r.ctx)
+}
+
+// Stop cancels the context of the running functions and waits for them
+// to return. Stop is called when the server of the file system is closed
+// or the file system is destroyed by the kernel.
+func (r *Runner) Stop() {
+	r.mu.Lock()
+	cancel := r.cancel
+	r.ctx, r.cancel = nil, nil
+	r.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	r.running.Wait()
+}
+
+var _ fs.FSDestroyer = (*FileSystem)(nil)
+
+// Destroy satisfies the bazil.org/fuse/fs.FSDestroyer interface. It stops
+// the file system's runner.
+func (fs *FileSystem) Destroy() {
+	fs.runner.Stop()
+}
@@ -8,8 +8,6 @@ import (
 	"context"
 	"io"
 	"os"
-	"path/filepath"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -18,7 +16,8 @@ import (
 	"bazil.org/fuse/fs"
 )
 
-// ReadWriter is the data interface for a read write file.
+// ReadWriter is the data interface for a read write file. The semantics
+// of WriteAt are as described for Writer.
 type ReadWriter interface {
 	io.ReaderAt
 	io.WriterAt
@@ -27,32 +26,63 @@ type ReadWriter interface {
 }
 
 // RW is a read write file node.
+//
+// The FUSE library in use does not decode fallocate or lseek requests, so
+// they are answered by the kernel: fallocate fails with EOPNOTSUPP and
+// SEEK_DATA and SEEK_HOLE report the whole file as data.
 type RW struct {
 	mu sync.Mutex
 
 	name string
 	attr
 
+	// attrFunc is an optional hook
+	// adjusting reported attributes.
+	attrFunc AttrFunc
+
+	// sizes caches the device
+	// size if enabled.
+	sizes sizeCache
+
+	// single reassembles split
+	// writes if enabled.
+	single assembler
+
+	// follow holds the state of
+	// reads waiting for appended
+	// data.
+	follow follower
+
 	fs *FileSystem
 
 	openFlags fuse.OpenResponseFlags
+	opens     OpenStats
+	stats     NodeStats
+
+	// writers is the number of open
+	// handles with write access.
+	writers int
 
 	dev ReadWriter
 }
 
 var (
-	_ Node              = (*RW)(nil)
-	_ fs.Node           = (*RW)(nil)
-	_ fs.Handle         = (*RW)(nil)
-	_ fs.NodeOpener     = (*RW)(nil)
-	_ fs.HandleReleaser = (*RW)(nil)
-	_ fs.HandleReader   = (*RW)(nil)
-	_ fs.HandleWriter   = (*RW)(nil)
-	_ fs.HandleFlusher  = (*RW)(nil)
-	_ fs.NodeSetattrer  = (*RW)(nil)
+	_ Node               = (*RW)(nil)
+	_ fs.Node            = (*RW)(nil)
+	_ fs.NodeGetxattrer  = (*RW)(nil)
+	_ fs.NodeListxattrer = (*RW)(nil)
+	_ fs.Handle          = (*RW)(nil)
+	_ fs.NodeOpener      = (*RW)(nil)
+	_ fs.HandleReleaser  = (*RW)(nil)
+	_ fs.HandleReader    = (*RW)(nil)
+	_ fs.HandleWriter    = (*RW)(nil)
+	_ fs.HandleFlusher   = (*RW)(nil)
+	_ fs.NodeSetattrer   = (*RW)(nil)
 )
 
-// NewRW returns a new RW file with the given name and file mode.
+// NewRW returns a new RW file with the given name and file mode. It
+// returns ErrBadName if name is not a valid base name and ErrNilDevice
+// if dev is nil.
 func NewRW(name string, mode os.FileMode, dev ReadWriter) (*RW, error) {
 	return NewRWFlags(name, mode, 0, dev)
 }
@@ -60,9 +90,12 @@ func NewRW(name string, mode os.FileMode, dev ReadWriter) (*RW, error) {
 // NewRWFlags returns a new RW file with the given name and file mode.
 // The provided flags are used when opening the RW node.
 func NewRWFlags(name string, mode os.FileMode, flags fuse.OpenResponseFlags, dev ReadWriter) (*RW, error) {
-	if strings.Contains(name, string(filepath.Separator)) {
+	if !validName(name) {
 		return nil, ErrBadName
 	}
+	if dev == nil {
+		return nil, ErrNilDevice
+	}
 	return &RW{
 		name: name,
 		attr: attr{
@@ -74,13 +107,13 @@ func NewRWFlags(name string, mode os.FileMode, flags fuse.OpenResponseFlags, dev
 }
 
 // MustNewRW returns a new RW with the given name and file mode. It
-// will panic if name contains a filepath separator.
+// will panic if name is not a valid base name or dev is nil.
 func MustNewRW(name string, mode os.FileMode, dev ReadWriter) *RW {
 	return MustNewRWFlags(name, mode, 0, dev)
 }
 
 // MustNewRWFlags returns a new RW with the given name and file mode. It
-// will panic if name contains a filepath separator.
+// will panic if name is not a valid base name or dev is nil.
 // The provided flags are used when opening the RW node.
 func MustNewRWFlags(name string, mode os.FileMode, flags fuse.OpenResponseFlags, dev ReadWriter) *RW {
 	rw, err := NewRWFlags(name, mode, flags, dev)
@@ -90,13 +123,78 @@ func MustNewRWFlags(name string, mode os.FileMode, flags fuse.OpenResponseFlags,
 	return rw
 }
 
-// Own sets the uid and gid of the file.
+// Own sets the uid and gid of the file. If the file is bound to a file
+// system, its change time is updated. Own may be called before the file
+// is bound.
 func (f *RW) Own(uid, gid uint32) *RW {
-	f.uid = uid
-	f.gid = gid
+	f.mu.Lock()
+	f.own(f.fs, uid, gid)
+	f.mu.Unlock()
+	return f
+}
+
+// SetAttrFunc sets a function that is called to adjust the attributes
+// reported for the file.
+func (f *RW) SetAttrFunc(fn AttrFunc) *RW {
+	f.mu.Lock()
+	f.attrFunc = fn
+	f.mu.Unlock()
+	return f
+}
+
+// SetSizeCache sets whether the file caches the size of its device. When
+// caching is enabled, Attr calls the device's Size method only when the
+// cached size has been invalidated by a write or truncation through the
+// file system, a call to InvalidateSize or Invalidate, or an invalidation
+// of the node's path by the file system.
+func (f *RW) SetSizeCache(cache bool) *RW {
+	f.mu.Lock()
+	f.sizes.setEnabled(cache)
+	f.mu.Unlock()
+	return f
+}
+
+// SetSingleValue sets whether the file holds a single value that must be
+// passed to its device in one write. The kernel splits client writes that
+// are larger than the maximum write request size into multiple requests;
+// when single value writes are enabled, these requests are reassembled and
+// the client write is passed to the device once it is complete, so that
+// command handlers do not receive truncated payloads. A client write whose
+// length is a multiple of the maximum request size is passed to the device
+// when the file is flushed or released. Requests that do not continue a
+// pending client write discard it and fail with EINVAL.
+func (f *RW) SetSingleValue(single bool) *RW {
+	f.mu.Lock()
+	f.single.setEnabled(single)
+	f.mu.Unlock()
+	return f
+}
+
+// SetFollow sets whether reads at or beyond the end of the file's data
+// wait for data to be appended rather than returning end of file, so that
+// clients following a continuously appended log, such as tail -f, see new
+// data as it arrives. Waiting reads are woken by writes and truncations
+// through the file system, a call to InvalidateSize or Invalidate, or an
+// invalidation of the node's path by the file system, and check the size
+// of the device every poll interval if poll is positive. Waiting reads
+// through handles opened with O_NONBLOCK return EAGAIN, and interrupted
+// reads return EINTR. Files following appended data are opened with
+// direct I/O so that reads beyond the cached file size reach the node.
+func (f *RW) SetFollow(follow bool, poll time.Duration) *RW {
+	f.mu.Lock()
+	f.follow.set(follow, poll)
+	f.mu.Unlock()
 	return f
 }
 
+// InvalidateSize discards the cached size of the file's device.
+func (f *RW) InvalidateSize() {
+	f.mu.Lock()
+	f.sizes.invalidate()
+	f.follow.signal()
+	f.mu.Unlock()
+}
+
 // Name returns the name of the file.
 func (f *RW) Name() string { return f.name }
 
@@ -121,103 +219,409 @@ func (f *RW) Sys() *FileSystem {
 	return f.fs
 }
 
+// size returns the size of the file's device.
+func (f *RW) size() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.fs.enterDevice(f)()
+	return f.sizes.get(f.fs, f.dev)
+}
+
+// Opens returns the open accounting of the file.
+func (f *RW) Opens() OpenStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.opens
+}
+
+// Stats returns the I/O accounting of the file.
+func (f *RW) Stats() NodeStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
+
 // Invalidate invalidates the kernel cache of the file.
 func (f *RW) Invalidate() error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	f.sizes.invalidate()
+	f.follow.signal()
 	return f.fs.Invalidate(f)
 }
 
 // Attr satisfies the bazil.org/fuse/fs.Node interface.
 func (f *RW) Attr(ctx context.Context, a *fuse.Attr) error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
+	return f.getattr(ctx, a, nil)
+}
+
+// Getattr satisfies the bazil.org/fuse/fs.NodeGetattrer interface. When
+// the attributes are requested through an open handle, the size is
+// obtained from the device rather than the size cache and includes any
+// reassembled write pending on the handle.
+func (f *RW) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+	resp.Attr.Valid = attrValid
+	return f.getattr(ctx, &resp.Attr, req)
+}
+
+// getattr fills a with the attributes of the file as seen by the handle
+// of req. If req is nil or not made through a handle, the attributes are
+// those of the node.
+func (f *RW) getattr(ctx context.Context, a *fuse.Attr, req *fuse.GetattrRequest) (err error) {
+	defer sys(ctx, f).trace(OpAttr, f)(&err)
 
+	done, err := sys(ctx, f).check(ctx, OpAttr, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	f.mu.Lock()
+	defer f.fs.enterDevice(f)()
 	copyAttr(a, f.attr)
-	size, err := f.dev.Size()
+	f.fs.mapAttr(a)
+	filesys := f.fs
+	var size int64
+	handle := req != nil && req.Flags&fuse.GetattrFh != 0
+	if !capabilities(f.dev).Stream {
+		if handle {
+			f.sizes.invalidate()
+		}
+		size, err = f.sizes.get(filesys, f.dev)
+	}
+	if handle && err == nil {
+		if end, ok := f.single.end(req.Handle); ok && end > size {
+			size = end
+		}
+	}
+	strict := filesys.strictSysfs()
+	writers := f.writers
+	fn := f.attrFunc
+	f.mu.Unlock()
 	if err != nil {
-		return errno{error: err, errno: fuse.Errno(syscall.EBADFD)}
+		return filesys.deviceError(OpAttr, f, err, syscall.EBADFD)
+	}
+	if strict {
+		size = sysfsSize
+	}
+	setSize(a, size)
+	if writers != 0 {
+		// Do not allow the kernel to cache
+		// the size while it may be changing.
+		a.Valid = 0
+	}
+	if fn != nil {
+		return fn(ctx, a)
 	}
-	a.Size = uint64(size)
 	return nil
 }
 
 // Open satisfies the bazil.org/fuse/fs.NodeOpener interface.
-func (f *RW) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	resp.Flags |= f.openFlags
+func (f *RW) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer sys(ctx, f).trace(OpOpen, f)(&err)
+
+	done, err := sys(ctx, f).check(ctx, OpOpen, f)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	f.mu.Lock()
+	filesys := f.fs
+	err = filesys.openDevice(ctx, f, f.dev, req.Flags)
+	if err != nil {
+		f.mu.Unlock()
+		return nil, filesys.deviceError(OpOpen, f, err, 0)
+	}
+	f.opens.opened(filesys.now())
+	if isWriter(req.Flags) {
+		f.writers++
+	}
+	if req.Flags&fuse.OpenTruncate != 0 {
+		// The size cached before the open
+		// no longer describes the device.
+		f.sizes.invalidate()
+	}
+	flags := f.handleFlags()
+	f.mu.Unlock()
+
+	resp.Flags |= flags
+	filesys.opened(header(ctx), f)
 	return f, nil
 }
 
+// handleFlags returns the open response flags for handles of the file.
+// handleFlags must be called with f.mu held.
+func (f *RW) handleFlags() fuse.OpenResponseFlags {
+	flags := f.openFlags | capabilities(f.dev).openFlags()
+	if f.follow.enabled {
+		flags |= fuse.OpenDirectIO
+	}
+	return flags
+}
+
 // Release satisfies the bazil.org/fuse/fs.HandleReleaser interface.
-// If the RW ReadWriter device is an io.Closer, its Close method is called.
-func (f *RW) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+// If the RW ReadWriter device has the Close capability, its Close method is
+// called.
+func (f *RW) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	defer sys(ctx, f).trace(OpRelease, f)(&err)
+
+	done, err := sys(ctx, f).check(ctx, OpRelease, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer f.Sys().released(header(ctx), f)
+
 	f.mu.Lock()
+	f.opens.closed(f.fs.now())
+
+	if isWriter(req.Flags) && f.writers > 0 {
+		f.writers--
+	}
+
+	var werr error
+	if w := f.single.take(req.Handle); w != nil {
+		_, werr = f.write(ctx, w, false)
+		f.mu.Lock()
+	}
+	defer f.fs.enterDevice(f)()
 	defer f.mu.Unlock()
 
-	if c, ok := f.dev.(io.Closer); ok {
-		return c.Close()
+	err = closeDevice(f.dev)
+	if werr != nil {
+		return werr
 	}
-	return nil
+	return fuseError(err)
 }
 
 // Read satisfies the bazil.org/fuse/fs.HandleReader interface.
-func (f *RW) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
+func (f *RW) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer sys(ctx, f).trace(OpRead, f)(&err)
+
+	done, err := sys(ctx, f).check(ctx, OpRead, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+	err = f.await(ctx, req)
+	if err != nil {
+		return err
+	}
 
+	f.mu.Lock()
 	f.atime = f.fs.now()
+	filesys := f.fs
+	_, concurrent := f.dev.(Concurrent)
+	if concurrent {
+		f.mu.Unlock()
+	} else {
+		defer filesys.enterDevice(f)()
+	}
 
-	n, err := f.dev.ReadAt(resp.Data[:req.Size], int64(req.Offset))
+	size := filesys.sysfsReadSize(req.Offset, req.Size)
+	n, err := filesys.deviceRead(ctx, f.dev, resp.Data[:size], int64(req.Offset), req.FileFlags)
+	if concurrent {
+		f.mu.Lock()
+	}
+	f.stats.read(n, err, header(ctx).Uid, f.atime)
+	f.mu.Unlock()
 	resp.Data = resp.Data[:n]
 	if err == io.EOF {
 		return nil
 	}
-	return err
+	return filesys.deviceError(OpRead, f, err, 0)
 }
 
 // Write satisfies the bazil.org/fuse/fs.HandleWriter interface.
-func (f *RW) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+// Unless the file is opened with direct I/O, a successful write made while
+// the file system is being served invalidates the kernel's cached pages of
+// the file so that clients reading through other handles see the new
+// content without needing to reopen the file.
+func (f *RW) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer sys(ctx, f).trace(OpWrite, f)(&err)
+
+	done, err := sys(ctx, f).check(ctx, OpWrite, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+	err = f.Sys().checkQuota(f, req.Offset+int64(len(req.Data)))
+	if err != nil {
+		return err
+	}
+	err = capabilities(f.dev).checkSize(req.Offset + int64(len(req.Data)))
+	if err != nil {
+		return err
+	}
+
 	f.mu.Lock()
-	defer f.mu.Unlock()
+	w, err := f.single.add(req)
+	if w == nil {
+		f.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		// The client write continues
+		// in a following request.
+		resp.Size = len(req.Data)
+		return nil
+	}
+	n, err := f.write(ctx, w, len(w.data) == len(req.Data))
+	if err != nil {
+		return err
+	}
+	// Leading parts of a reassembled write
+	// have already been acknowledged.
+	resp.Size = n - (len(w.data) - len(req.Data))
+	return nil
+}
 
+// write passes the client write w made by the request held in ctx to the
+// device and accounts for it, returning the number of bytes written. If
+// short is true, a write that fails after writing some but not all of the
+// data returns the partial count with a nil error so that the client sees
+// a short write. A failing write reporting the full count is an error.
+// write must be called with f.mu held and returns with it released.
+func (f *RW) write(ctx context.Context, w *pendingWrite, short bool) (int, error) {
 	f.mtime = f.fs.now()
+	filesys := f.fs
+	var (
+		n   int
+		err error
+	)
+	if _, ok := f.dev.(Concurrent); ok {
+		f.mu.Unlock()
+		n, err = filesys.deviceWrite(f.dev, w.data, w.off, w.flags)
+		f.mu.Lock()
+	} else {
+		exit := filesys.enterDevice(f)
+		n, err = filesys.deviceWrite(f.dev, w.data, w.off, w.flags)
+		exit()
+	}
+	if err != nil && n != 0 && n < len(w.data) && short {
+		err = nil
+	}
+	f.sizes.invalidate()
+	f.follow.signal()
+	f.stats.wrote(n, err, header(ctx).Uid, f.mtime)
+	cached := f.handleFlags()&fuse.OpenDirectIO == 0
+	f.mu.Unlock()
 
-	var err error
-	resp.Size, err = f.dev.WriteAt(req.Data, req.Offset)
-	return err
+	if n != 0 {
+		filesys.account(f, w.off+int64(n), false)
+		filesys.recordWrite(ctx, f, w.off, w.data[:n])
+		if cached {
+			filesys.invalidateWritten(f)
+		}
+	}
+	return n, filesys.deviceError(OpWrite, f, err, 0)
 }
 
 // Flush satisfies the bazil.org/fuse/fs.HandleFlusher interface.
-func (f *RW) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
+func (f *RW) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	defer sys(ctx, f).trace(OpFlush, f)(&err)
 
-	type syncer interface {
-		Sync() error
+	done, err := sys(ctx, f).check(ctx, OpFlush, f)
+	if err != nil {
+		return err
 	}
-	if s, ok := f.dev.(syncer); ok {
-		return s.Sync()
+	defer done()
+
+	f.mu.Lock()
+	if w := f.single.take(req.Handle); w != nil {
+		_, err = f.write(ctx, w, false)
+		if err != nil {
+			return err
+		}
+		f.mu.Lock()
 	}
-	return nil
+	defer f.fs.enterDevice(f)()
+	defer f.mu.Unlock()
+
+	return fuseError(syncDevice(f.dev))
 }
 
 // Setattr satisfies the bazil.org/fuse/fs.NodeSetattrer interface.
-func (f *RW) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+func (f *RW) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer sys(ctx, f).trace(OpSetattr, f)(&err)
+
+	done, err := sys(ctx, f).check(ctx, OpSetattr, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if req.Valid&fuse.SetattrSize != 0 {
+		err = f.Sys().checkQuota(f, int64(req.Size))
+		if err != nil {
+			return err
+		}
+		err = capabilities(f.dev).checkSize(int64(req.Size))
+		if err != nil {
+			return err
+		}
+	}
+
+	truncated := int64(-1)
+	defer func() {
+		if truncated >= 0 {
+			f.Sys().account(f, truncated, true)
+		}
+	}()
+
 	f.mu.Lock()
+	defer f.fs.enterDevice(f)()
 	defer f.mu.Unlock()
 
-	if req.Valid&fuse.SetattrSize != 0 {
+	switch {
+	case req.Valid&fuse.SetattrSize == 0:
+		// No size change requested.
+	case f.fs.strictSysfs():
+		// Truncation of sysfs attributes
+		// has no effect.
+		resp.Attr.Size = sysfsSize
+	default:
+		f.sizes.invalidate()
+		f.follow.signal()
 		err := f.dev.Truncate(int64(req.Size))
 		if err != nil {
-			return err
+			return fuseError(err)
 		}
 		size, err := f.dev.Size()
 		if err != nil {
-			return err
+			return fuseError(err)
 		}
+		f.sizes.set(size)
+		truncated = size
 		resp.Attr.Size = uint64(size)
 	}
 	setAttr(&f.attr, resp, req)
 
 	return nil
 }
+
+// Getxattr satisfies the bazil.org/fuse/fs.NodeGetxattrer interface.
+func (f *RW) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	defer sys(ctx, f).trace(OpGetxattr, f)(&err)
+
+	done, err := sys(ctx, f).check(ctx, OpGetxattr, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return f.Sys().getxattr(req, resp)
+}
+
+// Listxattr satisfies the bazil.org/fuse/fs.NodeListxattrer interface.
+func (f *RW) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	defer sys(ctx, f).trace(OpListxattr, f)(&err)
+
+	done, err := sys(ctx, f).check(ctx, OpListxattr, f)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return f.Sys().listxattr(req, resp)
+}
@@ -0,0 +1,202 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// selfTestName is the name of the probe node bound in the root of a file
+// system during a self-test.
+const selfTestName = ".sisyphus-selftest"
+
+// SelfTestReport holds the time taken by each step of a self-test.
+type SelfTestReport struct {
+	Open  time.Duration
+	Write time.Duration
+	Read  time.Duration
+	Stat  time.Duration
+	Close time.Duration
+}
+
+// Total returns the total time taken by the self-test.
+func (r SelfTestReport) Total() time.Duration {
+	return r.Open + r.Write + r.Read + r.Stat + r.Close
+}
+
+// SelfTest verifies that the mount of a served file system is serviceable
+// by opening, writing, reading back and stating a probe file through the
+// kernel, and reports the time taken by each step. The probe is a read
+// write file named .sisyphus-selftest that is bound in the root of the
+// file system for the duration of the test without generating events. An
+// error is returned if a step fails, the data read back does not match the
+// data written, or ctx is done before the test completes, in which case a
+// hung mount may leave the probing goroutine blocked in the kernel. The
+// probe is not subject to the name policy, access policy, read only mode,
+// freezes, quotas or other checks applying to the file system's nodes.
+//
+// SelfTest is also available through the io.Closer returned by Serve, which
+// implements
+//
+//	interface{ SelfTest(context.Context) (SelfTestReport, error) }
+func (fs *FileSystem) SelfTest(ctx context.Context) (SelfTestReport, error) {
+	fs.mu.Lock()
+	server := fs.server
+	fs.mu.Unlock()
+	if server == nil {
+		return SelfTestReport{}, fmt.Errorf("sisyphus: self-test: %w", syscall.ENOTCONN)
+	}
+	return server.SelfTest(ctx)
+}
+
+// SelfTest performs a self-test of the mount as described for the
+// FileSystem SelfTest method.
+func (s *server) SelfTest(ctx context.Context) (_ SelfTestReport, err error) {
+	probe, err := NewRWFlags(selfTestName, 0666, fuse.OpenDirectIO, NewBytes(nil))
+	if err != nil {
+		return SelfTestReport{}, err
+	}
+	probe.Own(uint32(os.Getuid()), uint32(os.Getgid()))
+
+	filesys := s.filesys
+	err = filesys.bindProbe(probe)
+	if err != nil {
+		return SelfTestReport{}, fmt.Errorf("sisyphus: self-test: %w", err)
+	}
+	defer func() {
+		filesys.unbindProbe(probe)
+		ierr := s.fuse.InvalidateEntry(filesys.root, selfTestName)
+		if ierr != nil && ierr != fuse.ErrNotCached && err == nil {
+			err = fmt.Errorf("sisyphus: self-test: %w", ierr)
+		}
+	}()
+
+	type result struct {
+		report SelfTestReport
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		r, err := probeMount(filepath.Join(s.mnt, selfTestName))
+		done <- result{report: r, err: err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.report, fmt.Errorf("sisyphus: self-test: %w", r.err)
+		}
+		return r.report, nil
+	case <-ctx.Done():
+		return SelfTestReport{}, fmt.Errorf("sisyphus: self-test: %w", ctx.Err())
+	}
+}
+
+// bindProbe binds the self-test probe p in the root of the file system
+// without checking its name against the name policy, and exempts it from
+// the checks made on operations.
+func (fs *FileSystem) bindProbe(p *RW) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.probe != nil {
+		return conflictError("/", p.Name())
+	}
+	d := fs.root
+	d.mu.Lock()
+	if _, exists := d.files[p.Name()]; exists {
+		d.mu.Unlock()
+		return conflictError("/", p.Name())
+	}
+	d.files[p.Name()] = p
+	d.mu.Unlock()
+	fs.sync(d)
+	fs.probe = p
+	return nil
+}
+
+// unbindProbe unbinds the self-test probe p.
+func (fs *FileSystem) unbindProbe(p *RW) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d := fs.root
+	d.mu.Lock()
+	if d.files[p.Name()] == p {
+		fs.detach(d, p)
+	}
+	d.mu.Unlock()
+	fs.probe = nil
+}
+
+// isProbe returns whether n, or its child named name if name is not
+// empty, is the bound self-test probe.
+func (fs *FileSystem) isProbe(n Node, name string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.probe == nil {
+		return false
+	}
+	if name != "" {
+		return n == fs.root && name == fs.probe.Name()
+	}
+	return n == fs.probe
+}
+
+// probeMount performs the steps of a self-test on the probe file at path.
+func probeMount(path string) (SelfTestReport, error) {
+	var r SelfTestReport
+	token := []byte(fmt.Sprintf("sisyphus self-test %d\n", time.Now().UnixNano()))
+
+	start := time.Now()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	r.Open = time.Since(start)
+	if err != nil {
+		return r, err
+	}
+
+	start = time.Now()
+	_, err = f.WriteAt(token, 0)
+	r.Write = time.Since(start)
+	if err != nil {
+		f.Close()
+		return r, err
+	}
+
+	buf := make([]byte, len(token))
+	start = time.Now()
+	_, err = f.ReadAt(buf, 0)
+	r.Read = time.Since(start)
+	if err != nil {
+		f.Close()
+		return r, err
+	}
+	if !bytes.Equal(buf, token) {
+		f.Close()
+		return r, fmt.Errorf("read %q after writing %q", buf, token)
+	}
+
+	start = time.Now()
+	fi, err := f.Stat()
+	r.Stat = time.Since(start)
+	if err != nil {
+		f.Close()
+		return r, err
+	}
+	if fi.Size() != int64(len(token)) {
+		f.Close()
+		return r, fmt.Errorf("size %d after writing %d bytes", fi.Size(), len(token))
+	}
+
+	start = time.Now()
+	err = f.Close()
+	r.Close = time.Since(start)
+	return r, err
+}
@@ -0,0 +1,258 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Session describes a client process of a served FileSystem, identified
+// by the process ID in the headers of its FUSE requests.
+type Session struct {
+	// Pid, Uid and Gid identify the
+	// client process.
+	Pid uint32
+	Uid uint32
+	Gid uint32
+
+	// FirstSeen and LastSeen are the
+	// times of the first and most recent
+	// requests made by the client.
+	FirstSeen time.Time
+	LastSeen  time.Time
+
+	// Requests is the number of requests
+	// made by the client.
+	Requests int64
+
+	// Open holds the number of open
+	// handles held by the client keyed
+	// by the absolute path of the node.
+	Open map[string]int
+}
+
+const (
+	// sessionIdle is the time after
+	// which a session holding no open
+	// handles ends if its process makes
+	// no further requests.
+	sessionIdle = time.Minute
+
+	// maxSessions is the number of
+	// sessions beyond which the least
+	// recently seen session holding no
+	// open handles ends.
+	maxSessions = 1024
+)
+
+// sessions tracks the client processes of a served FileSystem.
+type sessions struct {
+	mu    sync.Mutex
+	byPid map[uint32]*session
+}
+
+// session is the internal state of a Session.
+type session struct {
+	Session
+	opens map[Node]int
+	total int
+}
+
+// Sessions returns the client sessions of the file system ordered by
+// process ID. A session starts with the first request made by a process
+// and ends when the last handle opened by the process is released.
+// A session holding no open handles also ends when its process has made no
+// requests for a minute, or when it is the least recently seen of such
+// sessions and the number of sessions exceeds an internal limit. Requests
+// made by the kernel on its own behalf, which have a zero process ID, are
+// not attributed to a session.
+//
+// The process ID reported by the kernel for a request is the ID of the
+// thread making it, so the threads of a multithreaded client appear as
+// separate sessions.
+//
+// The kernel does not reliably report the process releasing a handle, so
+// a release is attributed to the releasing process if it holds a handle
+// on the node, and otherwise to the earliest seen session holding one.
+func (fs *FileSystem) Sessions() []Session {
+	fs.sessions.mu.Lock()
+	expired := fs.sessions.expire(fs.now(), 0)
+	list := make([]*session, 0, len(fs.sessions.byPid))
+	for _, s := range fs.sessions.byPid {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Pid < list[j].Pid })
+	out := make([]Session, len(list))
+	opens := make([]map[Node]int, len(list))
+	for i, s := range list {
+		out[i] = s.Session
+		opens[i] = make(map[Node]int, len(s.opens))
+		for n, c := range s.opens {
+			opens[i][n] = c
+		}
+	}
+	fs.sessions.mu.Unlock()
+	fs.ended(expired)
+
+	for i := range out {
+		out[i].Open = make(map[string]int, len(opens[i]))
+		for n, c := range opens[i] {
+			out[i].Open[fs.path(n)] += c
+		}
+	}
+	return out
+}
+
+// seen records a request with the header hdr, calling the SessionStart
+// hook if it is the first request of the process.
+func (fs *FileSystem) seen(hdr *fuse.Header) {
+	if hdr.Pid == 0 {
+		return
+	}
+	now := fs.now()
+	fs.sessions.mu.Lock()
+	s, ok := fs.sessions.byPid[hdr.Pid]
+	if !ok {
+		if fs.sessions.byPid == nil {
+			fs.sessions.byPid = make(map[uint32]*session)
+		}
+		s = &session{
+			Session: Session{Pid: hdr.Pid, Uid: hdr.Uid, Gid: hdr.Gid, FirstSeen: now},
+			opens:   make(map[Node]int),
+		}
+		fs.sessions.byPid[hdr.Pid] = s
+	}
+	s.LastSeen = now
+	s.Requests++
+	start := s.Session
+	var expired []Session
+	if !ok {
+		expired = fs.sessions.expire(now, hdr.Pid)
+	}
+	fs.sessions.mu.Unlock()
+
+	fs.ended(expired)
+	if !ok {
+		fs.mu.Lock()
+		hook := fs.hooks.SessionStart
+		fs.mu.Unlock()
+		if hook != nil {
+			hook(start)
+		}
+	}
+}
+
+// opened records the opening of n by the process making the request with
+// the header hdr. It must not be called with a node's lock held.
+func (fs *FileSystem) opened(hdr fuse.Header, n Node) {
+	if fs == nil || hdr.Pid == 0 {
+		return
+	}
+	fs.sessions.mu.Lock()
+	_, ok := fs.sessions.byPid[hdr.Pid]
+	fs.sessions.mu.Unlock()
+	if !ok {
+		fs.seen(&hdr)
+	}
+	fs.sessions.mu.Lock()
+	if s, ok := fs.sessions.byPid[hdr.Pid]; ok {
+		s.opens[n]++
+		s.total++
+	}
+	fs.sessions.mu.Unlock()
+}
+
+// released records the release of a handle on n by the request with the
+// header hdr, calling the SessionEnd hook if the session holding the
+// handle has no remaining open handles. It must not be called with a
+// node's lock held.
+func (fs *FileSystem) released(hdr fuse.Header, n Node) {
+	if fs == nil {
+		return
+	}
+	fs.sessions.mu.Lock()
+	s, ok := fs.sessions.byPid[hdr.Pid]
+	if !ok || s.opens[n] == 0 {
+		s = nil
+		for _, c := range fs.sessions.byPid {
+			if c.opens[n] != 0 && (s == nil || c.FirstSeen.Before(s.FirstSeen) || (c.FirstSeen.Equal(s.FirstSeen) && c.Pid < s.Pid)) {
+				s = c
+			}
+		}
+	}
+	if s == nil {
+		fs.sessions.mu.Unlock()
+		return
+	}
+	s.opens[n]--
+	if s.opens[n] == 0 {
+		delete(s.opens, n)
+	}
+	s.total--
+	ended := s.total == 0
+	var end []Session
+	if ended {
+		delete(fs.sessions.byPid, s.Pid)
+		end = []Session{s.Session}
+	}
+	fs.sessions.mu.Unlock()
+
+	fs.ended(end)
+}
+
+// expire removes the sessions holding no open handles that have been idle
+// for sessionIdle at now, and the least recently seen of the remaining
+// such sessions while there are more than maxSessions sessions, returning
+// the removed sessions. The session of the process keep is not removed.
+// expire must be called with s.mu held.
+func (s *sessions) expire(now time.Time, keep uint32) []Session {
+	var (
+		expired []Session
+		idle    []*session
+	)
+	for pid, c := range s.byPid {
+		if c.total != 0 || pid == keep {
+			continue
+		}
+		if now.Sub(c.LastSeen) >= sessionIdle {
+			delete(s.byPid, pid)
+			expired = append(expired, c.Session)
+			continue
+		}
+		idle = append(idle, c)
+	}
+	if len(s.byPid) <= maxSessions {
+		return expired
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].LastSeen.Before(idle[j].LastSeen) })
+	for _, c := range idle {
+		if len(s.byPid) <= maxSessions {
+			break
+		}
+		delete(s.byPid, c.Pid)
+		expired = append(expired, c.Session)
+	}
+	return expired
+}
+
+// ended calls the SessionEnd hook for each of the sessions in end.
+func (fs *FileSystem) ended(end []Session) {
+	if len(end) == 0 {
+		return
+	}
+	fs.mu.Lock()
+	hook := fs.hooks.SessionEnd
+	fs.mu.Unlock()
+	if hook == nil {
+		return
+	}
+	for _, s := range end {
+		hook(s)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"runtime"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// maxWrite is the maximum size of a write request negotiated with the
+// kernel by the FUSE library in use. The kernel splits larger client
+// writes into requests of this size. The value mirrors the one set by the
+// library, which does not export it, and must be kept in step with it.
+//
+// The requests holding the leading parts of a reassembled client write
+// are acknowledged as written before the device is called, since the
+// kernel only sends the following parts once they are answered. If the
+// device fails the write, the failure is returned for the final request,
+// or for the flush or release passing the write to the device, but the
+// client has already been told that the leading parts were written.
+var maxWrite = func() int {
+	if runtime.GOOS == "darwin" {
+		return 16 << 20
+	}
+	return 128 << 10
+}()
+
+// assembler reassembles client writes to single value nodes that have
+// been split by the kernel into multiple write requests. An assembler is
+// protected by the lock of the node holding it.
+type assembler struct {
+	enabled bool
+	pending map[fuse.HandleID]*pendingWrite
+}
+
+// pendingWrite is a partially received client write.
+type pendingWrite struct {
+	off   int64
+	data  []byte
+	flags fuse.OpenFlags
+}
+
+// setEnabled sets whether writes are reassembled, discarding any pending
+// writes.
+func (a *assembler) setEnabled(enabled bool) {
+	*a = assembler{enabled: enabled}
+}
+
+// add adds the write request req. It returns the client write to be
+// passed to the device if the write is complete, or nil if req is a full
+// sized request that may be followed by the remainder of the client write.
+// A request that does not continue the pending write of its handle
+// discards the pending write and returns EINVAL.
+func (a *assembler) add(req *fuse.WriteRequest) (*pendingWrite, error) {
+	if !a.enabled {
+		return &pendingWrite{off: req.Offset, data: req.Data, flags: req.FileFlags}, nil
+	}
+	p := a.pending[req.Handle]
+	if p != nil && req.Offset != p.off+int64(len(p.data)) {
+		delete(a.pending, req.Handle)
+		return nil, syscall.EINVAL
+	}
+	if p == nil {
+		p = &pendingWrite{off: req.Offset, flags: req.FileFlags}
+	}
+	p.data = append(p.data, req.Data...)
+	if len(req.Data) >= maxWrite {
+		if a.pending == nil {
+			a.pending = make(map[fuse.HandleID]*pendingWrite)
+		}
+		a.pending[req.Handle] = p
+		return nil, nil
+	}
+	delete(a.pending, req.Handle)
+	return p, nil
+}
+
+// end returns the end offset of the pending write of the handle h and
+// whether there is one.
+func (a *assembler) end(h fuse.HandleID) (int64, bool) {
+	p := a.pending[h]
+	if p == nil {
+		return 0, false
+	}
+	return p.off + int64(len(p.data)), true
+}
+
+// take removes and returns the pending write of the handle h, if any.
+func (a *assembler) take(h fuse.HandleID) *pendingWrite {
+	p := a.pending[h]
+	delete(a.pending, h)
+	return p
+}
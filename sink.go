@@ -0,0 +1,64 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"io"
+	"sync"
+	"syscall"
+)
+
+// SinkWriter is a Writer that forwards sequential writes to an io.Writer
+// without buffering, allowing clients to stream large payloads such as
+// firmware images through a node. Each write must start at the offset
+// following the previous write; writes at other offsets fail with ESPIPE.
+// Truncating the SinkWriter to zero, for example by opening its node with
+// O_TRUNC, starts a new stream at offset zero. The bytes of earlier
+// streams are not retracted from the io.Writer.
+type SinkWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	off int64
+}
+
+// NewSinkWriter returns a new SinkWriter writing to w.
+func NewSinkWriter(w io.Writer) *SinkWriter {
+	return &SinkWriter{w: w}
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (s *SinkWriter) WriteAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off != s.off {
+		return 0, syscall.ESPIPE
+	}
+	n, err := s.w.Write(b)
+	s.off += int64(n)
+	return n, err
+}
+
+// Truncate starts a new stream if size is zero. Truncating to the current
+// stream length has no effect. Other sizes return EINVAL.
+func (s *SinkWriter) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch size {
+	case 0:
+		s.off = 0
+	case s.off:
+	default:
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// Size returns the number of bytes written in the current stream and a
+// nil error.
+func (s *SinkWriter) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.off, nil
+}
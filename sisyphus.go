@@ -6,10 +6,13 @@
 package sisyphus
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,14 +21,21 @@ import (
 )
 
 // ErrBadName is returned when a new Node is created with a base name
-// that contains a filepath separator.
-var ErrBadName = errors.New("sisyphus: base contains filepath separator")
+// that is empty, is "." or "..", contains a filepath separator or NUL
+// byte, or is longer than MaxNameLen bytes.
+var ErrBadName = errors.New("sisyphus: invalid base name")
+
+// ErrNilDevice is returned when a new file Node is created with a nil
+// device.
+var ErrNilDevice = errors.New("sisyphus: nil device")
 
 // server is a FUSE server for a FileSystem.
 type server struct {
-	mnt  string
-	fuse *fs.Server
-	conn *fuse.Conn
+	mnt     string
+	fuse    *fs.Server
+	conn    *fuse.Conn
+	filesys *FileSystem
+	runner  *Runner
 
 	mu  sync.Mutex
 	err error
@@ -33,14 +43,17 @@ type server struct {
 
 // Serve starts a server for filesys mounted at the specified mount point.
 // It is the responsibility of the caller to close the returned io.Closer
-// when the server is no longer required.
+// when the server is no longer required. The file system's Runner is
+// started once the file system is mounted and stopped when the returned
+// io.Closer is closed. The returned io.Closer also has a SelfTest method
+// as described for the FileSystem SelfTest method.
 func Serve(mnt string, filesys *FileSystem, config *fs.Config, mntopts ...fuse.MountOption) (io.Closer, error) {
 	c, err := fuse.Mount(mnt, mntopts...)
 	if err != nil {
 		return nil, err
 	}
 
-	s := &server{mnt: mnt, fuse: fs.New(c, config), conn: c}
+	s := &server{mnt: mnt, fuse: fs.New(c, filesys.withRequest(config)), conn: c, filesys: filesys, runner: &filesys.runner}
 	filesys.server = s
 
 	go func() {
@@ -55,11 +68,13 @@ func Serve(mnt string, filesys *FileSystem, config *fs.Config, mntopts ...fuse.M
 	if s.conn.MountError != nil {
 		return nil, s.conn.MountError
 	}
+	s.runner.Start()
 	return s, nil
 }
 
-// Close closes the server.
+// Close closes the server, stopping the file system's Runner.
 func (s *server) Close() error {
+	s.runner.Stop()
 	defer s.conn.Close()
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -69,7 +84,119 @@ func (s *server) Close() error {
 	return fuse.Unmount(s.mnt)
 }
 
-// Bytes is a ReadWriter backed by a byte slice.
+// Concurrent is implemented by devices that are safe for concurrent use.
+// Nodes do not serialise ReadAt and WriteAt calls to a Concurrent device,
+// so a blocking read does not prevent writes from proceeding.
+type Concurrent interface {
+	Concurrent()
+}
+
+// Opener is implemented by devices that establish resources when their
+// node is opened. When a node's device is an Opener, its Open method is
+// called with the open flags of each open of the node before the open
+// succeeds, and an error returned by Open fails the open. A device that
+// is an Opener will usually also be an io.Closer, releasing resources
+// when the node is released.
+type Opener interface {
+	Open(ctx context.Context, flags fuse.OpenFlags) error
+}
+
+// openDevice calls the Open method of dev if it is an Opener. openDevice
+// must be called with the lock of n, the node holding dev, held.
+func (fs *FileSystem) openDevice(ctx context.Context, n Node, dev interface{}, flags fuse.OpenFlags) error {
+	o, ok := dev.(Opener)
+	if !ok {
+		return nil
+	}
+	defer fs.enterDevice(n)()
+	return o.Open(ctx, flags)
+}
+
+// FlagReaderAt is implemented by devices that take the open flags of the
+// reading file handle into account. When a node's device is a FlagReaderAt,
+// reads made through the file system call ReadAtFlags in place of ReadAt,
+// so that stream devices may return EAGAIN rather than block for clients
+// that opened the file with O_NONBLOCK.
+type FlagReaderAt interface {
+	ReadAtFlags(b []byte, off int64, flags fuse.OpenFlags) (int, error)
+}
+
+// FlagWriterAt is implemented by devices that take the open flags of the
+// writing file handle, such as O_NONBLOCK, O_SYNC and O_APPEND, into
+// account. When a node's device is a FlagWriterAt, writes made through the
+// file system call WriteAtFlags in place of WriteAt.
+type FlagWriterAt interface {
+	WriteAtFlags(b []byte, off int64, flags fuse.OpenFlags) (int, error)
+}
+
+// ReadAller is implemented by devices that produce their content in a
+// single call, such as devices generating their content on demand. When a
+// node's device is a ReadAller, reads made through the file system at
+// offset zero call ReadAll in place of ReadAt. If the content fits in the
+// read, it is produced once rather than for each chunk of the read; any
+// content beyond the read is obtained from ReadAt by later reads. The
+// returned slice is not modified or retained by the file system.
+type ReadAller interface {
+	ReadAll() ([]byte, error)
+}
+
+// readAllInto reads the content of dev into b using its ReadAll method.
+// It returns io.EOF with the read if all of the content fits in b.
+func readAllInto(dev ReadAller, b []byte) (int, error) {
+	data, err := dev.ReadAll()
+	if err != nil {
+		return 0, err
+	}
+	n := copy(b, data)
+	if n == len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// contextReaderAt is implemented by devices whose reads may wait
+// indefinitely, so that the wait ends when the request is interrupted.
+type contextReaderAt interface {
+	readAtContext(ctx context.Context, b []byte, off int64, flags fuse.OpenFlags) (int, error)
+}
+
+// readAtFlags reads from dev into b at off, passing flags to dev if it is
+// a FlagReaderAt and ctx to dev if it is a contextReaderAt. Reads at offset
+// zero from a ReadAller use ReadAll.
+func readAtFlags(ctx context.Context, dev io.ReaderAt, b []byte, off int64, flags fuse.OpenFlags) (int, error) {
+	if r, ok := dev.(contextReaderAt); ok {
+		return r.readAtContext(ctx, b, off, flags)
+	}
+	if r, ok := dev.(ReadAller); ok && off == 0 && len(b) != 0 {
+		return readAllInto(r, b)
+	}
+	if f, ok := dev.(FlagReaderAt); ok {
+		return f.ReadAtFlags(b, off, flags)
+	}
+	return dev.ReadAt(b, off)
+}
+
+// flagWriter is an io.WriterAt passing open flags to a FlagWriterAt.
+type flagWriter struct {
+	dev   FlagWriterAt
+	flags fuse.OpenFlags
+}
+
+func (w flagWriter) WriteAt(b []byte, off int64) (int, error) {
+	return w.dev.WriteAtFlags(b, off, w.flags)
+}
+
+// withFlags returns an io.WriterAt writing to dev, passing flags to dev if
+// it is a FlagWriterAt.
+func withFlags(dev io.WriterAt, flags fuse.OpenFlags) io.WriterAt {
+	if f, ok := dev.(FlagWriterAt); ok {
+		return flagWriter{dev: f, flags: flags}
+	}
+	return dev
+}
+
+// Bytes is a ReadWriter backed by a byte slice. The zero
+// value of Bytes is an empty buffer ready to use.
 type Bytes []byte
 
 // NewBytes returns a new Bytes backed by the provided data.
@@ -78,8 +205,12 @@ func NewBytes(data []byte) *Bytes {
 	return &b
 }
 
-// ReadAt satisfies the io.ReaderAt interface.
+// ReadAt satisfies the io.ReaderAt interface. It returns io.EOF
+// with any read that reaches the end of the data.
 func (f *Bytes) ReadAt(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
 	if len(b) == 0 {
 		return 0, nil
 	}
@@ -87,17 +218,31 @@ func (f *Bytes) ReadAt(b []byte, offset int64) (int, error) {
 		return 0, io.EOF
 	}
 	n := copy(b, (*f)[offset:])
-	if n <= len(b) {
+	if offset+int64(n) == int64(len(*f)) {
 		return n, io.EOF
 	}
 	return n, nil
 }
 
 // Truncate truncates the Bytes at n bytes from the beginning of the slice.
+// Truncation beyond the current length extends the data with zeros.
 func (f *Bytes) Truncate(n int64) error {
-	if n < 0 || n > int64(len(*f)) {
+	if n < 0 {
 		return syscall.EINVAL
 	}
+	if l := int64(len(*f)); n > l {
+		if n > int64(cap(*f)) {
+			t := make([]byte, n)
+			copy(t, *f)
+			*f = t
+			return nil
+		}
+		*f = (*f)[:n]
+		for i := l; i < n; i++ {
+			(*f)[i] = 0
+		}
+		return nil
+	}
 	tail := (*f)[n:cap(*f)]
 	for i := range tail {
 		tail[i] = 0
@@ -106,21 +251,68 @@ func (f *Bytes) Truncate(n int64) error {
 	return nil
 }
 
-// WriteAt satisfies the io.WriterAt interface.
+// WriteAt satisfies the io.WriterAt interface. Data within the
+// written range is overwritten and data beyond it is retained. Writes
+// beyond the end of the data extend it, filling any gap with zeros. To
+// replace the data, truncate it before writing.
 func (f *Bytes) WriteAt(b []byte, off int64) (int, error) {
-	if off >= int64(cap(*f)) {
-		t := make([]byte, off+int64(len(b)))
-		copy(t, *f)
-		*f = t
+	if off < 0 {
+		return 0, syscall.EINVAL
 	}
-	*f = (*f)[:off]
-	*f = append(*f, b...)
+	end := off + int64(len(b))
+	if n := int64(len(*f)); end > n {
+		if end > int64(cap(*f)) {
+			t := make([]byte, end)
+			copy(t, *f)
+			*f = t
+		} else {
+			*f = (*f)[:end]
+			for i := n; i < off; i++ {
+				(*f)[i] = 0
+			}
+		}
+	}
+	copy((*f)[off:], b)
 	return len(b), nil
 }
 
 // Size returns the length of the backing data and a nil error.
 func (f *Bytes) Size() (int64, error) { return int64(len(*f)), nil }
 
+// BoundedBytes is a ReadWriter backed by a byte slice with a maximum size.
+type BoundedBytes struct {
+	Bytes
+	max int64
+}
+
+// NewBoundedBytes returns a new BoundedBytes backed by the provided data
+// that may hold at most max bytes. NewBoundedBytes returns an error if
+// data is longer than max.
+func NewBoundedBytes(data []byte, max int64) (*BoundedBytes, error) {
+	if int64(len(data)) > max {
+		return nil, syscall.ENOSPC
+	}
+	return &BoundedBytes{Bytes: Bytes(data), max: max}, nil
+}
+
+// WriteAt satisfies the io.WriterAt interface. Writes that would extend
+// the data beyond the maximum size return ENOSPC.
+func (f *BoundedBytes) WriteAt(b []byte, off int64) (int, error) {
+	if off+int64(len(b)) > f.max {
+		return 0, syscall.ENOSPC
+	}
+	return f.Bytes.WriteAt(b, off)
+}
+
+// Truncate truncates the BoundedBytes at n bytes from the beginning of
+// the slice. Truncation beyond the maximum size returns ENOSPC.
+func (f *BoundedBytes) Truncate(n int64) error {
+	if n > f.max {
+		return syscall.ENOSPC
+	}
+	return f.Bytes.Truncate(n)
+}
+
 // Func is a Writer backed by a user defined function.
 type Func func([]byte, int64) (int, error)
 
@@ -138,10 +330,75 @@ func (f Func) Truncate(_ int64) error { return nil }
 // Size returns zero and a nil error.
 func (f Func) Size() (int64, error) { return 0, nil }
 
+// WithSize returns a Writer that calls f for writes and reports size as
+// its size. This allows nodes backed by a Func to report a nominal size,
+// such as the 4096 bytes reported for sysfs attributes.
+func (f Func) WithSize(size int64) Writer {
+	return sizedFunc{Func: f, size: size}
+}
+
+// sizedFunc is a Func with a nominal size.
+type sizedFunc struct {
+	Func
+	size int64
+}
+
+// Size returns the nominal size and a nil error.
+func (f sizedFunc) Size() (int64, error) { return f.size, nil }
+
+// TrimNewline returns a Func that calls f with any single trailing newline
+// removed from the written data. If f consumes all of the trimmed data, the
+// full length of the written data including the newline is reported.
+func (f Func) TrimNewline() Func {
+	if f == nil {
+		return nil
+	}
+	return func(b []byte, off int64) (int, error) {
+		t := bytes.TrimSuffix(b, []byte{'\n'})
+		n, err := f(t, off)
+		if n == len(t) {
+			n = len(b)
+		}
+		return n, err
+	}
+}
+
+// ReadFunc is a Reader backed by a user defined function. It is useful for
+// computed read only values. Since RO nodes are opened for direct I/O, the
+// function is called for reads even though the size is reported as zero.
+type ReadFunc func([]byte, int64) (int, error)
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (f ReadFunc) ReadAt(b []byte, off int64) (int, error) {
+	if f == nil {
+		return 0, syscall.EBADFD
+	}
+	return f(b, off)
+}
+
+// Size returns zero and a nil error.
+func (f ReadFunc) Size() (int64, error) { return 0, nil }
+
+// WithSize returns a Reader that calls f for reads and reports size as
+// its size.
+func (f ReadFunc) WithSize(size int64) Reader {
+	return sizedReadFunc{ReadFunc: f, size: size}
+}
+
+// sizedReadFunc is a ReadFunc with a nominal size.
+type sizedReadFunc struct {
+	ReadFunc
+	size int64
+}
+
+// Size returns the nominal size and a nil error.
+func (f sizedReadFunc) Size() (int64, error) { return f.size, nil }
+
 // String is a Reader backed by a string.
 type String string
 
-// ReadAt satisfies the io.ReaderAt interface.
+// ReadAt satisfies the io.ReaderAt interface. It returns io.EOF
+// with any read that reaches the end of the string.
 func (s String) ReadAt(b []byte, off int64) (int, error) {
 	if off < 0 {
 		return 0, syscall.EINVAL
@@ -150,7 +407,7 @@ func (s String) ReadAt(b []byte, off int64) (int, error) {
 		return 0, io.EOF
 	}
 	n := copy(b, s[off:])
-	if n <= len(b) {
+	if off+int64(n) == int64(len(s)) {
 		return n, io.EOF
 	}
 	return n, nil
@@ -159,6 +416,185 @@ func (s String) ReadAt(b []byte, off int64) (int, error) {
 // Size returns the length of the backing string and a nil error.
 func (s String) Size() (int64, error) { return int64(len(s)), nil }
 
+// readAt implements io.ReaderAt semantics over data.
+func readAt(data, b []byte, off int64) (int, error) {
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// writeAt writes b to dev at off, resubmitting the remainder after a
+// short write with a nil error. If an error is returned after some data
+// has been written, the partial count is returned with the error.
+func writeAt(dev io.WriterAt, b []byte, off int64) (int, error) {
+	var n int
+	for n < len(b) {
+		m, err := dev.WriteAt(b[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// readAll returns the complete content of r, reading from offset
+// zero until a short read returns io.EOF, or using ReadAll if r is a
+// ReadAller.
+func readAll(r io.ReaderAt) ([]byte, error) {
+	if ra, ok := r.(ReadAller); ok {
+		data, err := ra.ReadAll()
+		return append([]byte(nil), data...), err
+	}
+	var (
+		data []byte
+		buf  = make([]byte, 4096)
+		off  int64
+	)
+	for {
+		n, err := r.ReadAt(buf, off)
+		data = append(data, buf[:n]...)
+		off += int64(n)
+		// Devices may return io.EOF with a
+		// full read that reaches the end of
+		// their data, so only stop on a short
+		// read at io.EOF.
+		if err == io.EOF && n < len(buf) {
+			return data, nil
+		}
+		if err != nil && err != io.EOF {
+			return data, err
+		}
+		if n == 0 {
+			return data, io.ErrNoProgress
+		}
+	}
+}
+
+// MutableString is a Reader backed by a string that may be updated
+// atomically from Go code. The zero value of MutableString holds the
+// empty string.
+type MutableString struct {
+	v atomic.Value
+}
+
+// NewMutableString returns a new MutableString holding s.
+func NewMutableString(s string) *MutableString {
+	var m MutableString
+	m.Store(s)
+	return &m
+}
+
+// Store sets the string held by m.
+func (m *MutableString) Store(s string) { m.v.Store(s) }
+
+// Load returns the string held by m.
+func (m *MutableString) Load() string {
+	s, _ := m.v.Load().(string)
+	return s
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (m *MutableString) ReadAt(b []byte, off int64) (int, error) {
+	return String(m.Load()).ReadAt(b, off)
+}
+
+// Size returns the length of the string held by m and a nil error.
+func (m *MutableString) Size() (int64, error) { return int64(len(m.Load())), nil }
+
+// OpenStats holds the open accounting of a file node.
+type OpenStats struct {
+	// Open is the number of currently
+	// open handles.
+	Open int
+
+	// Opens and Closes are the total
+	// number of opens and releases.
+	Opens  int
+	Closes int
+
+	// LastOpen and LastClose are the
+	// times of the most recent open
+	// and release.
+	LastOpen  time.Time
+	LastClose time.Time
+}
+
+func (s *OpenStats) opened(now time.Time) {
+	s.Open++
+	s.Opens++
+	s.LastOpen = now
+}
+
+func (s *OpenStats) closed(now time.Time) {
+	if s.Open > 0 {
+		s.Open--
+	}
+	s.Closes++
+	s.LastClose = now
+}
+
+// NodeStats holds I/O accounting for a file node.
+type NodeStats struct {
+	// Reads and Writes are the total
+	// number of read and write requests.
+	Reads  int
+	Writes int
+
+	// BytesRead and BytesWritten are
+	// the total number of bytes read
+	// and written.
+	BytesRead    int64
+	BytesWritten int64
+
+	// LastError is the most recent
+	// error returned by the node's
+	// device for a read or write.
+	LastError error
+
+	// LastUid and LastAccess are the
+	// uid of the process making the
+	// most recent read or write and
+	// the time it was made.
+	LastUid    uint32
+	LastAccess time.Time
+}
+
+func (s *NodeStats) read(n int, err error, uid uint32, now time.Time) {
+	s.Reads++
+	s.BytesRead += int64(n)
+	if err != nil && err != io.EOF {
+		s.LastError = err
+	}
+	s.LastUid = uid
+	s.LastAccess = now
+}
+
+func (s *NodeStats) wrote(n int, err error, uid uint32, now time.Time) {
+	s.Writes++
+	s.BytesWritten += int64(n)
+	if err != nil {
+		s.LastError = err
+	}
+	s.LastUid = uid
+	s.LastAccess = now
+}
+
+// AttrFunc is a function that adjusts the attributes reported for a node.
+// It is called with the attributes filled in by the node and may modify any
+// of them, for example to report an mtime reflecting the last update of a
+// sensor value. A non-nil error is returned to the kernel. AttrFunc is
+// called without the node's lock held.
+type AttrFunc func(ctx context.Context, a *fuse.Attr) error
+
 // attr is the set of node attributes/
 type attr struct {
 	mode  os.FileMode
@@ -179,6 +615,38 @@ func copyAttr(dst *fuse.Attr, src attr) {
 	dst.Ctime = src.ctime
 }
 
+// own sets the uid and gid of a node, updating its change time from the
+// clock of filesys if the node is bound. own must be called with the node's
+// lock held.
+func (a *attr) own(filesys *FileSystem, uid, gid uint32) {
+	a.uid = uid
+	a.gid = gid
+	if filesys != nil {
+		a.ctime = filesys.now()
+	}
+}
+
+// attrValid is the time the kernel may cache node attributes. It matches
+// the default used by the FUSE library.
+const attrValid = time.Minute
+
+// blockSize is the preferred I/O block size reported for nodes.
+const blockSize = 4096
+
+// setSize sets the size, block count and block size of a file node's
+// attributes. File nodes have a single link.
+func setSize(a *fuse.Attr, size int64) {
+	a.Size = uint64(size)
+	a.Blocks = (uint64(size) + 511) / 512
+	a.BlockSize = blockSize
+	a.Nlink = 1
+}
+
+// isWriter returns whether flags open a file with write access.
+func isWriter(flags fuse.OpenFlags) bool {
+	return flags.IsWriteOnly() || flags.IsReadWrite()
+}
+
 // setAttr copies node attributes from a *fuse.SetattrRequest.
 func setAttr(dst *attr, resp *fuse.SetattrResponse, src *fuse.SetattrRequest) {
 	if src.Valid&fuse.SetattrMode != 0 {
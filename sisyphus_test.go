@@ -6,13 +6,29 @@ package sisyphus
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"testing/iotest"
@@ -121,6 +137,21 @@ func TestFileSystem(t *testing.T) {
 		}
 	}()
 
+	t.Run("self-test", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := c.(interface {
+			SelfTest(context.Context) (SelfTestReport, error)
+		}).SelfTest(ctx)
+		if err != nil {
+			t.Errorf("unexpected self-test failure: %v", err)
+		}
+		_, err = os.Stat(filepath.Join(prefix, selfTestName))
+		if !os.IsNotExist(err) {
+			t.Errorf("unexpected error for removed probe: got:%v want:%v", err, os.ErrNotExist)
+		}
+	})
+
 	t.Run("read directory", func(t *testing.T) {
 		var files []string
 		f, err := os.Open(filepath.Join(prefix, "sys/class"))
@@ -306,13 +337,14 @@ func TestFileSystem(t *testing.T) {
 
 	t.Run("unbind bind", func(t *testing.T) {
 		path := filepath.Join(prefix, "dev")
+		const dev = "/dev"
 
-		_, err := fs.Unbind(filepath.Join(path, "noexist"))
+		_, err := fs.Unbind(filepath.Join(dev, "noexist"))
 		if err == nil {
 			t.Errorf("expected error unbinding non-existent path")
 		}
 
-		n, err := fs.Unbind(filepath.Join(path, "input"))
+		n, err := fs.Unbind(filepath.Join(dev, "input"))
 		if err != nil {
 			t.Fatalf("unexpected error unbinding path: %v", err)
 		}
@@ -336,14 +368,14 @@ func TestFileSystem(t *testing.T) {
 			}
 		}
 
-		err = fs.Bind(filepath.Join(path, "noexist"), n)
+		err = fs.Bind(filepath.Join(dev, "noexist"), n)
 		if err == nil {
 			t.Errorf("expected error binding at non-existent path")
 		}
 
-		err = fs.Bind(path, n)
+		err = fs.Bind(dev, n)
 		if err != nil {
-			t.Errorf("unexpected error binding %q at %v: %v", n.Name(), path, err)
+			t.Errorf("unexpected error binding %q at %v: %v", n.Name(), dev, err)
 		}
 		f.Seek(0, io.SeekStart)
 		if err != nil {
@@ -365,3 +397,4526 @@ func TestFileSystem(t *testing.T) {
 		}
 	})
 }
+
+func TestPolicy(t *testing.T) {
+	const brickman = 1000
+	var gotPath string
+	fs := NewFileSystem(0775, clock).With(
+		d("sys", 0775).With(
+			d("class", 0775).With(
+				d("leds", 0775).With(
+					rw("trigger", 0666, NewBytes(nil)),
+				),
+			),
+		),
+	).Sync()
+	fs.SetPolicy(func(op Op, path string, hdr fuse.Header) error {
+		gotPath = path
+		if op == OpWrite && hdr.Uid != brickman {
+			return fuse.EPERM
+		}
+		return nil
+	})
+
+	n, err := walkPath(fs.root, "test", "/sys/class/leds/trigger")
+	if err != nil {
+		t.Fatalf("unexpected error finding node: %v", err)
+	}
+	f := n.(*RW)
+	for _, c := range []struct {
+		uid uint32
+		ok  bool
+	}{
+		{uid: 0, ok: false},
+		{uid: brickman, ok: true},
+	} {
+		ctx := context.WithValue(context.Background(), requestKey{}, fuse.Header{Uid: c.uid})
+		err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("heartbeat")}, &fuse.WriteResponse{})
+		if err == nil != c.ok {
+			t.Errorf("unexpected error state for uid %d: got:%v", c.uid, err)
+		}
+		if gotPath != "/sys/class/leds/trigger" {
+			t.Errorf("unexpected path: got:%q want:%q", gotPath, "/sys/class/leds/trigger")
+		}
+	}
+
+	_, err = n.Sys().root.Lookup(context.Background(), &fuse.LookupRequest{Name: "noexist"}, &fuse.LookupResponse{})
+	if err != fuse.ENOENT {
+		t.Errorf("unexpected error for lookup: got:%v want:%v", err, fuse.ENOENT)
+	}
+	if gotPath != "/noexist" {
+		t.Errorf("unexpected lookup path: got:%q want:%q", gotPath, "/noexist")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	f := rw("foo", 0666, NewBytes([]byte("data")))
+	fs := NewFileSystem(0775, clock).With(f).Sync()
+
+	ctx := context.Background()
+	fs.SetReadOnly(true)
+	err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("more")}, &fuse.WriteResponse{})
+	if err != syscall.EROFS {
+		t.Errorf("unexpected error writing read only file system: got:%v want:%v", err, syscall.EROFS)
+	}
+	err = f.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize}, &fuse.SetattrResponse{})
+	if err != syscall.EROFS {
+		t.Errorf("unexpected error truncating read only file system: got:%v want:%v", err, syscall.EROFS)
+	}
+	resp := fuse.ReadResponse{Data: make([]byte, 0, 10)}
+	err = f.Read(ctx, &fuse.ReadRequest{Size: 10}, &resp)
+	if err != nil {
+		t.Errorf("unexpected error reading read only file system: %v", err)
+	}
+
+	fs.SetReadOnly(false)
+	err = f.Write(ctx, &fuse.WriteRequest{Data: []byte("more"), Offset: 4}, &fuse.WriteResponse{})
+	if err != nil {
+		t.Errorf("unexpected error writing file system: %v", err)
+	}
+}
+
+func TestWriteRateLimit(t *testing.T) {
+	now := epoch
+	f := rw("foo", 0666, NewBytes(nil))
+	fs := NewFileSystem(0775, func() time.Time { return now }).With(f).Sync()
+	fs.SetWriteRateLimit(1, 2, LimitByUID)
+
+	write := func(uid uint32) error {
+		ctx := context.WithValue(context.Background(), requestKey{}, fuse.Header{Uid: uid})
+		return f.Write(ctx, &fuse.WriteRequest{Data: []byte("x")}, &fuse.WriteResponse{})
+	}
+	for i, want := range []error{nil, nil, syscall.EAGAIN} {
+		err := write(0)
+		if err != want {
+			t.Errorf("unexpected error for write %d: got:%v want:%v", i, err, want)
+		}
+	}
+	err := write(1)
+	if err != nil {
+		t.Errorf("unexpected error for write by other uid: %v", err)
+	}
+	now = now.Add(time.Second)
+	err = write(0)
+	if err != nil {
+		t.Errorf("unexpected error for write after refill: %v", err)
+	}
+
+	// Idle buckets are discarded once refilled.
+	for uid := uint32(2); uid < 100; uid++ {
+		write(uid)
+	}
+	now = now.Add(2 * time.Second)
+	err = write(0)
+	if err != nil {
+		t.Errorf("unexpected error for write after idle: %v", err)
+	}
+	if got := len(fs.limiter.buckets); got != 1 {
+		t.Errorf("unexpected number of buckets after idle: got:%d want:1", got)
+	}
+}
+
+func TestSecurityXattrs(t *testing.T) {
+	f := ro("foo", 0444, String("data"))
+	fs := NewFileSystem(0775, clock).With(f).Sync()
+
+	get := func(name string) ([]byte, error) {
+		var resp fuse.GetxattrResponse
+		err := f.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: name}, &resp)
+		return resp.Xattr, err
+	}
+
+	_, err := get("security.selinux")
+	if err != syscall.ENOTSUP {
+		t.Errorf("unexpected error for default mode: got:%v want:%v", err, syscall.ENOTSUP)
+	}
+
+	fs.SetSecurityXattrs(XattrDeny, nil)
+	_, err = get("security.selinux")
+	if err != syscall.EACCES {
+		t.Errorf("unexpected error for deny mode: got:%v want:%v", err, syscall.EACCES)
+	}
+	_, err = get("user.comment")
+	if err != fuse.ErrNoXattr {
+		t.Errorf("unexpected error for non-security attribute: got:%v want:%v", err, fuse.ErrNoXattr)
+	}
+
+	fs.SetSecurityXattrs(XattrValue, map[string][]byte{"security.selinux": []byte("sysfs_t")})
+	val, err := get("security.selinux")
+	if err != nil {
+		t.Errorf("unexpected error for value mode: %v", err)
+	}
+	if string(val) != "sysfs_t" {
+		t.Errorf("unexpected value: got:%q want:%q", val, "sysfs_t")
+	}
+	var list fuse.ListxattrResponse
+	err = f.Listxattr(context.Background(), &fuse.ListxattrRequest{}, &list)
+	if err != nil {
+		t.Errorf("unexpected error listing attributes: %v", err)
+	}
+	if string(list.Xattr) != "security.selinux\x00" {
+		t.Errorf("unexpected attribute list: got:%q want:%q", list.Xattr, "security.selinux\x00")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	f := rw("foo", 0666, NewBytes(nil))
+	fs := NewFileSystem(0775, clock).With(d("dev", 0775).With(f)).Sync()
+	audit := NewAuditLog()
+	fs.SetAudit(audit)
+
+	ctx := context.WithValue(context.Background(), requestKey{}, fuse.Header{Uid: 1000, Pid: 42})
+	for i, cmd := range []string{"start", "stop", "reset"} {
+		err := f.Write(ctx, &fuse.WriteRequest{Data: []byte(cmd), Offset: int64(i)}, &fuse.WriteResponse{})
+		if err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+	}
+
+	records := audit.Records()
+	if len(records) != 3 {
+		t.Fatalf("unexpected number of records: got:%d want:3", len(records))
+	}
+	if records[1].Path != "/dev/foo" || string(records[1].Data) != "stop" || records[1].Uid != 1000 {
+		t.Errorf("unexpected record: %+v", records[1])
+	}
+	err := audit.Verify()
+	if err != nil {
+		t.Errorf("unexpected error verifying audit log: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = audit.WriteJSON(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error writing JSON: %v", err)
+	}
+	var got []AuditRecord
+	err = json.Unmarshal(buf.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("unexpected error reading JSON: %v", err)
+	}
+	err = VerifyAudit(got)
+	if err != nil {
+		t.Errorf("unexpected error verifying exported records: %v", err)
+	}
+	got[1].Data = []byte("start")
+	err = VerifyAudit(got)
+	if !errors.Is(err, ErrAuditChain) {
+		t.Errorf("expected error verifying tampered records: got:%v", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	e := NewExec(time.Second, "echo", "hello")
+	b := make([]byte, 3)
+	var buf bytes.Buffer
+	for off := int64(0); ; {
+		n, err := e.ReadAt(b, off)
+		buf.Write(b[:n])
+		off += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading command output: %v", err)
+		}
+	}
+	if got := buf.String(); got != "hello\n" {
+		t.Errorf("unexpected command output: got:%q want:%q", got, "hello\n")
+	}
+
+	_, err := NewExec(time.Second, "false").ReadAt(b, 0)
+	if fuse.ToErrno(err) != fuse.Errno(syscall.EIO) {
+		t.Errorf("unexpected error for failing command: got:%v want:%v", err, syscall.EIO)
+	}
+	_, err = NewExec(10*time.Millisecond, "sleep", "1").ReadAt(b, 0)
+	if fuse.ToErrno(err) != fuse.Errno(syscall.ETIMEDOUT) {
+		t.Errorf("unexpected error for slow command: got:%v want:%v", err, syscall.ETIMEDOUT)
+	}
+}
+
+func TestHTTPDevice(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		content = []byte("remote content")
+		heads   int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if r.Method == http.MethodHead {
+				heads++
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		case http.MethodPut:
+			content, _ = ioutil.ReadAll(r.Body)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+
+	dev := NewHTTPDevice(srv.URL, "", time.Second, 0)
+	b := make([]byte, 7)
+	n, err := dev.ReadAt(b, 7)
+	if err != nil {
+		t.Errorf("unexpected error reading: %v", err)
+	}
+	if got := string(b[:n]); got != "content" {
+		t.Errorf("unexpected range read: got:%q want:%q", got, "content")
+	}
+	_, err = dev.WriteAt([]byte("new"), 0)
+	if err != nil {
+		t.Errorf("unexpected error writing: %v", err)
+	}
+	size, err := dev.Size()
+	if err != nil {
+		t.Errorf("unexpected error getting size: %v", err)
+	}
+	if size != 3 {
+		t.Errorf("unexpected size: got:%d want:3", size)
+	}
+	size, err = dev.Size()
+	if err != nil || size != 3 {
+		t.Errorf("unexpected repeated size: got:%d %v want:3", size, err)
+	}
+	mu.Lock()
+	if heads != 1 {
+		t.Errorf("unexpected number of HEAD requests: got:%d want:1", heads)
+	}
+	mu.Unlock()
+	_, err = dev.ReadAt(b, 3)
+	if err != io.EOF {
+		t.Errorf("unexpected error reading past end: got:%v want:%v", err, io.EOF)
+	}
+	_, err = dev.WriteAt([]byte("newer"), 0)
+	if err != nil {
+		t.Errorf("unexpected error writing: %v", err)
+	}
+	size, err = dev.Size()
+	if err != nil || size != 5 {
+		t.Errorf("unexpected size after write: got:%d %v want:5", size, err)
+	}
+}
+
+func TestChanWriter(t *testing.T) {
+	ch := make(chan []byte, 1)
+	w := NewChanWriter(ch, Reject, true)
+	n, err := w.WriteAt([]byte("start\n"), 0)
+	if err != nil {
+		t.Errorf("unexpected error writing: %v", err)
+	}
+	if n != len("start\n") {
+		t.Errorf("unexpected write count: got:%d want:%d", n, len("start\n"))
+	}
+	_, err = w.WriteAt([]byte("stop\n"), 0)
+	if err != syscall.EAGAIN {
+		t.Errorf("unexpected error writing to full channel: got:%v want:%v", err, syscall.EAGAIN)
+	}
+	if got := string(<-ch); got != "start" {
+		t.Errorf("unexpected payload: got:%q want:%q", got, "start")
+	}
+}
+
+func TestChanReader(t *testing.T) {
+	ch := make(chan []byte, 2)
+	ch <- []byte("event one\n")
+	ch <- []byte("event two\n")
+	close(ch)
+
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, io.NewSectionReader(NewChanReader(ch), 0, 1<<20))
+	if err != nil {
+		t.Errorf("unexpected error reading stream: %v", err)
+	}
+	want := "event one\nevent two\n"
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected stream contents:\ngot: %q\nwant:%q", got, want)
+	}
+}
+
+func TestChanReaderInterrupt(t *testing.T) {
+	ch := make(chan []byte, 1)
+	f := ro("events", 0444, NewChanReader(ch))
+	NewFileSystem(0775, clock).With(f).Sync()
+
+	read := func(ctx context.Context) (string, error) {
+		resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+		err := f.Read(ctx, &fuse.ReadRequest{Size: 16}, &resp)
+		return string(resp.Data), err
+	}
+
+	// An interrupted read does not hold
+	// up reads made after it.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := read(ctx)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != syscall.EINTR {
+			t.Errorf("unexpected error for interrupted read: got:%v want:%v", err, syscall.EINTR)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for interrupted read after one second")
+	}
+
+	ch <- []byte("event\n")
+	got, err := read(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error reading: %v", err)
+	}
+	if got != "event\n" {
+		t.Errorf("unexpected read after interrupt: got:%q want:%q", got, "event\n")
+	}
+}
+
+func TestPipe(t *testing.T) {
+	dev, end := NewPipe()
+	f := rw("tty", 0666, dev)
+	NewFileSystem(0775, clock).With(f).Sync()
+
+	go func() {
+		b := make([]byte, 16)
+		n, _ := end.Read(b)
+		end.Write(bytes.ToUpper(b[:n]))
+		end.Close()
+	}()
+
+	ctx := context.Background()
+	var wresp fuse.WriteResponse
+	done := make(chan error)
+	go func() {
+		resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+		err := f.Read(ctx, &fuse.ReadRequest{Size: 16}, &resp)
+		if string(resp.Data) != "HELLO" {
+			t.Errorf("unexpected read: got:%q want:%q", resp.Data, "HELLO")
+		}
+		done <- err
+	}()
+	err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, &wresp)
+	if err != nil {
+		t.Errorf("unexpected error writing: %v", err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("unexpected error reading: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("timed out waiting for read after one second")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	j := NewJSON(map[string]int{"position": 10}, false)
+	b := make([]byte, 64)
+	n, err := j.ReadAt(b, 0)
+	if err != io.EOF {
+		t.Errorf("unexpected error reading: got:%v want:%v", err, io.EOF)
+	}
+	if got, want := string(b[:n]), "{\"position\":10}\n"; got != want {
+		t.Errorf("unexpected JSON: got:%q want:%q", got, want)
+	}
+	j.Set(map[string]int{"position": 20})
+	size, err := j.Size()
+	if err != nil {
+		t.Errorf("unexpected error getting size: %v", err)
+	}
+	if size != int64(len("{\"position\":20}\n")) {
+		t.Errorf("unexpected size: got:%d want:%d", size, len("{\"position\":20}\n"))
+	}
+}
+
+func TestCounter(t *testing.T) {
+	var c Counter
+	c.Inc()
+	c.Inc()
+	c.Dec()
+	c.Add(41)
+	b := make([]byte, 8)
+	n, _ := c.ReadAt(b, 0)
+	if got := string(b[:n]); got != "42\n" {
+		t.Errorf("unexpected counter content: got:%q want:%q", got, "42\n")
+	}
+	_, err := c.WriteAt([]byte("-7\n"), 0)
+	if err != nil {
+		t.Errorf("unexpected error writing: %v", err)
+	}
+	if got := c.Load(); got != -7 {
+		t.Errorf("unexpected counter value: got:%d want:-7", got)
+	}
+	_, err = c.WriteAt([]byte("seven"), 0)
+	if err != syscall.EINVAL {
+		t.Errorf("unexpected error writing non-integer: got:%v want:%v", err, syscall.EINVAL)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	want := strings.Repeat("log line\n", 1000)
+	g, err := NewGzip(String(want), gzip.BestCompression)
+	if err != nil {
+		t.Fatalf("unexpected error creating gzip device: %v", err)
+	}
+	size, err := g.Size()
+	if err != nil {
+		t.Fatalf("unexpected error getting size: %v", err)
+	}
+	r, err := gzip.NewReader(io.NewSectionReader(g, 0, size))
+	if err != nil {
+		t.Fatalf("unexpected error opening compressed data: %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error reading compressed data: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("unexpected decompressed content:\ngot: %q\nwant:%q", got, want)
+	}
+
+	// Size does not replace the data of a read in progress.
+	j := NewJSON(strings.Repeat("a", 1000), false)
+	g, err = NewGzip(j, gzip.BestCompression)
+	if err != nil {
+		t.Fatalf("unexpected error creating gzip device: %v", err)
+	}
+	var buf bytes.Buffer
+	head := make([]byte, 10)
+	n, _ := g.ReadAt(head, 0)
+	buf.Write(head[:n])
+	j.Set(strings.Repeat("b", 1000))
+	_, err = g.Size()
+	if err != nil {
+		t.Fatalf("unexpected error getting size: %v", err)
+	}
+	_, err = io.Copy(&buf, io.NewSectionReader(g, int64(n), 1<<20))
+	if err != nil {
+		t.Fatalf("unexpected error reading compressed data: %v", err)
+	}
+	r, err = gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error opening compressed data: %v", err)
+	}
+	got, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error reading compressed data: %v", err)
+	}
+	if want := `"` + strings.Repeat("a", 1000) + "\"\n"; string(got) != want {
+		t.Errorf("unexpected decompressed content after size:\ngot: %q\nwant:%q", got, want)
+	}
+
+	// Sizes of unchanged content are not recompressed.
+	const sentinel = 1 << 40
+	g.size = sentinel
+	size, err = g.Size()
+	if err != nil || size != sentinel {
+		t.Errorf("unexpected cached size: got:%d %v want:%d", size, err, int64(sentinel))
+	}
+	j.Set(strings.Repeat("c", 1000))
+	size, err = g.Size()
+	if err != nil || size == sentinel {
+		t.Errorf("unexpected size after change: got:%d %v", size, err)
+	}
+	g.ReadAt(head, 0)
+	size, err = g.Size()
+	if err != nil || size != int64(len(g.data)) {
+		t.Errorf("unexpected size after read: got:%d %v want:%d", size, err, len(g.data))
+	}
+}
+
+func TestEncryptedBytes(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	e, err := NewEncryptedBytes(key, []byte("secret"))
+	if err != nil {
+		t.Fatalf("unexpected error creating device: %v", err)
+	}
+	if bytes.Contains(e.sealed, []byte("secret")) {
+		t.Error("plaintext found in backing data")
+	}
+	_, err = e.WriteAt([]byte(" value"), 6)
+	if err != nil {
+		t.Errorf("unexpected error writing: %v", err)
+	}
+	size, _ := e.Size()
+	b := make([]byte, size)
+	n, _ := e.ReadAt(b, 0)
+	if got := string(b[:n]); got != "secret value" {
+		t.Errorf("unexpected content: got:%q want:%q", got, "secret value")
+	}
+}
+
+func TestBoundedBytes(t *testing.T) {
+	f, err := NewBoundedBytes([]byte("0123"), 8)
+	if err != nil {
+		t.Fatalf("unexpected error creating device: %v", err)
+	}
+	_, err = f.WriteAt([]byte("4567"), 4)
+	if err != nil {
+		t.Errorf("unexpected error writing within bound: %v", err)
+	}
+	_, err = f.WriteAt([]byte("8"), 8)
+	if err != syscall.ENOSPC {
+		t.Errorf("unexpected error writing beyond bound: got:%v want:%v", err, syscall.ENOSPC)
+	}
+	err = f.Truncate(9)
+	if err != syscall.ENOSPC {
+		t.Errorf("unexpected error truncating beyond bound: got:%v want:%v", err, syscall.ENOSPC)
+	}
+	_, err = NewBoundedBytes([]byte("0123"), 2)
+	if err != syscall.ENOSPC {
+		t.Errorf("unexpected error creating oversized device: got:%v want:%v", err, syscall.ENOSPC)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	var got []string
+	dev := Func(func(b []byte, _ int64) (int, error) {
+		got = append(got, string(b))
+		return len(b), nil
+	})
+	w := NewDebounce(dev, time.Hour)
+	for _, v := range []string{"10", "20", "30"} {
+		_, err := w.WriteAt([]byte(v), 0)
+		if err != nil {
+			t.Errorf("unexpected error writing: %v", err)
+		}
+	}
+	err := w.Sync()
+	if err != nil {
+		t.Errorf("unexpected error syncing: %v", err)
+	}
+	if !reflect.DeepEqual(got, []string{"30"}) {
+		t.Errorf("unexpected delivered writes: got:%q want:%q", got, []string{"30"})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	w := NewValidateRegexp(NewBytes(nil), regexp.MustCompile(`-?[0-9]+`))
+	for _, c := range []struct {
+		send string
+		ok   bool
+	}{
+		{send: "100\n", ok: true},
+		{send: "-100", ok: true},
+		{send: "100 rpm", ok: false},
+		{send: "", ok: false},
+	} {
+		_, err := w.WriteAt([]byte(c.send), 0)
+		if err == nil != c.ok {
+			t.Errorf("unexpected error state for %q: got:%v", c.send, err)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	j := NewJournal(NewBytes(nil), clock)
+	j.WriteAt([]byte("hello"), 0)
+	j.Truncate(4)
+	j.WriteAt([]byte(" world"), 4)
+
+	dst := NewBytes(nil)
+	err := j.Replay(dst)
+	if err != nil {
+		t.Errorf("unexpected error replaying journal: %v", err)
+	}
+	if got := string(*dst); got != "hell world" {
+		t.Errorf("unexpected replayed content: got:%q want:%q", got, "hell world")
+	}
+	if n := len(j.Entries()); n != 3 {
+		t.Errorf("unexpected number of entries: got:%d want:3", n)
+	}
+}
+
+func TestObservableBytes(t *testing.T) {
+	f := NewObservableBytes([]byte("data"))
+	c := f.Subscribe()
+	f.WriteAt([]byte("more"), 4)
+	f.Truncate(2)
+	want := []Change{
+		{Kind: ChangeWrite, Offset: 4, Length: 4},
+		{Kind: ChangeTruncate, Offset: 2},
+	}
+	for _, w := range want {
+		if got := <-c; got != w {
+			t.Errorf("unexpected change: got:%+v want:%+v", got, w)
+		}
+	}
+	f.Unsubscribe(c)
+	if _, ok := <-c; ok {
+		t.Error("expected closed channel after unsubscribe")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	dev := NewBytes([]byte("7500\n"))
+	volts := NewTransform(dev, Scale(0.001, 3), Scale(1000, 0))
+	b := make([]byte, 16)
+	n, _ := volts.ReadAt(b, 0)
+	if got := string(b[:n]); got != "7.500\n" {
+		t.Errorf("unexpected transformed read: got:%q want:%q", got, "7.500\n")
+	}
+	n, err := volts.WriteAt([]byte("8.1\n"), 0)
+	if err != nil {
+		t.Errorf("unexpected error writing: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("unexpected write count: got:%d want:4", n)
+	}
+	if got := string(*dev); got != "8100\n" {
+		t.Errorf("unexpected transformed write: got:%q want:%q", got, "8100\n")
+	}
+	_, err = volts.WriteAt([]byte("high\n"), 0)
+	if err != syscall.EINVAL {
+		t.Errorf("unexpected error writing non-number: got:%v want:%v", err, syscall.EINVAL)
+	}
+}
+
+func TestMultiReader(t *testing.T) {
+	m := MultiReader(String("header\n"), NewBytes([]byte("body")), String("\n"))
+	size, err := m.Size()
+	if err != nil {
+		t.Fatalf("unexpected error getting size: %v", err)
+	}
+	if size != 12 {
+		t.Errorf("unexpected size: got:%d want:12", size)
+	}
+	b := make([]byte, 5)
+	n, err := m.ReadAt(b, 5)
+	if err != nil {
+		t.Errorf("unexpected error reading across parts: %v", err)
+	}
+	if got := string(b[:n]); got != "r\nbod" {
+		t.Errorf("unexpected read across parts: got:%q want:%q", got, "r\nbod")
+	}
+	n, err = m.ReadAt(b, 10)
+	if err != io.EOF {
+		t.Errorf("unexpected error reading at end: got:%v want:%v", err, io.EOF)
+	}
+	if got := string(b[:n]); got != "y\n" {
+		t.Errorf("unexpected read at end: got:%q want:%q", got, "y\n")
+	}
+}
+
+func TestAttrBlocks(t *testing.T) {
+	f := ro("foo", 0444, String(strings.Repeat("x", 1025)))
+	fs := NewFileSystem(0775, clock).With(
+		d("a", 0775),
+		d("b", 0775),
+		f,
+	).Sync()
+
+	var a fuse.Attr
+	err := f.Attr(context.Background(), &a)
+	if err != nil {
+		t.Fatalf("unexpected error getting file attributes: %v", err)
+	}
+	if a.Blocks != 3 || a.BlockSize != 4096 || a.Nlink != 1 {
+		t.Errorf("unexpected file attributes: blocks=%d blocksize=%d nlink=%d", a.Blocks, a.BlockSize, a.Nlink)
+	}
+	err = fs.root.Attr(context.Background(), &a)
+	if err != nil {
+		t.Fatalf("unexpected error getting directory attributes: %v", err)
+	}
+	if a.Nlink != 4 {
+		t.Errorf("unexpected directory link count: got:%d want:4", a.Nlink)
+	}
+}
+
+func TestAttrValidWhileWriting(t *testing.T) {
+	f := rw("foo", 0666, NewBytes(nil))
+	NewFileSystem(0775, clock).With(f).Sync()
+	ctx := context.Background()
+
+	valid := func() time.Duration {
+		a := fuse.Attr{Valid: time.Minute}
+		err := f.Attr(ctx, &a)
+		if err != nil {
+			t.Fatalf("unexpected error getting attributes: %v", err)
+		}
+		return a.Valid
+	}
+
+	_, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("unexpected error opening: %v", err)
+	}
+	if v := valid(); v != 0 {
+		t.Errorf("unexpected attribute validity with open writer: got:%v want:0", v)
+	}
+	err = f.Release(ctx, &fuse.ReleaseRequest{Flags: fuse.OpenWriteOnly})
+	if err != nil {
+		t.Fatalf("unexpected error releasing: %v", err)
+	}
+	if v := valid(); v != time.Minute {
+		t.Errorf("unexpected attribute validity after release: got:%v want:%v", v, time.Minute)
+	}
+}
+
+func TestFuncTrimNewline(t *testing.T) {
+	var got []byte
+	f := Func(func(b []byte, _ int64) (int, error) {
+		got = append([]byte(nil), b...)
+		return len(b), nil
+	}).TrimNewline()
+	for _, test := range []struct {
+		write string
+		want  string
+	}{
+		{write: "start\n", want: "start"},
+		{write: "stop", want: "stop"},
+		{write: "two\n\n", want: "two\n"},
+		{write: "\n", want: ""},
+	} {
+		got = nil
+		n, err := f.WriteAt([]byte(test.write), 0)
+		if err != nil {
+			t.Errorf("unexpected error writing %q: %v", test.write, err)
+		}
+		if n != len(test.write) {
+			t.Errorf("unexpected write count for %q: got:%d want:%d", test.write, n, len(test.write))
+		}
+		if string(got) != test.want {
+			t.Errorf("unexpected payload for %q: got:%q want:%q", test.write, got, test.want)
+		}
+	}
+}
+
+func TestZeroValueDevices(t *testing.T) {
+	var b Bytes
+	_, err := b.WriteAt([]byte("data"), 2)
+	if err != nil {
+		t.Errorf("unexpected error writing zero Bytes: %v", err)
+	}
+	if got := string(b); got != "\x00\x00data" {
+		t.Errorf("unexpected content: got:%q want:%q", got, "\x00\x00data")
+	}
+
+	var s MutableString
+	buf := make([]byte, 8)
+	n, _ := s.ReadAt(buf, 0)
+	if n != 0 {
+		t.Errorf("unexpected read from zero MutableString: got:%q", buf[:n])
+	}
+	s.Store("running\n")
+	n, _ = s.ReadAt(buf, 0)
+	if got := string(buf[:n]); got != "running\n" {
+		t.Errorf("unexpected read: got:%q want:%q", got, "running\n")
+	}
+}
+
+func TestFuncWithSize(t *testing.T) {
+	f := wo("command", 0222, Func(func(b []byte, _ int64) (int, error) {
+		return len(b), nil
+	}).TrimNewline().WithSize(4096))
+	NewFileSystem(0775, clock).With(f).Sync()
+	var a fuse.Attr
+	err := f.Attr(context.Background(), &a)
+	if err != nil {
+		t.Fatalf("unexpected error getting attributes: %v", err)
+	}
+	if a.Size != 4096 {
+		t.Errorf("unexpected size: got:%d want:4096", a.Size)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	dst := NewBytes([]byte("old content"))
+	fs := NewFileSystem(0775, clock).With(
+		ro("src", 0444, String("new")),
+		rw("dst", 0666, dst),
+	).Sync()
+	n, err := fs.Copy("/dst", "/src")
+	if err != nil {
+		t.Fatalf("unexpected error copying: %v", err)
+	}
+	if n != 3 || string(*dst) != "new" {
+		t.Errorf("unexpected copy result: n=%d content=%q", n, *dst)
+	}
+	_, err = fs.Copy("/src", "/dst")
+	if err == nil {
+		t.Error("expected error copying to read only node")
+	}
+}
+
+func TestOpenReport(t *testing.T) {
+	f := rw("position", 0666, NewBytes(nil))
+	fs := NewFileSystem(0775, clock).With(d("motor0", 0775).With(f)).Sync()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, err := f.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatalf("unexpected error opening: %v", err)
+		}
+	}
+	err := f.Release(ctx, &fuse.ReleaseRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error releasing: %v", err)
+	}
+	want := OpenStats{Open: 1, Opens: 2, Closes: 1, LastOpen: epoch, LastClose: epoch}
+	if got := f.Opens(); got != want {
+		t.Errorf("unexpected open stats:\ngot: %+v\nwant:%+v", got, want)
+	}
+	report := fs.OpenReport()
+	if got := report["/motor0/position"]; got != want {
+		t.Errorf("unexpected open report:\ngot: %+v\nwant:%+v", got, want)
+	}
+}
+
+func TestMaxPending(t *testing.T) {
+	// These mirror the debug message
+	// types of bazil.org/fuse/fs.
+	type logResponseHeader struct {
+		ID fuse.RequestID
+	}
+	type response struct {
+		Op      string
+		Request logResponseHeader
+	}
+
+	now := epoch
+	f := rw("foo", 0666, NewBytes(nil))
+	fs := NewFileSystem(0775, func() time.Time { return now }).With(f).Sync()
+	fs.SetMaxPending(1)
+	config := fs.withRequest(nil)
+
+	ctx1 := config.WithContext(context.Background(), &fuse.WriteRequest{Header: fuse.Header{ID: 1}})
+	ctx2 := config.WithContext(context.Background(), &fuse.WriteRequest{Header: fuse.Header{ID: 2}})
+
+	err := f.Write(ctx1, &fuse.WriteRequest{Data: []byte("x")}, &fuse.WriteResponse{})
+	if err != nil {
+		t.Errorf("unexpected error for first request: %v", err)
+	}
+	err = f.Write(ctx2, &fuse.WriteRequest{Data: []byte("x")}, &fuse.WriteResponse{})
+	if err != syscall.EAGAIN {
+		t.Errorf("unexpected error for second request: got:%v want:%v", err, syscall.EAGAIN)
+	}
+	stats := fs.RequestStats()
+	if stats.Pending != 2 || stats.Peak != 2 || stats.Rejected != 1 {
+		t.Errorf("unexpected request stats: %+v", stats)
+	}
+	config.Debug(response{Op: "Write", Request: logResponseHeader{ID: 1}})
+	config.Debug(response{Op: "Write", Request: logResponseHeader{ID: 2}})
+	config.Debug(response{Op: "Write", Request: logResponseHeader{ID: 2}})
+	if n := fs.RequestStats().Pending; n != 0 {
+		t.Errorf("unexpected pending requests after completion: got:%d want:0", n)
+	}
+
+	// Requests whose responses are not seen
+	// expire rather than holding a slot.
+	config.WithContext(context.Background(), &fuse.WriteRequest{Header: fuse.Header{ID: 3}})
+	now = now.Add(staleRequest)
+	ctx4 := config.WithContext(context.Background(), &fuse.WriteRequest{Header: fuse.Header{ID: 4}})
+	err = f.Write(ctx4, &fuse.WriteRequest{Data: []byte("x")}, &fuse.WriteResponse{})
+	if err != nil {
+		t.Errorf("unexpected error for request after stale request: %v", err)
+	}
+
+	// Responses that do not identify their
+	// request stop request tracking.
+	type unknown struct{ Op string }
+	type changed struct {
+		Op      string
+		Request unknown
+	}
+	{
+		type response changed
+		config.Debug(response{Op: "Write"})
+	}
+	config.WithContext(context.Background(), &fuse.WriteRequest{Header: fuse.Header{ID: 5}})
+	ctx6 := config.WithContext(context.Background(), &fuse.WriteRequest{Header: fuse.Header{ID: 6}})
+	err = f.Write(ctx6, &fuse.WriteRequest{Data: []byte("x")}, &fuse.WriteResponse{})
+	if err != nil {
+		t.Errorf("unexpected error for untracked request: %v", err)
+	}
+}
+
+// TestResponseID checks that the debug response message of the FUSE
+// library in use has the form inspected by responseID.
+func TestResponseID(t *testing.T) {
+	pkg, err := build.Import("bazil.org/fuse/fs", ".", build.FindOnly)
+	if err != nil {
+		t.Skipf("could not find bazil.org/fuse/fs source: %v", err)
+	}
+	pkgs, err := parser.ParseDir(token.NewFileSet(), pkg.Dir, nil, 0)
+	if err != nil {
+		t.Fatalf("unexpected error parsing bazil.org/fuse/fs: %v", err)
+	}
+	structs := make(map[string]*ast.StructType)
+	for _, p := range pkgs {
+		for _, f := range p.Files {
+			for _, decl := range f.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					ts := spec.(*ast.TypeSpec)
+					if st, ok := ts.Type.(*ast.StructType); ok {
+						structs[ts.Name.Name] = st
+					}
+				}
+			}
+		}
+	}
+	field := func(st *ast.StructType, name string) ast.Expr {
+		if st == nil {
+			return nil
+		}
+		for _, f := range st.Fields.List {
+			for _, n := range f.Names {
+				if n.Name == name {
+					return f.Type
+				}
+			}
+		}
+		return nil
+	}
+	hdr, ok := field(structs["response"], "Request").(*ast.Ident)
+	if !ok {
+		t.Fatal("bazil.org/fuse/fs response has no Request header field")
+	}
+	id, ok := field(structs[hdr.Name], "ID").(*ast.SelectorExpr)
+	if !ok || id.Sel.Name != "RequestID" {
+		t.Fatal("bazil.org/fuse/fs response header has no RequestID ID field")
+	}
+}
+
+func TestControlHandler(t *testing.T) {
+	fs := NewFileSystem(0775, clock).With(d("dev", 0775)).Sync()
+	srv := httptest.NewServer(NewControlHandler(fs))
+	defer srv.Close()
+
+	do := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error making request: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+		want               string
+	}{
+		{method: "POST", path: "/node?dir=/dev&name=foo&type=rw&mode=0666", body: "initial", code: 201},
+		{method: "GET", path: "/content?path=/dev/foo", code: 200, want: "initial"},
+		{method: "PUT", path: "/content?path=/dev/foo", body: "updated", code: 200},
+		{method: "GET", path: "/content?path=/dev/foo", code: 200, want: "updated"},
+		{method: "POST", path: "/node?dir=/dev/foo&name=bar&type=rw&mode=0666", code: 400},
+		{method: "PUT", path: "/readonly?on=true", code: 200},
+		{method: "DELETE", path: "/node?path=/dev/foo", code: 200},
+		{method: "GET", path: "/content?path=/dev/foo", code: 404},
+	} {
+		code, body := do(c.method, c.path, c.body)
+		if code != c.code {
+			t.Errorf("unexpected status for %s %s: got:%d want:%d (%s)", c.method, c.path, code, c.code, body)
+		}
+		if c.want != "" && body != c.want {
+			t.Errorf("unexpected body for %s %s: got:%q want:%q", c.method, c.path, body, c.want)
+		}
+	}
+
+	_, body := do("GET", "/stats", "")
+	var stats ControlStats
+	err := json.Unmarshal([]byte(body), &stats)
+	if err != nil {
+		t.Fatalf("unexpected error decoding stats: %v", err)
+	}
+	if !stats.ReadOnly {
+		t.Error("expected read only state in stats")
+	}
+}
+
+func TestSaveLoadState(t *testing.T) {
+	build := func() (*FileSystem, *Bytes, *Counter, *MutableString) {
+		b := NewBytes([]byte("initial"))
+		c := NewCounter(0)
+		m := NewMutableString("")
+		fs := NewFileSystem(0775, clock).With(
+			d("dev", 0775).With(
+				rw("bytes", 0666, b),
+				rw("counter", 0666, c),
+				ro("string", 0444, m),
+				ro("fixed", 0444, String("fixed")),
+			),
+		).Sync()
+		return fs, b, c, m
+	}
+
+	fs, b, c, m := build()
+	*b = Bytes("saved bytes")
+	c.Set(42)
+	m.Store("saved string")
+	var buf bytes.Buffer
+	err := fs.SaveState(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error saving state: %v", err)
+	}
+
+	fs, b, c, m = build()
+	err = fs.LoadState(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error loading state: %v", err)
+	}
+	if string(*b) != "saved bytes" {
+		t.Errorf("unexpected bytes content: got:%q want:%q", *b, "saved bytes")
+	}
+	if c.Load() != 42 {
+		t.Errorf("unexpected counter value: got:%d want:42", c.Load())
+	}
+	if m.Load() != "saved string" {
+		t.Errorf("unexpected string content: got:%q want:%q", m.Load(), "saved string")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	fs := NewFileSystem(0775, clock).With(d("dev", 0775)).Sync()
+	err := fs.SetEvents("/events")
+	if err != nil {
+		t.Fatalf("unexpected error setting events: %v", err)
+	}
+	err = fs.Bind("/dev", rw("foo", 0666, NewBytes(nil)))
+	if err != nil {
+		t.Fatalf("unexpected error binding: %v", err)
+	}
+	n, err := walkPath(fs.root, "test", "/dev/foo")
+	if err != nil {
+		t.Fatalf("unexpected error finding node: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), requestKey{}, fuse.Header{Uid: 1000, Pid: 42})
+	fs.recordWrite(ctx, n, 2, []byte("data"))
+	_, err = fs.Unbind("/dev/foo")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding: %v", err)
+	}
+
+	data, err := readAll(fs.events.dev)
+	if err != nil {
+		t.Fatalf("unexpected error reading events: %v", err)
+	}
+	want := []Event{
+		{Time: clock(), Op: "bind", Path: "/dev/foo"},
+		{Time: clock(), Op: "write", Path: "/dev/foo", Offset: 2, Length: 4, Uid: 1000, Pid: 42},
+		{Time: clock(), Op: "unbind", Path: "/dev/foo"},
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for i, w := range want {
+		var e Event
+		err = dec.Decode(&e)
+		if err != nil {
+			t.Fatalf("unexpected error decoding event %d: %v", i, err)
+		}
+		if !e.Time.Equal(w.Time) {
+			t.Errorf("unexpected time for event %d: got:%v want:%v", i, e.Time, w.Time)
+		}
+		e.Time = w.Time
+		if e != w {
+			t.Errorf("unexpected event %d: got:%+v want:%+v", i, e, w)
+		}
+	}
+	if dec.More() {
+		t.Error("unexpected additional events")
+	}
+}
+
+func TestEventLogLimit(t *testing.T) {
+	var l eventLog
+	for i := 0; len(l.data) < maxEventLog-100; i++ {
+		l.add(Event{Op: "write", Path: fmt.Sprintf("/motor%d/position", i)})
+	}
+	for i := 0; i < 100; i++ {
+		l.add(Event{Op: "bind", Path: "/last"})
+	}
+	size, _ := l.Size()
+	if size > maxEventLog {
+		t.Errorf("unexpected event log size: got:%d want:<=%d", size, maxEventLog)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(l.data), "\n"), "\n")
+	for i, line := range lines {
+		var e Event
+		err := json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			t.Fatalf("unexpected error decoding retained record %q: %v", line, err)
+		}
+		if i == 0 && e.Path == "/motor0/position" {
+			t.Error("oldest record not discarded")
+		}
+	}
+	var last Event
+	json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+	if last.Path != "/last" {
+		t.Errorf("unexpected last record path: got:%q want:%q", last.Path, "/last")
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	v, err := NewVersioned(NewBytes([]byte("v0")), 2, clock)
+	if err != nil {
+		t.Fatalf("unexpected error creating versioned: %v", err)
+	}
+	for _, s := range []string{"v1", "v1", "v2"} {
+		err = v.Truncate(0)
+		if err != nil {
+			t.Fatalf("unexpected error truncating: %v", err)
+		}
+		_, err = v.WriteAt([]byte(s), 0)
+		if err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		err = v.Sync()
+		if err != nil {
+			t.Fatalf("unexpected error syncing: %v", err)
+		}
+	}
+	versions := v.Versions()
+	var got []string
+	for _, ver := range versions {
+		got = append(got, string(ver.Data))
+	}
+	want := []string{"v1", "v2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected versions: got:%q want:%q", got, want)
+	}
+
+	text, err := readAll(v.History())
+	if err != nil {
+		t.Fatalf("unexpected error reading history: %v", err)
+	}
+	stamp := clock().Format(time.RFC3339Nano)
+	wantText := "0\t" + stamp + "\t\"v1\"\n1\t" + stamp + "\t\"v2\"\n"
+	if string(text) != wantText {
+		t.Errorf("unexpected history: got:%q want:%q", text, wantText)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	position := NewBytes([]byte("0"))
+	state := NewMutableString("idle")
+	fs := NewFileSystem(0775, clock).With(
+		d("motor", 0775).With(
+			rw("position", 0666, position),
+			ro("state", 0444, state),
+			ro("address", 0444, String("outA")),
+		),
+	).Sync()
+
+	txn := fs.Begin()
+	txn.Set("/motor/position", []byte("100"))
+	txn.Set("/motor/state", []byte("running"))
+	txn.Set("/motor/address", []byte("outB"))
+	err := txn.Commit()
+	if err == nil {
+		t.Error("expected error committing update to static node")
+	}
+	if string(*position) != "0" || state.Load() != "idle" {
+		t.Errorf("unexpected partial commit: position=%q state=%q", *position, state.Load())
+	}
+
+	txn.Set("/motor/position", []byte("100"))
+	txn.Set("/motor/state", []byte("running"))
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	if string(*position) != "100" {
+		t.Errorf("unexpected position: got:%q want:%q", *position, "100")
+	}
+	if state.Load() != "running" {
+		t.Errorf("unexpected state: got:%q want:%q", state.Load(), "running")
+	}
+
+	// Paths naming the same node update it once.
+	err = fs.Alias("/motor/position", "/")
+	if err != nil {
+		t.Fatalf("unexpected error aliasing: %v", err)
+	}
+	txn.Set("/motor/position", []byte("1"))
+	txn.Set("motor/position", []byte("2"))
+	txn.Set("/position", []byte("3"))
+	done := make(chan error)
+	go func() { done <- txn.Commit() }()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("unexpected error committing: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for commit after one second")
+	}
+	if string(*position) != "3" {
+		t.Errorf("unexpected position: got:%q want:%q", *position, "3")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	b := NewBytes([]byte("before"))
+	fs := NewFileSystem(0775, clock).With(
+		d("dev", 0775).With(
+			rw("data", 0666, b),
+			wo("command", 0222, Func(nil)),
+			ro("events", 0444, NewChanReader(make(chan []byte))),
+		),
+	).Sync()
+	snap, err := fs.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error taking snapshot: %v", err)
+	}
+	*b = Bytes("after")
+
+	n, err := walkPath(snap.root, "test", "/dev/data")
+	if err != nil {
+		t.Fatalf("unexpected error finding snapshot node: %v", err)
+	}
+	f, ok := n.(*RO)
+	if !ok {
+		t.Fatalf("unexpected snapshot node type: %T", n)
+	}
+	data, err := readAll(f.dev)
+	if err != nil {
+		t.Fatalf("unexpected error reading snapshot node: %v", err)
+	}
+	if string(data) != "before" {
+		t.Errorf("unexpected snapshot content: got:%q want:%q", data, "before")
+	}
+	if f.mode != 0444 {
+		t.Errorf("unexpected snapshot mode: got:%v want:%v", f.mode, os.FileMode(0444))
+	}
+	if f.Sys() != snap {
+		t.Error("snapshot node not held by snapshot file system")
+	}
+	_, err = walkPath(snap.root, "test", "/dev/command")
+	if err != nil {
+		t.Errorf("unexpected error finding snapshot of WO node: %v", err)
+	}
+
+	// Stream devices are not read.
+	n, err = walkPath(snap.root, "test", "/dev/events")
+	if err != nil {
+		t.Fatalf("unexpected error finding snapshot of stream node: %v", err)
+	}
+	data, err = readAll(n.(*RO).dev)
+	if err != nil || len(data) != 0 {
+		t.Errorf("unexpected snapshot of stream node: got:%q %v want empty", data, err)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	fs := NewFileSystem(0775, clock).With(
+		d("Class", 0775).With(
+			ro("Address", 0444, String("outA")),
+			ro("address", 0444, String("outB")),
+		),
+	).Sync()
+
+	_, err := walkPath(fs.root, "test", "/class/ADDRESS")
+	if err == nil {
+		t.Error("expected error for case-mismatched path")
+	}
+
+	fs.SetCaseInsensitive(true)
+	for _, test := range []struct {
+		path string
+		want string
+	}{
+		{path: "/class/ADDRESS", want: "Address"},
+		{path: "/CLASS/address", want: "address"},
+		{path: "/Class/Address", want: "Address"},
+	} {
+		n, err := walkPath(fs.root, "test", test.path)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.path, err)
+			continue
+		}
+		if n.Name() != test.want {
+			t.Errorf("unexpected node for %q: got:%q want:%q", test.path, n.Name(), test.want)
+		}
+	}
+
+	d, err := walkPath(fs.root, "test", "/class")
+	if err != nil {
+		t.Fatalf("unexpected error finding directory: %v", err)
+	}
+	n, err := d.(*Dir).Lookup(context.Background(), &fuse.LookupRequest{Name: "aDDRESS"}, &fuse.LookupResponse{})
+	if err != nil {
+		t.Fatalf("unexpected error looking up node: %v", err)
+	}
+	if n.(Node).Name() != "Address" {
+		t.Errorf("unexpected node: got:%q want:%q", n.(Node).Name(), "Address")
+	}
+}
+
+// name is a Node with an arbitrary name.
+type name struct {
+	*RO
+	name string
+}
+
+func (n name) Name() string { return n.name }
+
+func TestNameValidation(t *testing.T) {
+	for _, bad := range []string{"", ".", "..", "a/b", "a\x00b", strings.Repeat("a", MaxNameLen+1)} {
+		_, err := NewRO(bad, 0444, String(""))
+		if err != ErrBadName {
+			t.Errorf("unexpected error for RO name %q: got:%v want:%v", bad, err, ErrBadName)
+		}
+		_, err = NewRW(bad, 0666, NewBytes(nil))
+		if err != ErrBadName {
+			t.Errorf("unexpected error for RW name %q: got:%v want:%v", bad, err, ErrBadName)
+		}
+		_, err = NewWO(bad, 0222, Func(nil))
+		if err != ErrBadName {
+			t.Errorf("unexpected error for WO name %q: got:%v want:%v", bad, err, ErrBadName)
+		}
+		_, err = NewDir(bad, 0775)
+		if err != ErrBadName {
+			t.Errorf("unexpected error for Dir name %q: got:%v want:%v", bad, err, ErrBadName)
+		}
+
+		fs := NewFileSystem(0775, clock).Sync()
+		err = fs.Bind("/", name{RO: ro("valid", 0444, String("")), name: bad})
+		if !errors.Is(err, ErrBadName) {
+			t.Errorf("unexpected error binding name %q: got:%v want:%v", bad, err, ErrBadName)
+		}
+	}
+
+	fs := NewFileSystem(0775, clock).Sync()
+	fs.SetNamePolicy(SysfsName)
+	err := fs.Bind("/", ro("in_voltage0_raw", 0444, String("")))
+	if err != nil {
+		t.Errorf("unexpected error binding sysfs name: %v", err)
+	}
+	err = fs.Bind("/", ro("bad name", 0444, String("")))
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("unexpected error binding non-sysfs name: got:%v want:%v", err, syscall.EINVAL)
+	}
+}
+
+func TestNilDevice(t *testing.T) {
+	_, err := NewRO("ro", 0444, nil)
+	if err != ErrNilDevice {
+		t.Errorf("unexpected error for RO: got:%v want:%v", err, ErrNilDevice)
+	}
+	_, err = NewRW("rw", 0666, nil)
+	if err != ErrNilDevice {
+		t.Errorf("unexpected error for RW: got:%v want:%v", err, ErrNilDevice)
+	}
+	_, err = NewWO("wo", 0222, nil)
+	if err != ErrNilDevice {
+		t.Errorf("unexpected error for WO: got:%v want:%v", err, ErrNilDevice)
+	}
+	_, err = NewWO("", 0222, nil)
+	if err != ErrBadName {
+		t.Errorf("unexpected error for WO with bad name: got:%v want:%v", err, ErrBadName)
+	}
+
+	defer func() {
+		r := recover()
+		if r != ErrNilDevice {
+			t.Errorf("unexpected panic value: got:%v want:%v", r, ErrNilDevice)
+		}
+	}()
+	MustNewWO("wo", 0222, nil)
+}
+
+func TestUnbindNode(t *testing.T) {
+	foo := rw("foo", 0666, NewBytes(nil))
+	fs := NewFileSystem(0775, clock).With(d("dev", 0775).With(foo)).Sync()
+
+	err := fs.UnbindNode(foo)
+	if err != nil {
+		t.Fatalf("unexpected error unbinding node: %v", err)
+	}
+	_, err = walkPath(fs.root, "test", "/dev/foo")
+	if !os.IsNotExist(err) {
+		t.Errorf("expected node to be unbound: got err:%v", err)
+	}
+	if foo.Sys() != nil {
+		t.Error("expected unbound node to have nil file system")
+	}
+	err = fs.UnbindNode(foo)
+	if !os.IsNotExist(err) {
+		t.Errorf("unexpected error unbinding unbound node: got:%v want:%v", err, syscall.ENOENT)
+	}
+	err = fs.UnbindNode(fs.root)
+	if !os.IsNotExist(err) {
+		t.Errorf("unexpected error unbinding root: got:%v want:%v", err, syscall.ENOENT)
+	}
+}
+
+func TestAttrFunc(t *testing.T) {
+	updated := epoch.Add(time.Hour)
+	f := ro("value", 0444, String("42\n")).SetAttrFunc(func(_ context.Context, a *fuse.Attr) error {
+		a.Mtime = updated
+		a.Mode = 0400
+		return nil
+	})
+	d := d("sensor", 0775).SetAttrFunc(func(_ context.Context, a *fuse.Attr) error {
+		return syscall.EIO
+	})
+	NewFileSystem(0775, clock).With(d.With(f)).Sync()
+
+	var a fuse.Attr
+	err := f.Attr(context.Background(), &a)
+	if err != nil {
+		t.Fatalf("unexpected error getting attributes: %v", err)
+	}
+	if !a.Mtime.Equal(updated) {
+		t.Errorf("unexpected mtime: got:%v want:%v", a.Mtime, updated)
+	}
+	if a.Mode != 0400 {
+		t.Errorf("unexpected mode: got:%v want:%v", a.Mode, os.FileMode(0400))
+	}
+	if a.Size != 3 {
+		t.Errorf("unexpected size: got:%d want:3", a.Size)
+	}
+	err = d.Attr(context.Background(), &a)
+	if err != syscall.EIO {
+		t.Errorf("unexpected error from directory attributes: got:%v want:%v", err, syscall.EIO)
+	}
+}
+
+func TestBytesWriteAt(t *testing.T) {
+	for _, test := range []struct {
+		init string
+		cap  int
+		data string
+		off  int64
+		want string
+	}{
+		{init: "hello world", data: "J", off: 0, want: "Jello world"},
+		{init: "hello world", data: "there", off: 6, want: "hello there"},
+		{init: "hello", data: " world", off: 5, want: "hello world"},
+		{init: "hello", data: "p!", off: 4, want: "hellp!"},
+		{init: "ab", data: "c", off: 4, want: "ab\x00\x00c"},
+		{init: "ab", cap: 8, data: "c", off: 4, want: "ab\x00\x00c"},
+	} {
+		// Dirty the spare capacity to check
+		// that gaps are zero filled.
+		init := bytes.Repeat([]byte{'x'}, len(test.init)+test.cap)
+		copy(init, test.init)
+		b := NewBytes(init[:len(test.init)])
+		n, err := b.WriteAt([]byte(test.data), test.off)
+		if err != nil {
+			t.Errorf("unexpected error writing %q at %d to %q: %v", test.data, test.off, test.init, err)
+		}
+		if n != len(test.data) {
+			t.Errorf("unexpected write count: got:%d want:%d", n, len(test.data))
+		}
+		if string(*b) != test.want {
+			t.Errorf("unexpected result writing %q at %d to %q: got:%q want:%q", test.data, test.off, test.init, *b, test.want)
+		}
+	}
+}
+
+func TestBytesTruncate(t *testing.T) {
+	for _, test := range []struct {
+		init string
+		cap  int
+		size int64
+		want string
+	}{
+		{init: "hello world", size: 5, want: "hello"},
+		{init: "hello", size: 5, want: "hello"},
+		{init: "ab", size: 4, want: "ab\x00\x00"},
+		{init: "ab", cap: 8, size: 4, want: "ab\x00\x00"},
+		{init: "", size: 3, want: "\x00\x00\x00"},
+	} {
+		// Dirty the spare capacity to check
+		// that growth is zero filled.
+		init := bytes.Repeat([]byte{'x'}, len(test.init)+test.cap)
+		copy(init, test.init)
+		b := NewBytes(init[:len(test.init)])
+		err := b.Truncate(test.size)
+		if err != nil {
+			t.Errorf("unexpected error truncating %q to %d: %v", test.init, test.size, err)
+		}
+		if string(*b) != test.want {
+			t.Errorf("unexpected result truncating %q to %d: got:%q want:%q", test.init, test.size, *b, test.want)
+		}
+	}
+	err := NewBytes(nil).Truncate(-1)
+	if err != syscall.EINVAL {
+		t.Errorf("unexpected error for negative size: got:%v want:%v", err, syscall.EINVAL)
+	}
+
+	// Devices that reject growth by truncation
+	// are not grown by the node.
+	log := NewRotating(0, 0, 0, clock)
+	f := rw("log", 0666, log)
+	NewFileSystem(0775, clock).With(f).Sync()
+	var resp fuse.SetattrResponse
+	err = f.Setattr(context.Background(), &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 4}, &resp)
+	if err != syscall.EINVAL {
+		t.Errorf("unexpected error growing file: got:%v want:%v", err, syscall.EINVAL)
+	}
+	if got := log.Generation(0); len(got) != 0 {
+		t.Errorf("unexpected data after failed growth: got:%q want:%q", got, "")
+	}
+}
+
+func TestSingleValue(t *testing.T) {
+	var got [][]byte
+	record := Func(func(b []byte, off int64) (int, error) {
+		if off != 0 {
+			return 0, syscall.EINVAL
+		}
+		got = append(got, append([]byte(nil), b...))
+		return len(b), nil
+	})
+	f := wo("firmware", 0222, record).SetSingleValue(true)
+	NewFileSystem(0775, clock).With(f).Sync()
+
+	ctx := context.Background()
+	payload := bytes.Repeat([]byte("0123456789abcdef"), maxWrite/16+1)
+	var resp fuse.WriteResponse
+	for off := 0; off < len(payload); off += maxWrite {
+		end := off + maxWrite
+		if end > len(payload) {
+			end = len(payload)
+		}
+		err := f.Write(ctx, &fuse.WriteRequest{Handle: 1, Offset: int64(off), Data: payload[off:end]}, &resp)
+		if err != nil {
+			t.Fatalf("unexpected error writing at %d: %v", off, err)
+		}
+		if resp.Size != end-off {
+			t.Errorf("unexpected write size at %d: got:%d want:%d", off, resp.Size, end-off)
+		}
+	}
+	if len(got) != 1 || !bytes.Equal(got[0], payload) {
+		t.Errorf("unexpected device writes for split write: got %d writes want 1 write of %d bytes", len(got), len(payload))
+	}
+
+	got = nil
+	err := f.Write(ctx, &fuse.WriteRequest{Handle: 2, Data: payload[:maxWrite]}, &resp)
+	if err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("unexpected device write before flush: got %d writes", len(got))
+	}
+	err = f.Flush(ctx, &fuse.FlushRequest{Handle: 2})
+	if err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0], payload[:maxWrite]) {
+		t.Errorf("unexpected device writes for flushed write: got %d writes want 1 write of %d bytes", len(got), maxWrite)
+	}
+	if stats := f.Stats(); stats.BytesWritten != int64(len(payload)+maxWrite) {
+		t.Errorf("unexpected bytes written after flush: got:%d want:%d", stats.BytesWritten, len(payload)+maxWrite)
+	}
+
+	got = nil
+	err = f.Write(ctx, &fuse.WriteRequest{Handle: 3, Data: payload[:maxWrite]}, &resp)
+	if err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	err = f.Write(ctx, &fuse.WriteRequest{Handle: 3, Offset: 1, Data: []byte("x")}, &resp)
+	if err != syscall.EINVAL {
+		t.Errorf("unexpected error for discontinuous write: got:%v want:%v", err, syscall.EINVAL)
+	}
+	err = f.Flush(ctx, &fuse.FlushRequest{Handle: 3})
+	if err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("unexpected device write of discarded write: got %d writes", len(got))
+	}
+
+	// A device failing part way through a reassembled
+	// write fails the final request rather than
+	// reporting a short write.
+	failing := wo("failing", 0222, Func(func(b []byte, _ int64) (int, error) {
+		return len(b) / 2, syscall.ENOSPC
+	})).SetSingleValue(true)
+	NewFileSystem(0775, clock).With(failing).Sync()
+	err = failing.Write(ctx, &fuse.WriteRequest{Handle: 4, Data: payload[:maxWrite]}, &resp)
+	if err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	err = failing.Write(ctx, &fuse.WriteRequest{Handle: 4, Offset: int64(maxWrite), Data: []byte("x")}, &resp)
+	if err != syscall.ENOSPC {
+		t.Errorf("unexpected error for failed reassembled write: got:%v want:%v", err, syscall.ENOSPC)
+	}
+}
+
+func TestHandleGetattr(t *testing.T) {
+	ctx := context.Background()
+	dev := &countingSize{Bytes: Bytes("value")}
+	f := rw("value", 0666, dev).SetSizeCache(true).SetSingleValue(true)
+	NewFileSystem(0775, clock).With(f).Sync()
+
+	getattr := func(req *fuse.GetattrRequest) uint64 {
+		var resp fuse.GetattrResponse
+		err := f.Getattr(ctx, req, &resp)
+		if err != nil {
+			t.Fatalf("unexpected error getting attributes: %v", err)
+		}
+		return resp.Attr.Size
+	}
+
+	if got := getattr(&fuse.GetattrRequest{}); got != 5 {
+		t.Errorf("unexpected size: got:%d want:5", got)
+	}
+	dev.Bytes = Bytes("external value")
+	if got := getattr(&fuse.GetattrRequest{}); got != 5 {
+		t.Errorf("unexpected cached size without handle: got:%d want:5", got)
+	}
+	if got := getattr(&fuse.GetattrRequest{Flags: fuse.GetattrFh, Handle: 1}); got != 14 {
+		t.Errorf("unexpected size through handle: got:%d want:14", got)
+	}
+
+	payload := bytes.Repeat([]byte{'x'}, maxWrite)
+	err := f.Write(ctx, &fuse.WriteRequest{Handle: 2, Data: payload}, &fuse.WriteResponse{})
+	if err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if got := getattr(&fuse.GetattrRequest{Flags: fuse.GetattrFh, Handle: 2}); got != uint64(maxWrite) {
+		t.Errorf("unexpected size through writing handle: got:%d want:%d", got, maxWrite)
+	}
+	if got := getattr(&fuse.GetattrRequest{Flags: fuse.GetattrFh, Handle: 1}); got != 14 {
+		t.Errorf("unexpected size through other handle: got:%d want:14", got)
+	}
+
+	_, err = f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly | fuse.OpenTruncate}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("unexpected error opening: %v", err)
+	}
+	dev.Bytes = nil
+	if got := getattr(&fuse.GetattrRequest{}); got != 0 {
+		t.Errorf("unexpected size after truncating open: got:%d want:0", got)
+	}
+}
+
+func TestShortWrite(t *testing.T) {
+	var got []string
+	short := Func(func(b []byte, off int64) (int, error) {
+		if len(b) > 2 {
+			b = b[:2]
+		}
+		got = append(got, fmt.Sprintf("%d:%s", off, b))
+		return len(b), nil
+	})
+	f := wo("short", 0222, short)
+	NewFileSystem(0775, clock).With(f).Sync()
+	var resp fuse.WriteResponse
+	err := f.Write(context.Background(), &fuse.WriteRequest{Data: []byte("abcde")}, &resp)
+	if err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if resp.Size != 5 {
+		t.Errorf("unexpected write size: got:%d want:5", resp.Size)
+	}
+	want := []string{"0:ab", "2:cd", "4:e"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected resubmitted writes: got:%q want:%q", got, want)
+	}
+
+	partial := Func(func(b []byte, off int64) (int, error) {
+		return 1, syscall.ENOSPC
+	})
+	f = wo("partial", 0222, partial)
+	NewFileSystem(0775, clock).With(f).Sync()
+	err = f.Write(context.Background(), &fuse.WriteRequest{Data: []byte("abc")}, &resp)
+	if err != nil {
+		t.Fatalf("unexpected error for partial write: %v", err)
+	}
+	if resp.Size != 1 {
+		t.Errorf("unexpected partial write size: got:%d want:1", resp.Size)
+	}
+
+	full := Func(func(b []byte, off int64) (int, error) {
+		return len(b), syscall.EINVAL
+	})
+	f = wo("full", 0222, full)
+	NewFileSystem(0775, clock).With(f).Sync()
+	err = f.Write(context.Background(), &fuse.WriteRequest{Data: []byte("abc")}, &resp)
+	if err != syscall.EINVAL {
+		t.Errorf("unexpected error for failed full write: got:%v want:%v", err, syscall.EINVAL)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var log []string
+	logf := func(format string, args ...interface{}) {
+		log = append(log, fmt.Sprintf(format, args...))
+	}
+	now := epoch
+	dev := Chain(NewBytes(nil),
+		LimitWrites(1, 2, func() time.Time { return now }),
+		ValidateWrites(func(b []byte) bool { return len(b) != 0 && b[0] != '-' }),
+		TransformData(nil, func(b []byte) ([]byte, error) { return bytes.ToUpper(b), nil }),
+		LogOps(logf),
+	)
+
+	for _, test := range []struct {
+		data string
+		want error
+	}{
+		{data: "run", want: nil},
+		{data: "-1", want: syscall.EINVAL},
+		{data: "stop", want: syscall.EAGAIN},
+	} {
+		_, err := dev.WriteAt([]byte(test.data), 0)
+		if err != test.want {
+			t.Errorf("unexpected error writing %q: got:%v want:%v", test.data, err, test.want)
+		}
+	}
+	got, err := readAll(dev)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if string(got) != "RUN" {
+		t.Errorf("unexpected content: got:%q want:%q", got, "RUN")
+	}
+	wantLog := []string{`write "RUN" at 0: 3 <nil>`}
+	if len(log) == 0 || log[0] != wantLog[0] {
+		t.Errorf("unexpected log: got:%q want prefix:%q", log, wantLog)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	f := rw("foo", 0666, NewBytes([]byte("data")))
+	fs := NewFileSystem(0775, clock).With(d("dev", 0775).With(f)).Sync()
+	var got []string
+	fs.SetHooks(Hooks{
+		Before: func(op Op, path string) {
+			got = append(got, fmt.Sprintf("before %v %s", op, path))
+		},
+		After: func(op Op, path string, err error, _ time.Duration) {
+			got = append(got, fmt.Sprintf("after %v %s %v", op, path, err))
+		},
+	})
+	fs.SetReadOnly(true)
+
+	ctx := context.Background()
+	_, err := f.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("unexpected error opening: %v", err)
+	}
+	err = f.Write(ctx, &fuse.WriteRequest{Data: []byte("x")}, &fuse.WriteResponse{})
+	if err != syscall.EROFS {
+		t.Errorf("unexpected error writing: got:%v want:%v", err, syscall.EROFS)
+	}
+	want := []string{
+		"before open /dev/foo",
+		"after open /dev/foo <nil>",
+		"before write /dev/foo",
+		"after write /dev/foo read-only file system",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected hook calls:\ngot: %q\nwant:%q", got, want)
+	}
+}
+
+func TestReadDirAllBind(t *testing.T) {
+	fs := NewFileSystem(0775, clock).With(d("dev", 0775)).Sync()
+	fs.SetHooks(Hooks{Before: func(Op, string) {}})
+	dir, err := walkPath(fs.root, "test", "/dev")
+	if err != nil {
+		t.Fatalf("unexpected error finding directory: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			fs.Bind("/dev", ro(fmt.Sprint(i), 0444, String("")))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_, err := dir.(*Dir).ReadDirAll(context.Background())
+			if err != nil {
+				t.Errorf("unexpected error reading directory: %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestStrictSysfs(t *testing.T) {
+	b := NewBytes([]byte("ev3-ports:outA\n"))
+	f := rw("address", 0666, b)
+	fs := NewFileSystem(0775, clock).With(f).Sync()
+	fs.SetStrictSysfs(true)
+	ctx := context.Background()
+
+	var a fuse.Attr
+	err := f.Attr(ctx, &a)
+	if err != nil {
+		t.Fatalf("unexpected error getting attributes: %v", err)
+	}
+	if a.Size != sysfsSize {
+		t.Errorf("unexpected size: got:%d want:%d", a.Size, sysfsSize)
+	}
+
+	for _, test := range []struct {
+		off  int64
+		data string
+		want error
+	}{
+		{off: 0, data: "outB\n", want: nil},
+		{off: 2, data: "x", want: syscall.EINVAL},
+		{off: 0, data: strings.Repeat("x", sysfsSize+1), want: syscall.EINVAL},
+	} {
+		err = f.Write(ctx, &fuse.WriteRequest{Data: []byte(test.data), Offset: test.off}, &fuse.WriteResponse{})
+		if err != test.want {
+			t.Errorf("unexpected error writing %d bytes at %d: got:%v want:%v", len(test.data), test.off, err, test.want)
+		}
+	}
+
+	err = f.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 0}, &fuse.SetattrResponse{})
+	if err != nil {
+		t.Fatalf("unexpected error truncating: %v", err)
+	}
+	if string(*b) != "outB\n" {
+		t.Errorf("unexpected content after truncation: got:%q want:%q", *b, "outB\n")
+	}
+
+	*b = Bytes(strings.Repeat("x", sysfsSize+10))
+	resp := &fuse.ReadResponse{Data: make([]byte, 0, 2*sysfsSize)}
+	err = f.Read(ctx, &fuse.ReadRequest{Size: 2 * sysfsSize}, resp)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if len(resp.Data) != sysfsSize {
+		t.Errorf("unexpected read length: got:%d want:%d", len(resp.Data), sysfsSize)
+	}
+}
+
+func TestBinAttr(t *testing.T) {
+	a, err := NewBinAttr([]byte{0, 1, 2, 3}, 8)
+	if err != nil {
+		t.Fatalf("unexpected error creating binary attribute: %v", err)
+	}
+	buf := make([]byte, 2)
+	n, err := a.ReadAt(buf, 1)
+	if err != nil || n != 2 || !bytes.Equal(buf, []byte{1, 2}) {
+		t.Errorf("unexpected partial read: got:(%v, %d, %v) want:([1 2], 2, <nil>)", buf, n, err)
+	}
+
+	n, err = a.WriteAt([]byte{9, 9, 9, 9, 9, 9}, 4)
+	if err != syscall.EFBIG || n != 4 {
+		t.Errorf("unexpected result for overlong write: got:(%d, %v) want:(4, %v)", n, err, syscall.EFBIG)
+	}
+	want := []byte{0, 1, 2, 3, 9, 9, 9, 9}
+	if got := a.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("unexpected content: got:%v want:%v", got, want)
+	}
+	_, err = a.WriteAt([]byte{1}, 8)
+	if err != syscall.EFBIG {
+		t.Errorf("unexpected error writing at maximum size: got:%v want:%v", err, syscall.EFBIG)
+	}
+	err = a.Set(make([]byte, 9))
+	if err != syscall.EFBIG {
+		t.Errorf("unexpected error setting overlong content: got:%v want:%v", err, syscall.EFBIG)
+	}
+}
+
+func TestReadFunc(t *testing.T) {
+	var calls int
+	f := ro("uptime", 0444, ReadFunc(func(b []byte, off int64) (int, error) {
+		calls++
+		return readAt([]byte(fmt.Sprintf("%d\n", calls)), b, off)
+	}))
+	NewFileSystem(0775, clock).With(f).Sync()
+
+	ctx := context.Background()
+	for _, want := range []string{"1\n", "2\n"} {
+		resp := &fuse.ReadResponse{Data: make([]byte, 0, 16)}
+		err := f.Read(ctx, &fuse.ReadRequest{Size: 16}, resp)
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if string(resp.Data) != want {
+			t.Errorf("unexpected value: got:%q want:%q", resp.Data, want)
+		}
+	}
+
+	size, err := ReadFunc(nil).WithSize(4096).Size()
+	if err != nil || size != 4096 {
+		t.Errorf("unexpected size: got:(%d, %v) want:(4096, <nil>)", size, err)
+	}
+	_, err = ReadFunc(nil).ReadAt(make([]byte, 1), 0)
+	if err != syscall.EBADFD {
+		t.Errorf("unexpected error reading nil ReadFunc: got:%v want:%v", err, syscall.EBADFD)
+	}
+}
+
+func TestAutoInvalidate(t *testing.T) {
+	b := NewObservableBytes(nil)
+	f := rw("value", 0666, b)
+	fs := NewFileSystem(0775, clock).With(f).Sync()
+
+	// The file system is not served, so invalidations
+	// are skipped; check that the goroutines consume
+	// changes and stop cleanly.
+	changes := b.Subscribe()
+	stop := fs.InvalidateOnChange(f, changes)
+	for i := 0; i < 2*subscriptionBuffer; i++ {
+		_, err := b.WriteAt([]byte("x"), int64(i))
+		if err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+	}
+	stop()
+	stop()
+
+	stop = fs.InvalidateEvery(f, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	stop()
+}
+
+func TestInvalidateWritten(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		f    *RW
+		want bool
+	}{
+		{name: "cached", f: rw("value", 0666, NewBytes(nil)), want: true},
+		{name: "pollable", f: rw("value", 0666, &capped{}), want: false},
+		{name: "follow", f: rw("value", 0666, NewBytes(nil)).SetFollow(true, 0), want: false},
+	} {
+		NewFileSystem(0775, clock).With(test.f).Sync()
+		var resp fuse.OpenResponse
+		_, err := test.f.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &resp)
+		if err != nil {
+			t.Fatalf("unexpected error opening %s file: %v", test.name, err)
+		}
+		test.f.mu.Lock()
+		flags := test.f.handleFlags()
+		test.f.mu.Unlock()
+		if flags != resp.Flags {
+			t.Errorf("unexpected handle flags for %s file: got:%v want:%v", test.name, flags, resp.Flags)
+		}
+		if got := resp.Flags&fuse.OpenDirectIO == 0; got != test.want {
+			t.Errorf("unexpected page caching for %s file: got:%t want:%t", test.name, got, test.want)
+		}
+	}
+
+	a := rw("a", 0666, NewBytes(nil))
+	b := rw("b", 0666, NewBytes(nil))
+	var (
+		q       invalidationQueue
+		mu      sync.Mutex
+		got     []Node
+		started = make(chan struct{})
+		unblock = make(chan struct{})
+		done    = make(chan struct{})
+	)
+	q.add(a, func(n Node) {
+		mu.Lock()
+		got = append(got, n)
+		first := len(got) == 1
+		mu.Unlock()
+		if first {
+			close(started)
+			<-unblock
+		}
+	})
+	<-started
+	for i := 0; i < 3; i++ {
+		q.add(a, nil)
+		q.add(b, nil)
+	}
+	close(unblock)
+	go func() {
+		for {
+			q.mu.Lock()
+			running := q.running
+			q.mu.Unlock()
+			if !running {
+				close(done)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("invalidations did not complete")
+	}
+	if len(got) != 3 {
+		t.Errorf("unexpected number of invalidations: got:%d want:3", len(got))
+	}
+	if got[0] != a {
+		t.Errorf("unexpected first invalidation: got:%v want:%v", got[0], a)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	motor := d("motor0", 0775).With(ro("address", 0444, String("outA")))
+	fs := NewFileSystem(0775, clock).With(
+		d("devices", 0775).With(motor),
+		d("class", 0775),
+	).Sync()
+
+	err := fs.Alias("/devices/motor0", "/class")
+	if err != nil {
+		t.Fatalf("unexpected error aliasing: %v", err)
+	}
+	err = fs.Alias("/devices/motor0", "/class")
+	if !os.IsExist(err) {
+		t.Errorf("unexpected error for duplicate alias: got:%v want:%v", err, syscall.EEXIST)
+	}
+	err = fs.Alias("/devices", "/devices/motor0")
+	if err == nil {
+		t.Error("expected error aliasing a directory within itself")
+	}
+
+	n, err := walkPath(fs.root, "test", "/class/motor0/address")
+	if err != nil {
+		t.Fatalf("unexpected error finding aliased node: %v", err)
+	}
+	if got := fs.path(n); got != "/devices/motor0/address" {
+		t.Errorf("unexpected path for aliased node: got:%q want:%q", got, "/devices/motor0/address")
+	}
+
+	// Binding into the alias location must
+	// not move the original location.
+	err = fs.Bind("/class", d("motor1", 0775))
+	if err != nil {
+		t.Fatalf("unexpected error binding: %v", err)
+	}
+	if got := fs.path(motor); got != "/devices/motor0" {
+		t.Errorf("unexpected path after bind: got:%q want:%q", got, "/devices/motor0")
+	}
+
+	_, err = fs.Unbind("/devices/motor0")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding original: %v", err)
+	}
+	if motor.Sys() != fs {
+		t.Error("expected aliased node to remain bound")
+	}
+	if got := fs.path(motor); got != "/class/motor0" {
+		t.Errorf("unexpected path after unbinding original: got:%q want:%q", got, "/class/motor0")
+	}
+	_, err = fs.Unbind("/class/motor0")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding alias: %v", err)
+	}
+	if motor.Sys() != nil {
+		t.Error("expected node to be unbound after unbinding all locations")
+	}
+}
+
+// flaky is a Reader that fails a number of times before succeeding.
+type flaky struct {
+	String
+	fail int
+}
+
+var errFlaky = errors.New("flaky device")
+
+func (f *flaky) ReadAt(b []byte, off int64) (int, error) {
+	if f.fail > 0 {
+		f.fail--
+		return 0, errFlaky
+	}
+	return f.String.ReadAt(b, off)
+}
+
+func (f *flaky) Size() (int64, error) {
+	if f.fail > 0 {
+		f.fail--
+		return 0, errFlaky
+	}
+	return f.String.Size()
+}
+
+func TestErrorPolicy(t *testing.T) {
+	ctx := context.Background()
+	read := func(f *RO) (string, error) {
+		resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+		err := f.Read(ctx, &fuse.ReadRequest{Size: 16}, &resp)
+		return string(resp.Data), err
+	}
+
+	dev := &flaky{String: "value\n", fail: 1}
+	f := ro("value", 0444, dev)
+	fs := NewFileSystem(0775, clock).With(f).Sync()
+
+	var a fuse.Attr
+	err := f.Attr(ctx, &a)
+	if fuse.ToErrno(err) != fuse.Errno(syscall.EBADFD) {
+		t.Errorf("unexpected default attr error: got:%v want:%v", fuse.ToErrno(err), syscall.EBADFD)
+	}
+
+	var handled []string
+	fs.SetHooks(Hooks{Error: func(op Op, path string, err error) {
+		handled = append(handled, fmt.Sprintf("%v %s: %v", op, path, err))
+	}})
+	fs.SetErrorPolicy(ErrorPolicy{Retry: true, Errno: syscall.EIO, Detach: 2})
+
+	dev.fail = 1
+	got, err := read(f)
+	if err != nil {
+		t.Errorf("unexpected error for retried read: %v", err)
+	}
+	if got != "value\n" {
+		t.Errorf("unexpected read result: got:%q want:%q", got, "value\n")
+	}
+
+	dev.fail = 2
+	_, err = read(f)
+	if fuse.ToErrno(err) != fuse.Errno(syscall.EIO) {
+		t.Errorf("unexpected read error: got:%v want:%v", fuse.ToErrno(err), syscall.EIO)
+	}
+	if f.Sys() != fs {
+		t.Error("unexpected detach after single failure")
+	}
+	dev.fail = 2
+	err = f.Attr(ctx, &a)
+	if fuse.ToErrno(err) != fuse.Errno(syscall.EIO) {
+		t.Errorf("unexpected attr error: got:%v want:%v", fuse.ToErrno(err), syscall.EIO)
+	}
+	if f.Sys() != nil {
+		t.Error("expected node to be detached after repeated failures")
+	}
+
+	want := []string{
+		"read /value: flaky device",
+		"attr /value: flaky device",
+	}
+	if !reflect.DeepEqual(handled, want) {
+		t.Errorf("unexpected error hook calls:\ngot: %q\nwant:%q", handled, want)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	// These mirror the debug message
+	// types of bazil.org/fuse/fs.
+	type request struct {
+		Op      string
+		Request *fuse.Header
+		In      interface{}
+	}
+	type logResponseHeader struct {
+		ID fuse.RequestID
+	}
+	type response struct {
+		Op      string
+		Request logResponseHeader
+		Out     interface{}
+		Errno   string
+	}
+
+	fs := NewFileSystem(0775, clock)
+	var got []string
+	fs.SetDebug(func(r DebugRecord) {
+		got = append(got, fmt.Sprintf("%d %s %s", r.Level, r.Op, r.Path))
+	}, DebugAll, "/sys/motor0")
+
+	msgs := []interface{}{
+		request{Op: "Lookup", In: &fuse.LookupRequest{Header: fuse.Header{ID: 1, Node: fuse.RootID}, Name: "sys"}},
+		response{Op: "Lookup", Request: logResponseHeader{ID: 1}, Out: &fuse.LookupResponse{Node: 2}},
+		request{Op: "Lookup", In: &fuse.LookupRequest{Header: fuse.Header{ID: 2, Node: 2}, Name: "motor0"}},
+		response{Op: "Lookup", Request: logResponseHeader{ID: 2}, Out: &fuse.LookupResponse{Node: 3}},
+		request{Op: "Lookup", In: &fuse.LookupRequest{Header: fuse.Header{ID: 3, Node: 3}, Name: "address"}},
+		response{Op: "Lookup", Request: logResponseHeader{ID: 3}, Out: &fuse.LookupResponse{Node: 4}},
+		request{Op: "Read", In: &fuse.ReadRequest{Header: fuse.Header{ID: 4, Node: 4}}},
+		response{Op: "Read", Request: logResponseHeader{ID: 4}, Errno: "EIO"},
+		request{Op: "Getattr", In: &fuse.GetattrRequest{Header: fuse.Header{ID: 5, Node: 2}}},
+		response{Op: "Getattr", Request: logResponseHeader{ID: 5}, Errno: "EIO"},
+		"diagnostic",
+	}
+	for _, m := range msgs {
+		fs.debug.message(m)
+	}
+	want := []string{
+		"2 Lookup /sys/motor0",
+		"2 Lookup /sys/motor0",
+		"2 Lookup /sys/motor0/address",
+		"2 Lookup /sys/motor0/address",
+		"2 Read /sys/motor0/address",
+		"1 Read /sys/motor0/address",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected scoped debug records:\ngot: %q\nwant:%q", got, want)
+	}
+
+	got = nil
+	fs.SetDebug(fs.debug.log, DebugErrors)
+	for _, m := range msgs[6:] {
+		fs.debug.message(m)
+	}
+	want = []string{
+		"1 Read /sys/motor0/address",
+		"1 Getattr /sys",
+		"1  ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected error debug records:\ngot: %q\nwant:%q", got, want)
+	}
+}
+
+// countingSize is a ReadWriter that counts calls to Size.
+type countingSize struct {
+	Bytes
+	calls int
+}
+
+func (c *countingSize) Size() (int64, error) {
+	c.calls++
+	return c.Bytes.Size()
+}
+
+func TestSizeCache(t *testing.T) {
+	ctx := context.Background()
+	dev := &countingSize{Bytes: Bytes("value")}
+	f := rw("value", 0666, dev).SetSizeCache(true)
+	fs := NewFileSystem(0775, clock).With(f).Sync()
+
+	attrSize := func() uint64 {
+		var a fuse.Attr
+		err := f.Attr(ctx, &a)
+		if err != nil {
+			t.Fatalf("unexpected error getting attributes: %v", err)
+		}
+		return a.Size
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := attrSize(); got != 5 {
+			t.Errorf("unexpected size: got:%d want:5", got)
+		}
+	}
+	if dev.calls != 1 {
+		t.Errorf("unexpected number of Size calls with cache: got:%d want:1", dev.calls)
+	}
+
+	err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("longer value")}, &fuse.WriteResponse{})
+	if err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if got := attrSize(); got != 12 {
+		t.Errorf("unexpected size after write: got:%d want:12", got)
+	}
+
+	dev.Bytes = Bytes("external")
+	if got := attrSize(); got != 12 {
+		t.Errorf("unexpected size before invalidation: got:%d want:12", got)
+	}
+	err = fs.NotifyChanged("/value", 0, -1)
+	if err != nil {
+		t.Fatalf("unexpected error notifying change: %v", err)
+	}
+	if got := attrSize(); got != 8 {
+		t.Errorf("unexpected size after invalidation: got:%d want:8", got)
+	}
+
+	f.SetSizeCache(false)
+	dev.calls = 0
+	attrSize()
+	attrSize()
+	if dev.calls != 2 {
+		t.Errorf("unexpected number of Size calls without cache: got:%d want:2", dev.calls)
+	}
+
+	// Content replaced by transactions and
+	// restored state invalidates the cache.
+	cached := rw("cached", 0666, NewBytes([]byte("12"))).SetSizeCache(true)
+	fs = NewFileSystem(0775, clock).With(cached).Sync()
+	var a fuse.Attr
+	cached.Attr(ctx, &a)
+	txn := fs.Begin()
+	txn.Set("/cached", []byte("12345678"))
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	cached.Attr(ctx, &a)
+	if a.Size != 8 {
+		t.Errorf("unexpected size after commit: got:%d want:8", a.Size)
+	}
+	var buf bytes.Buffer
+	err = fs.SaveState(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error saving state: %v", err)
+	}
+	txn.Set("/cached", []byte("1"))
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	cached.Attr(ctx, &a)
+	err = fs.LoadState(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error loading state: %v", err)
+	}
+	cached.Attr(ctx, &a)
+	if a.Size != 8 {
+		t.Errorf("unexpected size after loading state: got:%d want:8", a.Size)
+	}
+}
+
+// selfAccess is a Reader that accesses its own node.
+type selfAccess struct {
+	String
+	fs   *FileSystem
+	node *RO
+	err  error
+}
+
+func (r *selfAccess) ReadAt(b []byte, off int64) (int, error) {
+	// Simulate a request made through the mount
+	// by the thread executing the device call.
+	pid := uint32(gettid())
+	ctx := context.WithValue(context.Background(), requestKey{}, fuse.Header{Pid: pid})
+	ctx = r.fs.withReentry(ctx, pid)
+	var a fuse.Attr
+	r.err = r.node.Attr(ctx, &a)
+	return r.String.ReadAt(b, off)
+}
+
+func TestDeadlockDetection(t *testing.T) {
+	if gettid() == 0 {
+		t.Skip("deadlock detection not supported")
+	}
+	dev := &selfAccess{String: "value\n"}
+	f := ro("value", 0444, dev)
+	fs := NewFileSystem(0775, clock).With(d("sys", 0775).With(f)).Sync()
+	dev.fs = fs
+	dev.node = f
+	fs.SetDeadlockDetection(true)
+	var traced []string
+	fs.SetHooks(Hooks{
+		After: func(op Op, path string, err error, _ time.Duration) {
+			traced = append(traced, fmt.Sprintf("%v %s %t", op, path, errors.Is(err, syscall.EDEADLK)))
+		},
+	})
+
+	done := make(chan error)
+	go func() {
+		resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+		done <- f.Read(context.Background(), &fuse.ReadRequest{Size: 16}, &resp)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error reading: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("re-entrant access deadlocked")
+	}
+	if fuse.ToErrno(dev.err) != fuse.Errno(syscall.EDEADLK) {
+		t.Errorf("unexpected error for re-entrant access: got:%v want:%v", dev.err, syscall.EDEADLK)
+	}
+	want := "sisyphus: re-entrant access to /sys/value from its device by thread"
+	if dev.err == nil || !strings.HasPrefix(dev.err.Error(), want) {
+		t.Errorf("unexpected diagnostic: got:%v want prefix:%q", dev.err, want)
+	}
+	wantTraced := []string{
+		"attr /sys/value true",
+		"read /sys/value false",
+	}
+	if !reflect.DeepEqual(traced, wantTraced) {
+		t.Errorf("unexpected traced operations:\ngot: %q\nwant:%q", traced, wantTraced)
+	}
+
+	// Access from other threads is not affected.
+	var a fuse.Attr
+	ctx := fs.withReentry(context.Background(), uint32(gettid()))
+	err := f.Attr(ctx, &a)
+	if err != nil {
+		t.Errorf("unexpected error for non-re-entrant access: %v", err)
+	}
+}
+
+// blocking is a ReadWriter that blocks reads until unblocked.
+type blocking struct {
+	Bytes
+	unblock chan struct{}
+}
+
+func (b *blocking) ReadAt(p []byte, off int64) (int, error) {
+	<-b.unblock
+	return b.Bytes.ReadAt(p, off)
+}
+
+func TestTimeout(t *testing.T) {
+	dev := &blocking{Bytes: Bytes("value\n"), unblock: make(chan struct{})}
+	timed := Chain(dev, Timeout(10*time.Millisecond))
+
+	buf := make([]byte, 16)
+	n, err := timed.ReadAt(buf, 0)
+	if err != syscall.ETIMEDOUT || n != 0 {
+		t.Errorf("unexpected result for blocked read: got:%d %v want:0 %v", n, err, syscall.ETIMEDOUT)
+	}
+	_, err = timed.WriteAt([]byte("new\n"), 0)
+	if err != syscall.ETIMEDOUT {
+		t.Errorf("unexpected error for write during abandoned read: got:%v want:%v", err, syscall.ETIMEDOUT)
+	}
+
+	close(dev.unblock)
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = timed.WriteAt([]byte("new\n"), 0)
+	if err != nil {
+		t.Errorf("unexpected error for write: %v", err)
+	}
+	n, err = timed.ReadAt(buf, 0)
+	if err != io.EOF {
+		t.Errorf("unexpected error for read: got:%v want:%v", err, io.EOF)
+	}
+	if got := string(buf[:n]); got != "new\ne\n" {
+		t.Errorf("unexpected read result: got:%q want:%q", got, "new\ne\n")
+	}
+}
+
+func TestTuning(t *testing.T) {
+	if got := len(Tuning{}.MountOptions()); got != 0 {
+		t.Errorf("unexpected number of mount options for zero tuning: got:%d want:0", got)
+	}
+	if got := len(DefaultTuning.MountOptions()); got != 1 {
+		t.Errorf("unexpected number of mount options for default tuning: got:%d want:1", got)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	var got [][]string
+	c := NewCommand().
+		Handle("run-to-abs-pos", func(args []string) error {
+			got = append(got, args)
+			return nil
+		}).
+		Handle("fail", func([]string) error {
+			return syscall.EBUSY
+		})
+
+	for _, test := range []struct {
+		line string
+		off  int64
+		args []string
+		err  error
+	}{
+		{line: "run-to-abs-pos\n", args: []string{}},
+		{line: "run-to-abs-pos 90  'a b' \"c \\\"d\\\"\" e\\ f\n", args: []string{"90", "a b", `c "d"`, "e f"}},
+		{line: "run-to-abs-pos ''", args: []string{""}},
+		{line: "run-to-abs-pos 'unterminated", err: syscall.EINVAL},
+		{line: "run-to-abs-pos", off: 1, err: syscall.EINVAL},
+		{line: "  \n", err: syscall.EINVAL},
+		{line: "unknown", err: syscall.EINVAL},
+		{line: "fail", err: syscall.EBUSY},
+	} {
+		got = nil
+		n, err := c.WriteAt([]byte(test.line), test.off)
+		if err != test.err {
+			t.Errorf("unexpected error for %q: got:%v want:%v", test.line, err, test.err)
+		}
+		if err != nil {
+			continue
+		}
+		if n != len(test.line) {
+			t.Errorf("unexpected write length for %q: got:%d want:%d", test.line, n, len(test.line))
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0], test.args) {
+			t.Errorf("unexpected arguments for %q: got:%q want:%q", test.line, got, test.args)
+		}
+	}
+
+	want := []string{"fail", "run-to-abs-pos"}
+	if verbs := c.Verbs(); !reflect.DeepEqual(verbs, want) {
+		t.Errorf("unexpected verbs: got:%q want:%q", verbs, want)
+	}
+}
+
+func TestNodeStats(t *testing.T) {
+	f := rw("position", 0666, NewBytes([]byte("0\n")))
+	fs := NewFileSystem(0775, clock).With(d("motor0", 0775).With(f)).Sync()
+
+	ctx := context.WithValue(context.Background(), requestKey{}, fuse.Header{Uid: 1000})
+	for i := 0; i < 10; i++ {
+		resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+		err := f.Read(ctx, &fuse.ReadRequest{Size: 16}, &resp)
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+	}
+	ctx = context.WithValue(context.Background(), requestKey{}, fuse.Header{Uid: 1001})
+	err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("90\n")}, &fuse.WriteResponse{})
+	if err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+
+	got, err := fs.NodeStats("/motor0/position")
+	if err != nil {
+		t.Fatalf("unexpected error getting stats: %v", err)
+	}
+	want := NodeStats{
+		Reads:        10,
+		Writes:       1,
+		BytesRead:    20,
+		BytesWritten: 3,
+		LastUid:      1001,
+		LastAccess:   epoch,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected stats:\ngot: %+v\nwant:%+v", got, want)
+	}
+
+	_, err = fs.NodeStats("/motor0")
+	if !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("unexpected error for directory stats: got:%v want:%v", err, syscall.EISDIR)
+	}
+	_, err = fs.NodeStats("/motor0/missing")
+	if !os.IsNotExist(err) {
+		t.Errorf("unexpected error for missing node: got:%v want:%v", err, syscall.ENOENT)
+	}
+}
+
+func TestLinkFarm(t *testing.T) {
+	fs := NewFileSystem(0775, clock).With(
+		d("sys", 0775).With(
+			d("class", 0775).With(
+				d("input", 0775).With(
+					d("event0", 0775),
+				),
+			),
+		),
+		d("dev", 0775).With(
+			d("input", 0775).With(
+				d("by-path", 0775),
+			),
+		),
+	).Sync()
+
+	l, err := fs.NewLinkFarm("/dev/input/by-path", "/sys/class/input", func(path string, n Node) string {
+		return "platform-" + n.Name()
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating link farm: %v", err)
+	}
+	links := func() map[string]string {
+		n, err := walkPath(fs.root, "test", "/dev/input/by-path")
+		if err != nil {
+			t.Fatalf("unexpected error finding link directory: %v", err)
+		}
+		d := n.(*Dir)
+		got := make(map[string]string)
+		for name, n := range d.files {
+			got[name], err = n.(*Symlink).Readlink(context.Background(), &fuse.ReadlinkRequest{})
+			if err != nil {
+				t.Errorf("unexpected error reading link %s: %v", name, err)
+			}
+		}
+		return got
+	}
+
+	want := map[string]string{"platform-event0": "../../../sys/class/input/event0"}
+	if got := links(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected initial links: got:%v want:%v", got, want)
+	}
+
+	err = fs.Bind("/sys/class/input", d("event1", 0775))
+	if err != nil {
+		t.Fatalf("unexpected error binding: %v", err)
+	}
+	want["platform-event1"] = "../../../sys/class/input/event1"
+	if got := links(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected links after bind: got:%v want:%v", got, want)
+	}
+
+	_, err = fs.Unbind("/sys/class/input/event0")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding: %v", err)
+	}
+	delete(want, "platform-event0")
+	if got := links(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected links after unbind: got:%v want:%v", got, want)
+	}
+
+	l.Close()
+
+	// Nodes with duplicate link names are ignored.
+	dup, err := fs.NewLinkFarm("/dev/input", "/sys/class/input", func(path string, n Node) string {
+		return "event"
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating link farm: %v", err)
+	}
+	err = fs.Bind("/sys/class/input", d("event3", 0775))
+	if err != nil {
+		t.Fatalf("unexpected error binding: %v", err)
+	}
+	_, err = fs.Unbind("/sys/class/input/event3")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding: %v", err)
+	}
+	dup.Close()
+	link, err := fs.Lookup("/dev/input/event")
+	if err != nil {
+		t.Fatalf("unexpected error looking up duplicate named link: %v", err)
+	}
+	target, _ := link.(*Symlink).Readlink(context.Background(), &fuse.ReadlinkRequest{})
+	if want := "../../sys/class/input/event1"; target != want {
+		t.Errorf("unexpected duplicate named link target: got:%q want:%q", target, want)
+	}
+
+	err = fs.Bind("/sys/class/input", d("event2", 0775))
+	if err != nil {
+		t.Fatalf("unexpected error binding: %v", err)
+	}
+	if got := links(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected links after close: got:%v want:%v", got, want)
+	}
+
+	var a fuse.Attr
+	n, _ := walkPath(fs.root, "test", "/dev/input/by-path/platform-event1")
+	err = n.Attr(context.Background(), &a)
+	if err != nil {
+		t.Fatalf("unexpected error getting link attributes: %v", err)
+	}
+	if a.Mode&os.ModeSymlink == 0 || a.Size != uint64(len(want["platform-event1"])) {
+		t.Errorf("unexpected link attributes: mode:%v size:%d", a.Mode, a.Size)
+	}
+}
+
+func TestEntryValid(t *testing.T) {
+	live := d("tacho-motor", 0775).With(d("motor0", 0775)).(*Dir)
+	static := d("sys", 0775).With(live).(*Dir)
+	NewFileSystem(0775, clock).With(static).Sync()
+
+	const def = time.Minute
+	for _, test := range []struct {
+		dir   *Dir
+		name  string
+		valid time.Duration
+		want  time.Duration
+	}{
+		{dir: static, name: "tacho-motor", valid: -1, want: def},
+		{dir: live, name: "motor0", valid: 0, want: 0},
+		{dir: static, name: "tacho-motor", valid: time.Hour, want: time.Hour},
+	} {
+		test.dir.SetEntryValid(test.valid)
+		resp := fuse.LookupResponse{EntryValid: def}
+		_, err := test.dir.Lookup(context.Background(), &fuse.LookupRequest{Name: test.name}, &resp)
+		if err != nil {
+			t.Fatalf("unexpected error looking up %q: %v", test.name, err)
+		}
+		if resp.EntryValid != test.want {
+			t.Errorf("unexpected entry validity for %q: got:%v want:%v", test.name, resp.EntryValid, test.want)
+		}
+	}
+}
+
+func TestBindConflict(t *testing.T) {
+	first := ro("address", 0444, String("outA\n"))
+	fs := NewFileSystem(0775, clock).With(d("motor0", 0775).With(first)).Sync()
+
+	_, err := fs.BindConflict("/motor0", ro("address", 0444, String("outB\n")), Fail)
+	if !os.IsExist(err) {
+		t.Errorf("unexpected error for failing conflict: got:%v want:%v", err, syscall.EEXIST)
+	}
+	n, _ := walkPath(fs.root, "test", "/motor0/address")
+	if n != Node(first) {
+		t.Error("existing node replaced by failing bind")
+	}
+
+	for i := 1; i <= 2; i++ {
+		name, err := fs.BindConflict("/motor0", ro("address", 0444, String("outC\n")), KeepBoth)
+		if err != nil {
+			t.Fatalf("unexpected error keeping both: %v", err)
+		}
+		want := fmt.Sprintf("address.%d", i)
+		if name != want {
+			t.Errorf("unexpected name for kept node: got:%q want:%q", name, want)
+		}
+		if _, err := walkPath(fs.root, "test", "/motor0/"+want); err != nil {
+			t.Errorf("kept node not bound: %v", err)
+		}
+	}
+
+	fs.SetNamePolicy(func(name string) error {
+		if strings.HasSuffix(name, ".3") {
+			return syscall.EINVAL
+		}
+		return nil
+	})
+	_, err = fs.BindConflict("/motor0", ro("address", 0444, String("outE\n")), KeepBoth)
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("unexpected error for rejected kept name: got:%v want:%v", err, syscall.EINVAL)
+	}
+	if _, err := walkPath(fs.root, "test", "/motor0/address.3"); !os.IsNotExist(err) {
+		t.Errorf("unexpected error for rejected kept node: got:%v want:%v", err, syscall.ENOENT)
+	}
+	fs.SetNamePolicy(nil)
+
+	second := ro("address", 0444, String("outD\n"))
+	name, err := fs.BindConflict("/motor0", second, Replace)
+	if err != nil || name != "address" {
+		t.Fatalf("unexpected result for replacing bind: got:(%q, %v) want:(%q, <nil>)", name, err, "address")
+	}
+	n, _ = walkPath(fs.root, "test", "/motor0/address")
+	if n != Node(second) {
+		t.Error("existing node not replaced")
+	}
+	if first.Sys() != nil {
+		t.Error("replaced node not detached from file system")
+	}
+}
+
+func TestUnbindPaths(t *testing.T) {
+	for _, test := range []struct {
+		path string
+		want string
+		err  error
+	}{
+		{path: "/", err: syscall.EINVAL},
+		{path: "//", err: syscall.EINVAL},
+		{path: "", err: syscall.EINVAL},
+		{path: "sys/motor0", want: "motor0"},
+		{path: "motor0", err: syscall.ENOENT},
+		{path: "/sys/missing", err: syscall.ENOENT},
+		{path: "/missing/motor0", err: syscall.ENOENT},
+		{path: "/sys/motor0/address/x", err: syscall.ENOTDIR},
+		{path: "/sys/motor0/", want: "motor0"},
+		{path: "/sys/../sys/motor0", want: "motor0"},
+		{path: "/sys/motor0/address", want: "address"},
+	} {
+		address := ro("address", 0444, String("outA\n"))
+		motor := d("motor0", 0775).With(address)
+		fs := NewFileSystem(0775, clock).With(d("sys", 0775).With(motor)).Sync()
+
+		n, err := fs.Unbind(test.path)
+		if !errors.Is(err, test.err) {
+			t.Errorf("unexpected error for %q: got:%v want:%v", test.path, err, test.err)
+		}
+		if err != nil {
+			var perr *os.PathError
+			if errors.As(err, &perr) && perr.Path != "/" && strings.HasSuffix(perr.Path, "/") {
+				t.Errorf("unexpected trailing separator in error path for %q: %q", test.path, perr.Path)
+			}
+			if n != nil {
+				t.Errorf("unexpected node for failed unbind of %q", test.path)
+			}
+			if address.Sys() != fs {
+				t.Errorf("node detached by failed unbind of %q", test.path)
+			}
+			continue
+		}
+		if n.Name() != test.want {
+			t.Errorf("unexpected node unbound for %q: got:%q want:%q", test.path, n.Name(), test.want)
+		}
+		if address.Sys() != nil {
+			t.Errorf("descendant not detached by unbind of %q", test.path)
+		}
+		if test.want == "address" && motor.(*Dir).Sys() != fs {
+			t.Errorf("parent detached by unbind of %q", test.path)
+		}
+	}
+}
+
+func TestChroot(t *testing.T) {
+	fs := NewFileSystem(0775, clock).With(
+		d("sys", 0775).With(
+			d("class", 0775).With(
+				d("tacho-motor", 0775),
+			),
+		),
+		ro("secret", 0444, String("hidden\n")),
+	).Sync()
+
+	err := fs.Bind("sys/class/tacho-motor", d("motor0", 0775))
+	if err != nil {
+		t.Fatalf("unexpected error binding relative path: %v", err)
+	}
+	if _, err := fs.Lookup("/sys/class/tacho-motor/motor0"); err != nil {
+		t.Errorf("unexpected error looking up relatively bound node: %v", err)
+	}
+
+	_, err = fs.Chroot("secret")
+	if !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("unexpected error for chroot to file: got:%v want:%v", err, syscall.ENOTDIR)
+	}
+	v, err := fs.Chroot("sys/class")
+	if err != nil {
+		t.Fatalf("unexpected error creating view: %v", err)
+	}
+	for _, path := range []string{"tacho-motor/motor0", "/tacho-motor/motor0", "../../tacho-motor/motor0"} {
+		n, err := v.Lookup(path)
+		if err != nil {
+			t.Errorf("unexpected error looking up %q in view: %v", path, err)
+			continue
+		}
+		if n.Name() != "motor0" {
+			t.Errorf("unexpected node for %q in view: got:%q want:%q", path, n.Name(), "motor0")
+		}
+	}
+	if _, err := v.Lookup("../secret"); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("unexpected error looking up node outside view: got:%v want:%v", err, syscall.ENOENT)
+	}
+
+	err = v.Bind("tacho-motor/motor0", ro("address", 0444, String("outA\n")))
+	if err != nil {
+		t.Fatalf("unexpected error binding in view: %v", err)
+	}
+	if _, err := fs.Lookup("/sys/class/tacho-motor/motor0/address"); err != nil {
+		t.Errorf("unexpected error looking up node bound in view: %v", err)
+	}
+	if _, err := v.Unbind("/"); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("unexpected error unbinding view root: got:%v want:%v", err, syscall.EINVAL)
+	}
+	n, err := v.Unbind("tacho-motor/motor0/address")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding in view: %v", err)
+	}
+	if n.Name() != "address" {
+		t.Errorf("unexpected node unbound in view: got:%q want:%q", n.Name(), "address")
+	}
+	if got, want := v.Path("tacho-motor"), "/sys/class/tacho-motor"; got != want {
+		t.Errorf("unexpected path in file system: got:%q want:%q", got, want)
+	}
+}
+
+func TestChownTree(t *testing.T) {
+	// Own must be safe before the nodes are bound.
+	motor := d("motor0", 0775).Own(1, 1)
+	address := ro("address", 0444, String("outA\n")).Own(1, 1)
+
+	now := epoch
+	fs := NewFileSystem(0775, func() time.Time { return now }).With(
+		d("sys", 0775).With(motor.With(address)),
+		ro("other", 0444, String("other\n")),
+	).Sync()
+
+	now = epoch.Add(time.Hour)
+	err := fs.ChownTree("/sys/motor0", 1000, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, path := range []string{"/sys/motor0", "/sys/motor0/address"} {
+		n, err := fs.Lookup(path)
+		if err != nil {
+			t.Fatalf("unexpected error looking up %q: %v", path, err)
+		}
+		var a fuse.Attr
+		err = n.Attr(context.Background(), &a)
+		if err != nil {
+			t.Fatalf("unexpected error getting attributes of %q: %v", path, err)
+		}
+		if a.Uid != 1000 || a.Gid != 100 {
+			t.Errorf("unexpected ownership of %q: got:%d:%d want:1000:100", path, a.Uid, a.Gid)
+		}
+		if !a.Ctime.Equal(now) {
+			t.Errorf("unexpected ctime of %q: got:%v want:%v", path, a.Ctime, now)
+		}
+		if !a.Mtime.Equal(epoch) {
+			t.Errorf("unexpected mtime of %q: got:%v want:%v", path, a.Mtime, epoch)
+		}
+	}
+
+	other, _ := fs.Lookup("/other")
+	var a fuse.Attr
+	err = other.Attr(context.Background(), &a)
+	if err != nil {
+		t.Fatalf("unexpected error getting attributes: %v", err)
+	}
+	if a.Uid != 0 || !a.Ctime.Equal(epoch) {
+		t.Errorf("unexpected change to node outside tree: uid:%d ctime:%v", a.Uid, a.Ctime)
+	}
+
+	err = fs.ChownTree("/sys/missing", 1000, 100)
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("unexpected error for missing path: got:%v want:%v", err, syscall.ENOENT)
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	in := make(chan []byte, 1)
+	out := make(chan []byte)
+	events := ro("events", 0444, NewChanReader(in))
+	command := wo("command", 0222, NewChanWriter(out, Block, true))
+	NewFileSystem(0775, clock).With(events, command).Sync()
+
+	ctx := context.Background()
+	resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+	err := events.Read(ctx, &fuse.ReadRequest{Size: 16, FileFlags: fuse.OpenNonblock}, &resp)
+	if err != syscall.EAGAIN {
+		t.Errorf("unexpected error for non-blocking read: got:%v want:%v", err, syscall.EAGAIN)
+	}
+	in <- []byte("ready\n")
+	err = events.Read(ctx, &fuse.ReadRequest{Size: 16, FileFlags: fuse.OpenNonblock}, &resp)
+	if err != nil {
+		t.Errorf("unexpected error for non-blocking read: %v", err)
+	}
+	if string(resp.Data) != "ready\n" {
+		t.Errorf("unexpected read: got:%q want:%q", resp.Data, "ready\n")
+	}
+
+	var wresp fuse.WriteResponse
+	err = command.Write(ctx, &fuse.WriteRequest{Data: []byte("stop\n"), FileFlags: fuse.OpenWriteOnly | fuse.OpenNonblock}, &wresp)
+	if err != syscall.EAGAIN {
+		t.Errorf("unexpected error for non-blocking write: got:%v want:%v", err, syscall.EAGAIN)
+	}
+	done := make(chan []byte)
+	go func() { done <- <-out }()
+	err = command.Write(ctx, &fuse.WriteRequest{Data: []byte("stop\n"), FileFlags: fuse.OpenWriteOnly}, &wresp)
+	if err != nil {
+		t.Errorf("unexpected error for blocking write: %v", err)
+	}
+	if got := string(<-done); got != "stop" {
+		t.Errorf("unexpected payload: got:%q want:%q", got, "stop")
+	}
+}
+
+// generator is a Reader that counts the calls
+// made to produce its content.
+type generator struct {
+	data  string
+	reads int
+	alls  int
+}
+
+func (g *generator) ReadAt(b []byte, off int64) (int, error) {
+	g.reads++
+	return readAt([]byte(g.data), b, off)
+}
+
+func (g *generator) ReadAll() ([]byte, error) {
+	g.alls++
+	return []byte(g.data), nil
+}
+
+func (g *generator) Size() (int64, error) { return int64(len(g.data)), nil }
+
+func TestReadAller(t *testing.T) {
+	gen := &generator{data: "port0: tacho-motor\nport1: lego-ev3-touch\n"}
+	f := ro("ports", 0444, gen)
+	NewFileSystem(0775, clock).With(f).Sync()
+
+	ctx := context.Background()
+	resp := fuse.ReadResponse{Data: make([]byte, 0, 4096)}
+	err := f.Read(ctx, &fuse.ReadRequest{Size: 4096}, &resp)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if string(resp.Data) != gen.data {
+		t.Errorf("unexpected read: got:%q want:%q", resp.Data, gen.data)
+	}
+	if gen.alls != 1 || gen.reads != 0 {
+		t.Errorf("unexpected calls for whole file read: got:%d ReadAll %d ReadAt want:1 ReadAll 0 ReadAt", gen.alls, gen.reads)
+	}
+
+	resp = fuse.ReadResponse{Data: make([]byte, 0, 8)}
+	err = f.Read(ctx, &fuse.ReadRequest{Offset: 8, Size: 8}, &resp)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if string(resp.Data) != gen.data[8:16] {
+		t.Errorf("unexpected read: got:%q want:%q", resp.Data, gen.data[8:16])
+	}
+	if gen.alls != 1 || gen.reads != 1 {
+		t.Errorf("unexpected calls for offset read: got:%d ReadAll %d ReadAt want:1 ReadAll 1 ReadAt", gen.alls, gen.reads)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	log := rw("log", 0666, NewBytes(nil)).SetFollow(true, 0)
+	data := NewBytes(nil)
+	events := ro("events", 0444, data).SetFollow(true, 0)
+	fs := NewFileSystem(0775, clock).With(log, events).Sync()
+
+	ctx := context.Background()
+	resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+	err := log.Read(ctx, &fuse.ReadRequest{Size: 16, FileFlags: fuse.OpenNonblock}, &resp)
+	if err != syscall.EAGAIN {
+		t.Errorf("unexpected error for non-blocking read at end: got:%v want:%v", err, syscall.EAGAIN)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = log.Read(cancelled, &fuse.ReadRequest{Size: 16}, &resp)
+	if err != syscall.EINTR {
+		t.Errorf("unexpected error for interrupted read at end: got:%v want:%v", err, syscall.EINTR)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- log.Read(ctx, &fuse.ReadRequest{Size: 16}, &resp)
+	}()
+	var wresp fuse.WriteResponse
+	err = log.Write(ctx, &fuse.WriteRequest{Data: []byte("link up\n")}, &wresp)
+	if err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	err = <-done
+	if err != nil {
+		t.Errorf("unexpected error for following read: %v", err)
+	}
+	if string(resp.Data) != "link up\n" {
+		t.Errorf("unexpected following read: got:%q want:%q", resp.Data, "link up\n")
+	}
+
+	eresp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+	go func() {
+		done <- events.Read(ctx, &fuse.ReadRequest{Size: 16}, &eresp)
+	}()
+	events.mu.Lock()
+	data.WriteAt([]byte("pressed\n"), 0)
+	events.mu.Unlock()
+	err = fs.NotifyChanged("events", 0, -1)
+	if err != nil {
+		t.Fatalf("unexpected error notifying change: %v", err)
+	}
+	err = <-done
+	if err != nil {
+		t.Errorf("unexpected error for following read: %v", err)
+	}
+	if string(eresp.Data) != "pressed\n" {
+		t.Errorf("unexpected following read: got:%q want:%q", eresp.Data, "pressed\n")
+	}
+}
+
+func TestFollowSizeCache(t *testing.T) {
+	dev := &countingSize{Bytes: Bytes("line\n")}
+	f := rw("log", 0666, dev).SetSizeCache(true).SetFollow(true, time.Millisecond)
+	NewFileSystem(0775, clock).With(f).Sync()
+
+	ctx := context.Background()
+	resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+	for i := 0; i < 2; i++ {
+		err := f.Read(ctx, &fuse.ReadRequest{Size: 16}, &resp)
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+	}
+	if dev.calls != 1 {
+		t.Errorf("unexpected number of Size calls with cache: got:%d want:1", dev.calls)
+	}
+
+	// Data appended without a write through the file
+	// system is seen when the waiting read polls.
+	done := make(chan error)
+	go func() {
+		resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+		done <- f.Read(ctx, &fuse.ReadRequest{Offset: 5, Size: 16}, &resp)
+	}()
+	f.mu.Lock()
+	dev.Bytes = append(dev.Bytes, "more\n"...)
+	f.mu.Unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error reading appended data: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("read did not see appended data")
+	}
+}
+
+func TestAttrMapping(t *testing.T) {
+	f := rw("speed", 0666, NewBytes(nil)).Own(0, 0)
+	dir := d("motor0", 0777).Own(0, 0).With(f)
+	fs := NewFileSystem(0775, clock).With(dir).Sync()
+	fs.SetAttrMapping(AttrMapping{MapOwners: true, Uid: 1000, Gid: 100, Umask: 0022})
+
+	ctx := context.Background()
+	for _, test := range []struct {
+		node interface {
+			Attr(context.Context, *fuse.Attr) error
+		}
+		want os.FileMode
+	}{
+		{node: f, want: 0644},
+		{node: dir, want: os.ModeDir | 0755},
+	} {
+		var a fuse.Attr
+		err := test.node.Attr(ctx, &a)
+		if err != nil {
+			t.Fatalf("unexpected error getting attributes: %v", err)
+		}
+		if a.Uid != 1000 || a.Gid != 100 {
+			t.Errorf("unexpected owner: got:%d:%d want:1000:100", a.Uid, a.Gid)
+		}
+		if a.Mode != test.want {
+			t.Errorf("unexpected mode: got:%v want:%v", a.Mode, test.want)
+		}
+	}
+
+	fs.SetAttrMapping(AttrMapping{})
+	var a fuse.Attr
+	err := f.Attr(ctx, &a)
+	if err != nil {
+		t.Fatalf("unexpected error getting attributes: %v", err)
+	}
+	if a.Uid != 0 || a.Gid != 0 || a.Mode != 0666 {
+		t.Errorf("unexpected unmapped attributes: got:%d:%d %v want:0:0 %v", a.Uid, a.Gid, a.Mode, os.FileMode(0666))
+	}
+}
+
+func TestTimeSpoofing(t *testing.T) {
+	later := epoch.Add(90*time.Minute + 1500*time.Millisecond)
+	f := rw("speed", 0666, NewBytes(nil))
+	NewFileSystem(0775, func() time.Time { return later }).With(f).Sync()
+
+	ctx := context.Background()
+	for _, test := range []struct {
+		name string
+		fn   AttrFunc
+		want time.Time
+	}{
+		{name: "fixed", fn: FixedTimes(epoch), want: epoch},
+		{name: "zero", fn: FixedTimes(time.Time{}), want: time.Unix(0, 0)},
+		{name: "quantized", fn: QuantizeTimes(time.Hour), want: later.Truncate(time.Hour)},
+		{name: "chained", fn: ChainAttrFuncs(QuantizeTimes(time.Second), nil), want: later.Truncate(time.Second)},
+	} {
+		f.SetAttrFunc(test.fn)
+		var a fuse.Attr
+		err := f.Attr(ctx, &a)
+		if err != nil {
+			t.Fatalf("unexpected error getting attributes for %s: %v", test.name, err)
+		}
+		for _, got := range []time.Time{a.Atime, a.Mtime, a.Ctime} {
+			if !got.Equal(test.want) {
+				t.Errorf("unexpected time for %s: got:%v want:%v", test.name, got, test.want)
+			}
+		}
+	}
+}
+
+// capped is a pollable device with a maximum size that
+// does not declare the Close capability.
+type capped struct {
+	Bytes
+	closed bool
+}
+
+func (c *capped) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *capped) Capabilities() Capabilities {
+	return Capabilities{Pollable: true, MaxSize: 8}
+}
+
+func TestCapabilities(t *testing.T) {
+	dev := &capped{}
+	f := rw("mode", 0666, dev)
+	events := ro("events", 0444, NewChanReader(nil))
+	NewFileSystem(0775, clock).With(f, events).Sync()
+
+	ctx := context.Background()
+	var oresp fuse.OpenResponse
+	_, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &oresp)
+	if err != nil {
+		t.Fatalf("unexpected error opening: %v", err)
+	}
+	if oresp.Flags&fuse.OpenDirectIO == 0 {
+		t.Errorf("expected direct I/O for pollable device: got flags %v", oresp.Flags)
+	}
+	var wresp fuse.WriteResponse
+	err = f.Write(ctx, &fuse.WriteRequest{Data: []byte("coast\n")}, &wresp)
+	if err != nil {
+		t.Errorf("unexpected error writing within maximum size: %v", err)
+	}
+	err = f.Write(ctx, &fuse.WriteRequest{Offset: 6, Data: []byte("brake\n")}, &wresp)
+	if err != syscall.EFBIG {
+		t.Errorf("unexpected error writing beyond maximum size: got:%v want:%v", err, syscall.EFBIG)
+	}
+	err = f.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 9}, &fuse.SetattrResponse{})
+	if err != syscall.EFBIG {
+		t.Errorf("unexpected error truncating beyond maximum size: got:%v want:%v", err, syscall.EFBIG)
+	}
+	err = f.Release(ctx, &fuse.ReleaseRequest{})
+	if err != nil {
+		t.Errorf("unexpected error releasing: %v", err)
+	}
+	if dev.closed {
+		t.Error("unexpected close of device without Close capability")
+	}
+
+	oresp = fuse.OpenResponse{}
+	_, err = events.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &oresp)
+	if err != nil {
+		t.Fatalf("unexpected error opening: %v", err)
+	}
+	if oresp.Flags&fuse.OpenNonSeekable == 0 {
+		t.Errorf("expected non-seekable open for stream device: got flags %v", oresp.Flags)
+	}
+}
+
+func TestSelfTestUnserved(t *testing.T) {
+	fs := NewFileSystem(0775, clock).Sync()
+	_, err := fs.SelfTest(context.Background())
+	if !errors.Is(err, syscall.ENOTCONN) {
+		t.Errorf("unexpected error for unserved self-test: got:%v want:%v", err, syscall.ENOTCONN)
+	}
+}
+
+func TestSelfTestProbeExempt(t *testing.T) {
+	fs := NewFileSystem(0775, clock).With(rw("value", 0666, NewBytes(nil))).Sync()
+	fs.SetReadOnly(true)
+	fs.SetPolicy(func(Op, string, fuse.Header) error { return syscall.EACCES })
+	fs.SetNamePolicy(func(string) error { return syscall.EINVAL })
+	if err := fs.SetQuota("/", 1); err != nil {
+		t.Fatalf("unexpected error setting quota: %v", err)
+	}
+	if err := fs.Freeze("/", syscall.EBUSY); err != nil {
+		t.Fatalf("unexpected error freezing: %v", err)
+	}
+
+	probe := rw(selfTestName, 0666, NewBytes(nil))
+	err := fs.bindProbe(probe)
+	if err != nil {
+		t.Fatalf("unexpected error binding probe: %v", err)
+	}
+	ctx := context.Background()
+	_, err = fs.root.Lookup(ctx, &fuse.LookupRequest{Name: selfTestName}, &fuse.LookupResponse{})
+	if err != nil {
+		t.Errorf("unexpected error looking up probe: %v", err)
+	}
+	_, err = probe.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Errorf("unexpected error opening probe: %v", err)
+	}
+	err = probe.Write(ctx, &fuse.WriteRequest{Data: []byte("probe\n")}, &fuse.WriteResponse{})
+	if err != nil {
+		t.Errorf("unexpected error writing probe: %v", err)
+	}
+	_, err = fs.root.Lookup(ctx, &fuse.LookupRequest{Name: "value"}, &fuse.LookupResponse{})
+	if err != syscall.EBUSY {
+		t.Errorf("unexpected error looking up frozen node: got:%v want:%v", err, syscall.EBUSY)
+	}
+
+	fs.unbindProbe(probe)
+	_, err = fs.root.Lookup(ctx, &fuse.LookupRequest{Name: selfTestName}, &fuse.LookupResponse{})
+	if err != syscall.EBUSY {
+		t.Errorf("unexpected error looking up removed probe: got:%v want:%v", err, syscall.EBUSY)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	mode := NewBytes([]byte("run-direct\n"))
+	var commands []string
+	command := Func(func(b []byte, _ int64) (int, error) {
+		if string(b) == "explode\n" {
+			return 0, syscall.EINVAL
+		}
+		commands = append(commands, string(b))
+		return len(b), nil
+	})
+	remote := NewFileSystem(0775, clock).With(
+		d("sensor0", 0775).With(
+			ro("value0", 0444, String("42\n")),
+			rw("mode", 0666, mode),
+			wo("command", 0222, command),
+			MustNewSymlink("device", "../device0"),
+		),
+	).Sync()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	go remote.Export(l, "sensor0")
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	imported, err := Import(conn, "sensor0", 0775)
+	if err != nil {
+		t.Fatalf("unexpected error importing: %v", err)
+	}
+	local := NewFileSystem(0775, clock).With(imported).Sync()
+
+	n, err := local.Lookup("sensor0/value0")
+	if err != nil {
+		t.Fatalf("unexpected error looking up imported node: %v", err)
+	}
+	ctx := context.Background()
+	resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+	err = n.(*RO).Read(ctx, &fuse.ReadRequest{Size: 16}, &resp)
+	if err != nil {
+		t.Errorf("unexpected error reading imported node: %v", err)
+	}
+	if string(resp.Data) != "42\n" {
+		t.Errorf("unexpected read from imported node: got:%q want:%q", resp.Data, "42\n")
+	}
+
+	n, err = local.Lookup("sensor0/mode")
+	if err != nil {
+		t.Fatalf("unexpected error looking up imported node: %v", err)
+	}
+	err = n.(*RW).Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize}, &fuse.SetattrResponse{})
+	if err != nil {
+		t.Errorf("unexpected error truncating imported node: %v", err)
+	}
+	var wresp fuse.WriteResponse
+	err = n.(*RW).Write(ctx, &fuse.WriteRequest{Data: []byte("coast\n")}, &wresp)
+	if err != nil {
+		t.Errorf("unexpected error writing imported node: %v", err)
+	}
+	if string(*mode) != "coast\n" {
+		t.Errorf("unexpected exported content: got:%q want:%q", *mode, "coast\n")
+	}
+
+	n, err = local.Lookup("sensor0/command")
+	if err != nil {
+		t.Fatalf("unexpected error looking up imported node: %v", err)
+	}
+	err = n.(*WO).Write(ctx, &fuse.WriteRequest{Data: []byte("explode\n")}, &wresp)
+	if err != syscall.EINVAL {
+		t.Errorf("unexpected error for failed remote write: got:%v want:%v", err, syscall.EINVAL)
+	}
+	err = n.(*WO).Write(ctx, &fuse.WriteRequest{Data: []byte("reset\n")}, &wresp)
+	if err != nil {
+		t.Errorf("unexpected error writing imported node: %v", err)
+	}
+	if !reflect.DeepEqual(commands, []string{"reset\n"}) {
+		t.Errorf("unexpected exported commands: got:%q want:%q", commands, []string{"reset\n"})
+	}
+
+	n, err = local.Lookup("sensor0/device")
+	if err != nil {
+		t.Fatalf("unexpected error looking up imported node: %v", err)
+	}
+	if target := n.(*Symlink).target; target != "../device0" {
+		t.Errorf("unexpected imported symlink target: got:%q want:%q", target, "../device0")
+	}
+
+	// Calls outside the listed tree are rejected.
+	remote.Bind("/", ro("secret", 0444, String("hidden\n")))
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer raw.Close()
+	c := &remoteClient{enc: gob.NewEncoder(raw), dec: gob.NewDecoder(raw)}
+	_, err = c.call(remoteIO{Op: "read", Path: "/value0", Size: 16})
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("unexpected error reading before listing tree: got:%v want:%v", err, syscall.ENOENT)
+	}
+	_, err = c.call(remoteIO{Op: "tree"})
+	if err != nil {
+		t.Fatalf("unexpected error listing tree: %v", err)
+	}
+	for _, path := range []string{"/../secret", "../secret", "/value0/../../secret"} {
+		res, err := c.call(remoteIO{Op: "read", Path: path, Size: 16})
+		if !errors.Is(err, syscall.ENOENT) {
+			t.Errorf("unexpected error reading %q: got:%v want:%v", path, err, syscall.ENOENT)
+		}
+		if len(res.Data) != 0 {
+			t.Errorf("unexpected data read from %q: %q", path, res.Data)
+		}
+	}
+	_, err = c.call(remoteIO{Op: "read", Path: "/value0", Size: -1})
+	if err != syscall.EINVAL {
+		t.Errorf("unexpected error for negative read size: got:%v want:%v", err, syscall.EINVAL)
+	}
+	res, err := c.call(remoteIO{Op: "read", Path: "/value0", Size: 1 << 40})
+	if err != io.EOF || string(res.Data) != "42\n" {
+		t.Errorf("unexpected result for large read: got:%q %v want:%q %v", res.Data, err, "42\n", io.EOF)
+	}
+}
+
+type warmup struct {
+	Bytes
+	flags []fuse.OpenFlags
+	err   error
+}
+
+func (w *warmup) Open(_ context.Context, flags fuse.OpenFlags) error {
+	w.flags = append(w.flags, flags)
+	return w.err
+}
+
+func TestOpener(t *testing.T) {
+	ok := &warmup{Bytes: Bytes("data\n")}
+	bad := &warmup{err: errno{error: errors.New("no backend"), errno: fuse.Errno(syscall.ENXIO)}}
+	dir, err := ioutil.TempDir("", "sisyphus")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	missing := OpenFileDevice(filepath.Join(dir, "missing"), os.O_RDWR, 0)
+	good := rw("good", 0666, ok)
+	failing := rw("failing", 0666, bad)
+	file := rw("file", 0666, missing)
+	NewFileSystem(0775, clock).With(good, failing, file).Sync()
+
+	ctx := context.Background()
+	var resp fuse.OpenResponse
+	_, err = good.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite | fuse.OpenNonblock}, &resp)
+	if err != nil {
+		t.Errorf("unexpected error opening: %v", err)
+	}
+	if len(ok.flags) != 1 || ok.flags[0] != fuse.OpenReadWrite|fuse.OpenNonblock {
+		t.Errorf("unexpected open flags passed to device: %v", ok.flags)
+	}
+	if got := good.Opens().Open; got != 1 {
+		t.Errorf("unexpected open count: got:%d want:1", got)
+	}
+
+	_, err = failing.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &resp)
+	if fuse.ToErrno(err) != fuse.Errno(syscall.ENXIO) {
+		t.Errorf("unexpected error opening failing device: got:%v want:%v", fuse.ToErrno(err), syscall.ENXIO)
+	}
+	if got := failing.Opens().Open; got != 0 {
+		t.Errorf("unexpected open count after failed open: got:%d want:0", got)
+	}
+
+	_, err = file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &resp)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected error opening missing file device: got:%v want:%v", err, os.ErrNotExist)
+	}
+}
+
+func TestFileDeviceReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sisyphus")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log")
+	f := OpenFileDevice(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_EXCL|os.O_APPEND, 0644)
+	for i, data := range []string{"first\n", "second\n"} {
+		_, err = f.WriteAt([]byte(data), 0)
+		if err != nil {
+			t.Fatalf("unexpected error writing %d: %v", i, err)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatalf("unexpected error closing %d: %v", i, err)
+		}
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if want := "first\nsecond\n"; string(got) != want {
+		t.Errorf("unexpected file content after reopen: got:%q want:%q", got, want)
+	}
+
+	// The file is held open until the
+	// last file handle is released.
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		err = f.Open(ctx, fuse.OpenWriteOnly)
+		if err != nil {
+			t.Fatalf("unexpected error opening %d: %v", i, err)
+		}
+	}
+	for i, open := range []bool{true, false} {
+		err = f.Close()
+		if err != nil {
+			t.Errorf("unexpected error closing handle %d: %v", i, err)
+		}
+		if (f.file != nil) != open {
+			t.Errorf("unexpected file state after closing handle %d: got open:%t want open:%t", i, f.file != nil, open)
+		}
+	}
+
+	// Provided files opened for appending
+	// are written at their end.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer file.Close()
+	_, err = NewFileDevice(file).WriteAt([]byte("third\n"), 0)
+	if err != nil {
+		t.Errorf("unexpected error writing to append mode file: %v", err)
+	}
+	got, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if want := "first\nsecond\nthird\n"; string(got) != want {
+		t.Errorf("unexpected file content after append: got:%q want:%q", got, want)
+	}
+}
+
+var errBadSpeed = errors.New("speed out of range")
+
+type disconnected struct{ String }
+
+func (disconnected) ReadAt(_ []byte, _ int64) (int, error) {
+	return 0, fmt.Errorf("port disconnected: %w", syscall.ENODEV)
+}
+
+func TestErrno(t *testing.T) {
+	err := Errno(syscall.EINVAL, "bad speed")
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Errno error does not match its errno: %v", err)
+	}
+	if got, want := err.Error(), "bad speed: invalid argument"; got != want {
+		t.Errorf("unexpected error message: got:%q want:%q", got, want)
+	}
+	var e syscall.Errno
+	if !errors.As(err, &e) || e != syscall.EINVAL {
+		t.Errorf("unexpected errno extracted: got:%v want:%v", e, syscall.EINVAL)
+	}
+	if fuse.ToErrno(err) != fuse.Errno(syscall.EINVAL) {
+		t.Errorf("unexpected FUSE errno: got:%v want:%v", fuse.ToErrno(err), syscall.EINVAL)
+	}
+
+	err = fmt.Errorf("motor0: %w", WithErrno(errBadSpeed, syscall.ERANGE))
+	if !errors.Is(err, errBadSpeed) {
+		t.Errorf("WithErrno error does not match wrapped error: %v", err)
+	}
+	if !errors.Is(err, syscall.ERANGE) {
+		t.Errorf("WithErrno error does not match its errno: %v", err)
+	}
+	if fuse.ToErrno(err) != fuse.Errno(syscall.ERANGE) {
+		t.Errorf("unexpected FUSE errno: got:%v want:%v", fuse.ToErrno(err), syscall.ERANGE)
+	}
+	if WithErrno(nil, syscall.EIO) != nil {
+		t.Error("expected nil error for nil WithErrno error")
+	}
+
+	// Rich device errors wrapping a syscall.Errno
+	// are returned to the kernel with that errno.
+	f := ro("speed", 0444, disconnected{})
+	NewFileSystem(0775, clock).With(f).Sync()
+	resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+	err = f.Read(context.Background(), &fuse.ReadRequest{Size: 16}, &resp)
+	if fuse.ToErrno(err) != fuse.Errno(syscall.ENODEV) {
+		t.Errorf("unexpected FUSE errno for device error: got:%v want:%v", fuse.ToErrno(err), syscall.ENODEV)
+	}
+	if !strings.Contains(fmt.Sprint(err), "port disconnected") {
+		t.Errorf("device error message lost: %v", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	address := ro("address", 0444, String("in1:i2c1\n"))
+	other := ro("other", 0444, String("other\n"))
+	fs := NewFileSystem(0775, clock).With(
+		d("bus", 0775).With(d("sensor0", 0775).With(address)),
+		other,
+	).Sync()
+
+	var (
+		mu  sync.Mutex
+		ops []Op
+	)
+	err := fs.SetLatency("/bus", func(op Op) time.Duration {
+		mu.Lock()
+		ops = append(ops, op)
+		mu.Unlock()
+		if op == OpRead {
+			return time.Hour
+		}
+		return 0
+	})
+	if err != nil {
+		t.Fatalf("unexpected error setting latency: %v", err)
+	}
+	if err := fs.SetLatency("/other", UniformLatency(nil, nil)); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("unexpected error setting latency on file: got:%v want:%v", err, syscall.ENOTDIR)
+	}
+
+	ctx := context.Background()
+	var oresp fuse.OpenResponse
+	_, err = address.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &oresp)
+	if err != nil {
+		t.Errorf("unexpected error opening: %v", err)
+	}
+	_, err = other.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &oresp)
+	if err != nil {
+		t.Errorf("unexpected error opening: %v", err)
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+	err = address.Read(cctx, &fuse.ReadRequest{Size: 16}, &resp)
+	if err != syscall.EINTR {
+		t.Errorf("unexpected error for interrupted delayed read: got:%v want:%v", err, syscall.EINTR)
+	}
+	mu.Lock()
+	if want := []Op{OpOpen, OpRead}; !reflect.DeepEqual(ops, want) {
+		t.Errorf("unexpected delayed operations: got:%v want:%v", ops, want)
+	}
+	mu.Unlock()
+
+	_, err = fs.Unbind("/bus")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding: %v", err)
+	}
+	if len(fs.latency) != 0 {
+		t.Errorf("latency profile retained after unbind")
+	}
+
+	p := UniformLatency(map[Op]LatencyRange{OpRead: {Min: time.Millisecond, Max: 2 * time.Millisecond}}, nil)
+	for i := 0; i < 10; i++ {
+		if l := p(OpRead); l < time.Millisecond || l >= 2*time.Millisecond {
+			t.Errorf("latency out of range: %v", l)
+		}
+	}
+	if l := p(OpWrite); l != 0 {
+		t.Errorf("unexpected latency for operation without range: %v", l)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	a := rw("a", 0666, &Bytes{})
+	b := rw("b", 0666, &Bytes{})
+	outside := rw("outside", 0666, &Bytes{})
+	fs := NewFileSystem(0775, clock).With(
+		d("data", 0775).With(a, d("sub", 0775).With(b)),
+		outside,
+	).Sync()
+
+	err := fs.SetQuota("/data", 10)
+	if err != nil {
+		t.Fatalf("unexpected error setting quota: %v", err)
+	}
+
+	ctx := context.Background()
+	write := func(f *RW, data string, off int64) error {
+		var resp fuse.WriteResponse
+		return f.Write(ctx, &fuse.WriteRequest{Data: []byte(data), Offset: off}, &resp)
+	}
+	if err := write(a, "12345", 0); err != nil {
+		t.Errorf("unexpected error writing within quota: %v", err)
+	}
+	if err := write(b, "123456", 0); err != syscall.EDQUOT {
+		t.Errorf("unexpected error writing beyond quota: got:%v want:%v", err, syscall.EDQUOT)
+	}
+	if err := write(b, "12345", 0); err != nil {
+		t.Errorf("unexpected error writing to quota: %v", err)
+	}
+	if err := write(a, "abc", 0); err != nil {
+		t.Errorf("unexpected error overwriting at quota: %v", err)
+	}
+	if err := write(outside, "123456789012", 0); err != nil {
+		t.Errorf("unexpected error writing outside quota: %v", err)
+	}
+	usage, err := fs.Usage("/data")
+	if err != nil {
+		t.Errorf("unexpected error getting usage: %v", err)
+	}
+	if usage != 10 {
+		t.Errorf("unexpected usage: got:%d want:10", usage)
+	}
+
+	var resp fuse.SetattrResponse
+	err = a.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 8}, &resp)
+	if err != syscall.EDQUOT {
+		t.Errorf("unexpected error extending beyond quota: got:%v want:%v", err, syscall.EDQUOT)
+	}
+	err = a.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 2}, &resp)
+	if err != nil {
+		t.Errorf("unexpected error truncating: %v", err)
+	}
+	if err := write(b, "6", 5); err != nil {
+		t.Errorf("unexpected error writing after truncation: %v", err)
+	}
+
+	err = fs.SetQuota("/data", -1)
+	if err != nil {
+		t.Fatalf("unexpected error removing quota: %v", err)
+	}
+	if err := write(b, "123456789012", 0); err != nil {
+		t.Errorf("unexpected error writing after removing quota: %v", err)
+	}
+}
+
+func TestQuotaIncremental(t *testing.T) {
+	dev := &countingSize{}
+	a := rw("a", 0666, dev)
+	data := d("data", 0775).With(a)
+	fs := NewFileSystem(0775, clock).With(data).Sync()
+	err := fs.SetQuota("/data", 10)
+	if err != nil {
+		t.Fatalf("unexpected error setting quota: %v", err)
+	}
+
+	ctx := context.Background()
+	write := func(f *RW, data string, off int64) error {
+		var resp fuse.WriteResponse
+		return f.Write(ctx, &fuse.WriteRequest{Data: []byte(data), Offset: off}, &resp)
+	}
+	for off := int64(0); off < 4; off++ {
+		if err := write(a, "x", off); err != nil {
+			t.Errorf("unexpected error writing within quota: %v", err)
+		}
+	}
+	if dev.calls != 1 {
+		t.Errorf("unexpected number of Size calls: got:%d want:1", dev.calls)
+	}
+
+	err = fs.Bind("/data", rw("b", 0666, NewBytes([]byte("123456"))))
+	if err != nil {
+		t.Fatalf("unexpected error binding: %v", err)
+	}
+	if err := write(a, "x", 4); err != syscall.EDQUOT {
+		t.Errorf("unexpected error writing beyond quota after bind: got:%v want:%v", err, syscall.EDQUOT)
+	}
+	if dev.calls != 2 {
+		t.Errorf("unexpected number of Size calls after bind: got:%d want:2", dev.calls)
+	}
+	_, err = fs.Unbind("/data/b")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding: %v", err)
+	}
+	if err := write(a, "x", 4); err != nil {
+		t.Errorf("unexpected error writing within quota after unbind: %v", err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	now := epoch
+	motor := d("motor0", 0775).With(ro("address", 0444, String("outA\n")))
+	fs := NewFileSystem(0775, func() time.Time { return now }).With(
+		d("sys", 0775).With(motor, d("motor1", 0775)),
+	).Sync()
+
+	_, err := fs.Unbind("/sys/motor1")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding: %v", err)
+	}
+	if len(fs.Trash()) != 0 {
+		t.Errorf("unexpected trash entries with trash disabled: %v", fs.Trash())
+	}
+
+	fs.SetTrash(time.Minute)
+	_, err = fs.Unbind("/sys/motor0")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding: %v", err)
+	}
+	trash := fs.Trash()
+	if len(trash) != 1 || trash[0].Path != "/sys/motor0" || trash[0].Node != Node(motor) {
+		t.Fatalf("unexpected trash entries: %v", trash)
+	}
+	err = fs.Restore("/sys/motor1")
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("unexpected error restoring untrashed path: got:%v want:%v", err, syscall.ENOENT)
+	}
+	err = fs.Restore("sys/motor0")
+	if err != nil {
+		t.Fatalf("unexpected error restoring: %v", err)
+	}
+	if _, err := fs.Lookup("/sys/motor0/address"); err != nil {
+		t.Errorf("unexpected error looking up restored node: %v", err)
+	}
+	if len(fs.Trash()) != 0 {
+		t.Errorf("unexpected trash entries after restore: %v", fs.Trash())
+	}
+
+	_, err = fs.Unbind("/sys/motor0")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding: %v", err)
+	}
+	fs.Bind("/sys", d("motor0", 0775))
+	err = fs.Restore("/sys/motor0")
+	if !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("unexpected error restoring over bound node: got:%v want:%v", err, syscall.EEXIST)
+	}
+
+	now = now.Add(time.Minute)
+	if len(fs.Trash()) != 0 {
+		t.Errorf("unexpected trash entries after retention time: %v", fs.Trash())
+	}
+}
+
+func TestParallelWith(t *testing.T) {
+	const (
+		dirs  = 16
+		files = 64
+	)
+	fs := NewFileSystem(0775, clock)
+	class := d("class", 0775)
+	fs.With(d("sys", 0775).With(class))
+	var wg sync.WaitGroup
+	for i := 0; i < dirs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dir := d(fmt.Sprintf("port%d", i), 0775)
+			for j := 0; j < files; j++ {
+				dir.With(ro(fmt.Sprintf("attr%d", j), 0444, String("value\n")))
+			}
+			class.With(dir)
+			fs.With(ro(fmt.Sprintf("top%d", i), 0444, String("value\n")))
+		}(i)
+	}
+	wg.Wait()
+	fs.Sync()
+
+	var n int
+	fs.walk(func(_ string, _ Node) { n++ })
+	// root, sys, class, the port directories and
+	// their files, and the top level files.
+	if want := 3 + dirs*(files+1) + dirs; n != want {
+		t.Errorf("unexpected number of nodes: got:%d want:%d", n, want)
+	}
+	if _, err := fs.Lookup("/sys/class/port7/attr63"); err != nil {
+		t.Errorf("unexpected error looking up node: %v", err)
+	}
+
+	// Nodes may be added to a synced tree
+	// while paths in it are walked.
+	for i := 0; i < dirs; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			class.With(d(fmt.Sprintf("late%d", i), 0775))
+		}(i)
+		go func() {
+			defer wg.Done()
+			fs.Lookup("/sys/class/late0")
+		}()
+	}
+	wg.Wait()
+	fs.Sync()
+	if _, err := fs.Lookup("/sys/class/late15"); err != nil {
+		t.Errorf("unexpected error looking up late node: %v", err)
+	}
+}
+
+func TestLazy(t *testing.T) {
+	var loads int
+	content := "large firmware image\n"
+	dev := NewLazy(
+		func() ([]byte, error) { loads++; return []byte(content), nil },
+		func() (int64, error) { return int64(len(content)), nil },
+		0,
+	)
+	f := ro("firmware", 0444, dev)
+	NewFileSystem(0775, clock).With(f).Sync()
+
+	ctx := context.Background()
+	var a fuse.Attr
+	err := f.Attr(ctx, &a)
+	if err != nil {
+		t.Fatalf("unexpected error getting attributes: %v", err)
+	}
+	if a.Size != uint64(len(content)) {
+		t.Errorf("unexpected size: got:%d want:%d", a.Size, len(content))
+	}
+	if dev.Loaded() || loads != 0 {
+		t.Errorf("content loaded by attribute request")
+	}
+	for i := 0; i < 2; i++ {
+		resp := fuse.ReadResponse{Data: make([]byte, 0, 64)}
+		err = f.Read(ctx, &fuse.ReadRequest{Size: 64}, &resp)
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if string(resp.Data) != content {
+			t.Errorf("unexpected content: got:%q want:%q", resp.Data, content)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("unexpected number of loads: got:%d want:1", loads)
+	}
+	_, err = dev.ReadAt(make([]byte, 8), -1)
+	if err != syscall.EINVAL {
+		t.Errorf("unexpected error for negative offset: got:%v want:%v", err, syscall.EINVAL)
+	}
+	dev.Evict()
+	if dev.Loaded() {
+		t.Error("content loaded after eviction")
+	}
+
+	idle := NewLazy(func() ([]byte, error) { return []byte(content), nil }, nil, time.Millisecond)
+	size, err := idle.Size()
+	if err != nil || size != int64(len(content)) {
+		t.Errorf("unexpected size: got:%d,%v want:%d", size, err, len(content))
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for idle.Loaded() {
+		if time.Now().After(deadline) {
+			t.Fatal("content not evicted after idle time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSinkWriter(t *testing.T) {
+	var buf bytes.Buffer
+	f := wo("firmware", 0222, NewSinkWriter(&buf))
+	NewFileSystem(0775, clock).With(f).Sync()
+
+	ctx := context.Background()
+	write := func(data string, off int64) error {
+		var resp fuse.WriteResponse
+		return f.Write(ctx, &fuse.WriteRequest{Data: []byte(data), Offset: off}, &resp)
+	}
+	for _, test := range []struct {
+		data string
+		off  int64
+		err  error
+	}{
+		{data: "block0", off: 0},
+		{data: "block1", off: 6},
+		{data: "block1", off: 6, err: syscall.ESPIPE},
+		{data: "block3", off: 18, err: syscall.ESPIPE},
+		{data: "block2", off: 12},
+	} {
+		err := write(test.data, test.off)
+		if err != test.err {
+			t.Errorf("unexpected error writing %q at %d: got:%v want:%v", test.data, test.off, err, test.err)
+		}
+	}
+	if got, want := buf.String(), "block0block1block2"; got != want {
+		t.Errorf("unexpected sink content: got:%q want:%q", got, want)
+	}
+
+	var resp fuse.SetattrResponse
+	err := f.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 0}, &resp)
+	if err != nil {
+		t.Fatalf("unexpected error truncating: %v", err)
+	}
+	if err := write("next", 0); err != nil {
+		t.Errorf("unexpected error starting new stream: %v", err)
+	}
+	if got, want := buf.String(), "block0block1block2next"; got != want {
+		t.Errorf("unexpected sink content: got:%q want:%q", got, want)
+	}
+}
+
+func TestBindChecksum(t *testing.T) {
+	data := &Bytes{}
+	f := rw("image", 0666, data)
+	fs := NewFileSystem(0775, clock).With(d("upload", 0775).With(f)).Sync()
+
+	sum, err := fs.BindChecksum("/upload/image")
+	if err != nil {
+		t.Fatalf("unexpected error binding checksum: %v", err)
+	}
+	if sum.Name() != "image.sha256" {
+		t.Errorf("unexpected checksum name: got:%q want:%q", sum.Name(), "image.sha256")
+	}
+	if _, err := fs.BindChecksum("/upload"); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("unexpected error for directory checksum: got:%v want:%v", err, syscall.EISDIR)
+	}
+
+	ctx := context.Background()
+	for _, content := range []string{"", "firmware v1\n", "firmware v2\n"} {
+		data.Truncate(0)
+		data.WriteAt([]byte(content), 0)
+
+		var a fuse.Attr
+		err = sum.Attr(ctx, &a)
+		if err != nil {
+			t.Fatalf("unexpected error getting attributes: %v", err)
+		}
+		resp := fuse.ReadResponse{Data: make([]byte, 0, 128)}
+		err = sum.Read(ctx, &fuse.ReadRequest{Size: 128}, &resp)
+		if err != nil {
+			t.Fatalf("unexpected error reading checksum: %v", err)
+		}
+		h := sha256.Sum256([]byte(content))
+		want := fmt.Sprintf("%x  image\n", h)
+		if string(resp.Data) != want {
+			t.Errorf("unexpected checksum: got:%q want:%q", resp.Data, want)
+		}
+		if a.Size != uint64(len(want)) {
+			t.Errorf("unexpected checksum size: got:%d want:%d", a.Size, len(want))
+		}
+	}
+	_, err = sum.dev.ReadAt(make([]byte, 8), -1)
+	if err != syscall.EINVAL {
+		t.Errorf("unexpected error for negative offset: got:%v want:%v", err, syscall.EINVAL)
+	}
+}
+
+func TestRotating(t *testing.T) {
+	now := epoch
+	r := NewRotating(16, time.Hour, 2, func() time.Time { return now })
+	nodes, err := r.Nodes("log", 0644)
+	if err != nil {
+		t.Fatalf("unexpected error creating nodes: %v", err)
+	}
+	NewFileSystem(0775, clock).With(d("driver", 0775).With(nodes...)).Sync()
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name())
+	}
+	if want := []string{"log", "log.1", "log.2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("unexpected node names: got:%q want:%q", names, want)
+	}
+
+	ctx := context.Background()
+	write := func(data string) {
+		var resp fuse.WriteResponse
+		err := nodes[0].(*RW).Write(ctx, &fuse.WriteRequest{Data: []byte(data), Offset: 1000}, &resp)
+		if err != nil {
+			t.Errorf("unexpected error writing %q: %v", data, err)
+		}
+	}
+	read := func(i int) string {
+		var (
+			resp = fuse.ReadResponse{Data: make([]byte, 0, 64)}
+			err  error
+		)
+		switch n := nodes[i].(type) {
+		case *RW:
+			err = n.Read(ctx, &fuse.ReadRequest{Size: 64}, &resp)
+		case *RO:
+			err = n.Read(ctx, &fuse.ReadRequest{Size: 64}, &resp)
+		}
+		if err != nil {
+			t.Errorf("unexpected error reading %s: %v", nodes[i].Name(), err)
+		}
+		return string(resp.Data)
+	}
+
+	write("boot\n")
+	write("probe ok\n")
+	write("link up\n") // Exceeds 16 bytes.
+	now = now.Add(time.Hour)
+	write("link down\n") // Exceeds age.
+	write("resetting\n") // Exceeds 16 bytes, retiring the first generation.
+
+	for i, want := range []string{"resetting\n", "link down\n", "link up\n"} {
+		if got := read(i); got != want {
+			t.Errorf("unexpected content of %s: got:%q want:%q", nodes[i].Name(), got, want)
+		}
+	}
+	if g := r.Generation(3); g != nil {
+		t.Errorf("unexpected generation beyond retention: %q", g)
+	}
+	r.Rotate()
+	if got := read(0); got != "" {
+		t.Errorf("unexpected content after rotation: %q", got)
+	}
+	if got := read(1); got != "resetting\n" {
+		t.Errorf("unexpected content of first generation after rotation: got:%q want:%q", got, "resetting\n")
+	}
+}
+
+func TestRunner(t *testing.T) {
+	fs := NewFileSystem(0775, clock)
+	r := fs.Runner()
+
+	var (
+		mu      sync.Mutex
+		running int
+		starts  int
+	)
+	loop := func(ctx context.Context) {
+		mu.Lock()
+		running++
+		starts++
+		mu.Unlock()
+		<-ctx.Done()
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+	state := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return running, starts
+	}
+	wait := func(want int) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if n, _ := state(); n == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d running functions", want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	r.Go(loop)
+	time.Sleep(10 * time.Millisecond)
+	if n, _ := state(); n != 0 {
+		t.Errorf("function started before runner: %d running", n)
+	}
+	r.Start()
+	wait(1)
+	r.Go(loop)
+	wait(2)
+	r.Start()
+	r.Stop()
+	if n, s := state(); n != 0 || s != 2 {
+		t.Errorf("unexpected state after stop: running:%d starts:%d want:0 2", n, s)
+	}
+	r.Stop()
+
+	r.Start()
+	wait(2)
+	fs.Destroy()
+	if n, s := state(); n != 0 || s != 4 {
+		t.Errorf("unexpected state after destroy: running:%d starts:%d want:0 4", n, s)
+	}
+}
+
+func TestDirFactory(t *testing.T) {
+	var made []string
+	sensor := d("sensor0", 0775).SetFactory(func(name string) (Node, error) {
+		var i int
+		_, err := fmt.Sscanf(name, "value%d", &i)
+		if err != nil || name != fmt.Sprintf("value%d", i) || i < 0 || i > 7 {
+			return nil, nil
+		}
+		made = append(made, name)
+		return NewRO(name, 0444, String(fmt.Sprintf("%d\n", i)))
+	})
+	fsys := NewFileSystem(0775, clock).With(d("lego-sensor", 0775).With(sensor)).Sync()
+
+	ctx := context.Background()
+	lookup := func(name string) (interface{}, error) {
+		return sensor.Lookup(ctx, &fuse.LookupRequest{Name: name}, &fuse.LookupResponse{})
+	}
+	for _, name := range []string{"value8", "mode"} {
+		_, err := lookup(name)
+		if err != fuse.ENOENT {
+			t.Errorf("unexpected error looking up %q: got:%v want:%v", name, err, fuse.ENOENT)
+		}
+	}
+	n, err := lookup("value3")
+	if err != nil {
+		t.Fatalf("unexpected error looking up value3: %v", err)
+	}
+	got, err := readAll(n.(*RO).dev)
+	if err != nil {
+		t.Errorf("unexpected error reading value3: %v", err)
+	}
+	if string(got) != "3\n" {
+		t.Errorf("unexpected value3 content: got:%q want:%q", got, "3\n")
+	}
+	again, err := lookup("value3")
+	if err != nil {
+		t.Fatalf("unexpected error looking up value3 again: %v", err)
+	}
+	if again != n {
+		t.Error("expected repeated lookup to return the bound node")
+	}
+	if !reflect.DeepEqual(made, []string{"value3"}) {
+		t.Errorf("unexpected factory calls: got:%q want:%q", made, []string{"value3"})
+	}
+	if p := fsys.path(n.(Node)); p != "/lego-sensor/sensor0/value3" {
+		t.Errorf("unexpected path of created node: got:%q want:%q", p, "/lego-sensor/sensor0/value3")
+	}
+}
+
+func TestValidateTree(t *testing.T) {
+	address := ro("address", 0444, String("outA\n"))
+	motor := d("motor0", 0775)
+	motor.With(address, rw("speed_sp", 0666, NewBytes(nil)), wo("command", 0222, NewBytes(nil)))
+	fs := NewFileSystem(0775, clock).With(d("tacho-motor", 0775).With(motor)).Sync()
+	err := fs.Validate()
+	if err != nil {
+		t.Fatalf("unexpected error validating valid tree: %v", err)
+	}
+
+	address.mode = 0644
+	motor.With(
+		rw("Speed_SP", 0666, NewBytes(nil)),
+		&WO{name: "reset", attr: attr{mode: 0622}},
+		MustNewSymlink("port", ""),
+	)
+	err = fs.Validate()
+	verr, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("unexpected error type: got:%T want:%T", err, ValidationError(nil))
+	}
+	want := []string{
+		`/tacho-motor/motor0: names "Speed_SP" and "speed_sp" are equal under case folding`,
+		`/tacho-motor/motor0/address: mode -rw-r--r-- grants write permission`,
+		`/tacho-motor/motor0/port: symbolic link has no target`,
+		`/tacho-motor/motor0/reset: nil device`,
+		`/tacho-motor/motor0/reset: mode -rw--w--w- grants read permission`,
+	}
+	if len(verr) != len(want) {
+		t.Fatalf("unexpected number of violations: got:%d want:%d\n%v", len(verr), len(want), verr)
+	}
+	for i, err := range verr {
+		if err.Error() != want[i] {
+			t.Errorf("unexpected violation %d: got:%q want:%q", i, err, want[i])
+		}
+	}
+}
+
+func TestQuiesce(t *testing.T) {
+	speed := rw("speed_sp", 0666, NewBytes([]byte("0\n")))
+	fs := NewFileSystem(0775, clock).With(speed).Sync()
+
+	// Simulate a write request in progress.
+	done, err := fs.check(context.Background(), OpWrite, speed)
+	if err != nil {
+		t.Fatalf("unexpected error checking write: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = fs.Quiesce(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("unexpected error quiescing with write in progress: got:%v want:%v", err, context.DeadlineExceeded)
+	}
+	write := func() error {
+		var resp fuse.WriteResponse
+		return speed.Write(context.Background(), &fuse.WriteRequest{Data: []byte("100\n")}, &resp)
+	}
+	err = write()
+	if err != nil {
+		t.Errorf("unexpected error writing after failed quiesce: %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		done()
+	}()
+	release, err := fs.Quiesce(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error quiescing: %v", err)
+	}
+
+	written := make(chan error)
+	go func() { written <- write() }()
+	select {
+	case err := <-written:
+		t.Fatalf("unexpected write completion while quiesced: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	var buf bytes.Buffer
+	err = fs.SaveState(&buf)
+	if err != nil {
+		t.Errorf("unexpected error saving state: %v", err)
+	}
+	release()
+	release()
+	err = <-written
+	if err != nil {
+		t.Errorf("unexpected error writing after release: %v", err)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	speed := rw("speed_sp", 0666, NewBytes([]byte("0\n")))
+	address := ro("address", 0444, String("outA\n"))
+	motor := d("motor0", 0775)
+	motor.With(speed, address)
+	fs := NewFileSystem(0775, clock).With(d("tacho-motor", 0775).With(motor)).Sync()
+
+	ctx := context.Background()
+	read := func(f interface {
+		Read(context.Context, *fuse.ReadRequest, *fuse.ReadResponse) error
+	}) error {
+		resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+		return f.Read(ctx, &fuse.ReadRequest{Size: 16}, &resp)
+	}
+
+	err := fs.Freeze("tacho-motor/motor0", 0)
+	if err != nil {
+		t.Fatalf("unexpected error freezing: %v", err)
+	}
+	if err := read(address); err != syscall.EBUSY {
+		t.Errorf("unexpected error reading frozen node: got:%v want:%v", err, syscall.EBUSY)
+	}
+	var wresp fuse.WriteResponse
+	err = speed.Write(ctx, &fuse.WriteRequest{Data: []byte("100\n")}, &wresp)
+	if err != syscall.EBUSY {
+		t.Errorf("unexpected error writing frozen node: got:%v want:%v", err, syscall.EBUSY)
+	}
+	_, err = motor.Lookup(ctx, &fuse.LookupRequest{Name: "address"}, &fuse.LookupResponse{})
+	if err != syscall.EBUSY {
+		t.Errorf("unexpected error looking up in frozen directory: got:%v want:%v", err, syscall.EBUSY)
+	}
+	var a fuse.Attr
+	err = speed.Attr(ctx, &a)
+	if err != nil {
+		t.Errorf("unexpected error getting attributes of frozen node: %v", err)
+	}
+
+	err = fs.Freeze("tacho-motor/motor0/speed_sp", syscall.EAGAIN)
+	if err != nil {
+		t.Fatalf("unexpected error freezing: %v", err)
+	}
+	err = fs.Thaw("tacho-motor/motor0")
+	if err != nil {
+		t.Fatalf("unexpected error thawing: %v", err)
+	}
+	if err := read(address); err != nil {
+		t.Errorf("unexpected error reading thawed node: %v", err)
+	}
+	if err := read(speed); err != syscall.EAGAIN {
+		t.Errorf("unexpected error reading separately frozen node: got:%v want:%v", err, syscall.EAGAIN)
+	}
+
+	_, err = fs.Unbind("tacho-motor/motor0/speed_sp")
+	if err != nil {
+		t.Fatalf("unexpected error unbinding: %v", err)
+	}
+	err = fs.Bind("tacho-motor/motor0", speed)
+	if err != nil {
+		t.Fatalf("unexpected error binding: %v", err)
+	}
+	if err := read(speed); err != nil {
+		t.Errorf("unexpected error reading rebound node: %v", err)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	status := ro("status", 0444, String("running\n"))
+	image := ro("image", 0444, String("large\n"))
+	other := ro("other", 0444, String("other\n"))
+	fs := NewFileSystem(0775, clock).With(
+		d("control", 0775).With(status),
+		d("data", 0775).With(image),
+		other,
+	).Sync()
+	if err := fs.SetPriority("/control", High); err != nil {
+		t.Fatalf("unexpected error setting priority: %v", err)
+	}
+	if err := fs.SetPriority("/data", Bulk); err != nil {
+		t.Fatalf("unexpected error setting priority: %v", err)
+	}
+	fs.SetBulkLimit(1)
+
+	read := func(ctx context.Context, f *RO) error {
+		resp := fuse.ReadResponse{Data: make([]byte, 0, 16)}
+		return f.Read(ctx, &fuse.ReadRequest{Size: 16}, &resp)
+	}
+
+	overloaded := context.WithValue(context.Background(), overloadKey{}, true)
+	if err := read(overloaded, status); err != nil {
+		t.Errorf("unexpected error reading high priority node while overloaded: %v", err)
+	}
+	if err := read(overloaded, other); err != syscall.EAGAIN {
+		t.Errorf("unexpected error reading normal node while overloaded: got:%v want:%v", err, syscall.EAGAIN)
+	}
+
+	if err := read(context.Background(), image); err != nil {
+		t.Errorf("unexpected error reading bulk node: %v", err)
+	}
+	// Simulate a bulk read in progress.
+	done, err := fs.check(context.Background(), OpRead, image)
+	if err != nil {
+		t.Fatalf("unexpected error checking bulk read: %v", err)
+	}
+	waiting, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := read(waiting, image); err != syscall.EINTR {
+		t.Errorf("unexpected error for bulk read waiting beyond limit: got:%v want:%v", err, syscall.EINTR)
+	}
+	if err := read(context.Background(), other); err != nil {
+		t.Errorf("unexpected error reading normal node during bulk read: %v", err)
+	}
+	done()
+	second, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := read(second, image); err != nil {
+		t.Errorf("unexpected error reading bulk node after completion: %v", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	speed := rw("speed", 0666, &Bytes{})
+	command := wo("command", 0222, &Bytes{})
+	fs := NewFileSystem(0775, clock).With(d("motor0", 0775).With(speed, command)).Sync()
+
+	var started, ended []uint32
+	fs.SetHooks(Hooks{
+		SessionStart: func(s Session) { started = append(started, s.Pid) },
+		SessionEnd:   func(s Session) { ended = append(ended, s.Pid) },
+	})
+
+	client := func(pid uint32) context.Context {
+		return context.WithValue(context.Background(), requestKey{}, fuse.Header{Pid: pid, Uid: 1000, Gid: 100})
+	}
+	open := func(pid uint32, f *RW) {
+		var resp fuse.OpenResponse
+		_, err := f.Open(client(pid), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &resp)
+		if err != nil {
+			t.Fatalf("unexpected error opening: %v", err)
+		}
+	}
+	open(10, speed)
+	var resp fuse.OpenResponse
+	_, err := command.Open(client(10), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &resp)
+	if err != nil {
+		t.Fatalf("unexpected error opening: %v", err)
+	}
+	open(20, speed)
+	if want := []uint32{10, 20}; !reflect.DeepEqual(started, want) {
+		t.Errorf("unexpected started sessions: got:%v want:%v", started, want)
+	}
+	sessions := fs.Sessions()
+	if len(sessions) != 2 {
+		t.Fatalf("unexpected number of sessions: got:%d want:2", len(sessions))
+	}
+	want := map[string]int{"/motor0/speed": 1, "/motor0/command": 1}
+	if sessions[0].Pid != 10 || sessions[0].Uid != 1000 || !reflect.DeepEqual(sessions[0].Open, want) {
+		t.Errorf("unexpected session: %+v", sessions[0])
+	}
+
+	// A release without a process ID is attributed
+	// to the earliest session holding a handle.
+	err = speed.Release(client(0), &fuse.ReleaseRequest{Flags: fuse.OpenWriteOnly})
+	if err != nil {
+		t.Fatalf("unexpected error releasing: %v", err)
+	}
+	err = command.Release(client(10), &fuse.ReleaseRequest{Flags: fuse.OpenWriteOnly})
+	if err != nil {
+		t.Fatalf("unexpected error releasing: %v", err)
+	}
+	if want := []uint32{10}; !reflect.DeepEqual(ended, want) {
+		t.Errorf("unexpected ended sessions: got:%v want:%v", ended, want)
+	}
+	sessions = fs.Sessions()
+	if len(sessions) != 1 || sessions[0].Pid != 20 || sessions[0].Open["/motor0/speed"] != 1 {
+		t.Errorf("unexpected sessions: %+v", sessions)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	now := epoch
+	speed := rw("speed", 0666, &Bytes{})
+	fs := NewFileSystem(0775, func() time.Time { return now }).With(speed).Sync()
+	var ended []uint32
+	fs.SetHooks(Hooks{
+		SessionEnd: func(s Session) { ended = append(ended, s.Pid) },
+	})
+
+	fs.seen(&fuse.Header{Pid: 10})
+	_, err := speed.Open(context.WithValue(context.Background(), requestKey{}, fuse.Header{Pid: 20}), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("unexpected error opening: %v", err)
+	}
+	now = now.Add(sessionIdle)
+	fs.seen(&fuse.Header{Pid: 30})
+	if want := []uint32{10}; !reflect.DeepEqual(ended, want) {
+		t.Errorf("unexpected ended sessions: got:%v want:%v", ended, want)
+	}
+	var pids []uint32
+	for _, s := range fs.Sessions() {
+		pids = append(pids, s.Pid)
+	}
+	if want := []uint32{20, 30}; !reflect.DeepEqual(pids, want) {
+		t.Errorf("unexpected sessions: got:%v want:%v", pids, want)
+	}
+
+	ended = nil
+	for pid := uint32(100); pid < 100+maxSessions; pid++ {
+		now = now.Add(time.Millisecond)
+		fs.seen(&fuse.Header{Pid: pid})
+	}
+	if n := len(fs.Sessions()); n != maxSessions {
+		t.Errorf("unexpected number of sessions: got:%d want:%d", n, maxSessions)
+	}
+	if want := []uint32{30, 100}; !reflect.DeepEqual(ended, want) {
+		t.Errorf("unexpected sessions ended by limit: got:%v want:%v", ended, want)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sisyphustest implements conformance tests for sisyphus devices.
+//
+// The tests check the semantics that sisyphus nodes rely on:
+//
+//   - ReadAt follows the io.ReaderAt contract. A read that returns fewer
+//     bytes than requested returns a non-nil error, which is io.EOF at the
+//     end of the data. A read that fills the buffer returns either nil or
+//     io.EOF, but may only return io.EOF if it reaches the end of the data.
+//     A read at or beyond the end of the data returns zero bytes and io.EOF.
+//     A read at a negative offset returns a non-nil error.
+//   - Size returns the length of the data that ReadAt serves.
+//   - WriteAt follows the io.WriterAt contract as described for
+//     sisyphus.Writer. Writes overwrite existing data without truncating it
+//     and writes beyond the end of the data extend it, filling any gap with
+//     zeros. A write at a negative offset returns a non-nil error.
+//   - Truncate sets the length of the data to the given size, discarding
+//     data beyond it.
+package sisyphustest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ev3go/sisyphus"
+)
+
+// TestReader tests that reading from r returns the expected content
+// and that r follows the sisyphus Reader contract. It returns an error
+// describing the first failure found.
+func TestReader(r sisyphus.Reader, content []byte) error {
+	size, err := r.Size()
+	if err != nil {
+		return fmt.Errorf("Size: unexpected error: %v", err)
+	}
+	if size != int64(len(content)) {
+		return fmt.Errorf("Size: got:%d want:%d", size, len(content))
+	}
+
+	for off := 0; off <= len(content); off++ {
+		for _, n := range []int{1, 2, 3, len(content) - off, len(content) - off + 1, len(content) + 1} {
+			if n <= 0 {
+				continue
+			}
+			err := checkRead(r, content, off, n)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	n, err := r.ReadAt(make([]byte, 1), int64(len(content)+1))
+	if n != 0 || err != io.EOF {
+		return fmt.Errorf("ReadAt(len=1, off=%d): got:(%d, %v) want:(0, EOF)", len(content)+1, n, err)
+	}
+	_, err = r.ReadAt(make([]byte, 1), -1)
+	if err == nil {
+		return fmt.Errorf("ReadAt(len=1, off=-1): expected error")
+	}
+	return nil
+}
+
+// checkRead checks a read of n bytes from r at off against content.
+func checkRead(r io.ReaderAt, content []byte, off, n int) error {
+	b := make([]byte, n)
+	got, err := r.ReadAt(b, int64(off))
+	want := content[off:]
+	if len(want) > n {
+		want = want[:n]
+	}
+	if !bytes.Equal(b[:got], want) {
+		return fmt.Errorf("ReadAt(len=%d, off=%d): got data:%q want:%q", n, off, b[:got], want)
+	}
+	switch {
+	case got < n:
+		if err != io.EOF {
+			return fmt.Errorf("ReadAt(len=%d, off=%d): short read of %d bytes returned error %v, want EOF", n, off, got, err)
+		}
+	case off+got < len(content):
+		if err != nil {
+			return fmt.Errorf("ReadAt(len=%d, off=%d): full read before end of data returned error %v", n, off, err)
+		}
+	default:
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("ReadAt(len=%d, off=%d): full read at end of data returned error %v", n, off, err)
+		}
+	}
+	return nil
+}
+
+// TestReadWriter tests that dev follows the sisyphus ReadWriter contract.
+// It truncates dev to zero length before testing and leaves it holding
+// arbitrary data. It returns an error describing the first failure found.
+func TestReadWriter(dev sisyphus.ReadWriter) error {
+	err := dev.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("Truncate(0): unexpected error: %v", err)
+	}
+	err = TestReader(dev, nil)
+	if err != nil {
+		return fmt.Errorf("after Truncate(0): %v", err)
+	}
+
+	var want []byte
+	for _, w := range []struct {
+		data string
+		off  int
+	}{
+		{data: "hello world", off: 0},
+		{data: "J", off: 0},
+		{data: "there", off: 6},
+		{data: "!", off: 11},
+		{data: "gap", off: 15},
+	} {
+		n, err := dev.WriteAt([]byte(w.data), int64(w.off))
+		if err != nil {
+			return fmt.Errorf("WriteAt(%q, off=%d): unexpected error: %v", w.data, w.off, err)
+		}
+		if n != len(w.data) {
+			return fmt.Errorf("WriteAt(%q, off=%d): got count:%d want:%d", w.data, w.off, n, len(w.data))
+		}
+		if end := w.off + len(w.data); end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[w.off:], w.data)
+		err = TestReader(dev, want)
+		if err != nil {
+			return fmt.Errorf("after WriteAt(%q, off=%d): %v", w.data, w.off, err)
+		}
+	}
+
+	_, err = dev.WriteAt([]byte("x"), -1)
+	if err == nil {
+		return fmt.Errorf("WriteAt(%q, off=-1): expected error", "x")
+	}
+
+	for _, size := range []int{5, 0} {
+		err = dev.Truncate(int64(size))
+		if err != nil {
+			return fmt.Errorf("Truncate(%d): unexpected error: %v", size, err)
+		}
+		err = TestReader(dev, want[:size])
+		if err != nil {
+			return fmt.Errorf("after Truncate(%d): %v", size, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphustest
+
+import (
+	"testing"
+
+	"github.com/ev3go/sisyphus"
+)
+
+func TestDevices(t *testing.T) {
+	const content = "ev3-ports:outA\n"
+	for _, test := range []struct {
+		name string
+		dev  sisyphus.Reader
+	}{
+		{name: "String", dev: sisyphus.String(content)},
+		{name: "Bytes", dev: sisyphus.NewBytes([]byte(content))},
+		{name: "MutableString", dev: sisyphus.NewMutableString(content)},
+	} {
+		err := TestReader(test.dev, []byte(content))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+
+	bounded, err := sisyphus.NewBoundedBytes(nil, 64)
+	if err != nil {
+		t.Fatalf("unexpected error creating bounded bytes: %v", err)
+	}
+	encrypted, err := sisyphus.NewEncryptedBytes(make([]byte, 32), nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating encrypted bytes: %v", err)
+	}
+	bin, err := sisyphus.NewBinAttr(nil, 64)
+	if err != nil {
+		t.Fatalf("unexpected error creating binary attribute: %v", err)
+	}
+	versioned, err := sisyphus.NewVersioned(sisyphus.NewBytes(nil), 1, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating versioned: %v", err)
+	}
+	for _, test := range []struct {
+		name string
+		dev  sisyphus.ReadWriter
+	}{
+		{name: "Bytes", dev: sisyphus.NewBytes(nil)},
+		{name: "BoundedBytes", dev: bounded},
+		{name: "BinAttr", dev: bin},
+		{name: "EncryptedBytes", dev: encrypted},
+		{name: "ObservableBytes", dev: sisyphus.NewObservableBytes(nil)},
+		{name: "Versioned", dev: versioned},
+	} {
+		err := TestReadWriter(test.dev)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
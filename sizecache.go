@@ -0,0 +1,59 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+// sizeCache holds the last successful Size result of a file node's device
+// so that Attr does not call into the device on each request. A sizeCache
+// is protected by the lock of the node holding it.
+type sizeCache struct {
+	enabled bool
+	valid   bool
+	size    int64
+}
+
+// setEnabled sets whether sizes are cached, discarding any cached size.
+func (c *sizeCache) setEnabled(enabled bool) {
+	*c = sizeCache{enabled: enabled}
+}
+
+// get returns the size of dev, calling Size only if caching is disabled
+// or the cached size is not valid.
+func (c *sizeCache) get(filesys *FileSystem, dev interface{ Size() (int64, error) }) (int64, error) {
+	if c.valid {
+		return c.size, nil
+	}
+	size, err := filesys.deviceSize(dev)
+	if err == nil && c.enabled {
+		c.size = size
+		c.valid = true
+	}
+	return size, err
+}
+
+// set records size as the size of the device.
+func (c *sizeCache) set(size int64) {
+	if c.enabled {
+		c.size = size
+		c.valid = true
+	}
+}
+
+// invalidate discards the cached size.
+func (c *sizeCache) invalidate() {
+	c.valid = false
+}
+
+// sizeInvalidator is implemented by nodes that cache device sizes.
+type sizeInvalidator interface {
+	InvalidateSize()
+}
+
+// invalidateSize discards the cached device size of n if it has one.
+// invalidateSize must not be called with n's lock held.
+func invalidateSize(n Node) {
+	if c, ok := n.(sizeInvalidator); ok {
+		c.InvalidateSize()
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Snapshot returns a read only copy of the file system holding the
+// structure, attributes and current content of its nodes. File nodes in
+// the snapshot are RO nodes backed by a copy of the content read from the
+// original device at the time of the snapshot, so reading devices with
+// side effects, such as an Exec, will invoke them. Devices are read after
+// the structure of the file system has been copied, so that slow devices
+// do not hold up other operations on the file system. Devices with the
+// Stream capability and Concurrent devices, which may block until data
+// arrives, are not read and are copied as empty RO nodes, as are WO nodes.
+// Write permission bits are removed from all copied nodes. Writes made
+// while the snapshot is taken may be excluded using Quiesce.
+func (fs *FileSystem) Snapshot() (*FileSystem, error) {
+	now := fs.now()
+	fs.root.mu.Lock()
+	snap := NewFileSystem(fs.root.mode, func() time.Time { return now })
+	fs.root.mu.Unlock()
+
+	// attrs holds the attributes of each
+	// snapshot node, applied after the
+	// snapshot is synced.
+	attrs := make(map[Node]attr)
+
+	// reads holds the content of each
+	// snapshot file node to be read from
+	// its original node.
+	type read struct {
+		n    Node
+		data *Bytes
+	}
+	var reads []read
+
+	dirs := map[string]*Dir{"/": snap.root}
+	fs.walk(func(path string, n Node) {
+		var (
+			s Node
+			a attr
+		)
+		switch n := n.(type) {
+		case *Dir:
+			n.mu.Lock()
+			a = n.attr
+			n.mu.Unlock()
+			if n == fs.root {
+				a.mode &^= 0222
+				attrs[snap.root] = a
+				return
+			}
+			d, _ := NewDir(n.name, a.mode)
+			dirs[path] = d
+			s = d
+		case *RO:
+			n.mu.Lock()
+			a = n.attr
+			n.mu.Unlock()
+			data := NewBytes(nil)
+			reads = append(reads, read{n: n, data: data})
+			s, _ = NewRO(n.name, a.mode&^0222, data)
+		case *RW:
+			n.mu.Lock()
+			a = n.attr
+			n.mu.Unlock()
+			data := NewBytes(nil)
+			reads = append(reads, read{n: n, data: data})
+			s, _ = NewRO(n.name, a.mode&^0222, data)
+		case *WO:
+			n.mu.Lock()
+			a = n.attr
+			n.mu.Unlock()
+			s, _ = NewRO(n.name, a.mode&^0222, String(""))
+		case *Symlink:
+			n.mu.Lock()
+			a = n.attr
+			n.mu.Unlock()
+			s, _ = NewSymlink(n.name, n.target)
+		default:
+			return
+		}
+		a.mode &^= 0222
+		attrs[s] = a
+		dirs[filepath.Dir(path)].With(s)
+	})
+	for _, r := range reads {
+		var err error
+		switch n := r.n.(type) {
+		case *RO:
+			*r.data, err = snapshotDevice(&n.mu, n, n.dev)
+		case *RW:
+			*r.data, err = snapshotDevice(&n.mu, n, n.dev)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	snap.Sync()
+
+	for n, a := range attrs {
+		switch n := n.(type) {
+		case *Dir:
+			n.attr = a
+		case *RO:
+			n.attr = a
+		case *Symlink:
+			n.attr = a
+		}
+	}
+	snap.SetReadOnly(true)
+	return snap, nil
+}
+
+// FreezeAt serves a read only snapshot of the file system, as returned
+// by Snapshot, mounted at mnt. The original file system is not affected
+// and continues to change. It is the responsibility of the caller to close
+// the returned io.Closer when the snapshot is no longer required.
+func (fs *FileSystem) FreezeAt(mnt string, mntopts ...fuse.MountOption) (io.Closer, error) {
+	snap, err := fs.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return Serve(mnt, snap, nil, mntopts...)
+}
+
+// snapshotDevice returns the content of dev, the device of the node n
+// whose lock is mu. The device is read with mu held. Stream and Concurrent
+// devices are not read. snapshotDevice must not be called with the file
+// system's lock held.
+func snapshotDevice(mu *sync.Mutex, n Node, dev io.ReaderAt) ([]byte, error) {
+	if _, ok := dev.(Concurrent); ok || capabilities(dev).Stream {
+		return nil, nil
+	}
+	filesys := n.Sys()
+	mu.Lock()
+	defer mu.Unlock()
+	defer filesys.enterDevice(n)()
+	return readAll(dev)
+}
@@ -0,0 +1,135 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// state is the persisted form of node content.
+type state struct {
+	// Nodes holds the content of each
+	// persisted node keyed by absolute
+	// path.
+	Nodes map[string][]byte `json:"nodes"`
+}
+
+// SaveState writes the content of every node backed by a *Bytes,
+// *BoundedBytes, *Counter or *MutableString device to w. The structure of
+// the file system is not saved. Writes made while the state is saved may
+// be excluded using Quiesce.
+func (fs *FileSystem) SaveState(w io.Writer) error {
+	s := state{Nodes: make(map[string][]byte)}
+	var err error
+	fs.walk(func(path string, n Node) {
+		if err != nil {
+			return
+		}
+		dev, mu := stateDevice(n)
+		if dev == nil {
+			return
+		}
+		mu.Lock()
+		s.Nodes[path], err = readAll(dev)
+		mu.Unlock()
+	})
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(s)
+}
+
+// LoadState restores node content written by SaveState from r. Saved nodes
+// that are not present in the file system or that are not backed by a
+// device that can be restored are ignored. If the file system is being
+// served, the kernel cache of each restored node is invalidated.
+func (fs *FileSystem) LoadState(r io.Reader) error {
+	var s state
+	err := json.NewDecoder(r).Decode(&s)
+	if err != nil {
+		return err
+	}
+	var restored []Node
+	fs.walk(func(path string, n Node) {
+		if err != nil {
+			return
+		}
+		data, ok := s.Nodes[path]
+		if !ok {
+			return
+		}
+		dev, mu := stateDevice(n)
+		if dev == nil {
+			return
+		}
+		mu.Lock()
+		err = restoreDevice(dev, data)
+		mu.Unlock()
+		restored = append(restored, n)
+	})
+	for _, n := range restored {
+		invalidateSize(n)
+	}
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	server := fs.server
+	fs.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	for _, n := range restored {
+		err = fs.Invalidate(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stateDevice returns the device of n if it can be persisted
+// by SaveState, and the lock of n protecting the device.
+func stateDevice(n Node) (io.ReaderAt, sync.Locker) {
+	var (
+		dev io.ReaderAt
+		mu  sync.Locker
+	)
+	switch n := n.(type) {
+	case *RO:
+		dev, mu = n.dev, &n.mu
+	case *RW:
+		dev, mu = n.dev, &n.mu
+	default:
+		return nil, nil
+	}
+	switch dev.(type) {
+	case *Bytes, *BoundedBytes, *Counter, *MutableString:
+		return dev, mu
+	}
+	return nil, nil
+}
+
+// restoreDevice replaces the content of dev with data.
+func restoreDevice(dev io.ReaderAt, data []byte) error {
+	switch dev := dev.(type) {
+	case *MutableString:
+		dev.Store(string(data))
+		return nil
+	case ReadWriter:
+		err := dev.Truncate(0)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		_, err = dev.WriteAt(data, 0)
+		return err
+	}
+	return nil
+}
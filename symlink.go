@@ -0,0 +1,134 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Symlink is a symbolic link node.
+type Symlink struct {
+	mu sync.Mutex
+
+	name string
+	attr
+
+	target string
+
+	fs *FileSystem
+}
+
+var (
+	_ Node               = (*Symlink)(nil)
+	_ fs.Node            = (*Symlink)(nil)
+	_ fs.NodeReadlinker  = (*Symlink)(nil)
+	_ fs.NodeGetxattrer  = (*Symlink)(nil)
+	_ fs.NodeListxattrer = (*Symlink)(nil)
+)
+
+// NewSymlink returns a new Symlink with the given name pointing to target.
+func NewSymlink(name, target string) (*Symlink, error) {
+	if !validName(name) {
+		return nil, ErrBadName
+	}
+	return &Symlink{
+		name: name,
+		attr: attr{
+			mode: os.ModeSymlink | 0777,
+		},
+		target: target,
+	}, nil
+}
+
+// MustNewSymlink returns a new Symlink with the given name pointing to
+// target. It will panic if name is not a valid base name.
+func MustNewSymlink(name, target string) *Symlink {
+	l, err := NewSymlink(name, target)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// Own sets the uid and gid of the link. If the link is bound to a file
+// system, its change time is updated. Own may be called before the link
+// is bound.
+func (l *Symlink) Own(uid, gid uint32) *Symlink {
+	l.mu.Lock()
+	l.own(l.fs, uid, gid)
+	l.mu.Unlock()
+	return l
+}
+
+// Name returns the name of the link.
+func (l *Symlink) Name() string { return l.name }
+
+// Target returns the target of the link.
+func (l *Symlink) Target() string { return l.target }
+
+// SetSys sets the link's containing file system.
+func (l *Symlink) SetSys(filesys *FileSystem) {
+	l.mu.Lock()
+	l.fs = filesys
+	var now time.Time
+	if filesys != nil {
+		now = filesys.now()
+	}
+	l.ctime = now
+	l.atime = now
+	l.mtime = now
+	l.mu.Unlock()
+}
+
+// Sys returns the link's containing filesystem.
+func (l *Symlink) Sys() *FileSystem {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fs
+}
+
+// Attr satisfies the bazil.org/fuse/fs.Node interface.
+func (l *Symlink) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	defer l.Sys().trace(OpAttr, l)(&err)
+
+	l.mu.Lock()
+	copyAttr(a, l.attr)
+	l.fs.mapAttr(a)
+	l.mu.Unlock()
+	setSize(a, int64(len(l.target)))
+	return nil
+}
+
+// Readlink satisfies the bazil.org/fuse/fs.NodeReadlinker interface.
+func (l *Symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (_ string, err error) {
+	defer l.Sys().trace(OpReadlink, l)(&err)
+
+	done, err := l.Sys().check(ctx, OpReadlink, l)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	return l.target, nil
+}
+
+// Getxattr satisfies the bazil.org/fuse/fs.NodeGetxattrer interface.
+func (l *Symlink) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	defer l.Sys().trace(OpGetxattr, l)(&err)
+
+	return l.Sys().getxattr(req, resp)
+}
+
+// Listxattr satisfies the bazil.org/fuse/fs.NodeListxattrer interface.
+func (l *Symlink) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	defer l.Sys().trace(OpListxattr, l)(&err)
+
+	return l.Sys().listxattr(req, resp)
+}
@@ -0,0 +1,85 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"sync/atomic"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// sysfsSize is the size reported for file nodes in strict sysfs mode.
+// It is the page size that bounds sysfs attribute values.
+const sysfsSize = 4096
+
+// SetStrictSysfs sets whether the file system enforces sysfs attribute
+// conventions for RO, RW and WO nodes. In strict sysfs mode:
+//
+//   - file nodes report a size of 4096 bytes regardless of their content,
+//     so seeks relative to the end of a file behave as on sysfs;
+//   - reads return at most the first 4096 bytes of a node's value;
+//   - writes must be complete values of at most 4096 bytes written at
+//     offset zero, and other writes return EINVAL; each write replaces
+//     the content of the node's device;
+//   - truncation through the file system has no effect.
+//
+// This allows client code to be tested against behaviour that matches
+// real hardware.
+func (fs *FileSystem) SetStrictSysfs(strict bool) {
+	var v uint32
+	if strict {
+		v = 1
+	}
+	atomic.StoreUint32(&fs.sysfs, v)
+}
+
+// strictSysfs returns whether the file system is in strict sysfs mode.
+// A nil FileSystem is not in strict sysfs mode.
+func (fs *FileSystem) strictSysfs() bool {
+	return fs != nil && atomic.LoadUint32(&fs.sysfs) != 0
+}
+
+// sysfsReadSize returns the number of bytes that may be read at off for
+// a request of size bytes.
+func (fs *FileSystem) sysfsReadSize(off int64, size int) int {
+	if !fs.strictSysfs() {
+		return size
+	}
+	if off >= sysfsSize {
+		return 0
+	}
+	if rem := sysfsSize - int(off); size > rem {
+		return rem
+	}
+	return size
+}
+
+// deviceWrite writes b to dev at off with the given open flags as
+// described for writeAt. In strict sysfs mode, b replaces the content of
+// dev, and EINVAL is returned if off is not zero or b is longer than 4096
+// bytes. A write that fails without writing any data is retried according
+// to the error policy.
+func (fs *FileSystem) deviceWrite(dev Writer, b []byte, off int64, flags fuse.OpenFlags) (int, error) {
+	n, err := fs.deviceWriteOnce(dev, b, off, flags)
+	if n == 0 && fs.retryable(err) {
+		n, err = fs.deviceWriteOnce(dev, b, off, flags)
+	}
+	return n, err
+}
+
+func (fs *FileSystem) deviceWriteOnce(dev Writer, b []byte, off int64, flags fuse.OpenFlags) (int, error) {
+	if !fs.strictSysfs() {
+		return writeAt(withFlags(dev, flags), b, off)
+	}
+	if off != 0 || len(b) > sysfsSize {
+		return 0, syscall.EINVAL
+	}
+	err := dev.Truncate(0)
+	if err != nil {
+		return 0, err
+	}
+	return writeAt(withFlags(dev, flags), b, 0)
+}
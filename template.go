@@ -0,0 +1,89 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"sync"
+	"syscall"
+	"text/template"
+)
+
+// Template is a Reader that serves the result of executing a text/template
+// against data obtained from a user function. The template is executed when
+// a read is made at offset zero, and the result is retained to serve reads
+// at later offsets.
+type Template struct {
+	mu   sync.Mutex
+	tmpl *template.Template
+	data func() interface{}
+
+	out []byte
+}
+
+// NewTemplate returns a new Template executing tmpl with the value returned
+// by data. If data is nil, the template is executed with nil data.
+func NewTemplate(tmpl *template.Template, data func() interface{}) *Template {
+	return &Template{tmpl: tmpl, data: data}
+}
+
+// MustNewTemplate returns a new Template executing the template parsed
+// from text with the value returned by data. It will panic if text cannot
+// be parsed.
+func MustNewTemplate(text string, data func() interface{}) *Template {
+	return NewTemplate(template.Must(template.New("sisyphus").Parse(text)), data)
+}
+
+// execute returns the result of executing the template.
+func (t *Template) execute() ([]byte, error) {
+	var d interface{}
+	if t.data != nil {
+		d = t.data()
+	}
+	var buf bytes.Buffer
+	err := t.tmpl.Execute(&buf, d)
+	if err != nil {
+		return nil, WithErrno(err, syscall.EIO)
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (t *Template) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if off == 0 || t.out == nil {
+		var err error
+		t.out, err = t.execute()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return readAt(t.out, b, off)
+}
+
+// ReadAll satisfies the ReadAller interface. The template is executed and
+// the result retained to serve reads at later offsets.
+func (t *Template) ReadAll() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out, err := t.execute()
+	if err != nil {
+		return nil, err
+	}
+	t.out = out
+	return out, nil
+}
+
+// Size returns the length of the result of executing the template.
+func (t *Template) Size() (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out, err := t.execute()
+	return int64(len(out)), err
+}
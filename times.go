@@ -0,0 +1,61 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"context"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// FixedTimes returns an AttrFunc that reports t as the access, modification,
+// change and creation times of a node regardless of the file system's clock,
+// so that archives and listings of a tree are reproducible. The zero time
+// is reported as the Unix epoch.
+func FixedTimes(t time.Time) AttrFunc {
+	if t.IsZero() {
+		t = time.Unix(0, 0)
+	}
+	return func(_ context.Context, a *fuse.Attr) error {
+		a.Atime = t
+		a.Mtime = t
+		a.Ctime = t
+		a.Crtime = t
+		return nil
+	}
+}
+
+// QuantizeTimes returns an AttrFunc that reports the access, modification,
+// change and creation times of a node rounded down to a multiple of d since
+// the zero time, for example to second granularity. If d is not positive,
+// times are reported unaltered.
+func QuantizeTimes(d time.Duration) AttrFunc {
+	return func(_ context.Context, a *fuse.Attr) error {
+		a.Atime = a.Atime.Truncate(d)
+		a.Mtime = a.Mtime.Truncate(d)
+		a.Ctime = a.Ctime.Truncate(d)
+		a.Crtime = a.Crtime.Truncate(d)
+		return nil
+	}
+}
+
+// ChainAttrFuncs returns an AttrFunc that calls each of fns in order,
+// returning the first error. Nil functions are skipped. It allows
+// timestamp adjustments to be combined with other attribute adjustments.
+func ChainAttrFuncs(fns ...AttrFunc) AttrFunc {
+	return func(ctx context.Context, a *fuse.Attr) error {
+		for _, fn := range fns {
+			if fn == nil {
+				continue
+			}
+			err := fn(ctx, a)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
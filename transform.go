@@ -0,0 +1,119 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Transform is a ReadWriter that applies transformations to data read
+// from and written to an underlying ReadWriter. Read transformations are
+// applied to the complete content of the underlying device when a read is
+// made at offset zero; the transformed content is retained to serve reads
+// at later offsets. Write transformations are applied to each payload and
+// the transformed payload is written at the requested offset.
+type Transform struct {
+	mu    sync.Mutex
+	dev   ReadWriter
+	read  func([]byte) ([]byte, error)
+	write func([]byte) ([]byte, error)
+
+	data []byte
+}
+
+// NewTransform returns a new Transform wrapping dev. The read function
+// transforms content read from dev and the write function transforms
+// payloads before they are written to dev. A nil function leaves data
+// unchanged. Errors returned by the transformations are returned to the
+// client; a transformation should return EINVAL for unacceptable input.
+func NewTransform(dev ReadWriter, read, write func([]byte) ([]byte, error)) *Transform {
+	return &Transform{dev: dev, read: read, write: write}
+}
+
+// content returns the transformed content of the underlying device.
+func (t *Transform) content() ([]byte, error) {
+	data, err := readAll(t.dev)
+	if err != nil {
+		return nil, err
+	}
+	if t.read == nil {
+		return data, nil
+	}
+	return t.read(data)
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (t *Transform) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if off == 0 || t.data == nil {
+		var err error
+		t.data, err = t.content()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return readAt(t.data, b, off)
+}
+
+// WriteAt satisfies the io.WriterAt interface. The length of the
+// untransformed payload is returned on success.
+func (t *Transform) WriteAt(b []byte, off int64) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := b
+	if t.write != nil {
+		var err error
+		p, err = t.write(b)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err := t.dev.WriteAt(p, off)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Truncate truncates the underlying device.
+func (t *Transform) Truncate(n int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dev.Truncate(n)
+}
+
+// Size returns the length of the transformed content.
+func (t *Transform) Size() (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	data, err := t.content()
+	return int64(len(data)), err
+}
+
+// Scale returns a transformation that parses its input as a decimal
+// number, ignoring surrounding white space, multiplies it by factor and
+// formats the result with prec digits after the decimal point. A trailing
+// newline in the input is retained in the output. The transformation
+// returns EINVAL if the input is not a number.
+func Scale(factor float64, prec int) func([]byte) ([]byte, error) {
+	return func(b []byte) ([]byte, error) {
+		v, err := strconv.ParseFloat(string(bytes.TrimSpace(b)), 64)
+		if err != nil {
+			return nil, syscall.EINVAL
+		}
+		out := strconv.AppendFloat(nil, v*factor, 'f', prec, 64)
+		if bytes.HasSuffix(b, []byte{'\n'}) {
+			out = append(out, '\n')
+		}
+		return out, nil
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TrashEntry is a node held in the trash of a FileSystem.
+type TrashEntry struct {
+	// Path is the absolute path the
+	// node was unbound from.
+	Path string
+
+	// Node is the unbound node.
+	Node Node
+
+	// Time is the time the node was
+	// unbound according to the clock
+	// of the file system.
+	Time time.Time
+}
+
+// trash holds unbound nodes for later restoration.
+type trash struct {
+	mu        sync.Mutex
+	retention time.Duration
+	entries   map[string]TrashEntry
+}
+
+// SetTrash sets the retention time of the file system's trash. While the
+// retention time is positive, nodes unbound by Unbind and UnbindNode are
+// held in the trash and may be rebound at their original path by Restore
+// until the retention time has passed according to the file system's
+// clock. Only the most recently unbound node is held for each path. A zero
+// or negative retention time disables the trash and empties it.
+func (fs *FileSystem) SetTrash(retention time.Duration) {
+	fs.trash.mu.Lock()
+	fs.trash.retention = retention
+	if retention <= 0 {
+		fs.trash.entries = nil
+	}
+	fs.trash.mu.Unlock()
+}
+
+// Trash returns the entries held in the trash of the file system in
+// lexical path order.
+func (fs *FileSystem) Trash() []TrashEntry {
+	now := fs.now()
+	fs.trash.mu.Lock()
+	defer fs.trash.mu.Unlock()
+	fs.trash.expire(now)
+	entries := make([]TrashEntry, 0, len(fs.trash.entries))
+	for _, e := range fs.trash.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// Restore rebinds the node held in the trash for the given path at that
+// path and removes it from the trash. Restore returns ENOENT if no node is
+// held for the path and EEXIST if a node is already bound at the path. The
+// restored node's timestamps are reset as for a newly bound node.
+func (fs *FileSystem) Restore(path string) error {
+	path = rooted(path)
+	now := fs.now()
+	fs.trash.mu.Lock()
+	fs.trash.expire(now)
+	e, ok := fs.trash.entries[path]
+	fs.trash.mu.Unlock()
+	if !ok {
+		return &os.PathError{Op: "restore", Path: path, Err: syscall.ENOENT}
+	}
+	_, err := fs.BindConflict(filepath.Dir(path), e.Node, Fail)
+	if err != nil {
+		return err
+	}
+	fs.trash.mu.Lock()
+	if cur, ok := fs.trash.entries[path]; ok && cur.Node == e.Node {
+		delete(fs.trash.entries, path)
+	}
+	fs.trash.mu.Unlock()
+	return nil
+}
+
+// discard places n, unbound from path, in the trash if the trash is
+// enabled.
+func (fs *FileSystem) discard(path string, n Node) {
+	now := fs.now()
+	fs.trash.mu.Lock()
+	defer fs.trash.mu.Unlock()
+	if fs.trash.retention <= 0 {
+		return
+	}
+	fs.trash.expire(now)
+	if fs.trash.entries == nil {
+		fs.trash.entries = make(map[string]TrashEntry)
+	}
+	fs.trash.entries[path] = TrashEntry{Path: path, Node: n, Time: now}
+}
+
+// expire removes entries held for longer than the retention time. It
+// must be called with t.mu held.
+func (t *trash) expire(now time.Time) {
+	for path, e := range t.entries {
+		if now.Sub(e.Time) >= t.retention {
+			delete(t.entries, path)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import "bazil.org/fuse"
+
+// Tuning holds FUSE connection parameters negotiated when a FileSystem is
+// mounted by Serve.
+//
+// The FUSE library in use fixes the maximum write size at 128KiB on Linux
+// and does not allow the kernel's congestion threshold or background request
+// limit to be set, so those parameters are not available. Since file nodes
+// are opened with direct IO, each write(2) call of up to the maximum write
+// size is passed to a node's device as a single WriteAt call.
+type Tuning struct {
+	// MaxReadahead is the maximum
+	// readahead in bytes requested by
+	// the kernel. If zero, the kernel's
+	// default is used.
+	MaxReadahead uint32
+}
+
+// DefaultTuning is a Tuning suitable for small ARM boards. Readahead is
+// limited to a single page since nodes hold small values that are read
+// with direct IO.
+var DefaultTuning = Tuning{
+	MaxReadahead: 4096,
+}
+
+// MountOptions returns the mount options that apply t. The options may be
+// passed to Serve along with other mount options.
+func (t Tuning) MountOptions() []fuse.MountOption {
+	var opts []fuse.MountOption
+	if t.MaxReadahead != 0 {
+		opts = append(opts, fuse.MaxReadahead(t.MaxReadahead))
+	}
+	return opts
+}
@@ -0,0 +1,137 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// Txn is a set of staged node content updates that are published
+// together. Txn values are not safe for concurrent use.
+type Txn struct {
+	fs      *FileSystem
+	updates map[string][]byte
+}
+
+// Begin returns a new empty transaction on the file system.
+func (fs *FileSystem) Begin() *Txn {
+	return &Txn{fs: fs, updates: make(map[string][]byte)}
+}
+
+// Set stages replacement of the content of the node at path with data.
+// The node must be an RW node or an RO node backed by a *MutableString.
+// If path is set more than once, the last data is used. Relative paths
+// are interpreted from the root of the file system.
+func (t *Txn) Set(path string, data []byte) {
+	t.updates[rooted(path)] = append([]byte(nil), data...)
+}
+
+// Commit publishes the staged updates. All the updated nodes are locked
+// while the updates are applied, so no read made through the file system
+// observes some updates without the others. If any path does not refer to
+// a node that can be updated, no update is applied. If a device returns an
+// error while an update is applied, earlier updates are retained and the
+// error is returned. If the file system is being served, the kernel cache
+// of each updated node is invalidated after all updates are applied. The
+// staged updates are discarded when Commit returns. If more than one path
+// refers to the same node, the data for the lexically last path is used.
+func (t *Txn) Commit() error {
+	paths := make([]string, 0, len(t.updates))
+	for path := range t.updates {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	updates := t.updates
+	t.updates = make(map[string][]byte)
+
+	fs := t.fs
+	var (
+		nodes []Node
+		data  [][]byte
+		devs  []io.ReaderAt
+		locks []sync.Locker
+		seen  = make(map[Node]int)
+	)
+	fs.mu.Lock()
+	for _, path := range paths {
+		n, err := walkPath(fs.root, "commit", path)
+		if err != nil {
+			fs.mu.Unlock()
+			return err
+		}
+		dev, mu := txnDevice(n)
+		if dev == nil {
+			fs.mu.Unlock()
+			return &os.PathError{Op: "commit", Path: path, Err: syscall.EBADF}
+		}
+		// Each node is locked and
+		// updated only once.
+		if i, ok := seen[n]; ok {
+			data[i] = updates[path]
+			continue
+		}
+		seen[n] = len(nodes)
+		nodes = append(nodes, n)
+		data = append(data, updates[path])
+		devs = append(devs, dev)
+		locks = append(locks, mu)
+	}
+	server := fs.server
+	fs.mu.Unlock()
+
+	// Locks are taken in lexical path
+	// order to avoid deadlock between
+	// concurrent commits.
+	for _, mu := range locks {
+		mu.Lock()
+	}
+	var err error
+	now := fs.now()
+	for i, dev := range devs {
+		err = restoreDevice(dev, data[i])
+		if err != nil {
+			break
+		}
+		switch n := nodes[i].(type) {
+		case *RO:
+			n.mtime = now
+		case *RW:
+			n.mtime = now
+		}
+	}
+	for _, mu := range locks {
+		mu.Unlock()
+	}
+	for _, n := range nodes {
+		invalidateSize(n)
+	}
+	if server != nil {
+		for _, n := range nodes {
+			ierr := fs.Invalidate(n)
+			if err == nil {
+				err = ierr
+			}
+		}
+	}
+	return err
+}
+
+// txnDevice returns the device of n if it can be updated by
+// a transaction, and the lock of n protecting the device.
+func txnDevice(n Node) (io.ReaderAt, sync.Locker) {
+	switch n := n.(type) {
+	case *RO:
+		if m, ok := n.dev.(*MutableString); ok {
+			return m, &n.mu
+		}
+	case *RW:
+		return n.dev, &n.mu
+	}
+	return nil, nil
+}
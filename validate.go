@@ -0,0 +1,189 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Validate is a Writer that checks each write before passing it to an
+// underlying Writer. Writes that fail validation return EINVAL.
+type Validate struct {
+	dev   Writer
+	valid func([]byte) bool
+}
+
+// NewValidate returns a new Validate that passes writes to dev when valid
+// returns true for the written payload with any single trailing newline
+// removed.
+func NewValidate(dev Writer, valid func([]byte) bool) *Validate {
+	return &Validate{dev: dev, valid: valid}
+}
+
+// NewValidateRegexp returns a new Validate that passes writes to dev when
+// re matches the complete written payload with any single trailing newline
+// removed.
+func NewValidateRegexp(dev Writer, re *regexp.Regexp) *Validate {
+	return NewValidate(dev, func(b []byte) bool {
+		loc := re.FindIndex(b)
+		return loc != nil && loc[0] == 0 && loc[1] == len(b)
+	})
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (v *Validate) WriteAt(b []byte, off int64) (int, error) {
+	if !v.valid(bytes.TrimSuffix(b, []byte{'\n'})) {
+		return 0, syscall.EINVAL
+	}
+	return v.dev.WriteAt(b, off)
+}
+
+// Truncate truncates the underlying Writer.
+func (v *Validate) Truncate(n int64) error { return v.dev.Truncate(n) }
+
+// Size returns the size of the underlying Writer.
+func (v *Validate) Size() (int64, error) { return v.dev.Size() }
+
+// ValidationError is the error returned by the FileSystem Validate method.
+// It holds an error for each invariant violation found in the tree.
+type ValidationError []error
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "sisyphus: invalid tree: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the tree of the file system for misconfiguration before
+// it is served. It reports nil nodes and devices, nodes bound under a name
+// other than their own, names in a directory that are equal under Unicode
+// case folding, directories without a directory mode, file nodes with a
+// directory or symbolic link mode, RO nodes with write permission bits,
+// WO nodes with read permission bits and symbolic links without a target.
+// If any violations are found, Validate returns a ValidationError listing
+// them in path order.
+func (fs *FileSystem) Validate() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var errs ValidationError
+	validateNode("/", fs.root, &errs)
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateNode appends violations found in the tree rooted at n with the
+// given path to errs. It must be called with the file system's lock held.
+func validateNode(path string, n Node, errs *ValidationError) {
+	report := func(format string, args ...interface{}) {
+		*errs = append(*errs, fmt.Errorf("%s: "+format, append([]interface{}{path}, args...)...))
+	}
+	if isNilNode(n) {
+		report("nil node")
+		return
+	}
+	switch n := n.(type) {
+	case *Dir:
+		n.mu.Lock()
+		mode := n.mode
+		names := make([]string, 0, len(n.files))
+		for name := range n.files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		files := make([]Node, len(names))
+		for i, name := range names {
+			files[i] = n.files[name]
+		}
+		n.mu.Unlock()
+
+		if !mode.IsDir() {
+			report("directory has mode %v", mode)
+		}
+		for i, name := range names {
+			for _, other := range names[:i] {
+				if strings.EqualFold(name, other) {
+					report("names %q and %q are equal under case folding", other, name)
+				}
+			}
+		}
+		for i, f := range files {
+			child := filepath.Join(path, names[i])
+			if !isNilNode(f) && f.Name() != names[i] {
+				*errs = append(*errs, fmt.Errorf("%s: node named %q", child, f.Name()))
+			}
+			validateNode(child, f, errs)
+		}
+	case *RO:
+		n.mu.Lock()
+		mode, nilDev := n.mode, n.dev == nil
+		n.mu.Unlock()
+		validateFile(mode, nilDev, 0222, "write", report)
+	case *RW:
+		n.mu.Lock()
+		mode, nilDev := n.mode, n.dev == nil
+		n.mu.Unlock()
+		validateFile(mode, nilDev, 0, "", report)
+	case *WO:
+		n.mu.Lock()
+		mode, nilDev := n.mode, n.dev == nil
+		n.mu.Unlock()
+		validateFile(mode, nilDev, 0444, "read", report)
+	case *Symlink:
+		n.mu.Lock()
+		mode, target := n.mode, n.target
+		n.mu.Unlock()
+		if mode&os.ModeSymlink == 0 {
+			report("symbolic link has mode %v", mode)
+		}
+		if target == "" {
+			report("symbolic link has no target")
+		}
+	}
+}
+
+// validateFile reports violations for a file node with the given mode and
+// device state. Permission bits in forbidden are reported as granting the
+// named access.
+func validateFile(mode os.FileMode, nilDev bool, forbidden os.FileMode, access string, report func(string, ...interface{})) {
+	if nilDev {
+		report("nil device")
+	}
+	if mode&(os.ModeDir|os.ModeSymlink) != 0 {
+		report("file has mode %v", mode)
+	}
+	if mode&forbidden != 0 {
+		report("mode %v grants %s permission", mode, access)
+	}
+}
+
+// isNilNode returns whether n is nil or a nil pointer to a sisyphus node.
+func isNilNode(n Node) bool {
+	switch n := n.(type) {
+	case nil:
+		return true
+	case *Dir:
+		return n == nil
+	case *RO:
+		return n == nil
+	case *RW:
+		return n == nil
+	case *WO:
+		return n == nil
+	case *Symlink:
+		return n == nil
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Version is a retained version of the content of a Versioned device.
+type Version struct {
+	Time time.Time
+	Data []byte
+}
+
+// Versioned is a ReadWriter that retains recent versions of the content
+// of an underlying ReadWriter. A version is recorded when the Versioned is
+// synced, which happens when a file handle holding the node is flushed, if
+// the content differs from the most recently recorded version.
+type Versioned struct {
+	mu       sync.Mutex
+	dev      ReadWriter
+	now      func() time.Time
+	max      int
+	versions []Version
+}
+
+// NewVersioned returns a new Versioned retaining at most n versions of
+// the content of dev. The current content of dev is recorded as the first
+// version. Versions are time stamped using clock, or time.Now if clock is
+// nil.
+func NewVersioned(dev ReadWriter, n int, clock func() time.Time) (*Versioned, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("sisyphus: invalid version count: %d", n)
+	}
+	if clock == nil {
+		clock = time.Now
+	}
+	v := &Versioned{dev: dev, now: clock, max: n}
+	err := v.record()
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (v *Versioned) ReadAt(b []byte, off int64) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.dev.ReadAt(b, off)
+}
+
+// WriteAt satisfies the io.WriterAt interface.
+func (v *Versioned) WriteAt(b []byte, off int64) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.dev.WriteAt(b, off)
+}
+
+// Truncate truncates the underlying ReadWriter.
+func (v *Versioned) Truncate(n int64) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.dev.Truncate(n)
+}
+
+// Size returns the size of the underlying ReadWriter.
+func (v *Versioned) Size() (int64, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.dev.Size()
+}
+
+// Sync records the current content as a new version if it differs from
+// the most recent version, and syncs the underlying ReadWriter if it has
+// a Sync method.
+func (v *Versioned) Sync() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	err := v.record()
+	if err != nil {
+		return err
+	}
+	if s, ok := v.dev.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// record records the current content of the underlying ReadWriter
+// if it differs from the most recent version, discarding the oldest
+// version if more than the maximum number would be retained.
+func (v *Versioned) record() error {
+	data, err := readAll(v.dev)
+	if err != nil {
+		return err
+	}
+	if len(v.versions) != 0 && bytes.Equal(v.versions[len(v.versions)-1].Data, data) {
+		return nil
+	}
+	v.versions = append(v.versions, Version{Time: v.now(), Data: data})
+	if len(v.versions) > v.max {
+		v.versions = append(v.versions[:0], v.versions[len(v.versions)-v.max:]...)
+	}
+	return nil
+}
+
+// Versions returns the retained versions, oldest first.
+func (v *Versioned) Versions() []Version {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	versions := make([]Version, len(v.versions))
+	for i, ver := range v.versions {
+		versions[i] = Version{Time: ver.Time, Data: append([]byte(nil), ver.Data...)}
+	}
+	return versions
+}
+
+// History returns a Reader holding a text description of the retained
+// versions of v, oldest first, suitable for binding as a sibling node of
+// the node holding v, conventionally named with a ".history" suffix. Each
+// line holds the version number, its time stamp and its quoted content.
+func (v *Versioned) History() Reader {
+	return history{v}
+}
+
+// history is a Reader describing the versions of a Versioned.
+type history struct {
+	v *Versioned
+}
+
+func (h history) text() []byte {
+	var buf bytes.Buffer
+	for i, ver := range h.v.Versions() {
+		fmt.Fprintf(&buf, "%d\t%s\t%q\n", i, ver.Time.Format(time.RFC3339Nano), ver.Data)
+	}
+	return buf.Bytes()
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (h history) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	return readAt(h.text(), b, off)
+}
+
+// Size returns the length of the history text and a nil error.
+func (h history) Size() (int64, error) { return int64(len(h.text())), nil }
@@ -0,0 +1,121 @@
+// Copyright ©2016 The ev3go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sisyphus
+
+import (
+	"sort"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// XattrMode specifies how security extended attribute queries are answered.
+type XattrMode int
+
+const (
+	// XattrUnsupported reports that extended
+	// attributes are not supported. This is
+	// the default behaviour.
+	XattrUnsupported XattrMode = iota
+
+	// XattrDeny denies access to security
+	// extended attributes with EACCES.
+	XattrDeny
+
+	// XattrEmpty reports that no security
+	// extended attributes are present.
+	XattrEmpty
+
+	// XattrValue reports the security extended
+	// attribute values provided by the user.
+	XattrValue
+)
+
+// xattrs holds the extended attribute configuration of a FileSystem.
+type xattrs struct {
+	mode   XattrMode
+	values map[string][]byte
+}
+
+// SetSecurityXattrs sets how queries for security.* and system.posix_acl_*
+// extended attributes are answered for all nodes in the file system. When
+// mode is XattrValue, the named values in values are returned for queries
+// and listed; values is ignored for other modes. Queries for any other
+// extended attribute report that the attribute is not present unless mode
+// is XattrUnsupported.
+func (fs *FileSystem) SetSecurityXattrs(mode XattrMode, values map[string][]byte) {
+	var v map[string][]byte
+	if mode == XattrValue {
+		v = make(map[string][]byte, len(values))
+		for name, val := range values {
+			if isSecurityXattr(name) {
+				v[name] = append([]byte(nil), val...)
+			}
+		}
+	}
+	fs.mu.Lock()
+	fs.xattrs = xattrs{mode: mode, values: v}
+	fs.mu.Unlock()
+}
+
+// isSecurityXattr returns whether name is a
+// security or POSIX ACL extended attribute.
+func isSecurityXattr(name string) bool {
+	return strings.HasPrefix(name, "security.") || strings.HasPrefix(name, "system.posix_acl_")
+}
+
+// getxattr responds to a getxattr request according to the
+// file system's extended attribute configuration.
+func (fs *FileSystem) getxattr(req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if fs == nil {
+		return syscall.ENOTSUP
+	}
+	fs.mu.Lock()
+	x := fs.xattrs
+	fs.mu.Unlock()
+
+	switch {
+	case x.mode == XattrUnsupported:
+		return syscall.ENOTSUP
+	case !isSecurityXattr(req.Name):
+		return fuse.ErrNoXattr
+	case x.mode == XattrDeny:
+		return syscall.EACCES
+	case x.mode == XattrValue:
+		val, ok := x.values[req.Name]
+		if !ok {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = append(resp.Xattr, val...)
+		return nil
+	default:
+		return fuse.ErrNoXattr
+	}
+}
+
+// listxattr responds to a listxattr request according to the
+// file system's extended attribute configuration.
+func (fs *FileSystem) listxattr(req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if fs == nil {
+		return syscall.ENOTSUP
+	}
+	fs.mu.Lock()
+	x := fs.xattrs
+	fs.mu.Unlock()
+
+	switch x.mode {
+	case XattrUnsupported:
+		return syscall.ENOTSUP
+	case XattrValue:
+		names := make([]string, 0, len(x.values))
+		for name := range x.values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		resp.Append(names...)
+	}
+	return nil
+}